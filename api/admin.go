@@ -0,0 +1,279 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// adminUsersSearchLimit caps the number of users we return from a search.
+	adminUsersSearchLimit = 100
+	// adminAuditEventsLimit defines how many of a user's latest audit events
+	// we include when an admin inspects their account.
+	adminAuditEventsLimit = 20
+)
+
+var (
+	// AdminSubs holds the subs of the users who can access the admin
+	// endpoints. This value is configurable via the ACCOUNTS_ADMIN_SUBS
+	// environment variable.
+	AdminSubs []string
+
+	// ErrNotAdmin is returned when a user who is not an admin tries to
+	// access an admin endpoint.
+	ErrNotAdmin = errors.New("this endpoint requires admin privileges")
+)
+
+type (
+	// AdminUsersGET is the response of GET /admin/users.
+	AdminUsersGET struct {
+		Items []*UserGET `json:"items"`
+	}
+	// AdminUserGET is the response of GET /admin/users/:sub. It holds
+	// everything support staff needs to know about an account.
+	AdminUserGET struct {
+		User    *UserGET              `json:"user"`
+		Stats   *database.UserStats   `json:"stats"`
+		APIKeys []*APIKeyResponse     `json:"apiKeys"`
+		Events  []database.AuditEvent `json:"events"`
+	}
+	// AdminUserSuspendPOST describes the body of a POST request that suspends
+	// a user.
+	AdminUserSuspendPOST struct {
+		Reason string `json:"reason"`
+		// Until is optional. The suspension doesn't expire without it.
+		Until *time.Time `json:"until,omitempty"`
+	}
+	// AdminUserTierPOST describes the body of a POST request that overrides
+	// a user's tier.
+	AdminUserTierPOST struct {
+		Tier int `json:"tier"`
+	}
+)
+
+// isAdmin returns true if the given user is one of the AdminSubs.
+func isAdmin(u *database.User) bool {
+	if u == nil {
+		return false
+	}
+	for _, sub := range AdminSubs {
+		if sub == u.Sub {
+			return true
+		}
+	}
+	return false
+}
+
+// adminUsersGET searches for users by email, sub, Stripe customer id, pubkey
+// or uploader IP.
+func (api *API) adminUsersGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	f := database.UsersFilter{
+		Email:      strings.TrimSpace(req.Form.Get("email")),
+		Sub:        req.Form.Get("sub"),
+		StripeID:   req.Form.Get("stripeId"),
+		UploaderIP: req.Form.Get("ip"),
+	}
+	if pkStr := req.Form.Get("pubKey"); pkStr != "" {
+		err := f.PubKey.LoadString(pkStr)
+		if err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	users, err := api.staticDB.UsersSearch(req.Context(), f, adminUsersSearchLimit)
+	if errors.Contains(err, database.ErrEmptyUsersFilter) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp := AdminUsersGET{Items: make([]*UserGET, 0, len(users))}
+	for i := range users {
+		resp.Items = append(resp.Items, UserGETFromUser(&users[i]))
+	}
+	api.WriteJSON(w, resp)
+}
+
+// adminUserGET returns the given user's account, stats, API keys and latest
+// audit events.
+func (api *API) adminUserGET(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, ok := api.adminTargetUser(w, req, ps)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	stats, err := api.staticDB.UserStats(ctx, *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	aks, err := api.staticDB.APIKeyList(ctx, *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	events, err := api.staticDB.AuditEventsByUser(ctx, u.ID, adminAuditEventsLimit)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	resp := AdminUserGET{
+		User:    UserGETFromUser(u),
+		Stats:   stats,
+		APIKeys: make([]*APIKeyResponse, 0, len(aks)),
+		Events:  events,
+	}
+	for _, ak := range aks {
+		resp.APIKeys = append(resp.APIKeys, APIKeyResponseFromAPIKey(ak))
+	}
+	api.WriteJSON(w, resp)
+}
+
+// adminUserSuspendPOST suspends the given user.
+func (api *API) adminUserSuspendPOST(admin *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminUserSuspendPOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		api.WriteError(w, errors.New("missing suspension reason"), http.StatusBadRequest)
+		return
+	}
+	if body.Until != nil && !body.Until.After(time.Now().UTC()) {
+		api.WriteError(w, errors.New("the suspension cannot expire in the past"), http.StatusBadRequest)
+		return
+	}
+	u, ok := api.adminTargetUser(w, req, ps)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	err = api.staticDB.UserSuspend(ctx, u, body.Reason, body.Until)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// The user's limits need to drop to the anonymous tier immediately.
+	api.staticUserTierCache.DeleteBySub(u.Sub)
+	details := body.Reason
+	if u.SuspendedUntil != nil {
+		details += " (until " + u.SuspendedUntil.Format(time.RFC3339) + ")"
+	}
+	api.audit(req, database.AuditEvent{
+		UserID:  u.ID,
+		Actor:   admin.Sub,
+		Action:  database.AuditActionUserSuspend,
+		Details: details,
+	})
+	if u.Email != "" {
+		err = api.staticMailer.SendAccountSuspendedEmail(ctx, u.Email, u.SuspensionReason, u.SuspendedUntil)
+		if err != nil {
+			api.staticLogger.Warnln(errors.AddContext(err, "failed to send an email"))
+		}
+	}
+	api.WriteSuccess(w)
+}
+
+// adminUserReinstatePOST lifts the suspension of the given user.
+func (api *API) adminUserReinstatePOST(admin *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, ok := api.adminTargetUser(w, req, ps)
+	if !ok {
+		return
+	}
+	err := api.staticDB.UserReinstate(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.DeleteBySub(u.Sub)
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  admin.Sub,
+		Action: database.AuditActionUserReinstate,
+	})
+	api.WriteSuccess(w)
+}
+
+// adminUserTierPOST overrides the given user's tier.
+func (api *API) adminUserTierPOST(admin *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body AdminUserTierPOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if body.Tier < database.TierFree || body.Tier >= database.TierMaxReserved {
+		api.WriteError(w, fmt.Errorf("invalid tier %d", body.Tier), http.StatusBadRequest)
+		return
+	}
+	u, ok := api.adminTargetUser(w, req, ps)
+	if !ok {
+		return
+	}
+	oldTier := u.Tier
+	err = api.staticDB.UserSetTier(req.Context(), u, body.Tier)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.Set(u.Sub, u)
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  admin.Sub,
+		Action: database.AuditActionUserTier,
+		Before: strconv.Itoa(oldTier),
+		After:  strconv.Itoa(body.Tier),
+	})
+	api.WriteSuccess(w)
+}
+
+// adminUserConfirmPOST marks the given user's email as confirmed.
+func (api *API) adminUserConfirmPOST(admin *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	u, ok := api.adminTargetUser(w, req, ps)
+	if !ok {
+		return
+	}
+	err := api.staticDB.UserForceConfirmEmail(req.Context(), u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.audit(req, database.AuditEvent{
+		UserID:  u.ID,
+		Actor:   admin.Sub,
+		Action:  database.AuditActionUserConfirmEmail,
+		Details: u.Email.String(),
+	})
+	api.WriteSuccess(w)
+}
+
+// adminTargetUser fetches the user identified by the `sub` parameter. If that
+// fails, it writes the error response and returns false.
+func (api *API) adminTargetUser(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (*database.User, bool) {
+	u, err := api.staticDB.UserBySub(req.Context(), ps.ByName("sub"))
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return u, true
+}
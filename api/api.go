@@ -46,6 +46,11 @@ type (
 		staticMailer        *email.Mailer
 		staticTierLimits    []TierLimitsPublic
 		staticUserTierCache *userTierCache
+
+		// staticInternalRouter serves the internal endpoints. It's the same
+		// as staticRouter unless we have a separate internal listener.
+		staticInternalRouter  *httprouter.Router
+		staticRevokedSessions *revokedSessionsCache
 	}
 
 	// Promoter defines a payment processor.
@@ -73,6 +78,11 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 	}
 	router := httprouter.New()
 	router.RedirectTrailingSlash = true
+	internalRouter := router
+	if InternalPort != 0 {
+		internalRouter = httprouter.New()
+		internalRouter.RedirectTrailingSlash = true
+	}
 
 	tierLimits := make([]TierLimitsPublic, len(database.UserLimits))
 	for i, t := range database.UserLimits {
@@ -96,6 +106,9 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 		staticMailer:        mailer,
 		staticTierLimits:    tierLimits,
 		staticUserTierCache: newUserTierCache(),
+
+		staticInternalRouter:  internalRouter,
+		staticRevokedSessions: newRevokedSessionsCache(db),
 	}
 	api.buildHTTPRoutes()
 	return api, nil
@@ -106,10 +119,21 @@ func (api *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	api.staticRouter.ServeHTTP(w, req)
 }
 
-// ListenAndServe starts the API server on the given port.
+// ListenAndServe starts the API server on the given port. If InternalPort is
+// set, it also starts the internal listener on it. It returns the error of
+// whichever listener fails first.
 func (api *API) ListenAndServe(port int) error {
-	api.staticLogger.Info(fmt.Sprintf("Listening on port %d", port))
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), api.staticRouter)
+	errCh := make(chan error, 2)
+	if InternalPort != 0 {
+		go func() {
+			errCh <- api.ListenAndServeInternal(InternalPort)
+		}()
+	}
+	go func() {
+		api.staticLogger.Info(fmt.Sprintf("Listening on port %d", port))
+		errCh <- http.ListenAndServe(fmt.Sprintf(":%d", port), api.staticRouter)
+	}()
+	return <-errCh
 }
 
 // WithDBSession injects a session context into the request context of the
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
@@ -12,6 +14,15 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+const (
+	// HeaderNextCursor holds the name of the header in which we send the
+	// cursor of the next page of a list whose body is a plain JSON array.
+	HeaderNextCursor = "Skynet-Next-Cursor"
+	// HeaderPrevCursor holds the name of the header in which we send the
+	// cursor of the previous page of a list whose body is a plain JSON array.
+	HeaderPrevCursor = "Skynet-Prev-Cursor"
+)
+
 type (
 	// Revive complains about these names stuttering but we like them as they
 	// are, so we'll disable revive for a moment here.
@@ -19,9 +30,12 @@ type (
 
 	// APIKeyPOST describes the body of a POST request that creates an API key
 	APIKeyPOST struct {
-		Name     string   `json:"name,omitempty"`
-		Public   bool     `json:"public,string,omitempty"`
-		Skylinks []string `json:"skylinks,omitempty"`
+		Name       string     `json:"name,omitempty"`
+		Public     bool       `json:"public,string,omitempty"`
+		Skylinks   []string   `json:"skylinks,omitempty"`
+		Scopes     []string   `json:"scopes,omitempty"`
+		AllowedIPs []string   `json:"allowedIPs,omitempty"`
+		ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
 	}
 	// APIKeyPUT describes the request body for updating an API key
 	APIKeyPUT struct {
@@ -35,13 +49,19 @@ type (
 	}
 	// APIKeyResponse is an API DTO which mirrors database.APIKey.
 	APIKeyResponse struct {
-		ID        primitive.ObjectID `json:"id"`
-		UserID    primitive.ObjectID `json:"-"`
-		Name      string             `json:"name"`
-		Public    bool               `json:"public,string"`
-		Key       database.APIKey    `json:"-"`
-		Skylinks  []string           `json:"skylinks"`
-		CreatedAt time.Time          `json:"createdAt"`
+		ID         primitive.ObjectID `json:"id"`
+		UserID     primitive.ObjectID `json:"-"`
+		Name       string             `json:"name"`
+		Public     bool               `json:"public,string"`
+		Key        database.APIKey    `json:"-"`
+		KeyPrefix  string             `json:"keyPrefix"`
+		Skylinks   []string           `json:"skylinks"`
+		Scopes     []string           `json:"scopes,omitempty"`
+		AllowedIPs []string           `json:"allowedIPs,omitempty"`
+		CreatedAt  time.Time          `json:"createdAt"`
+		ExpiresAt  *time.Time         `json:"expiresAt,omitempty"`
+		LastUsedAt *time.Time         `json:"lastUsedAt,omitempty"`
+		LastUsedIP string             `json:"lastUsedIP,omitempty"`
 	}
 	// APIKeyResponseWithKey is an API DTO which mirrors database.APIKey but
 	// also reveals the value of the Key field. This should only be used on key
@@ -59,6 +79,18 @@ func (akp APIKeyPOST) Validate() error {
 	if !akp.Public && len(akp.Skylinks) > 0 {
 		return errors.New("public API keys cannot refer to skylinks")
 	}
+	if akp.Public && len(akp.Scopes) > 0 {
+		return errors.New("public API keys cannot have scopes")
+	}
+	if err := database.ValidateAPIKeyScopes(akp.Scopes); err != nil {
+		return err
+	}
+	if _, err := database.NormalizeCIDRs(akp.AllowedIPs); err != nil {
+		return err
+	}
+	if akp.ExpiresAt != nil && !akp.ExpiresAt.After(time.Now().UTC()) {
+		return errors.New("expiresAt must be in the future")
+	}
 	var errs []error
 	for _, s := range akp.Skylinks {
 		if !database.ValidSkylink(s) {
@@ -76,13 +108,19 @@ func (akp APIKeyPOST) Validate() error {
 // APIKeyResponseFromAPIKey creates a new APIKeyResponse from the given API key.
 func APIKeyResponseFromAPIKey(ak database.APIKeyRecord) *APIKeyResponse {
 	return &APIKeyResponse{
-		ID:        ak.ID,
-		UserID:    ak.UserID,
-		Name:      ak.Name,
-		Public:    ak.Public,
-		Key:       ak.Key,
-		Skylinks:  ak.Skylinks,
-		CreatedAt: ak.CreatedAt,
+		ID:         ak.ID,
+		UserID:     ak.UserID,
+		Name:       ak.Name,
+		Public:     ak.Public,
+		Key:        ak.Key,
+		KeyPrefix:  ak.KeyPrefix,
+		Skylinks:   ak.Skylinks,
+		Scopes:     ak.Scopes,
+		AllowedIPs: ak.AllowedIPs,
+		CreatedAt:  ak.CreatedAt,
+		ExpiresAt:  ak.ExpiresAt,
+		LastUsedAt: ak.LastUsedAt,
+		LastUsedIP: ak.LastUsedIP,
 	}
 }
 
@@ -90,16 +128,8 @@ func APIKeyResponseFromAPIKey(ak database.APIKeyRecord) *APIKeyResponse {
 // given API key.
 func APIKeyResponseWithKeyFromAPIKey(ak database.APIKeyRecord) *APIKeyResponseWithKey {
 	return &APIKeyResponseWithKey{
-		APIKeyResponse: APIKeyResponse{
-			ID:        ak.ID,
-			UserID:    ak.UserID,
-			Name:      ak.Name,
-			Public:    ak.Public,
-			Key:       ak.Key,
-			Skylinks:  ak.Skylinks,
-			CreatedAt: ak.CreatedAt,
-		},
-		Key: ak.Key,
+		APIKeyResponse: *APIKeyResponseFromAPIKey(ak),
+		Key:            ak.Key,
 	}
 }
 
@@ -117,7 +147,34 @@ func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks)
+	// An API key can't create API keys with more access than it has itself.
+	// Public API keys allow downloads and private ones without scopes have
+	// full access.
+	if akr := apiKeyFromContext(req.Context()); akr != nil {
+		want := body.Scopes
+		if body.Public {
+			want = []string{database.APIKeyScopeDownload}
+		} else if len(want) == 0 {
+			want = database.APIKeyScopes
+		}
+		if !akr.HasScopes(want...) {
+			api.WriteError(w, errors.AddContext(ErrAPIKeyInsufficientScope, "cannot grant scopes this api key doesn't have"), http.StatusForbidden)
+			return
+		}
+		// Nor can it create API keys which can be used from addresses it
+		// can't be used from.
+		allowedIPs, _ := database.NormalizeCIDRs(body.AllowedIPs)
+		if !database.CIDRsWithin(allowedIPs, akr.AllowedIPs) {
+			api.WriteError(w, errors.AddContext(ErrAPIKeyInsufficientScope, "cannot allow addresses this api key doesn't allow"), http.StatusForbidden)
+			return
+		}
+		// Nor can it create API keys which outlive it.
+		if akr.ExpiresAt != nil && (body.ExpiresAt == nil || body.ExpiresAt.After(*akr.ExpiresAt)) {
+			api.WriteError(w, errors.AddContext(ErrAPIKeyInsufficientScope, "cannot create api keys which expire after this api key"), http.StatusForbidden)
+			return
+		}
+	}
+	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks, body.Scopes, body.AllowedIPs, body.ExpiresAt)
 	if errors.Contains(err, database.ErrMaxNumAPIKeysExceeded) {
 		err = errors.AddContext(err, "the maximum number of API keys a user can create is "+strconv.Itoa(database.MaxNumAPIKeysPerUser))
 		api.WriteError(w, err, http.StatusBadRequest)
@@ -127,6 +184,12 @@ func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionAPIKeyCreate,
+		After:  apiKeySummary(*ak),
+	})
 	api.WriteJSON(w, APIKeyResponseWithKeyFromAPIKey(*ak))
 }
 
@@ -150,9 +213,35 @@ func (api *API) userAPIKeyGET(u *database.User, w http.ResponseWriter, req *http
 	api.WriteJSON(w, APIKeyResponseFromAPIKey(ak))
 }
 
-// userAPIKeyLIST lists all API keys associated with the user.
+// userAPIKeyLIST lists all API keys associated with the user. When the caller
+// passes a `cursor` or a `pageSize` we only list a single page of API keys and
+// send the cursors of the neighbouring pages in the response headers. This
+// keeps the response body backwards compatible.
 func (api *API) userAPIKeyLIST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	aks, err := api.staticDB.APIKeyList(req.Context(), *u)
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var aks []database.APIKeyRecord
+	var err error
+	if req.Form.Get("cursor") != "" || req.Form.Get("pageSize") != "" {
+		pageSize, err1 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+		cursor, err2 := fetchCursor(req.Form)
+		if err = errors.Compose(err1, err2); err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		var pcs database.PageCursors
+		aks, pcs, err = api.staticDB.APIKeyListCursor(req.Context(), *u, cursor, pageSize)
+		if pcs.Next != "" {
+			w.Header().Set(HeaderNextCursor, pcs.Next)
+		}
+		if pcs.Prev != "" {
+			w.Header().Set(HeaderPrevCursor, pcs.Prev)
+		}
+	} else {
+		aks, err = api.staticDB.APIKeyList(req.Context(), *u)
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -171,15 +260,28 @@ func (api *API) userAPIKeyDELETE(u *database.User, w http.ResponseWriter, req *h
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	err = api.staticDB.APIKeyDelete(req.Context(), *u, akID)
-	if err == mongo.ErrNoDocuments {
-		api.WriteError(w, err, http.StatusNotFound)
+	// Fetch the API key first, so we can record what we deleted.
+	ak, err := api.staticDB.APIKeyGet(req.Context(), akID)
+	if err == nil && ak.UserID != u.ID {
+		err = mongo.ErrNoDocuments
+	}
+	if err == nil {
+		err = api.staticDB.APIKeyDelete(req.Context(), *u, akID)
+	}
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, mongo.ErrNoDocuments, http.StatusNotFound)
 		return
 	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionAPIKeyDelete,
+		Before: apiKeySummary(ak),
+	})
 	api.WriteSuccess(w)
 }
 
@@ -234,3 +336,20 @@ func (api *API) userAPIKeyPATCH(u *database.User, w http.ResponseWriter, req *ht
 	}
 	api.WriteSuccess(w)
 }
+
+// apiKeySummary describes the given API key in audit events without revealing
+// the key itself.
+func apiKeySummary(ak database.APIKeyRecord) string {
+	kind := "private"
+	if ak.Public {
+		kind = "public"
+	}
+	summary := fmt.Sprintf("%s key %s", kind, ak.KeyPrefix)
+	if ak.Name != "" {
+		summary += fmt.Sprintf(" %q", ak.Name)
+	}
+	if len(ak.Scopes) > 0 {
+		summary += " with scopes " + strings.Join(ak.Scopes, ",")
+	}
+	return summary
+}
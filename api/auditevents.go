@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+type (
+	// AuditEventsGET is the response of GET /user/events and
+	// GET /admin/events.
+	AuditEventsGET struct {
+		Items    []database.AuditEvent `json:"items"`
+		PageSize int                   `json:"pageSize"`
+		database.PageCursors
+	}
+)
+
+// userEventsGET returns the audit events of the current user's account,
+// newest first.
+func (api *API) userEventsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	f, err := parseAuditEventsFilter(req)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	f.UserID = u.ID
+	api.writeAuditEvents(w, req, f)
+}
+
+// adminEventsGET returns the audit events which match the given filter,
+// newest first. Unlike GET /user/events it can filter by user, actor and IP.
+func (api *API) adminEventsGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	f, err := parseAuditEventsFilter(req)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	f.Actor = req.FormValue("actor")
+	f.IP = req.FormValue("ip")
+	if sub := req.FormValue("sub"); sub != "" {
+		u, err := api.staticDB.UserBySub(req.Context(), sub)
+		if errors.Contains(err, database.ErrUserNotFound) {
+			api.WriteError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		f.UserID = u.ID
+	}
+	api.writeAuditEvents(w, req, f)
+}
+
+// writeAuditEvents writes the page of audit events which match the given
+// filter and the request's pagination parameters.
+func (api *API) writeAuditEvents(w http.ResponseWriter, req *http.Request, f database.AuditEventsFilter) {
+	pageSize, err1 := fetchPageSize(req.Form, DefaultPageSizeSmall)
+	cursor, err2 := fetchCursor(req.Form)
+	if err := errors.Compose(err1, err2); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	events, pcs, err := api.staticDB.AuditEventsCursor(req.Context(), f, cursor, pageSize)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, AuditEventsGET{Items: events, PageSize: pageSize, PageCursors: pcs})
+}
+
+// parseAuditEventsFilter parses the filtering parameters which both
+// GET /user/events and GET /admin/events support.
+func parseAuditEventsFilter(req *http.Request) (database.AuditEventsFilter, error) {
+	if err := req.ParseForm(); err != nil {
+		return database.AuditEventsFilter{}, err
+	}
+	from, err1 := parseInt64Param(req, "from")
+	to, err2 := parseInt64Param(req, "to")
+	if err := errors.Compose(err1, err2); err != nil {
+		return database.AuditEventsFilter{}, err
+	}
+	f := database.AuditEventsFilter{
+		Action: req.Form.Get("action"),
+	}
+	if from != 0 {
+		f.From = time.Unix(from, 0).UTC()
+	}
+	if to != 0 {
+		f.To = time.Unix(to, 0).UTC()
+	}
+	return f, nil
+}
+
+// audit records the given event on behalf of the given request. It fills in
+// the IP and user agent of the caller. Failing to record the event doesn't
+// undo the action, so we only log the error.
+func (api *API) audit(req *http.Request, ae database.AuditEvent) {
+	ae.IP = clientIP(req)
+	ae.UserAgent = req.UserAgent()
+	err := api.staticDB.AuditEventCreate(req.Context(), ae)
+	if err != nil {
+		api.staticLogger.Errorf("Failed to record audit event '%s' on user %s: %v", ae.Action, ae.UserID.Hex(), err)
+	}
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"strings"
 
@@ -8,6 +10,8 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	jwt2 "github.com/lestrrat-go/jwx/jwt"
 	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // userAndTokenByRequestToken scans the request for an authentication token,
@@ -22,40 +26,216 @@ func (api *API) userAndTokenByRequestToken(req *http.Request) (*database.User, j
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "error decoding token from request")
 	}
+	// Tokens which belong to a session carry its ID in their `jti` claim.
+	// Tokens without one, e.g. ones issued before we had sessions, can't be
+	// revoked and remain valid until they expire.
+	sessionID := token.JwtID()
+	if sessionID != "" {
+		revoked, err := api.staticRevokedSessions.IsRevoked(req.Context(), sessionID)
+		if err != nil {
+			return nil, nil, errors.AddContext(err, "error checking session revocation")
+		}
+		if revoked {
+			return nil, nil, ErrSessionRevoked
+		}
+	}
 	u, err := api.staticDB.UserBySub(req.Context(), sub)
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "error fetching user from database")
 	}
+	if sessionID != "" {
+		go api.touchSession(sessionID, clientIP(req))
+	}
 	return u, token, nil
 }
 
+// touchSession updates the last seen time and IP of the given session.
+func (api *API) touchSession(sessionID, ip string) {
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return
+	}
+	err = api.staticDB.SessionTouch(context.Background(), id, ip)
+	if err != nil {
+		api.staticLogger.Debugf("Failed to touch session %s: %v", sessionID, err)
+	}
+}
+
+// revokeRequestSession revokes the session to which the request's JWT or
+// refresh token belongs. Requests without a session are ignored.
+func (api *API) revokeRequestSession(req *http.Request, u *database.User) error {
+	ctx := req.Context()
+	var sessionID string
+	if token, err := tokenFromRequest(req); err == nil {
+		sessionID = token.JwtID()
+	}
+	if id, err := primitive.ObjectIDFromHex(sessionID); err == nil {
+		err = api.staticDB.SessionRevoke(ctx, *u, id)
+		if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+			return errors.AddContext(err, "failed to revoke session")
+		}
+		api.staticRevokedSessions.Add(sessionID)
+	}
+	// Also revoke the refresh token's session, in case it's a different one.
+	if rt := refreshTokenFromRequest(req); rt != "" {
+		err := api.staticDB.SessionRevokeByRefreshToken(ctx, rt)
+		if err != nil {
+			return errors.AddContext(err, "failed to revoke session")
+		}
+	}
+	return nil
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges of trusted proxies.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	cidrs, err := database.NormalizeCIDRs(strings.Split(s, ","))
+	if err != nil {
+		return nil, err
+	}
+	proxies := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// isTrustedProxy returns true if the given IP address belongs to one of the
+// TrustedProxies.
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client making the request. Since we
+// run behind a reverse proxy, we check the headers it sets but only if the
+// request comes from one of the TrustedProxies. Clients can send their own
+// X-Forwarded-For header, so we walk it from right to left and take the first
+// address which doesn't belong to a trusted proxy.
+func clientIP(req *http.Request) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+	var hops []string
+	for _, xff := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if i == 0 || !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	if xri := req.Header.Get("X-Real-Ip"); xri != "" {
+		return strings.TrimSpace(xri)
+	}
+	return remote
+}
+
+var (
+	// TrustedProxies lists the IP ranges of the reverse proxies whose
+	// X-Forwarded-For and X-Real-Ip headers we trust. This value is
+	// configurable via the ACCOUNTS_TRUSTED_PROXIES environment variable. It
+	// defaults to the loopback and private ranges.
+	TrustedProxies, _ = ParseTrustedProxies("127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,::1/128,fc00::/7")
+)
+
+// ctxValue is a helper type which makes it safe to register values in the
+// context.
+type ctxValue string
+
+// ctxValueAPIKey is the context key of the API key a request was
+// authenticated with.
+const ctxValueAPIKey = ctxValue("apikey")
+
+// contextWithAPIKey returns a copy of the given context that contains the API
+// key the request was authenticated with.
+func contextWithAPIKey(ctx context.Context, akr *database.APIKeyRecord) context.Context {
+	return context.WithValue(ctx, ctxValueAPIKey, akr)
+}
+
+// apiKeyFromContext returns the API key the request was authenticated with or
+// nil if it wasn't authenticated with an API key.
+func apiKeyFromContext(ctx context.Context) *database.APIKeyRecord {
+	akr, _ := ctx.Value(ctxValueAPIKey).(*database.APIKeyRecord)
+	return akr
+}
+
 // userAndTokenByAPIKey extracts the APIKey from the request and validates it.
-// It then returns the user who owns it and a token for that user.
+// It then returns the user who owns it, a token for that user and the API key
+// record. The API key needs to have all of the given scopes.
 // It first checks the headers and then the query.
 // This method accesses the database.
-func (api *API) userAndTokenByAPIKey(req *http.Request, ak database.APIKey) (*database.User, jwt2.Token, error) {
-	akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
+func (api *API) userAndTokenByAPIKey(req *http.Request, ak database.APIKey, scopes ...string) (*database.User, jwt2.Token, *database.APIKeyRecord, error) {
+	akr, err := api.apiKeyRecord(req, ak)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	// If we're dealing with a public API key, we need to validate that this
 	// request is a GET for a covered skylink.
 	if akr.Public {
 		// Public API keys can only be used with GET.
 		if req.Method != http.MethodGet {
-			return nil, nil, database.ErrInvalidAPIKey
+			return nil, nil, nil, database.ErrInvalidAPIKey
 		}
 		sl, err := database.ExtractSkylink(req.RequestURI)
 		if err != nil || !akr.CoversSkylink(sl) {
-			return nil, nil, database.ErrInvalidAPIKey
+			return nil, nil, nil, database.ErrInvalidAPIKey
 		}
+	} else if !akr.HasScopes(scopes...) {
+		return nil, nil, nil, errors.AddContext(ErrAPIKeyInsufficientScope, "required scopes: "+strings.Join(scopes, ", "))
 	}
 	u, err := api.staticDB.UserByID(req.Context(), akr.UserID)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	api.apiKeyUsed(req, &akr)
 	t, err := jwt.TokenForUser(u.Email, u.Sub, 0)
-	return u, t, err
+	return u, t, &akr, err
+}
+
+// apiKeyRecord fetches the record of the given API key and makes sure the key
+// hasn't expired and is allowed from the client's IP address.
+func (api *API) apiKeyRecord(req *http.Request, ak database.APIKey) (database.APIKeyRecord, error) {
+	akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
+	if err != nil {
+		return database.APIKeyRecord{}, err
+	}
+	if akr.Expired() {
+		return database.APIKeyRecord{}, database.ErrAPIKeyExpired
+	}
+	if !akr.AllowsIP(clientIP(req)) {
+		return database.APIKeyRecord{}, database.ErrAPIKeyIPNotAllowed
+	}
+	return akr, nil
+}
+
+// apiKeyUsed records the use of the given API key. Failing to do so shouldn't
+// fail the request, so we only log the error.
+func (api *API) apiKeyUsed(req *http.Request, akr *database.APIKeyRecord) {
+	err := api.staticDB.APIKeyUsed(req.Context(), akr, clientIP(req))
+	if err != nil {
+		api.staticLogger.Debugln("Failed to record API key use:", err)
+	}
 }
 
 // apiKeyFromRequest extracts the API key from the request headers and returns
@@ -137,3 +137,40 @@ func TestTokenFromRequest(t *testing.T) {
 func randomAPIKeyString() string {
 	return base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(fastrand.Bytes(database.PubKeySize))
 }
+
+// TestClientIP ensures that clientIP only trusts forwarded headers which come
+// from trusted proxies.
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xri        string
+		expected   string
+	}{
+		{name: "untrusted remote", remoteAddr: "203.0.113.1:1234", expected: "203.0.113.1"},
+		{name: "untrusted remote with headers", remoteAddr: "203.0.113.1:1234", xff: []string{"198.51.100.1"}, xri: "198.51.100.2", expected: "203.0.113.1"},
+		{name: "trusted remote without headers", remoteAddr: "127.0.0.1:1234", expected: "127.0.0.1"},
+		{name: "trusted remote with single hop", remoteAddr: "127.0.0.1:1234", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "spoofed hop", remoteAddr: "127.0.0.1:1234", xff: []string{"1.1.1.1, 198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "trusted hops", remoteAddr: "127.0.0.1:1234", xff: []string{"1.1.1.1, 198.51.100.1, 10.0.0.1", "192.168.0.1"}, expected: "198.51.100.1"},
+		{name: "only trusted hops", remoteAddr: "127.0.0.1:1234", xff: []string{"10.0.0.2, 10.0.0.1"}, expected: "10.0.0.2"},
+		{name: "real ip fallback", remoteAddr: "127.0.0.1:1234", xri: "198.51.100.2", expected: "198.51.100.2"},
+		{name: "remote without port", remoteAddr: "203.0.113.1", expected: "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		req := &http.Request{
+			RemoteAddr: tt.remoteAddr,
+			Header:     make(map[string][]string),
+		}
+		for _, xff := range tt.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		if tt.xri != "" {
+			req.Header.Set("X-Real-Ip", tt.xri)
+		}
+		if ip := clientIP(req); ip != tt.expected {
+			t.Errorf("Test '%s': expected '%s', got '%s'.", tt.name, tt.expected, ip)
+		}
+	}
+}
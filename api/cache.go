@@ -1,15 +1,34 @@
 package api
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"gitlab.com/SkynetLabs/skyd/build"
 )
 
 const (
 	// userTierCacheTTL is the TTL of the entries in the userTierCache.
 	userTierCacheTTL = time.Hour
+
+	// revokedSessionsSyncSlack defines how far back we look when syncing the
+	// revokedSessionsCache with the DB. This covers revocations which were
+	// written by other servers while we were syncing.
+	revokedSessionsSyncSlack = 5 * time.Second
+)
+
+var (
+	// revokedSessionsSyncInterval defines how often we sync the
+	// revokedSessionsCache with the DB. A session revoked on another server
+	// might still be accepted here for up to this long.
+	revokedSessionsSyncInterval = build.Select(build.Var{
+		Dev:      5 * time.Second,
+		Testing:  time.Second,
+		Standard: 30 * time.Second,
+	}).(time.Duration)
 )
 
 type (
@@ -26,6 +45,21 @@ type (
 		Tier          int
 		QuotaExceeded bool
 		ExpiresAt     time.Time
+		// AllowedIPs holds the allowed CIDR ranges of the API key the entry
+		// is cached under, if any.
+		AllowedIPs []string
+	}
+
+	// revokedSessionsCache is an in-mem set of the IDs of all sessions which
+	// were revoked while they might still have valid JWTs out there. It
+	// allows us to reject the JWTs of revoked sessions without hitting the DB
+	// on every request.
+	revokedSessionsCache struct {
+		// revoked maps from a session ID to the time it was revoked.
+		revoked  map[string]time.Time
+		lastSync time.Time
+		mu       sync.Mutex
+		staticDB *database.DB
 	}
 )
 
@@ -53,12 +87,117 @@ func (utc *userTierCache) Get(sub string) (userTierCacheEntry, bool) {
 
 // Set stores the user's tier in the cache under the given key.
 func (utc *userTierCache) Set(key string, u *database.User) {
+	utc.set(key, u, userTierCacheEntry{})
+}
+
+// SetAPIKey stores the user's tier in the cache under the given key which is
+// derived from the given API key. The entry doesn't outlive the API key and
+// remembers its allowed IP ranges.
+func (utc *userTierCache) SetAPIKey(key string, u *database.User, akr database.APIKeyRecord) {
+	ce := userTierCacheEntry{AllowedIPs: akr.AllowedIPs}
+	if akr.ExpiresAt != nil {
+		ce.ExpiresAt = *akr.ExpiresAt
+	}
+	utc.set(key, u, ce)
+}
+
+// DeleteBySub removes all entries of the user with the given sub from the
+// cache, regardless of the key they are stored under. We use it when the
+// user's tier changes in a way that needs to take effect immediately.
+func (utc *userTierCache) DeleteBySub(sub string) {
 	utc.mu.Lock()
-	utc.cache[key] = userTierCacheEntry{
-		Sub:           u.Sub,
-		Tier:          u.Tier,
-		QuotaExceeded: u.QuotaExceeded,
-		ExpiresAt:     time.Now().UTC().Add(userTierCacheTTL).Truncate(time.Millisecond),
+	for key, ce := range utc.cache {
+		if ce.Sub == sub {
+			delete(utc.cache, key)
+		}
 	}
 	utc.mu.Unlock()
 }
+
+// set stores the user's tier in the cache under the given key. The given entry
+// provides its allowed IP ranges and an expiration time which overrides the
+// default TTL if it comes sooner. The entries of suspended users expire
+// together with their suspension.
+func (utc *userTierCache) set(key string, u *database.User, ce userTierCacheEntry) {
+	expiresAt := time.Now().UTC().Add(userTierCacheTTL).Truncate(time.Millisecond)
+	if u.Suspended() && u.SuspendedUntil != nil && u.SuspendedUntil.Before(expiresAt) {
+		expiresAt = *u.SuspendedUntil
+	}
+	if ce.ExpiresAt.IsZero() || ce.ExpiresAt.After(expiresAt) {
+		ce.ExpiresAt = expiresAt
+	}
+	ce.Sub = u.Sub
+	ce.Tier = userTier(u)
+	ce.QuotaExceeded = u.QuotaExceeded
+	utc.mu.Lock()
+	utc.cache[key] = ce
+	utc.mu.Unlock()
+}
+
+// newRevokedSessionsCache creates a new revokedSessionsCache.
+func newRevokedSessionsCache(db *database.DB) *revokedSessionsCache {
+	return &revokedSessionsCache{
+		revoked:  make(map[string]time.Time),
+		staticDB: db,
+	}
+}
+
+// Add marks the given session as revoked.
+func (rsc *revokedSessionsCache) Add(sessionID string) {
+	rsc.mu.Lock()
+	rsc.revoked[sessionID] = time.Now().UTC()
+	rsc.mu.Unlock()
+}
+
+// IsRevoked returns true if the given session has been revoked. It syncs the
+// cache with the DB if the last sync is older than
+// revokedSessionsSyncInterval.
+func (rsc *revokedSessionsCache) IsRevoked(ctx context.Context, sessionID string) (bool, error) {
+	rsc.mu.Lock()
+	defer rsc.mu.Unlock()
+	now := time.Now().UTC()
+	if now.Sub(rsc.lastSync) > revokedSessionsSyncInterval {
+		err := rsc.syncWithDB(ctx, now)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, revoked := rsc.revoked[sessionID]
+	return revoked, nil
+}
+
+// syncWithDB fetches all sessions revoked since the last sync and drops the
+// ones which can no longer have valid JWTs. The caller must hold the lock.
+func (rsc *revokedSessionsCache) syncWithDB(ctx context.Context, now time.Time) error {
+	// JWTs issued before a session got revoked expire within jwt.TTL, so we
+	// don't need to remember revocations older than that.
+	jwtTTL := time.Duration(jwt.TTL) * time.Second
+	since := now.Add(-jwtTTL)
+	if !rsc.lastSync.IsZero() && rsc.lastSync.Add(-revokedSessionsSyncSlack).After(since) {
+		since = rsc.lastSync.Add(-revokedSessionsSyncSlack)
+	}
+	sessions, err := rsc.staticDB.SessionsRevokedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.RevokedAt != nil {
+			rsc.revoked[s.ID.Hex()] = *s.RevokedAt
+		}
+	}
+	for id, revokedAt := range rsc.revoked {
+		if revokedAt.Add(jwtTTL).Before(now) {
+			delete(rsc.revoked, id)
+		}
+	}
+	rsc.lastSync = now
+	return nil
+}
+
+// Invalidate forces the next revocation check to sync the cache with the DB.
+// We use it after revoking sessions whose IDs we don't know.
+func (rsc *revokedSessionsCache) Invalidate() {
+	rsc.mu.Lock()
+	rsc.lastSync = time.Time{}
+	rsc.mu.Unlock()
+}
@@ -81,4 +81,25 @@ func TestUserTierCache(t *testing.T) {
 	if ce.Tier != u.Tier {
 		t.Fatalf("Expected tier %d, got %d", u.Tier, ce.Tier)
 	}
+	// Cache the entry until an API key expires.
+	keyExpiresAt := time.Now().UTC().Add(time.Minute)
+	akr := database.APIKeyRecord{
+		ExpiresAt:  &keyExpiresAt,
+		AllowedIPs: []string{"10.0.0.0/8"},
+	}
+	cache.SetAPIKey(string(ak), u, akr)
+	ce, ok = cache.Get(string(ak))
+	if !ok || !ce.ExpiresAt.Equal(keyExpiresAt) {
+		t.Fatalf("Expected ExpiresAt %s, got %s", keyExpiresAt, ce.ExpiresAt)
+	}
+	if len(ce.AllowedIPs) != 1 || ce.AllowedIPs[0] != akr.AllowedIPs[0] {
+		t.Fatalf("Expected allowed IPs %v, got %v", akr.AllowedIPs, ce.AllowedIPs)
+	}
+	// An expired API key shouldn't be served from the cache.
+	keyExpiresAt = time.Now().UTC().Add(-time.Minute)
+	cache.SetAPIKey(string(ak), u, akr)
+	_, ok = cache.Get(string(ak))
+	if ok {
+		t.Fatal("Did not expect to get a cache entry!")
+	}
 }
@@ -14,6 +14,9 @@ import (
 const (
 	// CookieName is the name of the cookie where we store the user's JWT token.
 	CookieName = "skynet-jwt"
+	// RefreshCookieName is the name of the cookie where we store the user's
+	// refresh token.
+	RefreshCookieName = "skynet-refresh"
 
 	// envCookieDomain holds the name of the environment variable for the
 	// domain name of the portal
@@ -56,7 +59,19 @@ var (
 // secure cookie.
 // See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Set-Cookie
 func writeCookie(w http.ResponseWriter, token string, exp int64) error {
-	encodedValue, err := secureCookie.Encode(CookieName, token)
+	return writeSecureCookie(w, CookieName, token, exp)
+}
+
+// writeRefreshCookie is a helper function that writes the given refresh token
+// as a secure cookie.
+func writeRefreshCookie(w http.ResponseWriter, token string, exp int64) error {
+	return writeSecureCookie(w, RefreshCookieName, token, exp)
+}
+
+// writeSecureCookie encodes the given value and writes it as a secure cookie
+// with the given name.
+func writeSecureCookie(w http.ResponseWriter, name, value string, exp int64) error {
+	encodedValue, err := secureCookie.Encode(name, value)
 	if err != nil {
 		return err
 	}
@@ -66,7 +81,7 @@ func writeCookie(w http.ResponseWriter, token string, exp int64) error {
 		domain = "127.0.0.1"
 	}
 	cookie := &http.Cookie{
-		Name:     CookieName,
+		Name:     name,
 		Value:    encodedValue,
 		HttpOnly: true,
 		Path:     "/",
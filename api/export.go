@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// ExportFormatCSV exports records as comma-separated values with a header
+	// row.
+	ExportFormatCSV = "csv"
+	// ExportFormatNDJSON exports records as newline-delimited JSON objects.
+	ExportFormatNDJSON = "ndjson"
+
+	// exportFlushInterval defines after how many records we flush the export
+	// to the client.
+	exportFlushInterval = 100
+)
+
+var (
+	// ErrInvalidExportFormat is returned when the requested export format is
+	// not supported.
+	ErrInvalidExportFormat = errors.New("invalid export format, supported formats are 'csv' and 'ndjson'")
+
+	// uploadsExportHeader defines the CSV header of the uploads export.
+	uploadsExportHeader = []string{"skylink", "name", "size", "rawStorage", "uploadedOn", "unpinned"}
+	// downloadsExportHeader defines the CSV header of the downloads export.
+	downloadsExportHeader = []string{"skylink", "name", "size", "downloadedOn", "updatedOn"}
+)
+
+// exportWriter streams export records to the client in the requested format.
+// Nothing is written to the client before the first record or the call to
+// finish, so we can still respond with a proper error if the export fails
+// right away.
+type exportWriter struct {
+	staticFormat    string
+	staticFilename  string
+	staticCSVHeader []string
+	staticW         http.ResponseWriter
+
+	csvW    *csv.Writer
+	jsonEnc *json.Encoder
+	started bool
+	written int
+}
+
+// newExportWriter creates a new exportWriter for the given format.
+func newExportWriter(w http.ResponseWriter, format, filename string, csvHeader []string) (*exportWriter, error) {
+	if format == "" {
+		format = ExportFormatCSV
+	}
+	if format != ExportFormatCSV && format != ExportFormatNDJSON {
+		return nil, ErrInvalidExportFormat
+	}
+	return &exportWriter{
+		staticFormat:    format,
+		staticFilename:  filename,
+		staticCSVHeader: csvHeader,
+		staticW:         w,
+	}, nil
+}
+
+// start writes the response headers and, for CSV, the header row.
+func (ew *exportWriter) start() error {
+	ew.started = true
+	h := ew.staticW.Header()
+	if ew.staticFormat == ExportFormatNDJSON {
+		h.Set("Content-Type", "application/x-ndjson")
+	} else {
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ew.staticFilename+"."+ew.staticFormat))
+	ew.staticW.WriteHeader(http.StatusOK)
+	if ew.staticFormat == ExportFormatNDJSON {
+		ew.jsonEnc = json.NewEncoder(ew.staticW)
+		return nil
+	}
+	ew.csvW = csv.NewWriter(ew.staticW)
+	return ew.csvW.Write(ew.staticCSVHeader)
+}
+
+// write writes a single record. The record is encoded as JSON in NDJSON
+// exports and written as the given CSV row in CSV exports.
+func (ew *exportWriter) write(record interface{}, csvRow []string) error {
+	if !ew.started {
+		if err := ew.start(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if ew.staticFormat == ExportFormatNDJSON {
+		err = ew.jsonEnc.Encode(record)
+	} else {
+		err = ew.csvW.Write(csvRow)
+	}
+	if err != nil {
+		return err
+	}
+	ew.written++
+	if ew.written%exportFlushInterval == 0 {
+		return ew.flush()
+	}
+	return nil
+}
+
+// finish flushes all remaining records to the client. It starts the export if
+// there were no records.
+func (ew *exportWriter) finish() error {
+	if !ew.started {
+		if err := ew.start(); err != nil {
+			return err
+		}
+	}
+	return ew.flush()
+}
+
+// flush pushes all buffered records to the client.
+func (ew *exportWriter) flush() error {
+	if ew.csvW != nil {
+		ew.csvW.Flush()
+		if err := ew.csvW.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := ew.staticW.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// userUploadsExportGET streams all uploads of the user, optionally limited to
+// the given time range, as CSV or NDJSON.
+func (api *API) userUploadsExportGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ew, from, to, err := parseExportParams(w, req, "uploads", uploadsExportHeader)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.UploadsExport(req.Context(), *u, from, to, func(up database.UploadExport) error {
+		row := []string{
+			up.Skylink,
+			up.Name,
+			strconv.FormatInt(up.Size, 10),
+			strconv.FormatInt(up.RawStorage, 10),
+			up.Timestamp.UTC().Format(time.RFC3339),
+			strconv.FormatBool(up.Unpinned),
+		}
+		return ew.write(up, row)
+	})
+	if err == nil {
+		err = ew.finish()
+	}
+	api.handleExportError(w, ew, err)
+}
+
+// userDownloadsExportGET streams all downloads of the user, optionally limited
+// to the given time range, as CSV or NDJSON.
+func (api *API) userDownloadsExportGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ew, from, to, err := parseExportParams(w, req, "downloads", downloadsExportHeader)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.DownloadsExport(req.Context(), *u, from, to, func(d database.DownloadExport) error {
+		row := []string{
+			d.Skylink,
+			d.Name,
+			strconv.FormatInt(d.Size, 10),
+			d.CreatedAt.UTC().Format(time.RFC3339),
+			d.UpdatedAt.UTC().Format(time.RFC3339),
+		}
+		return ew.write(d, row)
+	})
+	if err == nil {
+		err = ew.finish()
+	}
+	api.handleExportError(w, ew, err)
+}
+
+// handleExportError reports an export error to the client if we haven't
+// started streaming the export yet. Otherwise, all we can do is log it and
+// let the client deal with the truncated export.
+func (api *API) handleExportError(w http.ResponseWriter, ew *exportWriter, err error) {
+	if err == nil {
+		return
+	}
+	if !ew.started {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.Warnf("Export of %s failed after %d records: %v", ew.staticFilename, ew.written, err)
+}
+
+// parseExportParams parses the `format`, `from` and `to` parameters of an
+// export request. The `from` and `to` parameters are Unix timestamps and are
+// optional.
+func parseExportParams(w http.ResponseWriter, req *http.Request, filename string, csvHeader []string) (*exportWriter, time.Time, time.Time, error) {
+	ew, err := newExportWriter(w, req.FormValue("format"), filename, csvHeader)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	fromUnix, err := parseInt64Param(req, "from")
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	toUnix, err := parseInt64Param(req, "to")
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	var from, to time.Time
+	if fromUnix != 0 {
+		from = time.Unix(fromUnix, 0).UTC()
+	}
+	if toUnix != 0 {
+		to = time.Unix(toUnix, 0).UTC()
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return nil, time.Time{}, time.Time{}, database.ErrInvalidTimePeriod
+	}
+	return ew, from, to, nil
+}
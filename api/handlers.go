@@ -17,13 +17,13 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/hash"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/lib"
-	"github.com/SkynetLabs/skynet-accounts/metafetcher"
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/julienschmidt/httprouter"
 	jwt2 "github.com/lestrrat-go/jwx/jwt"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -71,6 +71,7 @@ type (
 		Offset   int                         `json:"offset"`
 		PageSize int                         `json:"pageSize"`
 		Count    int                         `json:"count"`
+		database.PageCursors
 	}
 	// HealthGET is the response type of GET /health.
 	// Primary field is only populated on error.
@@ -110,13 +111,15 @@ type (
 		Offset   int                       `json:"offset"`
 		PageSize int                       `json:"pageSize"`
 		Count    int64                     `json:"count"`
+		database.PageCursors
 	}
 	// UserGET defines a representation of the User struct returned by all
 	// handlers. This allows us to tweak the fields of the struct before
 	// returning it.
 	UserGET struct {
 		database.User
-		EmailConfirmed bool `json:"emailConfirmed"`
+		EmailConfirmed   bool `json:"emailConfirmed"`
+		TwoFactorEnabled bool `json:"twoFactorEnabled"`
 	}
 	// UserLimitsGET is response of GET /user/limits
 	// The returned speeds might be in bits or bytes per second, depending on
@@ -141,6 +144,20 @@ type (
 		ConfirmPassword string `json:"confirmPassword"`
 	}
 
+	// UserDELETE is the response of DELETE /user for users without an email
+	// address. We can't email them a restore link, so we give them the
+	// restore token directly.
+	UserDELETE struct {
+		RestoreToken string    `json:"restoreToken"`
+		DeleteAt     time.Time `json:"deleteAt"`
+	}
+
+	// accountRestorePOST defines the payload we expect when a user is trying
+	// to restore their account which is scheduled for deletion.
+	accountRestorePOST struct {
+		Token string `json:"token"`
+	}
+
 	// credentialsPOST defines the standard credentials package we expect.
 	credentialsPOST struct {
 		Email    types.Email `json:"email"`
@@ -294,25 +311,41 @@ func (api *API) loginPOSTChallengeResponse(w http.ResponseWriter, req *http.Requ
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
-	api.loginUser(w, u, jwtTTL, false)
+	api.loginUser(w, req, u, jwtTTL, false)
 }
 
 // loginPOSTCredentials is a helper that handles logins with credentials.
 func (api *API) loginPOSTCredentials(w http.ResponseWriter, req *http.Request, email types.Email, password string, jwtTTL int) {
+	ctx := req.Context()
+	// Make sure the caller isn't blocked after too many failed attempts.
+	ip := clientIP(req)
+	if api.attemptBlocked(w, req, database.LoginAttemptScopeLogin, email, ip) {
+		return
+	}
 	// Fetch the user with that email, if they exist.
-	u, err := api.staticDB.UserByEmail(req.Context(), email)
+	u, err := api.staticDB.UserByEmail(ctx, email)
 	if err != nil {
 		api.staticLogger.Debugf("Error fetching a user with email '%s': %v\n", email, err)
+		api.attemptFailed(ctx, database.LoginAttemptScopeLogin, email, ip, nil)
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
 	// Check if the password matches.
 	err = hash.Compare(password, []byte(u.PasswordHash))
 	if err != nil {
+		api.attemptFailed(ctx, database.LoginAttemptScopeLogin, email, ip, u)
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
 	}
-	api.loginUser(w, u, jwtTTL, false)
+	// Users with a second factor haven't completed their login yet, so we
+	// only forget their failed attempts once they pass `POST /login/2fa`.
+	if !u.TwoFactorEnabled() {
+		err = api.staticDB.LoginAttemptsReset(ctx, database.LoginAttemptScopeLogin, email)
+		if err != nil {
+			api.staticLogger.Debugln("Failed to reset failed login attempts:", err)
+		}
+	}
+	api.loginOrRequireTwoFactor(w, req, u, jwtTTL)
 }
 
 // loginPOSTToken is a helper that handles logins via a token attached to the
@@ -345,11 +378,88 @@ func (api *API) loginPOSTToken(w http.ResponseWriter, req *http.Request) {
 	api.WriteSuccess(w)
 }
 
-// loginUser is a helper method that generates a JWT for the user and writes the
-// login cookie.
-func (api *API) loginUser(w http.ResponseWriter, u *database.User, jwtTTL int, returnUser bool) {
+// loginUser is a helper method that starts a new session for the user. It
+// issues the session's first refresh token and then writes the user's tokens
+// to the response.
+func (api *API) loginUser(w http.ResponseWriter, req *http.Request, u *database.User, jwtTTL int, returnUser bool) {
+	if u.Suspended() {
+		api.WriteError(w, database.ErrUserSuspended, http.StatusForbidden)
+		return
+	}
+	if u.PendingDeletion() {
+		api.WriteError(w, database.ErrUserPendingDeletion, http.StatusForbidden)
+		return
+	}
+	ctx := req.Context()
+	s, err := api.staticDB.SessionCreate(ctx, *u, req.UserAgent(), clientIP(req))
+	if err != nil {
+		api.staticLogger.Debugf("Error creating a session for user: %v", err)
+		api.WriteError(w, errors.AddContext(err, "failed to create a session for user"), http.StatusInternalServerError)
+		return
+	}
+	rt, rtr, err := api.staticDB.RefreshTokenCreate(ctx, *s)
+	if err != nil {
+		api.staticLogger.Debugf("Error creating a refresh token for user: %v", err)
+		api.WriteError(w, errors.AddContext(err, "failed to create a refresh token for user"), http.StatusInternalServerError)
+		return
+	}
+	api.writeTokens(w, u, s.ID.Hex(), jwtTTL, rt, rtr.ExpiresAt, returnUser)
+}
+
+// reissueTokens is a helper method that writes fresh tokens for a user whose
+// details have changed, e.g. their email. If the request belongs to an active
+// session of the user the new tokens are issued within that session, so we
+// don't leave the old session behind. Otherwise the user gets logged in.
+func (api *API) reissueTokens(w http.ResponseWriter, req *http.Request, u *database.User, returnUser bool) {
+	s := api.requestSession(req, u)
+	if s == nil {
+		api.loginUser(w, req, u, 0, returnUser)
+		return
+	}
+	if u.Suspended() {
+		api.WriteError(w, database.ErrUserSuspended, http.StatusForbidden)
+		return
+	}
+	if u.PendingDeletion() {
+		api.WriteError(w, database.ErrUserPendingDeletion, http.StatusForbidden)
+		return
+	}
+	rt, rtr, err := api.staticDB.RefreshTokenCreate(req.Context(), *s)
+	if err != nil {
+		api.staticLogger.Debugf("Error creating a refresh token for user: %v", err)
+		api.WriteError(w, errors.AddContext(err, "failed to create a refresh token for user"), http.StatusInternalServerError)
+		return
+	}
+	api.writeTokens(w, u, s.ID.Hex(), 0, rt, rtr.ExpiresAt, returnUser)
+}
+
+// requestSession returns the active session of the given user to which the
+// request's JWT belongs. It returns nil if there is no such session.
+func (api *API) requestSession(req *http.Request, u *database.User) *database.Session {
+	token, err := tokenFromRequest(req)
+	if err != nil {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(token.JwtID())
+	if err != nil {
+		return nil
+	}
+	s, err := api.staticDB.SessionByID(req.Context(), id)
+	if err != nil {
+		return nil
+	}
+	if s.UserID != u.ID || s.RevokedAt != nil || s.ExpiresAt.Before(time.Now().UTC()) {
+		return nil
+	}
+	return s
+}
+
+// writeTokens is a helper method that generates a JWT for the user's session
+// and writes it, together with the given refresh token, to the login cookies
+// and the response headers.
+func (api *API) writeTokens(w http.ResponseWriter, u *database.User, sessionID string, jwtTTL int, refreshToken string, refreshExp time.Time, returnUser bool) {
 	// Generate a JWT.
-	tk, err := jwt.TokenForUser(u.Email, u.Sub, jwtTTL)
+	tk, err := jwt.TokenForSession(u.Email, u.Sub, sessionID, jwtTTL)
 	if err != nil {
 		api.staticLogger.Debugf("Error creating a token for user: %v", err)
 		err = errors.AddContext(err, "failed to create a token for user")
@@ -362,14 +472,16 @@ func (api *API) loginUser(w http.ResponseWriter, u *database.User, jwtTTL int, r
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	// Write the JWT to an encrypted cookie.
-	err = writeCookie(w, string(tkBytes), tk.Expiration().UTC().Unix())
-	if err != nil {
+	// Write the JWT and the refresh token to encrypted cookies.
+	err1 := writeCookie(w, string(tkBytes), tk.Expiration().UTC().Unix())
+	err2 := writeRefreshCookie(w, refreshToken, refreshExp.UTC().Unix())
+	if err = errors.Compose(err1, err2); err != nil {
 		api.staticLogger.Debugln("Error writing cookie:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Skynet-Token", string(tkBytes))
+	w.Header().Set(RefreshTokenHeader, refreshToken)
 	if returnUser {
 		api.WriteJSON(w, UserGETFromUser(u))
 	} else {
@@ -377,13 +489,20 @@ func (api *API) loginUser(w http.ResponseWriter, u *database.User, jwtTTL int, r
 	}
 }
 
-// logoutPOST ends a user session by removing a cookie
-func (api *API) logoutPOST(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	// Remove the user's cookie. We achieve that by overwriting the cookie with
-	// a new one, which has its expiration time in the past. The browser will
-	// remove it for us.
-	err := writeCookie(w, "", time.Now().UTC().Unix()-1)
+// logoutPOST ends a user session by revoking it and removing its cookies.
+// Revoking the session invalidates both its JWTs and its refresh tokens.
+func (api *API) logoutPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	err := api.revokeRequestSession(req, u)
 	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// Remove the user's cookies. We achieve that by overwriting the cookies
+	// with new ones, which have their expiration time in the past. The browser
+	// will remove them for us.
+	err1 := writeCookie(w, "", time.Now().UTC().Unix()-1)
+	err2 := writeRefreshCookie(w, "", time.Now().UTC().Unix()-1)
+	if err = errors.Compose(err1, err2); err != nil {
 		api.staticLogger.Debugln("Error deleting cookie:", err)
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -480,7 +599,7 @@ func (api *API) registerPOST(_ *database.User, w http.ResponseWriter, req *http.
 	if err != nil {
 		api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
 	}
-	api.loginUser(w, u, 0, true)
+	api.loginUser(w, req, u, 0, true)
 }
 
 // userGET returns information about an existing user and create it if it
@@ -504,15 +623,20 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 	if err == nil {
 		// Check the cache before going any further.
 		ce, ok := api.staticUserTierCache.Get(ak.String())
+		if ok && !database.IPAllowed(ce.AllowedIPs, clientIP(req)) {
+			api.staticLogger.Trace("API key is not allowed from this IP address.")
+			api.WriteJSON(w, respAnon)
+			return
+		}
 		if ok {
 			api.staticLogger.Traceln("Fetching user limits from cache by API key.")
 			api.WriteJSON(w, userLimitsGetFromTier(ce.Sub, ce.Tier, ce.QuotaExceeded, inBytes))
 			return
 		}
 		// Get the API key.
-		akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
+		akr, err := api.apiKeyRecord(req, *ak)
 		if err != nil {
-			api.staticLogger.Trace("API key doesn't exist in the database.")
+			api.staticLogger.Traceln("API key doesn't exist in the database or can't be used:", err)
 			api.WriteJSON(w, respAnon)
 			return
 		}
@@ -528,9 +652,10 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 			api.WriteJSON(w, respAnon)
 			return
 		}
+		api.apiKeyUsed(req, &akr)
 		// Cache the user under the API key they used.
-		api.staticUserTierCache.Set(ak.String(), u)
-		api.WriteJSON(w, userLimitsGetFromTier(u.Sub, u.Tier, u.QuotaExceeded, inBytes))
+		api.staticUserTierCache.SetAPIKey(ak.String(), u, akr)
+		api.WriteJSON(w, userLimitsGetFromTier(u.Sub, userTier(u), u.QuotaExceeded, inBytes))
 		return
 	}
 	// Next check for a token.
@@ -607,15 +732,20 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 	}
 	// Check the cache before hitting the database.
 	ce, ok := api.staticUserTierCache.Get(ak.String() + skylink)
+	if ok && !database.IPAllowed(ce.AllowedIPs, clientIP(req)) {
+		api.staticLogger.Trace("API key is not allowed from this IP address.")
+		api.WriteJSON(w, respAnon)
+		return
+	}
 	if ok {
 		api.staticLogger.Traceln("Fetching user limits from cache by API key.")
 		api.WriteJSON(w, userLimitsGetFromTier(ce.Sub, ce.Tier, ce.QuotaExceeded, inBytes))
 		return
 	}
 	// Get the API key.
-	akr, err := api.staticDB.APIKeyByKey(req.Context(), ak.String())
+	akr, err := api.apiKeyRecord(req, *ak)
 	if err != nil {
-		api.staticLogger.Trace("API key doesn't exist in the database.")
+		api.staticLogger.Traceln("API key doesn't exist in the database or can't be used:", err)
 		api.WriteJSON(w, respAnon)
 		return
 	}
@@ -624,6 +754,11 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 		api.WriteJSON(w, respAnon)
 		return
 	}
+	if !akr.Public && !akr.HasScopes(database.APIKeyScopeDownload) {
+		api.staticLogger.Trace("API key doesn't have the download scope.")
+		api.WriteJSON(w, respAnon)
+		return
+	}
 	// Get the owner of this API key from the database.
 	user, err := api.staticDB.UserByID(req.Context(), akr.UserID)
 	if err != nil {
@@ -631,9 +766,10 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 		api.WriteJSON(w, respAnon)
 		return
 	}
+	api.apiKeyUsed(req, &akr)
 	// Store the user in the cache with a custom key.
-	api.staticUserTierCache.Set(ak.String()+skylink, user)
-	api.WriteJSON(w, userLimitsGetFromTier(user.Sub, user.Tier, user.QuotaExceeded, inBytes))
+	api.staticUserTierCache.SetAPIKey(ak.String()+skylink, user, akr)
+	api.WriteJSON(w, userLimitsGetFromTier(user.Sub, userTier(user), user.QuotaExceeded, inBytes))
 }
 
 // userStatsGET returns statistics about an existing user.
@@ -646,9 +782,78 @@ func (api *API) userStatsGET(u *database.User, w http.ResponseWriter, req *http.
 	api.WriteJSON(w, us)
 }
 
-// userDELETE deletes the user and all of their data.
+// userStatsHistoryGET returns the user's stats over the given time period,
+// split into buckets of the given granularity. The `from` and `to` parameters
+// are Unix timestamps and `granularity` is one of `day`, `week` and `month`.
+func (api *API) userStatsHistoryGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	granularity := database.StatsGranularity(req.FormValue("granularity"))
+	if granularity == "" {
+		granularity = database.StatsGranularityDay
+	}
+	if err := granularity.Validate(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	fromUnix, err := parseInt64Param(req, "from")
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	toUnix, err := parseInt64Param(req, "to")
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC()
+	if toUnix != 0 {
+		to = time.Unix(toUnix, 0).UTC()
+	}
+	from := to.AddDate(0, 0, -30)
+	if granularity == database.StatsGranularityWeek {
+		from = to.AddDate(0, 0, -12*7)
+	} else if granularity == database.StatsGranularityMonth {
+		from = to.AddDate(0, -12, 0)
+	}
+	if fromUnix != 0 {
+		from = time.Unix(fromUnix, 0).UTC()
+	}
+	history, err := api.staticDB.UserStatsHistory(req.Context(), *u, from, to, granularity)
+	if errors.Contains(err, database.ErrInvalidTimePeriod) || errors.Contains(err, database.ErrTooManyBuckets) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, history)
+}
+
+// userDELETE schedules the user's account for deletion. The user can restore
+// it until database.UserDeletionGracePeriod passes, after which we delete the
+// user and all of their data. Without a grace period we delete them right
+// away.
 func (api *API) userDELETE(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	err := api.staticDB.UserDelete(req.Context(), u)
+	ctx := req.Context()
+	if database.UserDeletionGracePeriod == 0 {
+		err := api.staticDB.UserDelete(ctx, u)
+		if errors.Contains(err, database.ErrUserNotFound) {
+			api.WriteError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		api.WriteSuccess(w)
+		return
+	}
+	token, err := lib.GenerateUUID()
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to generate a restore token"), http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserScheduleDeletion(ctx, u, token)
 	if errors.Contains(err, database.ErrUserNotFound) {
 		api.WriteError(w, err, http.StatusNotFound)
 		return
@@ -657,6 +862,82 @@ func (api *API) userDELETE(u *database.User, w http.ResponseWriter, req *http.Re
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// The user can't restore their account without the email, so we cancel
+	// the deletion if we fail to send it. Users without an email address get
+	// the restore token in the response instead.
+	if u.Email != "" {
+		err = api.staticMailer.SendAccountDeletionScheduledEmail(ctx, u.Email, token, *u.DeleteAt)
+		if err != nil {
+			errRestore := api.staticDB.UserRestore(ctx, u)
+			api.WriteError(w, errors.Compose(errors.AddContext(err, "failed to send the restore email"), errRestore), http.StatusInternalServerError)
+			return
+		}
+	}
+	api.staticUserTierCache.DeleteBySub(u.Sub)
+	api.audit(req, database.AuditEvent{
+		UserID:  u.ID,
+		Actor:   u.Sub,
+		Action:  database.AuditActionUserDelete,
+		Details: "scheduled for " + u.DeleteAt.Format(time.RFC3339),
+	})
+	// Log the user out everywhere. The account can't be used until it's
+	// restored anyway.
+	_, err = api.staticDB.SessionsRevokeAll(ctx, *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticRevokedSessions.Invalidate()
+	err1 := writeCookie(w, "", time.Now().UTC().Unix()-1)
+	err2 := writeRefreshCookie(w, "", time.Now().UTC().Unix()-1)
+	if err = errors.Compose(err1, err2); err != nil {
+		api.staticLogger.Debugln("Error deleting cookie:", err)
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u.Email == "" {
+		api.WriteJSON(w, UserDELETE{RestoreToken: token, DeleteAt: *u.DeleteAt})
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// userRestorePOST cancels the scheduled deletion of a user's account. The user
+// needs to provide the restore token we sent them when they deleted their
+// account. The user doesn't need to be logged in.
+func (api *API) userRestorePOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var payload accountRestorePOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &payload)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	u, err := api.staticDB.UserByRestoreToken(ctx, payload.Token)
+	if errors.Contains(err, database.ErrInvalidToken) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserRestore(ctx, u)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, database.ErrInvalidToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticUserTierCache.DeleteBySub(u.Sub)
+	// The restore token proves that the caller controls the user's email.
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionUserRestore,
+	})
 	api.WriteSuccess(w)
 }
 
@@ -715,7 +996,7 @@ func (api *API) userPOST(_ *database.User, w http.ResponseWriter, req *http.Requ
 	if err != nil {
 		api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
 	}
-	api.loginUser(w, u, 0, true)
+	api.loginUser(w, req, u, 0, true)
 }
 
 // userPUT allows changing some user information.
@@ -736,6 +1017,7 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 	}
 
 	ctx := req.Context()
+	oldEmail := u.Email
 	if payload.Password != "" {
 		// Check if the registrations are open. If they are not then changing
 		// passwords is also not allowed.
@@ -818,6 +1100,22 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	if payload.Password != "" {
+		api.audit(req, database.AuditEvent{
+			UserID: u.ID,
+			Actor:  u.Sub,
+			Action: database.AuditActionUserPassword,
+		})
+	}
+	if changedEmail && u.Email != oldEmail {
+		api.audit(req, database.AuditEvent{
+			UserID: u.ID,
+			Actor:  u.Sub,
+			Action: database.AuditActionUserEmail,
+			Before: oldEmail.String(),
+			After:  u.Email.String(),
+		})
+	}
 	// Send a confirmation email if the user's email address was changed.
 	if changedEmail {
 		err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.Email, u.EmailConfirmationToken)
@@ -825,7 +1123,7 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 			api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
 		}
 	}
-	api.loginUser(w, u, 0, true)
+	api.reissueTokens(w, req, u, true)
 }
 
 // userPubKeyDELETE removes a given pubkey from the list of pubkeys associated
@@ -853,6 +1151,12 @@ func (api *API) userPubKeyDELETE(u *database.User, w http.ResponseWriter, req *h
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionPubKeyRemove,
+		Before: pk.String(),
+	})
 	api.WriteSuccess(w)
 }
 
@@ -912,8 +1216,9 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 	}
 	// Check if the pubkey is already associated with the current user.
 	if u.HasKey(pk) {
-		// This pubkey already belongs to the user. Log them in and return.
-		api.loginUser(w, u, 0, true)
+		// This pubkey already belongs to the user. Refresh their tokens and
+		// return.
+		api.reissueTokens(w, req, u, true)
 		return
 	}
 	// Check if the pubkey from the UnconfirmedUserUpdate is already associated
@@ -944,6 +1249,12 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionPubKeyAdd,
+		After:  pk.String(),
+	})
 	updatedUser, err := api.staticDB.UserByID(ctx, u.ID)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
@@ -954,7 +1265,7 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, updatedUser, 0, true)
+	api.reissueTokens(w, req, updatedUser, true)
 }
 
 // userUploadsGET returns all uploads made by the current user.
@@ -965,11 +1276,30 @@ func (api *API) userUploadsGET(u *database.User, w http.ResponseWriter, req *htt
 	}
 	offset, err1 := fetchOffset(req.Form)
 	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
-	if err := errors.Compose(err1, err2); err != nil {
+	cursor, err3 := fetchCursor(req.Form)
+	if err := errors.Compose(err1, err2, err3); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseUploadsFilter(req)
+	if err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	ups, total, err := api.staticDB.UploadsByUser(req.Context(), *u, offset, pageSize)
+	if cursor != nil {
+		ups, pcs, err := api.staticDB.UploadsByUserCursor(req.Context(), *u, filter, cursor, pageSize)
+		if errors.Contains(err, database.ErrCursorSortUnsupported) {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		api.WriteJSON(w, UploadsGET{Items: ups, PageSize: pageSize, PageCursors: pcs})
+		return
+	}
+	ups, total, err := api.staticDB.UploadsByUserFiltered(req.Context(), *u, filter, offset, pageSize)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -980,9 +1310,57 @@ func (api *API) userUploadsGET(u *database.User, w http.ResponseWriter, req *htt
 		PageSize: pageSize,
 		Count:    total,
 	}
+	// Cursors only make sense for uploads sorted by time.
+	if filter.SortBy == database.UploadsSortByTimestamp && len(ups) > 0 {
+		hasNext := int64(offset+len(ups)) < total
+		response.PageCursors = database.NewPageCursors(ups[0].PageCursor(), ups[len(ups)-1].PageCursor(), offset > 0, hasNext)
+	}
 	api.WriteJSON(w, response)
 }
 
+// parseUploadsFilter parses the optional filtering and sorting parameters of
+// `GET /user/uploads`.
+func parseUploadsFilter(req *http.Request) (database.UploadsFilter, error) {
+	minSize, err1 := parseInt64Param(req, "minSize")
+	maxSize, err2 := parseInt64Param(req, "maxSize")
+	from, err3 := parseInt64Param(req, "from")
+	to, err4 := parseInt64Param(req, "to")
+	if err := errors.Compose(err1, err2, err3, err4); err != nil {
+		return database.UploadsFilter{}, err
+	}
+	filter := database.UploadsFilter{
+		Name:    req.FormValue("name"),
+		MinSize: minSize,
+		MaxSize: maxSize,
+		State:   req.FormValue("state"),
+	}
+	if from != 0 {
+		filter.From = time.Unix(from, 0).UTC()
+	}
+	if to != 0 {
+		filter.To = time.Unix(to, 0).UTC()
+	}
+	// We accept the names of the response's JSON fields as sort fields.
+	switch req.FormValue("sortBy") {
+	case "", "uploadedOn":
+		filter.SortBy = database.UploadsSortByTimestamp
+	case "name":
+		filter.SortBy = database.UploadsSortByName
+	case "size":
+		filter.SortBy = database.UploadsSortBySize
+	default:
+		return database.UploadsFilter{}, errors.New("invalid 'sortBy' value, supported values are 'uploadedOn', 'name' and 'size'")
+	}
+	switch req.FormValue("sortDir") {
+	case "", "desc":
+	case "asc":
+		filter.SortAsc = true
+	default:
+		return database.UploadsFilter{}, errors.New("invalid 'sortDir' value, supported values are 'asc' and 'desc'")
+	}
+	return filter, filter.Validate()
+}
+
 // userDownloadsGET returns all downloads made by the current user.
 func (api *API) userDownloadsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	if err := req.ParseForm(); err != nil {
@@ -991,10 +1369,20 @@ func (api *API) userDownloadsGET(u *database.User, w http.ResponseWriter, req *h
 	}
 	offset, err1 := fetchOffset(req.Form)
 	pageSize, err2 := fetchPageSize(req.Form, DefaultPageSizeSmall)
-	if err := errors.Compose(err1, err2); err != nil {
+	cursor, err3 := fetchCursor(req.Form)
+	if err := errors.Compose(err1, err2, err3); err != nil {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	if cursor != nil {
+		downs, pcs, err := api.staticDB.DownloadsByUserCursor(req.Context(), *u, cursor, pageSize)
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		api.WriteJSON(w, DownloadsGET{Items: downs, PageSize: pageSize, PageCursors: pcs})
+		return
+	}
 	downs, total, err := api.staticDB.DownloadsByUser(req.Context(), *u, offset, pageSize)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
@@ -1006,6 +1394,9 @@ func (api *API) userDownloadsGET(u *database.User, w http.ResponseWriter, req *h
 		PageSize: pageSize,
 		Count:    total,
 	}
+	if len(downs) > 0 {
+		response.PageCursors = database.NewPageCursors(downs[0].PageCursor(), downs[len(downs)-1].PageCursor(), offset > 0, offset+len(downs) < total)
+	}
 	api.WriteJSON(w, response)
 }
 
@@ -1028,7 +1419,14 @@ func (api *API) userConfirmGET(_ *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, u, 0, false)
+	// The user might already be logged in, in which case their tokens remain
+	// valid.
+	if api.requestSession(req, u) != nil {
+		api.WriteSuccess(w)
+		return
+	}
+	// A confirmation link is not enough to bypass the user's second factor.
+	api.loginOrRequireTwoFactor(w, req, u, 0)
 }
 
 // userReconfirmPOST allows the user to request a new email address confirmation
@@ -1080,6 +1478,13 @@ func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter,
 		api.WriteError(w, errors.New("missing required parameter 'email'"), http.StatusBadRequest)
 		return
 	}
+	// Each recovery request sends an email, so we limit them the same way we
+	// limit failed logins.
+	ip := clientIP(req)
+	if api.attemptBlocked(w, req, database.LoginAttemptScopeRecover, payload.Email, ip) {
+		return
+	}
+	api.attemptFailed(req.Context(), database.LoginAttemptScopeRecover, payload.Email, ip, nil)
 	u, err := api.staticDB.UserByEmail(req.Context(), payload.Email)
 	if errors.Contains(err, database.ErrUserNotFound) {
 		// Someone tried to recover an account with an email that's not in our
@@ -1176,7 +1581,14 @@ func (api *API) userRecoverPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, errors.AddContext(err, "failed to save password"), http.StatusInternalServerError)
 		return
 	}
-	api.loginUser(w, u, 0, false)
+	// The recovery token proves that the caller controls the user's email.
+	api.audit(req, database.AuditEvent{
+		UserID: u.ID,
+		Actor:  u.Sub,
+		Action: database.AuditActionUserRecover,
+	})
+	// Access to the user's email is not enough to bypass their second factor.
+	api.loginOrRequireTwoFactor(w, req, u, 0)
 }
 
 // trackUploadPOST registers a new upload in the system.
@@ -1195,7 +1607,13 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	u, _, _ := api.userFromRequest(req, true)
+	u, _, _, err := api.userFromRequest(req, true, database.APIKeyScopeUpload)
+	if errors.Contains(err, ErrAPIKeyInsufficientScope) {
+		// Don't let an API key without the upload scope pass its uploads off
+		// as anonymous ones.
+		api.WriteError(w, err, http.StatusForbidden)
+		return
+	}
 	if u == nil {
 		// This will be tracked as an anonymous request.
 		u = &database.AnonUser
@@ -1209,11 +1627,10 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 	if skylink.Size == 0 {
 		// Zero size means that we haven't fetched the skyfile's size yet.
 		// Queue the skylink to have its metadata fetched and updated in the DB.
-		go func() {
-			api.staticMF.Queue <- metafetcher.Message{
-				SkylinkID: skylink.ID,
-			}
-		}()
+		err = api.staticMF.Enqueue(req.Context(), skylink.ID)
+		if err != nil {
+			api.staticLogger.Warnf("Failed to queue skylink %s for metadata fetching: %v", skylink.Skylink, err)
+		}
 	}
 	api.WriteSuccess(w)
 	// Now that we've returned results to the caller, we can take care of some
@@ -1272,24 +1689,31 @@ func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *
 		// Queue the skylink to have its metadata fetched. We do not specify a user
 		// here because this is not an upload, so nobody's used storage needs to be
 		// adjusted.
-		go func() {
-			api.staticMF.Queue <- metafetcher.Message{
-				SkylinkID: skylink.ID,
-			}
-		}()
+		err = api.staticMF.Enqueue(req.Context(), skylink.ID)
+		if err != nil {
+			api.staticLogger.Warnf("Failed to queue skylink %s for metadata fetching: %v", skylink.Skylink, err)
+		}
 	}
 	api.WriteSuccess(w)
 }
 
 // trackRegistryReadPOST registers a new registry read in the system.
-func (api *API) trackRegistryReadPOST(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	// Tracking registry reads is disabled.
+func (api *API) trackRegistryReadPOST(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	err := api.staticDB.RegistryReadTrack(*u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
 	api.WriteSuccess(w)
 }
 
 // trackRegistryWritePOST registers a new registry write in the system.
-func (api *API) trackRegistryWritePOST(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	// Tracking registry writes is disabled.
+func (api *API) trackRegistryWritePOST(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	err := api.staticDB.RegistryWriteTrack(*u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
 	api.WriteSuccess(w)
 }
 
@@ -1345,32 +1769,48 @@ func (api *API) checkUserQuotas(ctx context.Context, u *database.User) {
 
 // userFromRequest checks the requests for various forms of authentication (API
 // key, cookie, authorization header) and returns user information based on
-// those.
-func (api *API) userFromRequest(req *http.Request, allowsAPIKey bool) (*database.User, jwt2.Token, error) {
+// those. API keys need to have all of the given scopes. If the request was
+// authenticated with an API key, we return its record as well. Suspended users
+// get ErrUserSuspended and users whose account is scheduled for deletion get
+// ErrUserPendingDeletion.
+func (api *API) userFromRequest(req *http.Request, allowsAPIKey bool, scopes ...string) (*database.User, jwt2.Token, *database.APIKeyRecord, error) {
+	u, tk, akr, err := api.managedUserFromRequest(req, allowsAPIKey, scopes...)
+	if err == nil && u.Suspended() {
+		return nil, nil, nil, database.ErrUserSuspended
+	}
+	if err == nil && u.PendingDeletion() {
+		return nil, nil, nil, database.ErrUserPendingDeletion
+	}
+	return u, tk, akr, err
+}
+
+// managedUserFromRequest implements userFromRequest without checking whether
+// the user is suspended or pending deletion.
+func (api *API) managedUserFromRequest(req *http.Request, allowsAPIKey bool, scopes ...string) (*database.User, jwt2.Token, *database.APIKeyRecord, error) {
 	// Check for a token.
-	u, tk, err := api.userAndTokenByRequestToken(req)
-	if err == nil {
-		return u, tk, nil
+	u, tk, tkErr := api.userAndTokenByRequestToken(req)
+	if tkErr == nil {
+		return u, tk, nil, nil
 	}
 	// Check for an API key.
 	ak, err := apiKeyFromRequest(req)
+	if errors.Contains(err, ErrNoAPIKey) && errors.Contains(tkErr, ErrSessionRevoked) {
+		return nil, nil, nil, tkErr
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if !allowsAPIKey {
-		return nil, nil, ErrAPIKeyNotAllowed
-	}
-	u, tk, err = api.userAndTokenByAPIKey(req, *ak)
-	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, ErrAPIKeyNotAllowed
 	}
-	return u, tk, err
+	return api.userAndTokenByAPIKey(req, *ak, scopes...)
 }
 
 // wellKnownJWKSGET returns our public JWKS, so people can use that to verify
-// the authenticity of the JWT tokens we issue.
+// the authenticity of the JWT tokens we issue. It contains all keys which
+// haven't been retired, yet.
 func (api *API) wellKnownJWKSGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	api.WriteJSON(w, jwt.AccountsPublicJWKS)
+	api.WriteJSON(w, jwt.PublicKeySet())
 }
 
 // UserGETFromUser converts a database.User struct to a UserGET struct.
@@ -1379,9 +1819,20 @@ func UserGETFromUser(u *database.User) *UserGET {
 		return nil
 	}
 	return &UserGET{
-		User:           *u,
-		EmailConfirmed: u.EmailConfirmationToken == "",
+		User:             *u,
+		EmailConfirmed:   u.EmailConfirmationToken == "",
+		TwoFactorEnabled: u.TwoFactorEnabled(),
+	}
+}
+
+// userTier returns the tier whose limits apply to the given user. Suspended
+// users and users whose account is scheduled for deletion get the limits of
+// anonymous users.
+func userTier(u *database.User) int {
+	if u.Suspended() || u.PendingDeletion() {
+		return database.TierAnonymous
 	}
+	return u.Tier
 }
 
 // fetchOffset extracts the offset from the params and validates its value.
@@ -1393,6 +1844,20 @@ func fetchOffset(form url.Values) (int, error) {
 	return offset, nil
 }
 
+// fetchCursor extracts the optional page cursor from the params. It returns
+// nil if there is no cursor.
+func fetchCursor(form url.Values) (*database.PageCursor, error) {
+	token := form.Get("cursor")
+	if token == "" {
+		return nil, nil
+	}
+	cursor, err := database.ParsePageCursor(token)
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
 // fetchPageSize extracts the page size from the params and validates its value.
 func fetchPageSize(form url.Values, defaultPageSize int) (int, error) {
 	pageSize, _ := strconv.Atoi(form.Get("pageSize"))
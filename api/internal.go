@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// InternalSignatureHeader holds the name of the header which carries the
+	// HMAC signature of a request to an internal endpoint.
+	InternalSignatureHeader = "Skynet-Internal-Signature"
+	// InternalTimestampHeader holds the name of the header which carries the
+	// Unix timestamp at which a request to an internal endpoint was signed.
+	InternalTimestampHeader = "Skynet-Internal-Timestamp"
+
+	// internalSignatureMaxSkew defines how far the timestamp of a signed
+	// request can be from our clock before we reject it. This limits the
+	// window in which a captured request can be replayed.
+	internalSignatureMaxSkew = 5 * time.Minute
+)
+
+var (
+	// InternalSecret is the shared secret with which callers of the internal
+	// endpoints sign their requests. This value is configurable via the
+	// ACCOUNTS_INTERNAL_SECRET environment variable.
+	InternalSecret []byte
+	// InternalPort is the port of the separate listener which serves the
+	// internal endpoints. When it's zero, the internal endpoints are served on
+	// the public port. This value is configurable via the
+	// ACCOUNTS_INTERNAL_PORT environment variable.
+	InternalPort int
+	// InternalTLSConfig makes the internal listener require client
+	// certificates signed by its ClientCAs. It's only used when InternalPort
+	// is set. See LoadInternalTLSConfig.
+	InternalTLSConfig *tls.Config
+
+	// ErrInternalAuthFailed is returned when a request to an internal endpoint
+	// has neither a valid signature nor a verified client certificate.
+	ErrInternalAuthFailed = errors.New("this endpoint requires a valid signature or client certificate")
+)
+
+// InternalSignature returns the hex-encoded HMAC-SHA256 signature of a request
+// to an internal endpoint. The request URI is the path and query of the
+// request, exactly as they appear in the request line.
+func InternalSignature(secret []byte, method, requestURI string, timestamp int64, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%d\n%x", method, requestURI, timestamp, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadInternalTLSConfig loads the internal listener's certificate and the CA
+// bundle we verify client certificates against.
+func LoadInternalTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to load the internal listener's certificate")
+	}
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to read the client CA bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ListenAndServeInternal starts the listener of the internal endpoints on the
+// given port. It uses mTLS if InternalTLSConfig is set.
+func (api *API) ListenAndServeInternal(port int) error {
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   api.staticInternalRouter,
+		TLSConfig: InternalTLSConfig,
+	}
+	if InternalTLSConfig != nil {
+		api.staticLogger.Info(fmt.Sprintf("Listening for internal requests with mTLS on port %d", port))
+		return srv.ListenAndServeTLS("", "")
+	}
+	api.staticLogger.Info(fmt.Sprintf("Listening for internal requests on port %d", port))
+	return srv.ListenAndServe()
+}
+
+// withInternalAuth ensures that the request to an internal endpoint either
+// comes with a verified client certificate or is signed with InternalSecret.
+func (api *API) withInternalAuth(h HandlerWithUser) httprouter.Handle {
+	return api.noAuth(func(_ *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		err := verifyInternalRequest(req, InternalSecret, time.Now().UTC())
+		if err != nil {
+			api.staticLogger.Debugf("Rejected internal request %s %s from %s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+			api.WriteError(w, ErrInternalAuthFailed, http.StatusUnauthorized)
+			return
+		}
+		h(nil, w, req, ps)
+	})
+}
+
+// verifyInternalRequest checks whether the given request comes with a verified
+// client certificate or a valid signature. In the latter case it reads the
+// body of the request and replaces it with an identical one.
+func verifyInternalRequest(req *http.Request, secret []byte, now time.Time) error {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return nil
+	}
+	if len(secret) == 0 {
+		return errors.New("request signing is not configured")
+	}
+	sig := req.Header.Get(InternalSignatureHeader)
+	tsStr := req.Header.Get(InternalTimestampHeader)
+	if sig == "" || tsStr == "" {
+		return errors.New("missing signature")
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return errors.AddContext(err, "invalid timestamp")
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > internalSignatureMaxSkew || skew < -internalSignatureMaxSkew {
+		return errors.New("timestamp is too far from the server's time")
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, LimitBodySizeLarge))
+		if err != nil {
+			return errors.AddContext(err, "failed to read body")
+		}
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	expected := InternalSignature(secret, req.Method, req.RequestURI, ts, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestVerifyInternalRequest ensures that verifyInternalRequest accepts only
+// requests with a valid, fresh signature or a verified client certificate.
+func TestVerifyInternalRequest(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now().UTC()
+	body := []byte(`{"tier":2}`)
+	// newReq creates a request signed with the given secret at the given
+	// time.
+	newReq := func(s []byte, ts time.Time) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/promoter/settier/abc?x=1", bytes.NewReader(body))
+		req.Header.Set(InternalTimestampHeader, strconv.FormatInt(ts.Unix(), 10))
+		req.Header.Set(InternalSignatureHeader, InternalSignature(s, req.Method, req.RequestURI, ts.Unix(), body))
+		return req
+	}
+
+	// A valid signature. Expect the body to remain readable.
+	req := newReq(secret, now)
+	if err := verifyInternalRequest(req, secret, now); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Fatalf("Expected body '%s', got '%s'", body, b)
+	}
+	// Signing isn't configured.
+	if err = verifyInternalRequest(newReq(secret, now), nil, now); err == nil {
+		t.Fatal("Expected an error without a secret.")
+	}
+	// A signature made with the wrong secret.
+	if err = verifyInternalRequest(newReq([]byte("wrong"), now), secret, now); err == nil {
+		t.Fatal("Expected an error for a wrong secret.")
+	}
+	// Stale and future timestamps.
+	for _, ts := range []time.Time{now.Add(-2 * internalSignatureMaxSkew), now.Add(2 * internalSignatureMaxSkew)} {
+		if err = verifyInternalRequest(newReq(secret, ts), secret, now); err == nil {
+			t.Fatalf("Expected an error for timestamp %v", ts)
+		}
+	}
+	// A tampered body, path and method.
+	req = newReq(secret, now)
+	req.Body = io.NopCloser(bytes.NewReader([]byte(`{"tier":4}`)))
+	if err = verifyInternalRequest(req, secret, now); err == nil {
+		t.Fatal("Expected an error for a tampered body.")
+	}
+	req = newReq(secret, now)
+	req.RequestURI = "/promoter/settier/def?x=1"
+	if err = verifyInternalRequest(req, secret, now); err == nil {
+		t.Fatal("Expected an error for a tampered path.")
+	}
+	req = newReq(secret, now)
+	req.Method = http.MethodDelete
+	if err = verifyInternalRequest(req, secret, now); err == nil {
+		t.Fatal("Expected an error for a tampered method.")
+	}
+	// Missing headers.
+	req = newReq(secret, now)
+	req.Header.Del(InternalSignatureHeader)
+	if err = verifyInternalRequest(req, secret, now); err == nil {
+		t.Fatal("Expected an error for a missing signature.")
+	}
+	// A verified client certificate doesn't need a signature.
+	req = httptest.NewRequest(http.MethodGet, "/uploadedskylinks", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	if err = verifyInternalRequest(req, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	// An unverified one does.
+	req.TLS = &tls.ConnectionState{}
+	if err = verifyInternalRequest(req, nil, now); err == nil {
+		t.Fatal("Expected an error for a TLS connection without a verified client certificate.")
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// ErrTooManyAttempts is returned when the caller has made too many failed
+	// attempts and needs to wait before trying again.
+	ErrTooManyAttempts = errors.New("too many failed attempts, please try again later")
+)
+
+type (
+	// LockoutsGET is the response of GET /admin/lockouts.
+	LockoutsGET struct {
+		Items []database.LoginAttempt `json:"items"`
+	}
+	// LockoutsDELETE is the response of DELETE /admin/lockouts.
+	LockoutsDELETE struct {
+		Cleared int64 `json:"cleared"`
+	}
+)
+
+// attemptBlocked checks whether attempts with the given email or from the
+// given IP are currently blocked within the given scope. If they are, it
+// responds with a 429 and returns true.
+func (api *API) attemptBlocked(w http.ResponseWriter, req *http.Request, scope string, email types.Email, ip string) bool {
+	until, err := api.staticDB.LoginAttemptsBlockedUntil(req.Context(), scope, email, ip)
+	if err != nil {
+		// Don't lock everybody out because of a DB hiccup.
+		api.staticLogger.Warnln("Failed to check for blocked attempts:", err)
+		return false
+	}
+	if until.IsZero() {
+		return false
+	}
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	api.WriteError(w, ErrTooManyAttempts, http.StatusTooManyRequests)
+	return true
+}
+
+// attemptFailed records a failed attempt with the given email and from the
+// given IP. If the failure locks out the email of an existing user, we notify
+// them.
+func (api *API) attemptFailed(ctx context.Context, scope string, email types.Email, ip string, u *database.User) {
+	la, lockedOut, err := api.staticDB.LoginAttemptFailed(ctx, scope, email, ip)
+	if err != nil {
+		api.staticLogger.Warnln("Failed to record a failed attempt:", err)
+		return
+	}
+	if !lockedOut || u == nil || scope != database.LoginAttemptScopeLogin {
+		return
+	}
+	api.staticLogger.Infof("Locking out %s after %d failed login attempts.", email, la.Failures)
+	err = api.staticMailer.SendAccountLockedEmail(ctx, u.Email, la.BlockedUntil)
+	if err != nil {
+		api.staticLogger.Warnln(errors.AddContext(err, "failed to send an email"))
+	}
+}
+
+// lockoutsGET returns all emails and IPs which are currently blocked from
+// logging in or recovering accounts.
+func (api *API) lockoutsGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	las, err := api.staticDB.LoginAttemptsBlocked(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, LockoutsGET{Items: las})
+}
+
+// lockoutsDELETE clears the failed attempts and lifts the lockouts of the
+// given email and/or IP.
+func (api *API) lockoutsDELETE(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	email := types.NewEmail(req.Form.Get("email"))
+	ip := req.Form.Get("ip")
+	if email == "" && ip == "" {
+		api.WriteError(w, errors.New("missing required parameter 'email' or 'ip'"), http.StatusBadRequest)
+		return
+	}
+	n, err := api.staticDB.LoginAttemptsClear(req.Context(), email, ip)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, LockoutsDELETE{Cleared: n})
+}
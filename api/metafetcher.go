@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// metafetcherReconciliationGET returns the report of the last reconciliation
+// run of the metafetcher.
+func (api *API) metafetcherReconciliationGET(_ *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	api.WriteJSON(w, api.staticMF.LastReconciliation())
+}
+
+// metafetcherReconciliationPOST runs a reconciliation of the metafetcher's
+// queue and returns its report.
+func (api *API) metafetcherReconciliationPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	api.WriteJSON(w, api.staticMF.Reconcile(req.Context()))
+}
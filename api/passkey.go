@@ -0,0 +1,355 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/SkynetLabs/skynet-accounts/webauthn"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// passkeyCeremonyTimeout is the time we give the browser to complete a
+	// WebAuthn ceremony. It's shorter than the lifetime of our challenges.
+	passkeyCeremonyTimeout = 5 * time.Minute
+	// passkeyCredentialType is the only WebAuthn credential type.
+	passkeyCredentialType = "public-key"
+)
+
+var (
+	// passkeyVerificationErrors are the errors which mean that the caller sent
+	// us an invalid WebAuthn response.
+	passkeyVerificationErrors = []error{
+		database.ErrInvalidWebAuthnChallenge,
+		database.ErrPasskeyNotFound,
+		webauthn.ErrInvalidAttestation,
+		webauthn.ErrInvalidAuthenticatorData,
+		webauthn.ErrInvalidClientData,
+		webauthn.ErrInvalidPublicKey,
+		webauthn.ErrInvalidSignature,
+		webauthn.ErrSignCountRegressed,
+		webauthn.ErrUnsupportedAlgorithm,
+		webauthn.ErrUserNotVerified,
+	}
+)
+
+type (
+	// PasskeyCredentialDescriptor identifies a WebAuthn credential.
+	PasskeyCredentialDescriptor struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	// PasskeyCredentialParam describes a credential algorithm we accept.
+	PasskeyCredentialParam struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	}
+	// PasskeyRelyingParty describes this portal as a WebAuthn relying party.
+	PasskeyRelyingParty struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	// PasskeyUserEntity describes the user to the authenticator.
+	PasskeyUserEntity struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	// PasskeyAuthenticatorSelection describes the authenticators we accept.
+	PasskeyAuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+	// PasskeyCreationOptionsGET is the response of
+	// GET /user/passkeys/register. Its fields match the browser's
+	// PublicKeyCredentialCreationOptions with all binary values encoded as
+	// base64url.
+	PasskeyCreationOptionsGET struct {
+		Challenge              string                        `json:"challenge"`
+		RP                     PasskeyRelyingParty           `json:"rp"`
+		User                   PasskeyUserEntity             `json:"user"`
+		PubKeyCredParams       []PasskeyCredentialParam      `json:"pubKeyCredParams"`
+		Timeout                int64                         `json:"timeout"`
+		Attestation            string                        `json:"attestation"`
+		ExcludeCredentials     []PasskeyCredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection PasskeyAuthenticatorSelection `json:"authenticatorSelection"`
+	}
+	// PasskeyRequestOptionsGET is the response of GET /login/passkey. Its
+	// fields match the browser's PublicKeyCredentialRequestOptions with all
+	// binary values encoded as base64url.
+	PasskeyRequestOptionsGET struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		Timeout          int64  `json:"timeout"`
+		UserVerification string `json:"userVerification"`
+	}
+	// PasskeyRegisterPOST defines the body of POST /user/passkeys/register.
+	// All binary values are base64url-encoded.
+	PasskeyRegisterPOST struct {
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	}
+	// PasskeyLoginPOST defines the body of POST /login/passkey. All binary
+	// values are base64url-encoded.
+	PasskeyLoginPOST struct {
+		ID                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		TTL               int    `json:"TTL"`
+	}
+	// PasskeyPATCH defines the body of PATCH /user/passkeys/:id.
+	PasskeyPATCH struct {
+		Name string `json:"name"`
+	}
+	// PasskeyGET describes a user's passkey.
+	PasskeyGET struct {
+		ID         string    `json:"id"`
+		Name       string    `json:"name"`
+		AAGUID     string    `json:"aaguid"`
+		CreatedAt  time.Time `json:"createdAt"`
+		LastUsedAt time.Time `json:"lastUsedAt"`
+	}
+)
+
+// newPasskeyGET converts a database.Passkey into a PasskeyGET.
+func newPasskeyGET(pk database.Passkey) PasskeyGET {
+	return PasskeyGET{
+		ID:         webauthn.EncodeToString(pk.CredentialID),
+		Name:       pk.Name,
+		AAGUID:     hex.EncodeToString(pk.AAGUID),
+		CreatedAt:  pk.CreatedAt,
+		LastUsedAt: pk.LastUsedAt,
+	}
+}
+
+// loginPasskeyGET starts a passkey login. The browser passes the returned
+// options to `navigator.credentials.get()`.
+func (api *API) loginPasskeyGET(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ch, err := api.staticDB.NewWebAuthnChallenge(req.Context(), primitive.NilObjectID, database.ChallengeTypeWebAuthnLogin)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	challenge, err := passkeyChallenge(ch)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, PasskeyRequestOptionsGET{
+		Challenge:        challenge,
+		RPID:             database.PasskeyRPID(),
+		Timeout:          passkeyCeremonyTimeout.Milliseconds(),
+		UserVerification: "required",
+	})
+}
+
+// loginPasskeyPOST completes a passkey login and starts a user session.
+func (api *API) loginPasskeyPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body PasskeyLoginPOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	if body.TTL > jwt.TTL {
+		api.WriteError(w, fmt.Errorf("jwt ttl value is too high. it cannot exceed %d", jwt.TTL), http.StatusBadRequest)
+		return
+	}
+	if body.TTL <= 0 {
+		body.TTL = jwt.TTL
+	}
+	credID, errID := webauthn.DecodeString(body.ID)
+	cd, errCD := webauthn.DecodeString(body.ClientDataJSON)
+	ad, errAD := webauthn.DecodeString(body.AuthenticatorData)
+	sig, errSig := webauthn.DecodeString(body.Signature)
+	err = errors.Compose(errID, errCD, errAD, errSig)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "invalid passkey assertion"), http.StatusBadRequest)
+		return
+	}
+	if len(credID) == 0 {
+		api.WriteError(w, errors.New("missing passkey id"), http.StatusBadRequest)
+		return
+	}
+	u, err := api.staticDB.UserByPasskeyAssertion(req.Context(), credID, cd, ad, sig)
+	if isPasskeyVerificationError(err) {
+		api.WriteError(w, errors.AddContext(err, "failed to verify passkey assertion"), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.loginUser(w, req, u, body.TTL, false)
+}
+
+// userPasskeysGET returns the user's passkeys.
+func (api *API) userPasskeysGET(u *database.User, w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	pks := make([]PasskeyGET, 0, len(u.Passkeys))
+	for _, pk := range u.Passkeys {
+		pks = append(pks, newPasskeyGET(pk))
+	}
+	api.WriteJSON(w, pks)
+}
+
+// userPasskeyRegisterGET starts the registration of a new passkey. The browser
+// passes the returned options to `navigator.credentials.create()`.
+func (api *API) userPasskeyRegisterGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if len(u.Passkeys) >= database.MaxPasskeysPerUser {
+		err := errors.AddContext(database.ErrPasskeyLimitReached, "the maximum number of passkeys a user can register is "+strconv.Itoa(database.MaxPasskeysPerUser))
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ch, err := api.staticDB.NewWebAuthnChallenge(req.Context(), u.ID, database.ChallengeTypeWebAuthnRegister)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	challenge, err := passkeyChallenge(ch)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	name := u.Email.String()
+	if name == "" {
+		name = u.Sub
+	}
+	params := make([]PasskeyCredentialParam, 0, len(webauthn.SupportedAlgorithms))
+	for _, alg := range webauthn.SupportedAlgorithms {
+		params = append(params, PasskeyCredentialParam{Type: passkeyCredentialType, Alg: alg})
+	}
+	exclude := make([]PasskeyCredentialDescriptor, 0, len(u.Passkeys))
+	for _, pk := range u.Passkeys {
+		exclude = append(exclude, PasskeyCredentialDescriptor{
+			Type: passkeyCredentialType,
+			ID:   webauthn.EncodeToString(pk.CredentialID),
+		})
+	}
+	api.WriteJSON(w, PasskeyCreationOptionsGET{
+		Challenge: challenge,
+		RP: PasskeyRelyingParty{
+			ID:   database.PasskeyRPID(),
+			Name: database.PasskeyRPID(),
+		},
+		User: PasskeyUserEntity{
+			ID:          webauthn.EncodeToString(u.ID[:]),
+			Name:        name,
+			DisplayName: name,
+		},
+		PubKeyCredParams:   params,
+		Timeout:            passkeyCeremonyTimeout.Milliseconds(),
+		Attestation:        "none",
+		ExcludeCredentials: exclude,
+		// We require discoverable credentials, so users can log in without
+		// telling us who they are first.
+		AuthenticatorSelection: PasskeyAuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+	})
+}
+
+// userPasskeyRegisterPOST completes the registration of a new passkey.
+func (api *API) userPasskeyRegisterPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body PasskeyRegisterPOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	cd, errCD := webauthn.DecodeString(body.ClientDataJSON)
+	att, errAtt := webauthn.DecodeString(body.AttestationObject)
+	err = errors.Compose(errCD, errAtt)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "invalid passkey attestation"), http.StatusBadRequest)
+		return
+	}
+	pk, err := api.staticDB.UserPasskeyRegister(req.Context(), u, body.Name, cd, att)
+	if errors.Contains(err, database.ErrPasskeyExists) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if errors.Contains(err, database.ErrPasskeyLimitReached) || isPasskeyVerificationError(err) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, newPasskeyGET(*pk))
+}
+
+// userPasskeyPATCH renames one of the user's passkeys.
+func (api *API) userPasskeyPATCH(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	credID, err := webauthn.DecodeString(ps.ByName("id"))
+	if err != nil || len(credID) == 0 {
+		api.WriteError(w, errors.New("invalid passkey id"), http.StatusBadRequest)
+		return
+	}
+	var body PasskeyPATCH
+	err = parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.UserPasskeyRename(req.Context(), u, credID, body.Name)
+	if errors.Contains(err, database.ErrPasskeyNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// userPasskeyDELETE removes one of the user's passkeys.
+func (api *API) userPasskeyDELETE(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	credID, err := webauthn.DecodeString(ps.ByName("id"))
+	if err != nil || len(credID) == 0 {
+		api.WriteError(w, errors.New("invalid passkey id"), http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.UserPasskeyDelete(req.Context(), u, credID)
+	if errors.Contains(err, database.ErrPasskeyNotFound) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// isPasskeyVerificationError returns true if the error means that the caller
+// sent us an invalid WebAuthn response.
+func isPasskeyVerificationError(err error) bool {
+	for _, e := range passkeyVerificationErrors {
+		if errors.Contains(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// passkeyChallenge converts a challenge from its hex-encoded DB form to the
+// base64url form WebAuthn uses.
+func passkeyChallenge(ch *database.Challenge) (string, error) {
+	b, err := hex.DecodeString(ch.Challenge)
+	if err != nil {
+		return "", errors.AddContext(err, "invalid challenge")
+	}
+	return webauthn.EncodeToString(b), nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/julienschmidt/httprouter"
@@ -36,10 +37,24 @@ func (api *API) promoterSetTierPOST(_ *database.User, w http.ResponseWriter, req
 		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	oldTier := u.Tier
 	err = api.staticDB.UserSetTier(ctx, u, body.Tier)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	if oldTier != body.Tier {
+		api.audit(req, database.AuditEvent{
+			UserID: u.ID,
+			Actor:  database.AuditActorPromoter,
+			Action: database.AuditActionUserTier,
+			Before: strconv.Itoa(oldTier),
+			After:  strconv.Itoa(body.Tier),
+		})
+	}
 	api.WriteSuccess(w)
 }
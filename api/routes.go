@@ -17,12 +17,18 @@ var (
 	// ErrAPIKeyNotAllowed is an error returned when an API key was passed to an
 	// endpoint that doesn't allow API key use.
 	ErrAPIKeyNotAllowed = errors.New("this endpoint does not allow the use of API keys")
+	// ErrAPIKeyInsufficientScope is an error returned when an API key was
+	// passed to an endpoint which requires a scope the API key doesn't have.
+	ErrAPIKeyInsufficientScope = errors.New("this api key lacks the scope required by this endpoint")
 	// ErrNoAPIKey is an error returned when we expect an API key but we don't
 	// find one.
 	ErrNoAPIKey = errors.New("no api key found")
 	// ErrNoToken is returned when we expected a JWT token to be provided but it
 	// was not.
 	ErrNoToken = errors.New("no authorisation token found")
+	// ErrSessionRevoked is returned when the caller's JWT belongs to a session
+	// which has been revoked.
+	ErrSessionRevoked = errors.New("session revoked")
 )
 
 type (
@@ -39,15 +45,19 @@ func (api *API) buildHTTPRoutes() {
 
 	api.staticRouter.GET("/login", api.WithDBSession(api.noAuth(api.loginGET)))
 	api.staticRouter.POST("/login", api.WithDBSession(api.noAuth(api.loginPOST)))
+	api.staticRouter.POST("/login/2fa", api.noAuth(api.loginTwoFactorPOST))
+	api.staticRouter.GET("/login/passkey", api.noAuth(api.loginPasskeyGET))
+	api.staticRouter.POST("/login/passkey", api.noAuth(api.loginPasskeyPOST))
 	api.staticRouter.POST("/logout", api.withAuth(api.logoutPOST, false))
+	api.staticRouter.POST("/token/refresh", api.noAuth(api.tokenRefreshPOST))
 	api.staticRouter.GET("/register", api.noAuth(api.registerGET))
 	api.staticRouter.POST("/register", api.WithDBSession(api.noAuth(api.registerPOST)))
 
 	// Endpoints at which Nginx reports portal usage.
 	api.staticRouter.POST("/track/upload/:skylink", api.noAuth(api.trackUploadPOST))
-	api.staticRouter.POST("/track/download/:skylink", api.withAuth(api.trackDownloadPOST, true))
-	api.staticRouter.POST("/track/registry/read", api.withAuth(api.trackRegistryReadPOST, true))
-	api.staticRouter.POST("/track/registry/write", api.withAuth(api.trackRegistryWritePOST, true))
+	api.staticRouter.POST("/track/download/:skylink", api.withAuth(api.trackDownloadPOST, true, database.APIKeyScopeDownload))
+	api.staticRouter.POST("/track/registry/read", api.withAuth(api.trackRegistryReadPOST, true, database.APIKeyScopeDownload))
+	api.staticRouter.POST("/track/registry/write", api.withAuth(api.trackRegistryWritePOST, true, database.APIKeyScopeUpload))
 
 	api.staticRouter.POST("/user", api.noAuth(api.userPOST)) // This will be removed in the future.
 	api.staticRouter.GET("/user", api.withAuth(api.userGET, false))
@@ -55,27 +65,43 @@ func (api *API) buildHTTPRoutes() {
 	api.staticRouter.DELETE("/user", api.withAuth(api.userDELETE, false))
 	api.staticRouter.GET("/user/limits", api.noAuth(api.userLimitsGET))
 	api.staticRouter.GET("/user/limits/:skylink", api.noAuth(api.userLimitsSkylinkGET))
-	api.staticRouter.GET("/user/stats", api.withAuth(api.userStatsGET, false))
+	api.staticRouter.GET("/user/stats", api.withAuth(api.userStatsGET, true, database.APIKeyScopeStatsRead))
+	api.staticRouter.GET("/user/stats/history", api.withAuth(api.userStatsHistoryGET, true, database.APIKeyScopeStatsRead))
 	api.staticRouter.DELETE("/user/pubkey/:pubKey", api.WithDBSession(api.withAuth(api.userPubKeyDELETE, false)))
 	api.staticRouter.GET("/user/pubkey/register", api.WithDBSession(api.withAuth(api.userPubKeyRegisterGET, false)))
 	api.staticRouter.POST("/user/pubkey/register", api.WithDBSession(api.withAuth(api.userPubKeyRegisterPOST, false)))
 	api.staticRouter.GET("/user/uploads", api.withAuth(api.userUploadsGET, false))
-	api.staticRouter.DELETE("/user/uploads/:skylink", api.withAuth(api.userUploadsDELETE, false))
+	api.staticRouter.GET("/user/uploads/export", api.withAuth(api.userUploadsExportGET, false))
+	api.staticRouter.DELETE("/user/uploads/:skylink", api.withAuth(api.userUploadsDELETE, true, database.APIKeyScopeUploadsDelete))
 	api.staticRouter.GET("/user/downloads", api.withAuth(api.userDownloadsGET, false))
+	api.staticRouter.GET("/user/downloads/export", api.withAuth(api.userDownloadsExportGET, false))
+	api.staticRouter.GET("/user/events", api.withAuth(api.userEventsGET, false))
+	api.staticRouter.GET("/user/sessions", api.withAuth(api.userSessionsGET, false))
+	api.staticRouter.DELETE("/user/sessions", api.withAuth(api.userSessionsDELETE, false))
+	api.staticRouter.DELETE("/user/sessions/:id", api.withAuth(api.userSessionDELETE, false))
+	api.staticRouter.POST("/user/2fa/totp", api.withAuth(api.userTOTPPOST, false))
+	api.staticRouter.POST("/user/2fa/totp/confirm", api.withAuth(api.userTOTPConfirmPOST, false))
+	api.staticRouter.POST("/user/2fa/totp/disable", api.withAuth(api.userTOTPDisablePOST, false))
+	api.staticRouter.GET("/user/passkeys", api.withAuth(api.userPasskeysGET, false))
+	api.staticRouter.GET("/user/passkeys/register", api.withAuth(api.userPasskeyRegisterGET, false))
+	api.staticRouter.POST("/user/passkeys/register", api.withAuth(api.userPasskeyRegisterPOST, false))
+	api.staticRouter.PATCH("/user/passkeys/:id", api.withAuth(api.userPasskeyPATCH, false))
+	api.staticRouter.DELETE("/user/passkeys/:id", api.withAuth(api.userPasskeyDELETE, false))
 
 	// Endpoints for user API keys.
-	api.staticRouter.POST("/user/apikeys", api.WithDBSession(api.withAuth(api.userAPIKeyPOST, true)))
-	api.staticRouter.GET("/user/apikeys", api.withAuth(api.userAPIKeyLIST, true))
-	api.staticRouter.GET("/user/apikeys/:id", api.withAuth(api.userAPIKeyGET, true))
-	api.staticRouter.PUT("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPUT, true)))
-	api.staticRouter.PATCH("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPATCH, true)))
-	api.staticRouter.DELETE("/user/apikeys/:id", api.withAuth(api.userAPIKeyDELETE, true))
+	api.staticRouter.POST("/user/apikeys", api.WithDBSession(api.withAuth(api.userAPIKeyPOST, true, database.APIKeyScopeAPIKeysManage)))
+	api.staticRouter.GET("/user/apikeys", api.withAuth(api.userAPIKeyLIST, true, database.APIKeyScopeAPIKeysManage))
+	api.staticRouter.GET("/user/apikeys/:id", api.withAuth(api.userAPIKeyGET, true, database.APIKeyScopeAPIKeysManage))
+	api.staticRouter.PUT("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPUT, true, database.APIKeyScopeAPIKeysManage)))
+	api.staticRouter.PATCH("/user/apikeys/:id", api.WithDBSession(api.withAuth(api.userAPIKeyPATCH, true, database.APIKeyScopeAPIKeysManage)))
+	api.staticRouter.DELETE("/user/apikeys/:id", api.withAuth(api.userAPIKeyDELETE, true, database.APIKeyScopeAPIKeysManage))
 
 	// Endpoints for email communication with the user.
 	api.staticRouter.GET("/user/confirm", api.WithDBSession(api.noAuth(api.userConfirmGET))) // TODO POST
 	api.staticRouter.POST("/user/reconfirm", api.WithDBSession(api.withAuth(api.userReconfirmPOST, false)))
 	api.staticRouter.POST("/user/recover/request", api.WithDBSession(api.noAuth(api.userRecoverRequestPOST)))
 	api.staticRouter.POST("/user/recover", api.WithDBSession(api.noAuth(api.userRecoverPOST)))
+	api.staticRouter.POST("/user/restore", api.WithDBSession(api.noAuth(api.userRestorePOST)))
 
 	if api.staticPromoter == PromoterStripe {
 		api.staticRouter.GET("/stripe/billing", api.WithDBSession(api.withAuth(api.stripeBillingHANDLER, false)))
@@ -89,12 +115,27 @@ func (api *API) buildHTTPRoutes() {
 
 	api.staticRouter.GET("/.well-known/jwks.json", api.noAuth(api.wellKnownJWKSGET))
 
-	// Internal endpoints. Never expose these!
-	api.staticRouter.GET("/uploadinfo/:skylink", api.noAuth(api.uploadInfoGET))
-	api.staticRouter.GET("/uploadedskylinks", api.noAuth(api.uploadedSkylinksGET))
+	// Endpoints for support staff.
+	api.staticRouter.GET("/admin/events", api.withAdmin(api.adminEventsGET))
+	api.staticRouter.GET("/admin/users", api.withAdmin(api.adminUsersGET))
+	api.staticRouter.GET("/admin/users/:sub", api.withAdmin(api.adminUserGET))
+	api.staticRouter.POST("/admin/users/:sub/suspend", api.withAdmin(api.adminUserSuspendPOST))
+	api.staticRouter.POST("/admin/users/:sub/reinstate", api.withAdmin(api.adminUserReinstatePOST))
+	api.staticRouter.POST("/admin/users/:sub/tier", api.withAdmin(api.adminUserTierPOST))
+	api.staticRouter.POST("/admin/users/:sub/confirm", api.withAdmin(api.adminUserConfirmPOST))
+	api.staticRouter.GET("/admin/lockouts", api.withAdmin(api.lockoutsGET))
+	api.staticRouter.DELETE("/admin/lockouts", api.withAdmin(api.lockoutsDELETE))
+
+	// Internal endpoints. They require a signature or a client certificate
+	// and they can be served on a separate port. Never expose these!
+	api.staticInternalRouter.GET("/uploadinfo/:skylink", api.withInternalAuth(api.uploadInfoGET))
+	api.staticInternalRouter.GET("/uploadedskylinks", api.withInternalAuth(api.uploadedSkylinksGET))
+	api.staticInternalRouter.GET("/metafetcher/reconciliation", api.withInternalAuth(api.metafetcherReconciliationGET))
+	api.staticInternalRouter.POST("/metafetcher/reconciliation", api.withInternalAuth(api.metafetcherReconciliationPOST))
+	api.staticInternalRouter.POST("/usage/rollups/rebuild", api.withInternalAuth(api.usageRollupsRebuildPOST))
 
 	if api.staticPromoter == PromoterPromoter {
-		api.staticRouter.POST("/promoter/settier/:sub", api.noAuth(api.promoterSetTierPOST))
+		api.staticInternalRouter.POST("/promoter/settier/:sub", api.withInternalAuth(api.promoterSetTierPOST))
 	}
 }
 
@@ -107,12 +148,17 @@ func (api *API) noAuth(h HandlerWithUser) httprouter.Handle {
 	}
 }
 
-// withAuth ensures that the user making the request has logged in.
-func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool) httprouter.Handle {
+// withAuth ensures that the user making the request has logged in. API keys
+// need to have all of the given scopes.
+func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool, scopes ...string) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		api.logRequest(req)
-		u, token, err := api.userFromRequest(req, allowsAPIKey)
-		if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) {
+		u, token, akr, err := api.userFromRequest(req, allowsAPIKey, scopes...)
+		if errors.Contains(err, ErrAPIKeyInsufficientScope) || errors.Contains(err, database.ErrAPIKeyIPNotAllowed) || errors.Contains(err, database.ErrUserSuspended) || errors.Contains(err, database.ErrUserPendingDeletion) {
+			api.WriteError(w, err, http.StatusForbidden)
+			return
+		}
+		if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrAPIKeyExpired) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) || errors.Contains(err, ErrSessionRevoked) {
 			api.WriteError(w, err, http.StatusUnauthorized)
 			return
 		}
@@ -122,10 +168,25 @@ func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool) httprouter.Handle
 		}
 		// Embed the verified token in the context of the request.
 		ctx := jwt.ContextWithToken(req.Context(), token)
+		if akr != nil {
+			ctx = contextWithAPIKey(ctx, akr)
+		}
 		h(u, w, req.WithContext(ctx), ps)
 	}
 }
 
+// withAdmin ensures that the user making the request has logged in and is an
+// admin. Admin endpoints don't accept API keys.
+func (api *API) withAdmin(h HandlerWithUser) httprouter.Handle {
+	return api.withAuth(func(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !isAdmin(u) {
+			api.WriteError(w, ErrNotAdmin, http.StatusForbidden)
+			return
+		}
+		h(u, w, req, ps)
+	}, false)
+}
+
 // logRequest logs information about the current request.
 func (api *API) logRequest(r *http.Request) {
 	hasAuth := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer")
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	// SessionGET describes a user session as returned by the API.
+	SessionGET struct {
+		database.Session
+		Current bool `json:"current"`
+	}
+)
+
+// userSessionsGET lists the active sessions of the user. The session making
+// the request is marked as current.
+func (api *API) userSessionsGET(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	sessions, err := api.staticDB.SessionsByUser(req.Context(), *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var currentID string
+	if token, err := tokenFromRequest(req); err == nil {
+		currentID = token.JwtID()
+	}
+	resp := make([]SessionGET, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, SessionGET{
+			Session: s,
+			Current: s.ID.Hex() == currentID,
+		})
+	}
+	api.WriteJSON(w, resp)
+}
+
+// userSessionDELETE revokes the given session of the user. This invalidates
+// the session's JWTs and refresh tokens.
+func (api *API) userSessionDELETE(u *database.User, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = api.staticDB.SessionRevoke(req.Context(), *u, id)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticRevokedSessions.Add(id.Hex())
+	api.WriteSuccess(w)
+}
+
+// userSessionsDELETE revokes all sessions of the user, including the one
+// making the request, thus logging the user out everywhere.
+func (api *API) userSessionsDELETE(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	_, err := api.staticDB.SessionsRevokeAll(req.Context(), *u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticRevokedSessions.Invalidate()
+	// The caller's session is gone, so we remove its cookies as well.
+	err1 := writeCookie(w, "", time.Now().UTC().Unix()-1)
+	err2 := writeRefreshCookie(w, "", time.Now().UTC().Unix()-1)
+	if err = errors.Compose(err1, err2); err != nil {
+		api.staticLogger.Debugln("Error deleting cookie:", err)
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -130,14 +131,17 @@ type (
 )
 
 // processStripeSub reads the information about the user's subscription and
-// adjusts the user's record accordingly.
-func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) error {
+// adjusts the user's record accordingly. The given request is the webhook call
+// which notified us about the subscription.
+func (api *API) processStripeSub(req *http.Request, s *stripe.Subscription) error {
+	ctx := req.Context()
 	api.staticLogger.Traceln("Processing subscription:", s.ID)
 	u, err := api.staticDB.UserByStripeID(ctx, s.Customer.ID)
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to fetch user from DB for customer id %s", s.Customer.ID)
 		return errors.AddContext(err, errMsg)
 	}
+	oldTier := u.Tier
 	// Get all active subscriptions for this customer. There should be only one
 	// (or none) but we'd better check.
 	it := sub.List(&stripe.SubscriptionListParams{
@@ -196,6 +200,16 @@ func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) er
 	if err == nil {
 		api.staticLogger.Tracef("Subscribed user id '%s', tier %d, until %s.", u.ID, u.Tier, u.SubscribedUntil.String())
 	}
+	if err == nil && u.Tier != oldTier {
+		api.audit(req, database.AuditEvent{
+			UserID:  u.ID,
+			Actor:   database.AuditActorStripe,
+			Action:  database.AuditActionUserTier,
+			Details: s.ID,
+			Before:  strconv.Itoa(oldTier),
+			After:   strconv.Itoa(u.Tier),
+		})
+	}
 	// Re-set the tier cache for this user, in case their tier changed.
 	api.staticUserTierCache.Set(u.Sub, u)
 	return err
@@ -341,11 +355,20 @@ func (api *API) stripeCheckoutIDGET(u *database.User, w http.ResponseWriter, req
 	}
 	// Promote the user, if needed.
 	if tier > u.Tier {
+		oldTier := u.Tier
 		err = api.staticDB.UserSetTier(req.Context(), u, tier)
 		if err != nil {
 			api.WriteError(w, errors.AddContext(err, "failed to promote user"), http.StatusInternalServerError)
 			return
 		}
+		api.audit(req, database.AuditEvent{
+			UserID:  u.ID,
+			Actor:   database.AuditActorStripe,
+			Action:  database.AuditActionUserTier,
+			Details: coSub.ID,
+			Before:  strconv.Itoa(oldTier),
+			After:   strconv.Itoa(tier),
+		})
 	}
 	// Build the response DTO.
 	var discountInfo *SubscriptionDiscountGET
@@ -491,7 +514,7 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 			api.WriteError(w, err, http.StatusBadRequest)
 			return
 		}
-		err = api.processStripeSub(req.Context(), &s)
+		err = api.processStripeSub(req, &s)
 		if err != nil {
 			api.staticLogger.Debugln("Webhook: Failed to process sub:", err)
 			api.WriteError(w, err, http.StatusInternalServerError)
@@ -526,7 +549,7 @@ func (api *API) stripeWebhookPOST(_ *database.User, w http.ResponseWriter, req *
 			api.WriteError(w, err, http.StatusInternalServerError)
 			return
 		}
-		err = api.processStripeSub(req.Context(), s)
+		err = api.processStripeSub(req, s)
 		if err != nil {
 			api.staticLogger.Debugln("Webhook: Failed to process sub:", err)
 			api.WriteError(w, err, http.StatusInternalServerError)
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// RefreshTokenHeader holds the name of the header in which we send the
+	// refresh token on login and in which clients which don't use cookies can
+	// send it back to us.
+	RefreshTokenHeader = "Skynet-Refresh-Token"
+)
+
+// tokenRefreshPOST exchanges a refresh token for a new short-lived JWT and a
+// new refresh token. Each refresh token can only be used once. Presenting a
+// used refresh token revokes the session to which it belongs.
+func (api *API) tokenRefreshPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rt := refreshTokenFromRequest(req)
+	if rt == "" {
+		api.WriteError(w, database.ErrInvalidRefreshToken, http.StatusUnauthorized)
+		return
+	}
+	ctx := req.Context()
+	newRT, rtr, err := api.staticDB.RefreshTokenRotate(ctx, rt)
+	if errors.Contains(err, database.ErrInvalidRefreshToken) || errors.Contains(err, database.ErrRefreshTokenReused) {
+		// The client's refresh token is useless, so we might as well remove
+		// it. We ignore the error because we're already failing.
+		_ = writeRefreshCookie(w, "", time.Now().UTC().Unix()-1)
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	u, err := api.staticDB.UserByID(ctx, rtr.UserID)
+	if errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u.Suspended() {
+		api.WriteError(w, database.ErrUserSuspended, http.StatusForbidden)
+		return
+	}
+	if u.PendingDeletion() {
+		api.WriteError(w, database.ErrUserPendingDeletion, http.StatusForbidden)
+		return
+	}
+	api.writeTokens(w, u, rtr.SessionID.Hex(), jwt.TTL, newRT, rtr.ExpiresAt, false)
+}
+
+// refreshTokenFromRequest extracts the refresh token from the request. It
+// first checks the refresh token header and then the cookies. It returns an
+// empty string if there is no refresh token.
+func refreshTokenFromRequest(r *http.Request) string {
+	if rt := r.Header.Get(RefreshTokenHeader); rt != "" {
+		return rt
+	}
+	cookie, err := r.Cookie(RefreshCookieName)
+	if err != nil {
+		return ""
+	}
+	var rt string
+	err = secureCookie.Decode(RefreshCookieName, cookie.Value, &rt)
+	if err != nil {
+		return ""
+	}
+	return rt
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+type (
+	// TwoFactorChallenge is what we return when a password login needs a
+	// second factor before we can issue a JWT.
+	TwoFactorChallenge struct {
+		TwoFactorRequired bool      `json:"twoFactorRequired"`
+		Token             string    `json:"token"`
+		ExpiresAt         time.Time `json:"expiresAt"`
+	}
+	// TwoFactorLoginPOST defines the body of a `POST /login/2fa` request.
+	TwoFactorLoginPOST struct {
+		Token string `json:"token"`
+		Code  string `json:"code"`
+	}
+	// TOTPCodePOST defines the body of requests which only carry a TOTP or a
+	// recovery code.
+	TOTPCodePOST struct {
+		Code string `json:"code"`
+	}
+	// TOTPEnrollmentGET describes a pending TOTP enrollment. The URI is meant
+	// to be shown as a QR code.
+	TOTPEnrollmentGET struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	// TOTPRecoveryCodesGET holds the user's one-time recovery codes.
+	TOTPRecoveryCodesGET struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+)
+
+// loginTwoFactorPOST completes a password login which requires a second
+// factor. The caller needs to provide the token they got when they sent their
+// credentials and a valid TOTP or recovery code.
+func (api *API) loginTwoFactorPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body TwoFactorLoginPOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	if body.Token == "" || body.Code == "" {
+		api.WriteError(w, errors.New("missing required parameter"), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	// Wrong codes count as failed logins, so we need to know whose login this
+	// is before we check the code.
+	ip := clientIP(req)
+	var email types.Email
+	tflUser, err := api.staticDB.TwoFactorLoginUser(ctx, body.Token)
+	if err == nil {
+		email = tflUser.Email
+	} else if !errors.Contains(err, database.ErrInvalidTwoFactorLogin) && !errors.Contains(err, database.ErrUserNotFound) {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if api.attemptBlocked(w, req, database.LoginAttemptScopeLogin, email, ip) {
+		return
+	}
+	u, tfl, err := api.staticDB.TwoFactorLoginComplete(ctx, body.Token, body.Code)
+	if errors.Contains(err, database.ErrInvalidTwoFactorLogin) || errors.Contains(err, database.ErrInvalidTOTPCode) || errors.Contains(err, database.ErrUserNotFound) {
+		api.attemptFailed(ctx, database.LoginAttemptScopeLogin, email, ip, tflUser)
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if errors.Contains(err, database.ErrTwoFactorLocked) {
+		api.WriteError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// The login is complete, so we can forget the user's failed attempts.
+	err = api.staticDB.LoginAttemptsReset(ctx, database.LoginAttemptScopeLogin, u.Email)
+	if err != nil {
+		api.staticLogger.Debugln("Failed to reset failed login attempts:", err)
+	}
+	api.loginUser(w, req, u, tfl.JWTTTL, false)
+}
+
+// userTOTPPOST starts a TOTP enrollment for the user. The enrollment needs to
+// be confirmed with a valid code before it takes effect.
+func (api *API) userTOTPPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	secret, uri, err := api.staticDB.UserTOTPEnrollStart(req.Context(), u)
+	if errors.Contains(err, database.ErrTOTPAlreadyEnabled) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, TOTPEnrollmentGET{Secret: secret, URI: uri})
+}
+
+// userTOTPConfirmPOST confirms the user's pending TOTP enrollment and returns
+// their recovery codes.
+func (api *API) userTOTPConfirmPOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body TOTPCodePOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	codes, err := api.staticDB.UserTOTPEnrollConfirm(req.Context(), u, body.Code)
+	if errors.Contains(err, database.ErrInvalidTOTPCode) || errors.Contains(err, database.ErrTOTPNotPending) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, database.ErrTOTPAlreadyEnabled) {
+		api.WriteError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, TOTPRecoveryCodesGET{RecoveryCodes: codes})
+}
+
+// userTOTPDisablePOST removes the user's second factor. The user needs to
+// provide a valid TOTP or recovery code.
+func (api *API) userTOTPDisablePOST(u *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body TOTPCodePOST
+	err := parseRequestBodyJSON(req.Body, LimitBodySizeSmall, &body)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to parse request body"), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	err = api.staticDB.UserTOTPCheck(ctx, u, body.Code)
+	if errors.Contains(err, database.ErrTOTPNotEnabled) || errors.Contains(err, database.ErrInvalidTOTPCode) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, database.ErrTwoFactorLocked) {
+		api.WriteError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = api.staticDB.UserTOTPDisable(ctx, u)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// loginOrRequireTwoFactor logs the user in, unless they have enabled
+// two-factor authentication. In that case it starts a two-factor login and
+// returns its token, which the user needs to send to `POST /login/2fa`
+// together with a valid code.
+func (api *API) loginOrRequireTwoFactor(w http.ResponseWriter, req *http.Request, u *database.User, jwtTTL int) {
+	if !u.TwoFactorEnabled() {
+		api.loginUser(w, req, u, jwtTTL, false)
+		return
+	}
+	token, tfl, err := api.staticDB.TwoFactorLoginCreate(req.Context(), *u, jwtTTL)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, TwoFactorChallenge{
+		TwoFactorRequired: true,
+		Token:             token,
+		ExpiresAt:         tfl.ExpiresAt,
+	})
+}
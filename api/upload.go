@@ -38,6 +38,7 @@ type (
 	SkylinksList struct {
 		Skylinks   []string `json:"skylinks"`
 		TotalCount int      `json:"totalCount"`
+		database.PageCursors
 	}
 )
 
@@ -119,6 +120,11 @@ func (api *API) uploadedSkylinksGET(_ *database.User, w http.ResponseWriter, req
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	cursor, err := fetchCursor(req.Form)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	dayInSecs := int64(24 * 3600)
 	defaultPeriod := 3 * dayInSecs
 	maxPeriod := 30 * dayInSecs
@@ -137,7 +143,18 @@ func (api *API) uploadedSkylinksGET(_ *database.User, w http.ResponseWriter, req
 		return
 	}
 	// Fetch all uploads from the period.
-	uploads, totalCount, err := api.staticDB.UploadsByPeriod(req.Context(), time.Unix(from, 0), time.Unix(to, 0), offset, pageSize)
+	var uploads []database.UploadResponse
+	var totalCount int64
+	var pcs database.PageCursors
+	if cursor != nil {
+		uploads, pcs, err = api.staticDB.UploadsByPeriodCursor(req.Context(), time.Unix(from, 0), time.Unix(to, 0), cursor, pageSize)
+	} else {
+		uploads, totalCount, err = api.staticDB.UploadsByPeriod(req.Context(), time.Unix(from, 0), time.Unix(to, 0), offset, pageSize)
+		if err == nil && len(uploads) > 0 {
+			hasNext := int64(offset+len(uploads)) < totalCount
+			pcs = database.NewPageCursors(uploads[0].PageCursor(), uploads[len(uploads)-1].PageCursor(), offset > 0, hasNext)
+		}
+	}
 	if errors.Contains(err, database.ErrInvalidTimePeriod) {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
@@ -147,8 +164,9 @@ func (api *API) uploadedSkylinksGET(_ *database.User, w http.ResponseWriter, req
 		return
 	}
 	resp := SkylinksList{
-		Skylinks:   CollectUniqueSkylinks(uploads),
-		TotalCount: int(totalCount),
+		Skylinks:    CollectUniqueSkylinks(uploads),
+		TotalCount:  int(totalCount),
+		PageCursors: pcs,
 	}
 	api.WriteJSON(w, resp)
 }
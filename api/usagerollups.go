@@ -0,0 +1,45 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// UsageRollupsRebuildPOST is the response to a request for rebuilding the
+	// usage rollups.
+	UsageRollupsRebuildPOST struct {
+		Users int `json:"users"`
+	}
+)
+
+// usageRollupsRebuildPOST rebuilds the usage rollups from the raw uploads and
+// downloads. If a `userId` is given only that user's rollups are rebuilt,
+// otherwise we rebuild the rollups of all users.
+func (api *API) usageRollupsRebuildPOST(_ *database.User, w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if uidStr := req.FormValue("userId"); uidStr != "" {
+		uid, err := primitive.ObjectIDFromHex(uidStr)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid 'userId' value"), http.StatusBadRequest)
+			return
+		}
+		err = api.staticDB.UsageRollupsRebuild(req.Context(), uid)
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		api.WriteJSON(w, UsageRollupsRebuildPOST{Users: 1})
+		return
+	}
+	n, err := api.staticDB.UsageRollupsRebuildAll(req.Context())
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, fmt.Sprintf("rebuilt the usage rollups of %d users before failing", n)), http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, UsageRollupsRebuildPOST{Users: n})
+}
@@ -2,36 +2,77 @@ package database
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /**
-API keys are authentication tokens generated by users. They do not expire, thus
-allowing users to use them for a long time and to embed them in apps and on
-machines. API keys can be revoked when they are no longer needed or if they get
-compromised or are no longer needed. This is done by deleting them from this
-service.
+API keys are authentication tokens generated by users. They do not expire by
+default, thus allowing users to use them for a long time and to embed them in
+apps and on machines. Users can optionally set an expiration time when they
+create an API key. API keys can be revoked when they are no longer needed or if
+they get compromised or are no longer needed. This is done by deleting them
+from this service.
+
+Users can restrict the addresses from which an API key can be used by
+attaching a list of allowed CIDR ranges to it. API keys without such a list
+can be used from anywhere.
+
+We keep track of when and from where each API key was last used, so users can
+tell which keys are still in use. In order to avoid a DB write on every
+request, we only update that information once per apiKeyLastUsedThrottle.
 
 There are two kinds of API keys - public and private. We differentiate between
 them by the `public` flag.
 
 Private API keys give full API access - using them is equivalent to using a JWT
-token, either via an authorization header or a cookie.
+token, either via an authorization header or a cookie. Private API keys can be
+restricted to a set of scopes, e.g. a CI pipeline might only need to upload and
+read stats. Each endpoint which accepts API keys defines the scope it requires.
+Private API keys without any scopes keep their full access.
 
 Public API keys can only be use for downloading skylinks. The list of skylinks
 that can be downloaded by a given public API key is stored under the `skylinks`
 array within the API key record.
+
+We never store API keys in plaintext. Instead, we store a keyed hash of each key
+and a short prefix which helps users identify their keys. The hash is keyed with
+APIKeyHashSecret, so changing the secret invalidates all existing API keys.
 */
 
+const (
+	// APIKeyScopeUpload allows uploading and writing to the registry.
+	APIKeyScopeUpload = "upload"
+	// APIKeyScopeDownload allows downloading and reading from the registry.
+	APIKeyScopeDownload = "download"
+	// APIKeyScopeStatsRead allows reading the user's stats.
+	APIKeyScopeStatsRead = "stats:read"
+	// APIKeyScopeUploadsDelete allows deleting the user's uploads.
+	APIKeyScopeUploadsDelete = "uploads:delete"
+	// APIKeyScopeAPIKeysManage allows listing, creating, updating and deleting
+	// the user's API keys. An API key can't create API keys with scopes it
+	// doesn't have itself.
+	APIKeyScopeAPIKeysManage = "apikeys:manage"
+
+	// apiKeyPrefixLen is the number of leading characters of an API key which
+	// we store in plaintext, so users can identify their keys.
+	apiKeyPrefixLen = 8
+)
+
 var (
 	// MaxNumAPIKeysPerUser sets the limit for number of API keys a single user
 	// can create. If a user reaches that limit they can always delete some API
@@ -43,28 +84,66 @@ var (
 	ErrMaxNumAPIKeysExceeded = errors.New("maximum number of api keys exceeded")
 	// ErrInvalidAPIKey is an error returned when the given API key is invalid.
 	ErrInvalidAPIKey = errors.New("invalid api key")
+	// APIKeyScopes lists all valid API key scopes.
+	APIKeyScopes = []string{
+		APIKeyScopeUpload,
+		APIKeyScopeDownload,
+		APIKeyScopeStatsRead,
+		APIKeyScopeUploadsDelete,
+		APIKeyScopeAPIKeysManage,
+	}
+
+	// ErrAPIKeyExpired is returned when the given API key has expired.
+	ErrAPIKeyExpired = errors.New("api key expired")
+	// ErrAPIKeyIPNotAllowed is returned when the given API key is used from an
+	// IP address outside of its allowed CIDR ranges.
+	ErrAPIKeyIPNotAllowed = errors.New("api key not allowed from this ip address")
 	// ErrInvalidAPIKeyOperation covers a range of invalid operations on API
 	// keys. Some examples include: defining a list of skylinks on a private
 	// API key, editing a private API key. This error should be used with
 	// additional context, specifying the exact operation that failed.
 	ErrInvalidAPIKeyOperation = errors.New("invalid api key operation")
+
+	// APIKeyHashSecret is the secret with which we hash API keys before storing
+	// them. This value is configurable via the ACCOUNTS_API_KEY_SECRET
+	// environment variable.
+	APIKeyHashSecret = ""
+
+	// apiKeyLastUsedThrottle defines how often we update the last use of an
+	// API key.
+	apiKeyLastUsedThrottle = build.Select(build.Var{
+		Dev:      10 * time.Second,
+		Testing:  time.Second,
+		Standard: 5 * time.Minute,
+	}).(time.Duration)
 )
 
 type (
 	// APIKey is the hex representation of a base32-encoded random 32-byte slice
 	// length PubKeySize
 	APIKey string
-	// APIKeyRecord is a non-expiring authentication token generated on user
-	// demand. Public API keys allow downloading a given set of skylinks, while
-	// private API keys give full API access.
+	// APIKeyRecord is an authentication token generated on user demand.
+	// Public API keys allow downloading a given set of skylinks, while private
+	// API keys give full API access. API keys without an ExpiresAt never
+	// expire.
+	//
+	// The Key itself is never stored, so it's only set on the record returned
+	// by APIKeyCreate.
 	APIKeyRecord struct {
-		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-		UserID    primitive.ObjectID `bson:"user_id" json:"-"`
-		Name      string             `bson:"name" json:"name"`
-		Public    bool               `bson:"public,string" json:"public,string"`
-		Key       APIKey             `bson:"key" json:"-"`
-		Skylinks  []string           `bson:"skylinks" json:"skylinks"`
-		CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+		ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+		Name       string             `bson:"name" json:"name"`
+		Public     bool               `bson:"public,string" json:"public,string"`
+		Key        APIKey             `bson:"-" json:"-"`
+		KeyHash    string             `bson:"key_hash" json:"-"`
+		KeyPrefix  string             `bson:"key_prefix" json:"keyPrefix"`
+		Skylinks   []string           `bson:"skylinks" json:"skylinks"`
+		Scopes     []string           `bson:"scopes,omitempty" json:"scopes,omitempty"`
+		AllowedIPs []string           `bson:"allowed_ips,omitempty" json:"allowedIPs,omitempty"`
+		CreatedAt  time.Time          `bson:"created_at" json:"createdAt"`
+		ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+		LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"lastUsedAt,omitempty"`
+		LastUsedIP string             `bson:"last_used_ip,omitempty" json:"lastUsedIP,omitempty"`
 	}
 )
 
@@ -120,6 +199,24 @@ func (ak APIKey) String() string {
 	return string(ak)
 }
 
+// Hash returns the hex-encoded keyed hash under which we store the API key.
+// API keys are case-insensitive, so we hash their canonical upper case form.
+func (ak APIKey) Hash() string {
+	mac := hmac.New(sha256.New, []byte(APIKeyHashSecret))
+	_, _ = mac.Write([]byte(strings.ToUpper(string(ak))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Prefix returns the leading characters of the API key which we store in
+// plaintext, so users can identify their keys.
+func (ak APIKey) Prefix() string {
+	s := strings.ToUpper(string(ak))
+	if len(s) > apiKeyPrefixLen {
+		s = s[:apiKeyPrefixLen]
+	}
+	return s
+}
+
 // CoversSkylink tells us whether a given API key covers a given skylink.
 // Private API keys cover all skylinks while public ones - only a limited set.
 func (akr APIKeyRecord) CoversSkylink(sl string) bool {
@@ -134,11 +231,142 @@ func (akr APIKeyRecord) CoversSkylink(sl string) bool {
 	return false
 }
 
-// APIKeyCreate creates a new API key.
-func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks []string) (*APIKeyRecord, error) {
+// HasScopes tells us whether the API key has all of the given scopes. Private
+// API keys without scopes have all scopes, while public ones have none.
+func (akr APIKeyRecord) HasScopes(scopes ...string) bool {
+	if akr.Public {
+		return len(scopes) == 0
+	}
+	return len(akr.Scopes) == 0 || ScopesCover(akr.Scopes, scopes)
+}
+
+// ScopesCover returns true if the first set of scopes contains all scopes of
+// the second one.
+func ScopesCover(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateAPIKeyScopes returns an error if any of the given scopes is not a
+// valid API key scope.
+func ValidateAPIKeyScopes(scopes []string) error {
+	for _, s := range scopes {
+		if !ScopesCover(APIKeyScopes, []string{s}) {
+			return errors.AddContext(ErrInvalidAPIKeyOperation, "invalid scope: "+s)
+		}
+	}
+	return nil
+}
+
+// AllowsIP tells us whether the API key can be used from the given IP address.
+func (akr APIKeyRecord) AllowsIP(ip string) bool {
+	return IPAllowed(akr.AllowedIPs, ip)
+}
+
+// IPAllowed returns true if the given IP address is within any of the given
+// CIDR ranges. An empty list of ranges allows all addresses.
+func IPAllowed(cidrs []string, ip string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err == nil && ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDRsWithin returns true if each of the given CIDR ranges lies within one of
+// the parent ranges. An empty list of parent ranges contains everything, while
+// an empty list of ranges is only contained by it.
+func CIDRsWithin(cidrs, parents []string) bool {
+	if len(parents) == 0 {
+		return true
+	}
+	if len(cidrs) == 0 {
+		return false
+	}
+	for _, c := range cidrs {
+		_, child, err := net.ParseCIDR(c)
+		if err != nil {
+			return false
+		}
+		childOnes, childBits := child.Mask.Size()
+		within := false
+		for _, p := range parents {
+			_, parent, err := net.ParseCIDR(p)
+			if err != nil {
+				continue
+			}
+			ones, bits := parent.Mask.Size()
+			if bits == childBits && ones <= childOnes && parent.Contains(child.IP) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeCIDRs validates the given CIDR ranges and returns them in their
+// canonical form. Plain IP addresses are converted to single-address ranges.
+func NormalizeCIDRs(cidrs []string) ([]string, error) {
+	var normalized []string
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if ip := net.ParseIP(c); ip != nil {
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "invalid CIDR range: "+c)
+		}
+		normalized = append(normalized, ipNet.String())
+	}
+	return normalized, nil
+}
+
+// Expired returns true if the API key has an expiration time which has
+// passed.
+func (akr APIKeyRecord) Expired() bool {
+	return akr.ExpiresAt != nil && !akr.ExpiresAt.After(time.Now().UTC())
+}
+
+// APIKeyCreate creates a new API key. Only private API keys can have scopes
+// and ones without scopes get full access. API keys can only be used from the
+// given CIDR ranges, unless there are none. A nil expiresAt creates an API key
+// which never expires.
+func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks, scopes, allowedIPs []string, expiresAt *time.Time) (*APIKeyRecord, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
+	if expiresAt != nil && !expiresAt.After(time.Now().UTC()) {
+		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "expiration time must be in the future")
+	}
 	n, err := db.staticAPIKeys.CountDocuments(ctx, bson.M{"user_id": user.ID})
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to ensure user can create a new API key")
@@ -149,13 +377,32 @@ func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public b
 	if !public && len(skylinks) > 0 {
 		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "cannot define skylinks for a private api key")
 	}
+	if public && len(scopes) > 0 {
+		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "cannot define scopes for a public api key")
+	}
+	if err = ValidateAPIKeyScopes(scopes); err != nil {
+		return nil, err
+	}
+	allowedIPs, err = NormalizeCIDRs(allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	key := NewAPIKey()
 	akr := APIKeyRecord{
-		UserID:    user.ID,
-		Name:      name,
-		Public:    public,
-		Key:       NewAPIKey(),
-		Skylinks:  skylinks,
-		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+		UserID:     user.ID,
+		Name:       name,
+		Public:     public,
+		Key:        key,
+		KeyHash:    key.Hash(),
+		KeyPrefix:  key.Prefix(),
+		Skylinks:   skylinks,
+		Scopes:     scopes,
+		AllowedIPs: allowedIPs,
+		CreatedAt:  time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if expiresAt != nil {
+		t := expiresAt.UTC().Truncate(time.Millisecond)
+		akr.ExpiresAt = &t
 	}
 	ior, err := db.staticAPIKeys.InsertOne(ctx, akr)
 	if err != nil {
@@ -184,9 +431,9 @@ func (db *DB) APIKeyDelete(ctx context.Context, user User, akID primitive.Object
 	return nil
 }
 
-// APIKeyByKey returns a specific API key.
+// APIKeyByKey returns a specific API key. We look it up by its hash.
 func (db *DB) APIKeyByKey(ctx context.Context, key string) (APIKeyRecord, error) {
-	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"key": key})
+	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"key_hash": APIKey(key).Hash()})
 	if sr.Err() != nil {
 		return APIKeyRecord{}, sr.Err()
 	}
@@ -198,6 +445,37 @@ func (db *DB) APIKeyByKey(ctx context.Context, key string) (APIKeyRecord, error)
 	return akr, nil
 }
 
+// APIKeyUsed records that the given API key was used from the given IP. We
+// skip the write if the key's last recorded use is more recent than
+// apiKeyLastUsedThrottle.
+func (db *DB) APIKeyUsed(ctx context.Context, akr *APIKeyRecord, ip string) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	threshold := now.Add(-apiKeyLastUsedThrottle)
+	if akr.LastUsedAt != nil && akr.LastUsedAt.After(threshold) {
+		return nil
+	}
+	// Filter by the last use as well, so concurrent requests, possibly on
+	// other servers, don't all write.
+	filter := bson.M{
+		"_id": akr.ID,
+		"$or": bson.A{
+			bson.M{"last_used_at": bson.M{"$exists": false}},
+			bson.M{"last_used_at": bson.M{"$lte": threshold}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"last_used_at": now,
+		"last_used_ip": ip,
+	}}
+	_, err := db.staticAPIKeys.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to record API key use")
+	}
+	akr.LastUsedAt = &now
+	akr.LastUsedIP = ip
+	return nil
+}
+
 // APIKeyGet returns a specific API key.
 func (db *DB) APIKeyGet(ctx context.Context, akID primitive.ObjectID) (APIKeyRecord, error) {
 	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"_id": akID})
@@ -217,7 +495,8 @@ func (db *DB) APIKeyList(ctx context.Context, user User) ([]APIKeyRecord, error)
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
-	c, err := db.staticAPIKeys.Find(ctx, bson.M{"user_id": user.ID})
+	opts := options.Find().SetSort(bson.D{{"created_at", 1}, {"_id", 1}})
+	c, err := db.staticAPIKeys.Find(ctx, bson.M{"user_id": user.ID}, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +510,33 @@ func (db *DB) APIKeyList(ctx context.Context, user User) ([]APIKeyRecord, error)
 	return aks, nil
 }
 
+// APIKeyListCursor lists the page of the user's API keys which follows, or
+// precedes if the cursor goes backwards, the given cursor. API keys are
+// listed in the order of their creation. A nil cursor fetches the first page.
+func (db *DB) APIKeyListCursor(ctx context.Context, user User, cursor *PageCursor, pageSize int) ([]APIKeyRecord, PageCursors, error) {
+	if user.ID.IsZero() {
+		return nil, PageCursors{}, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(0, pageSize); err != nil {
+		return nil, PageCursors{}, err
+	}
+	pipeline := mongo.Pipeline{bson.D{{"$match", bson.D{{"user_id", user.ID}}}}}
+	pipeline = append(pipeline, cursorStages("created_at", cursor, false, pageSize)...)
+	c, err := db.staticAPIKeys.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	aks := make([]APIKeyRecord, 0, pageSize+1)
+	err = c.All(ctx, &aks)
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	n, pcs := cursorPage(aks, cursor, pageSize, func(i int) PageCursor {
+		return PageCursor{Timestamp: aks[i].CreatedAt, ID: aks[i].ID}
+	})
+	return aks[:n], pcs, nil
+}
+
 // APIKeyUpdate updates an existing API key. This works by replacing the
 // list of Skylinks within the API key record. Only valid for public API keys.
 func (db *DB) APIKeyUpdate(ctx context.Context, user User, akID primitive.ObjectID, skylinks []string) error {
@@ -304,3 +610,48 @@ func (db *DB) APIKeyPatch(ctx context.Context, user User, akID primitive.ObjectI
 	}
 	return nil
 }
+
+// migrateAPIKeyHashes replaces the plaintext keys of API key records created
+// before we started hashing them with their hashes and prefixes. The keys
+// themselves remain valid. It's safe to run this multiple times and on
+// multiple servers at once.
+func (db *DB) migrateAPIKeyHashes(ctx context.Context) error {
+	filter := bson.M{"key": bson.M{"$exists": true}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "key": 1})
+	c, err := db.staticAPIKeys.Find(ctx, filter, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch plaintext API keys")
+	}
+	defer func() { _ = c.Close(ctx) }()
+	n := 0
+	for c.Next(ctx) {
+		var rec struct {
+			ID  primitive.ObjectID `bson:"_id"`
+			Key APIKey             `bson:"key"`
+		}
+		if err = c.Decode(&rec); err != nil {
+			return errors.AddContext(err, "failed to decode API key")
+		}
+		// Match the key as well, so we don't overwrite a record which another
+		// server has already migrated.
+		update := bson.M{
+			"$set": bson.M{
+				"key_hash":   rec.Key.Hash(),
+				"key_prefix": rec.Key.Prefix(),
+			},
+			"$unset": bson.M{"key": ""},
+		}
+		ur, err := db.staticAPIKeys.UpdateOne(ctx, bson.M{"_id": rec.ID, "key": rec.Key}, update)
+		if err != nil {
+			return errors.AddContext(err, "failed to hash API key "+rec.ID.Hex())
+		}
+		n += int(ur.ModifiedCount)
+	}
+	if err = c.Err(); err != nil {
+		return errors.AddContext(err, "failed to iterate over plaintext API keys")
+	}
+	if n > 0 {
+		db.staticLogger.Infof("Hashed %d plaintext API keys.", n)
+	}
+	return nil
+}
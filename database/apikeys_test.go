@@ -1,6 +1,7 @@
 package database
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -84,3 +85,128 @@ func TestCoversSkylink(t *testing.T) {
 		}
 	}
 }
+
+// TestAPIKeyHash ensures that API key hashes are case-insensitive and keyed
+// with APIKeyHashSecret.
+func TestAPIKeyHash(t *testing.T) {
+	secret := APIKeyHashSecret
+	defer func() {
+		APIKeyHashSecret = secret
+	}()
+	APIKeyHashSecret = "secret"
+
+	ak := NewAPIKey()
+	h := ak.Hash()
+	if len(h) != 64 {
+		t.Fatalf("Expected a hex-encoded SHA256 hash, got %s", h)
+	}
+	if h == NewAPIKey().Hash() {
+		t.Fatal("Expected different keys to have different hashes.")
+	}
+	if APIKey(strings.ToLower(ak.String())).Hash() != h {
+		t.Fatal("Expected the hash to be case-insensitive.")
+	}
+	if ak.Prefix() != ak.String()[:apiKeyPrefixLen] {
+		t.Fatalf("Unexpected prefix %s of key %s", ak.Prefix(), ak)
+	}
+	APIKeyHashSecret = "another secret"
+	if ak.Hash() == h {
+		t.Fatal("Expected the hash to depend on the secret.")
+	}
+}
+
+// TestAPIKeyHasScopes ensures that HasScopes and ValidateAPIKeyScopes work as
+// expected.
+func TestAPIKeyHasScopes(t *testing.T) {
+	full := APIKeyRecord{}
+	scoped := APIKeyRecord{Scopes: []string{APIKeyScopeUpload, APIKeyScopeStatsRead}}
+	public := APIKeyRecord{Public: true}
+
+	tests := []struct {
+		name     string
+		akr      APIKeyRecord
+		scopes   []string
+		expected bool
+	}{
+		{name: "no scopes required", akr: scoped, scopes: nil, expected: true},
+		{name: "private key without scopes", akr: full, scopes: APIKeyScopes, expected: true},
+		{name: "scoped key, one scope", akr: scoped, scopes: []string{APIKeyScopeUpload}, expected: true},
+		{name: "scoped key, all scopes", akr: scoped, scopes: []string{APIKeyScopeStatsRead, APIKeyScopeUpload}, expected: true},
+		{name: "scoped key, missing scope", akr: scoped, scopes: []string{APIKeyScopeUpload, APIKeyScopeDownload}, expected: false},
+		{name: "public key", akr: public, scopes: []string{APIKeyScopeDownload}, expected: false},
+		{name: "public key, no scopes required", akr: public, scopes: nil, expected: true},
+	}
+	for _, tt := range tests {
+		if tt.akr.HasScopes(tt.scopes...) != tt.expected {
+			t.Errorf("Test '%s' failed.", tt.name)
+		}
+	}
+
+	if err := ValidateAPIKeyScopes(APIKeyScopes); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateAPIKeyScopes([]string{APIKeyScopeUpload, "admin"}); err == nil {
+		t.Fatal("Expected an invalid scope to fail validation.")
+	}
+}
+
+// TestIPAllowed ensures that IPAllowed and NormalizeCIDRs work as expected.
+func TestIPAllowed(t *testing.T) {
+	cidrs, err := NormalizeCIDRs([]string{"10.0.0.1", " 192.168.0.0/16", "2001:db8::1", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1/32", "192.168.0.0/16", "2001:db8::1/128", "2001:db8:1::/48"}
+	if strings.Join(cidrs, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, cidrs)
+	}
+	_, err = NormalizeCIDRs([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Fatal("Expected an invalid CIDR range to fail.")
+	}
+
+	tests := []struct {
+		name     string
+		cidrs    []string
+		ip       string
+		expected bool
+	}{
+		{name: "no ranges", cidrs: nil, ip: "1.2.3.4", expected: true},
+		{name: "single address", cidrs: cidrs, ip: "10.0.0.1", expected: true},
+		{name: "outside single address", cidrs: cidrs, ip: "10.0.0.2", expected: false},
+		{name: "within range", cidrs: cidrs, ip: "192.168.10.20", expected: true},
+		{name: "ipv6 within range", cidrs: cidrs, ip: "2001:db8:1::42", expected: true},
+		{name: "ipv6 outside range", cidrs: cidrs, ip: "2001:db8:2::42", expected: false},
+		{name: "invalid ip", cidrs: cidrs, ip: "not-an-ip", expected: false},
+	}
+	for _, tt := range tests {
+		if IPAllowed(tt.cidrs, tt.ip) != tt.expected {
+			t.Errorf("Test '%s' failed.", tt.name)
+		}
+	}
+}
+
+// TestCIDRsWithin ensures that CIDRsWithin works as expected.
+func TestCIDRsWithin(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		parents []string
+		within  bool
+	}{
+		{name: "no parents", cidrs: nil, parents: nil, within: true},
+		{name: "no ranges", cidrs: nil, parents: []string{"203.0.113.0/24"}, within: false},
+		{name: "same range", cidrs: []string{"203.0.113.0/24"}, parents: []string{"203.0.113.0/24"}, within: true},
+		{name: "narrower range", cidrs: []string{"203.0.113.5/32"}, parents: []string{"203.0.113.0/24"}, within: true},
+		{name: "wider range", cidrs: []string{"203.0.0.0/16"}, parents: []string{"203.0.113.0/24"}, within: false},
+		{name: "other range", cidrs: []string{"198.51.100.0/24"}, parents: []string{"203.0.113.0/24"}, within: false},
+		{name: "one of many", cidrs: []string{"203.0.113.5/32", "198.51.100.7/32"}, parents: []string{"203.0.113.0/24"}, within: false},
+		{name: "many parents", cidrs: []string{"203.0.113.5/32", "198.51.100.7/32"}, parents: []string{"203.0.113.0/24", "198.51.100.0/24"}, within: true},
+		{name: "other family", cidrs: []string{"::ffff:cb00:7105/128"}, parents: []string{"203.0.113.0/24"}, within: false},
+	}
+	for _, tt := range tests {
+		if CIDRsWithin(tt.cidrs, tt.parents) != tt.within {
+			t.Errorf("Test '%s' failed.", tt.name)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// AuditActionUserSuspend is recorded when a user's account gets
+	// suspended.
+	AuditActionUserSuspend = "user.suspend"
+	// AuditActionUserReinstate is recorded when a suspended account gets
+	// reinstated.
+	AuditActionUserReinstate = "user.reinstate"
+	// AuditActionUserTier is recorded when a user's tier changes.
+	AuditActionUserTier = "user.tier"
+	// AuditActionUserConfirmEmail is recorded when a user's email gets
+	// confirmed without the user following the confirmation link.
+	AuditActionUserConfirmEmail = "user.confirm_email"
+	// AuditActionUserEmail is recorded when a user changes their email.
+	AuditActionUserEmail = "user.email"
+	// AuditActionUserPassword is recorded when a user changes their password.
+	AuditActionUserPassword = "user.password"
+	// AuditActionUserRecover is recorded when a user regains access to their
+	// account via the account recovery flow.
+	AuditActionUserRecover = "user.recover"
+	// AuditActionUserDelete is recorded when a user schedules their account
+	// for deletion.
+	AuditActionUserDelete = "user.delete"
+	// AuditActionUserRestore is recorded when a user cancels the scheduled
+	// deletion of their account.
+	AuditActionUserRestore = "user.restore"
+	// AuditActionPubKeyAdd is recorded when a user adds a pubkey to their
+	// account.
+	AuditActionPubKeyAdd = "pubkey.add"
+	// AuditActionPubKeyRemove is recorded when a user removes a pubkey from
+	// their account.
+	AuditActionPubKeyRemove = "pubkey.remove"
+	// AuditActionAPIKeyCreate is recorded when a user creates an API key.
+	AuditActionAPIKeyCreate = "apikey.create"
+	// AuditActionAPIKeyDelete is recorded when a user deletes an API key.
+	AuditActionAPIKeyDelete = "apikey.delete"
+
+	// AuditActorStripe is the actor of the events caused by Stripe webhooks.
+	AuditActorStripe = "stripe"
+	// AuditActorPromoter is the actor of the events caused by the promoter.
+	AuditActorPromoter = "promoter"
+)
+
+type (
+	// AuditEvent records an action which affected a user's account, who took
+	// it and from where. Audit events are never modified or deleted.
+	AuditEvent struct {
+		ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		UserID primitive.ObjectID `bson:"user_id" json:"-"`
+		// Actor is the sub of the user who took the action or, if it was
+		// taken by an external system, one of the AuditActor constants.
+		Actor     string `bson:"actor" json:"actor"`
+		Action    string `bson:"action" json:"action"`
+		IP        string `bson:"ip,omitempty" json:"ip,omitempty"`
+		UserAgent string `bson:"user_agent,omitempty" json:"userAgent,omitempty"`
+		Details   string `bson:"details,omitempty" json:"details,omitempty"`
+		// Before and After summarise the affected value before and after the
+		// action, e.g. the old and the new tier. We never store secrets in
+		// them.
+		Before    string    `bson:"before,omitempty" json:"before,omitempty"`
+		After     string    `bson:"after,omitempty" json:"after,omitempty"`
+		CreatedAt time.Time `bson:"created_at" json:"createdAt"`
+	}
+
+	// AuditEventsFilter selects audit events. Empty fields match all events.
+	AuditEventsFilter struct {
+		UserID primitive.ObjectID
+		Actor  string
+		Action string
+		IP     string
+		// From and To limit the time range of the events. From is inclusive
+		// and To is exclusive.
+		From time.Time
+		To   time.Time
+	}
+)
+
+// AuditEventCreate records the given event.
+func (db *DB) AuditEventCreate(ctx context.Context, ae AuditEvent) error {
+	if ae.UserID.IsZero() || ae.Action == "" {
+		return errors.New("audit events need a user and an action")
+	}
+	ae.ID = primitive.NewObjectID()
+	ae.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	_, err := db.staticAuditEvents.InsertOne(ctx, ae)
+	if err != nil {
+		return errors.AddContext(err, "failed to insert audit event")
+	}
+	return nil
+}
+
+// AuditEventsByUser returns the latest audit events of the given user, newest
+// first.
+func (db *DB) AuditEventsByUser(ctx context.Context, uID primitive.ObjectID, limit int) ([]AuditEvent, error) {
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}, {"_id", -1}}).SetLimit(int64(limit))
+	c, err := db.staticAuditEvents.Find(ctx, bson.M{"user_id": uID}, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find audit events")
+	}
+	events := make([]AuditEvent, 0)
+	err = c.All(ctx, &events)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse audit events")
+	}
+	return events, nil
+}
+
+// AuditEventsCursor lists the page of audit events which match the given
+// filter and follow, or precede if the cursor goes backwards, the given
+// cursor. Events are listed newest first. A nil cursor fetches the first page.
+func (db *DB) AuditEventsCursor(ctx context.Context, f AuditEventsFilter, cursor *PageCursor, pageSize int) ([]AuditEvent, PageCursors, error) {
+	if err := validateOffsetPageSize(0, pageSize); err != nil {
+		return nil, PageCursors{}, err
+	}
+	match := bson.D{}
+	if !f.UserID.IsZero() {
+		match = append(match, bson.E{Key: "user_id", Value: f.UserID})
+	}
+	if f.Actor != "" {
+		match = append(match, bson.E{Key: "actor", Value: f.Actor})
+	}
+	if f.Action != "" {
+		match = append(match, bson.E{Key: "action", Value: f.Action})
+	}
+	if f.IP != "" {
+		match = append(match, bson.E{Key: "ip", Value: f.IP})
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		timeRange := bson.D{}
+		if !f.From.IsZero() {
+			timeRange = append(timeRange, bson.E{Key: "$gte", Value: f.From.UTC()})
+		}
+		if !f.To.IsZero() {
+			timeRange = append(timeRange, bson.E{Key: "$lt", Value: f.To.UTC()})
+		}
+		match = append(match, bson.E{Key: "created_at", Value: timeRange})
+	}
+	pipeline := mongo.Pipeline{bson.D{{"$match", match}}}
+	pipeline = append(pipeline, cursorStages("created_at", cursor, true, pageSize)...)
+	c, err := db.staticAuditEvents.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, PageCursors{}, errors.AddContext(err, "failed to find audit events")
+	}
+	events := make([]AuditEvent, 0, pageSize+1)
+	err = c.All(ctx, &events)
+	if err != nil {
+		return nil, PageCursors{}, errors.AddContext(err, "failed to parse audit events")
+	}
+	n, pcs := cursorPage(events, cursor, pageSize, func(i int) PageCursor {
+		return PageCursor{Timestamp: events[i].CreatedAt, ID: events[i].ID}
+	})
+	return events[:n], pcs, nil
+}
@@ -31,6 +31,12 @@ const (
 	// ChallengeTypeUpdate is the type of the update challenge which we use when
 	// we register a new pubkey for the user.
 	ChallengeTypeUpdate = "skynet-portal-update"
+	// ChallengeTypeWebAuthnLogin is the type of the WebAuthn authentication
+	// challenge.
+	ChallengeTypeWebAuthnLogin = "webauthn-login"
+	// ChallengeTypeWebAuthnRegister is the type of the WebAuthn registration
+	// challenge which we use when the user adds a new passkey.
+	ChallengeTypeWebAuthnRegister = "webauthn-register"
 
 	// PubKeySize defines the length of the public key in bytes.
 	PubKeySize = ed25519.PublicKeySize
@@ -62,6 +68,9 @@ type (
 		Type      string    `bson:"type" json:"-"`
 		PubKey    PubKey    `bson:"pub_key" json:"-"`
 		ExpiresAt time.Time `bson:"expires_at" json:"-"`
+		// UserID is only set for WebAuthn registration challenges. It's the
+		// user who is adding a passkey.
+		UserID primitive.ObjectID `bson:"user_id,omitempty" json:"-"`
 	}
 
 	// ChallengeResponse defines the format of a fully parsed and validated
@@ -19,6 +19,10 @@ var (
 	// ConfValRegistrationsDisabled is the configuration value that disables
 	// new registration on the service.
 	ConfValRegistrationsDisabled = "registrations_disabled"
+	// ConfValUsageRollupsBuilt is the configuration value that marks that the
+	// usage rollups of all users have been built from their raw uploads and
+	// downloads.
+	ConfValUsageRollupsBuilt = "usage_rollups_built"
 
 	// ConfValTrue represents the truthy value for flag-like configuration
 	// options.
@@ -53,6 +53,30 @@ var (
 	collConfiguration = "configuration"
 	// collAPIKeys defines the name of the db table with API keys for users.
 	collAPIKeys = "api_keys"
+	// collRegistryUsage defines the name of the collection which holds the
+	// aggregated registry reads and writes of all users.
+	collRegistryUsage = "registry_usage"
+	// collMetaFetcherJobs defines the name of the collection which holds all
+	// skylinks waiting to have their metadata fetched.
+	collMetaFetcherJobs = "metafetcher_jobs"
+	// collUsageRollups defines the name of the collection which holds the
+	// daily aggregated upload and download usage of all users.
+	collUsageRollups = "usage_rollups"
+	// collRefreshTokens defines the name of the collection which holds the
+	// hashes of all refresh tokens we've issued.
+	collRefreshTokens = "refresh_tokens"
+	// collSessions defines the name of the collection which holds the login
+	// sessions of all users.
+	collSessions = "sessions"
+	// collTwoFactorLogins defines the name of the collection which holds the
+	// logins which await their second factor.
+	collTwoFactorLogins = "two_factor_logins"
+	// collLoginAttempts defines the name of the collection which holds the
+	// failed login and recovery attempts per email and per IP.
+	collLoginAttempts = "login_attempts"
+	// collAuditEvents defines the name of the collection which holds the
+	// audit trail of security-relevant account events.
+	collAuditEvents = "audit_events"
 
 	// DefaultPageSize defines the default number of records to return.
 	DefaultPageSize = 10
@@ -93,15 +117,26 @@ type (
 		staticSkylinks               *mongo.Collection
 		staticUploads                *mongo.Collection
 		staticDownloads              *mongo.Collection
-		staticRegistryReads          *mongo.Collection
-		staticRegistryWrites         *mongo.Collection
+		staticRegistryUsage          *mongo.Collection
 		staticEmails                 *mongo.Collection
 		staticChallenges             *mongo.Collection
 		staticUnconfirmedUserUpdates *mongo.Collection
 		staticConfiguration          *mongo.Collection
 		staticAPIKeys                *mongo.Collection
+		staticMetaFetcherJobs        *mongo.Collection
+		staticUsageRollups           *mongo.Collection
+		staticRefreshTokens          *mongo.Collection
+		staticSessions               *mongo.Collection
+		staticTwoFactorLogins        *mongo.Collection
+		staticLoginAttempts          *mongo.Collection
+		staticAuditEvents            *mongo.Collection
 		staticDeps                   lib.Dependencies
 		staticLogger                 *logrus.Logger
+
+		staticRegistryAggregator *registryAggregator
+		// cancelFlush stops the background flushing of the registry usage and
+		// the purging of deleted users.
+		cancelFlush context.CancelFunc
 	}
 
 	// DBCredentials is a helper struct that binds together all values needed for
@@ -154,26 +189,54 @@ func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger
 	if err != nil {
 		return nil, err
 	}
-	return &DB{
+	newDB := &DB{
 		staticDB:                     db,
 		staticUsers:                  db.Collection(collUsers),
 		staticSkylinks:               db.Collection(collSkylinks),
 		staticUploads:                db.Collection(collUploads),
 		staticDownloads:              db.Collection(collDownloads),
-		staticRegistryReads:          db.Collection(collRegistryReads),
-		staticRegistryWrites:         db.Collection(collRegistryWrites),
+		staticRegistryUsage:          db.Collection(collRegistryUsage),
 		staticEmails:                 db.Collection(collEmails),
 		staticChallenges:             db.Collection(collChallenges),
 		staticUnconfirmedUserUpdates: db.Collection(collUnconfirmedUserUpdates),
 		staticConfiguration:          db.Collection(collConfiguration),
 		staticAPIKeys:                db.Collection(collAPIKeys),
+		staticMetaFetcherJobs:        db.Collection(collMetaFetcherJobs),
+		staticUsageRollups:           db.Collection(collUsageRollups),
+		staticRefreshTokens:          db.Collection(collRefreshTokens),
+		staticSessions:               db.Collection(collSessions),
+		staticTwoFactorLogins:        db.Collection(collTwoFactorLogins),
+		staticLoginAttempts:          db.Collection(collLoginAttempts),
+		staticAuditEvents:            db.Collection(collAuditEvents),
 		staticDeps:                   deps,
 		staticLogger:                 logger,
-	}, nil
+		staticRegistryAggregator:     newRegistryAggregator(),
+	}
+	err = newDB.migrateAPIKeyHashes(ctx)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to hash plaintext API keys")
+	}
+	err = newDB.ensureUsageRollups(ctx)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to build usage rollups")
+	}
+	// The flushing of registry usage and the purging of deleted users are
+	// bound to the lifetime of the DB connection and not to the passed
+	// context which might be short-lived.
+	flushCtx, cancel := context.WithCancel(context.Background())
+	newDB.cancelFlush = cancel
+	go newDB.threadedFlushRegistryUsage(flushCtx)
+	go newDB.threadedPurgeUsers(flushCtx)
+	return newDB, nil
 }
 
 // Disconnect closes the connection to the database in an orderly fashion.
 func (db *DB) Disconnect(ctx context.Context) error {
+	db.cancelFlush()
+	err := db.RegistryUsageFlush(ctx)
+	if err != nil {
+		db.staticLogger.Warnln("Failed to flush registry usage on disconnect:", err)
+	}
 	return db.staticDB.Client().Disconnect(ctx)
 }
 
@@ -246,20 +309,31 @@ func ensureDBSchema(ctx context.Context, db *mongo.Database, schema map[string][
 	if err != nil {
 		return err
 	}
-	// Drop indexes we no longer need.
-	_, err = db.Collection(collUsers).Indexes().DropOne(ctx, "email_unique")
-	// We want to ignore IndexNotFound errors - we'll have that each time we run
-	// this code after the initial run on which we drop the index.
-	// We also want to ignore NamespaceNotFound errors - we'll have that on the
-	// very first run of the service when users collection doesn't exist, yet.
-	// We don't want to worry new portal operators and waste their time.
-	// All other errors we want to log for informational purposes but we don't
-	// want to return an error and prevent the service from running - if there
-	// is any issue with the database that would affect the operation of the
-	// service, it will surface during the next step where we ensure collections
-	// indexes exist.
-	if err != nil && !strings.Contains(err.Error(), "IndexNotFound") && !strings.Contains(err.Error(), "NamespaceNotFound") {
-		log.Debugf("Error while dropping index '%s': %v", "email_unique", err)
+	// Drop indexes we no longer need. The plaintext API key index needs to go
+	// before we migrate API keys to hashes because their records lose their
+	// `key` field in the process. We filter uploads by skylink name after
+	// joining them with their skylinks, so the skylink name index is of no use.
+	obsoleteIndexes := map[string]string{
+		collUsers:    "email_unique",
+		collAPIKeys:  "key_unique",
+		collSkylinks: "name",
+	}
+	for collName, idxName := range obsoleteIndexes {
+		_, err = db.Collection(collName).Indexes().DropOne(ctx, idxName)
+		// We want to ignore IndexNotFound errors - we'll have that each time we
+		// run this code after the initial run on which we drop the index.
+		// We also want to ignore NamespaceNotFound errors - we'll have that on
+		// the very first run of the service when the collection doesn't exist,
+		// yet. We don't want to worry new portal operators and waste their
+		// time.
+		// All other errors we want to log for informational purposes but we
+		// don't want to return an error and prevent the service from running -
+		// if there is any issue with the database that would affect the
+		// operation of the service, it will surface during the next step where
+		// we ensure collections indexes exist.
+		if err != nil && !strings.Contains(err.Error(), "IndexNotFound") && !strings.Contains(err.Error(), "NamespaceNotFound") {
+			log.Debugf("Error while dropping index '%s': %v", idxName, err)
+		}
 	}
 	// Ensure current schema.
 	for collName, models := range schema {
@@ -321,7 +395,7 @@ func ensureCollection(ctx context.Context, db *mongo.Database, collName string)
 // join with the `skylinks` collection in order to fetch some additional
 // data about each download.
 func generateUploadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipeline {
-	sortStage := bson.D{{"$sort", bson.D{{"timestamp", -1}}}}
+	sortStage := bson.D{{"$sort", bson.D{{"timestamp", -1}, {"_id", -1}}}}
 	skipStage := bson.D{{"$skip", offset}}
 	limitStage := bson.D{{"$limit", pageSize}}
 	lookupStage := bson.D{
@@ -345,11 +419,59 @@ func generateUploadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipe
 	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, lookupStage, replaceStage, projectStage}
 }
 
+// generateFilteredUploadsPipeline is similar to generateUploadsPipeline but it
+// also supports filtering by fields of the skylinks collection and custom
+// sorting. When neither the skylinks match stage nor the sort stage need data
+// from the skylinks collection, which sortsBySkylink indicates for the latter,
+// we paginate before joining with it, just like generateUploadsPipeline does.
+// Otherwise, we need to join all of the user's uploads which match the
+// uploads match stage before we can filter and sort them and no index can
+// help with that.
+func generateFilteredUploadsPipeline(matchStage, skylinksMatchStage, sortStage bson.D, sortsBySkylink bool, offset, pageSize int) mongo.Pipeline {
+	skipStage := bson.D{{"$skip", offset}}
+	limitStage := bson.D{{"$limit", pageSize}}
+	projectStage := bson.D{{"$project", bson.D{{"fromSkylinks", 0}}}}
+	pipeline := mongo.Pipeline{matchStage}
+	if skylinksMatchStage == nil && !sortsBySkylink {
+		pipeline = append(pipeline, sortStage, skipStage, limitStage)
+		pipeline = append(pipeline, skylinkLookupStages()...)
+		return append(pipeline, projectStage)
+	}
+	pipeline = append(pipeline, skylinkLookupStages()...)
+	if skylinksMatchStage != nil {
+		pipeline = append(pipeline, skylinksMatchStage)
+	}
+	return append(pipeline, sortStage, skipStage, limitStage, projectStage)
+}
+
+// skylinkLookupStages returns the stages which join the documents with the
+// skylinks they reference and merge the skylink's fields into them.
+func skylinkLookupStages() []bson.D {
+	lookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "skylink_id"}, // field in the uploads collection
+			{"foreignField", "_id"},      // field in the skylinks collection
+			{"as", "fromSkylinks"},
+		}},
+	}
+	replaceStage := bson.D{
+		{"$replaceRoot", bson.D{
+			{"newRoot", bson.D{
+				{"$mergeObjects", bson.A{
+					bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks", 0}}}, "$$ROOT"},
+				},
+			}},
+		}},
+	}
+	return []bson.D{lookupStage, replaceStage}
+}
+
 // generateDownloadsPipeline is similar to generateUploadsPipeline. The only
 // difference is that it supports partial downloads via the `bytes` field in the
 // `downloads` collection.
 func generateDownloadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pipeline {
-	sortStage := bson.D{{"$sort", bson.D{{"created_at", -1}}}}
+	sortStage := bson.D{{"$sort", bson.D{{"created_at", -1}, {"_id", -1}}}}
 	skipStage := bson.D{{"$skip", offset}}
 	limitStage := bson.D{{"$limit", pageSize}}
 	lookupStage := bson.D{
@@ -369,15 +491,54 @@ func generateDownloadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pi
 			}},
 		}},
 	}
+	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, lookupStage, replaceStage, downloadsProjectStage()}
+}
+
+// generateCursorUploadsPipeline is similar to generateFilteredUploadsPipeline
+// but it selects the page of uploads which follows the given cursor instead
+// of using an offset. The uploads are sorted by timestamp in descending order,
+// unless asc is set. See cursorStages for the order in which they come out.
+func generateCursorUploadsPipeline(matchStage, skylinksMatchStage bson.D, cursor *PageCursor, asc bool, pageSize int) mongo.Pipeline {
+	projectStage := bson.D{{"$project", bson.D{{"fromSkylinks", 0}}}}
+	pipeline := mongo.Pipeline{matchStage}
+	if skylinksMatchStage == nil {
+		pipeline = append(pipeline, cursorStages("timestamp", cursor, !asc, pageSize)...)
+		pipeline = append(pipeline, skylinkLookupStages()...)
+		return append(pipeline, projectStage)
+	}
+	pipeline = append(pipeline, skylinkLookupStages()...)
+	pipeline = append(pipeline, skylinksMatchStage)
+	pipeline = append(pipeline, cursorStages("timestamp", cursor, !asc, pageSize)...)
+	return append(pipeline, projectStage)
+}
+
+// generateCursorDownloadsPipeline is similar to generateDownloadsPipeline but
+// it selects the page of downloads which follows the given cursor instead of
+// using an offset.
+func generateCursorDownloadsPipeline(matchStage bson.D, cursor *PageCursor, pageSize int) mongo.Pipeline {
+	pipeline := mongo.Pipeline{matchStage}
+	pipeline = append(pipeline, cursorStages("created_at", cursor, true, pageSize)...)
+	pipeline = append(pipeline, skylinkLookupStages()...)
+	return append(pipeline, downloadsProjectStage())
+}
+
+// downloadsProjectStage returns the stage which shapes the downloads joined
+// with their skylinks into DownloadResponse documents.
+func downloadsProjectStage() bson.D {
 	// This stage checks if the download has a non-zero `bytes` field and if so,
 	// it takes it as the download's size, otherwise it reports the full
 	// skylink's size as download's size.
-	projectStage := bson.D{{"$project", bson.D{
+	return bson.D{{"$project", bson.D{
 		{"skylink", 1},
 		{"name", 1},
 		{"user_id", 1},
 		{"skylink_id", 1},
 		{"created_at", 1},
+		{"content_type", 1},
+		{"default_path", 1},
+		{"subfiles_count", 1},
+		{"subfiles_size", 1},
+		{"fetched_at", 1},
 		{"size", bson.D{
 			{"$cond", bson.A{
 				bson.D{{"$gt", bson.A{"$bytes", 0}}}, // if
@@ -386,14 +547,21 @@ func generateDownloadsPipeline(matchStage bson.D, offset, pageSize int) mongo.Pi
 			}},
 		}},
 	}}}
-	return mongo.Pipeline{matchStage, sortStage, skipStage, limitStage, lookupStage, replaceStage, projectStage}
 }
 
 // count returns the number of documents in the given collection that match the
 // given matchStage.
 func (db *DB) count(ctx context.Context, coll *mongo.Collection, matchStage bson.D) (int64, error) {
-	pipeline := mongo.Pipeline{matchStage, bson.D{{"$count", "count"}}}
-	c, err := coll.Aggregate(ctx, pipeline)
+	return db.countPipeline(ctx, coll, mongo.Pipeline{matchStage})
+}
+
+// countPipeline returns the number of documents the given pipeline produces
+// over the given collection. The pipeline might need to join and filter a
+// large number of documents, so we allow it to spill over to disk.
+func (db *DB) countPipeline(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (int64, error) {
+	pipeline = append(pipeline, bson.D{{"$count", "count"}})
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	c, err := coll.Aggregate(ctx, pipeline, opts)
 	if err != nil {
 		return 0, errors.AddContext(err, "DB query failed")
 	}
@@ -35,6 +35,15 @@ type DownloadResponse struct {
 	Name      string    `bson:"name" json:"name"`
 	Size      uint64    `bson:"size" json:"size"`
 	CreatedAt time.Time `bson:"created_at" json:"downloadedOn"`
+
+	SkylinkMetadata `bson:",inline"`
+}
+
+// PageCursor returns the cursor which points at this download in a list of
+// downloads sorted by creation time.
+func (dr DownloadResponse) PageCursor() PageCursor {
+	id, _ := primitive.ObjectIDFromHex(dr.ID)
+	return PageCursor{Timestamp: dr.CreatedAt, ID: id}
 }
 
 // DownloadByID fetches a single download from the DB.
@@ -77,6 +86,14 @@ func (db *DB) DownloadCreate(ctx context.Context, user User, skylink Skylink, by
 		return nil, err
 	}
 	down.ID = ior.InsertedID.(primitive.ObjectID)
+	size := bytes
+	if size <= 0 {
+		size = skylink.Size
+	}
+	err = db.usageRollupDownload(ctx, *down, -1, size)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to account for download %s in usage rollups: %v", down.ID.Hex(), err)
+	}
 	return down, nil
 }
 
@@ -106,6 +123,32 @@ func (db *DB) DownloadsByUser(ctx context.Context, user User, offset, pageSize i
 	return db.downloadsBy(ctx, matchStage, offset, pageSize)
 }
 
+// DownloadsByUserCursor fetches the page of downloads by this user which
+// follows, or precedes if the cursor goes backwards, the given cursor. A nil
+// cursor fetches the first page.
+func (db *DB) DownloadsByUserCursor(ctx context.Context, user User, cursor *PageCursor, pageSize int) ([]DownloadResponse, PageCursors, error) {
+	if user.ID.IsZero() {
+		return nil, PageCursors{}, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(0, pageSize); err != nil {
+		return nil, PageCursors{}, err
+	}
+	matchStage := bson.D{{"$match", bson.D{{"user_id", user.ID}}}}
+	c, err := db.staticDownloads.Aggregate(ctx, generateCursorDownloadsPipeline(matchStage, cursor, pageSize))
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	downloads := make([]DownloadResponse, 0, pageSize+1)
+	err = c.All(ctx, &downloads)
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	n, pcs := cursorPage(downloads, cursor, pageSize, func(i int) PageCursor {
+		return downloads[i].PageCursor()
+	})
+	return downloads[:n], pcs, nil
+}
+
 // downloadsBy fetches a page of downloads, filtered by an arbitrary match
 // criteria. It also reports the total number of records in the list.
 func (db *DB) downloadsBy(ctx context.Context, matchStage bson.D, offset, pageSize int) ([]DownloadResponse, int, error) {
@@ -156,5 +199,23 @@ func (db *DB) DownloadIncrement(ctx context.Context, d *Download, additionalByte
 	if err != nil {
 		return errors.AddContext(err, "failed to update download record")
 	}
+	// Full downloads have zero bytes, so their size is the skylink's size.
+	oldSize := d.Bytes
+	if oldSize <= 0 {
+		sl, err := db.SkylinkByID(ctx, d.SkylinkID)
+		if err != nil {
+			db.staticLogger.Warnf("Failed to fetch skylink %s: %v", d.SkylinkID.Hex(), err)
+			return nil
+		}
+		oldSize = sl.Size
+	}
+	newSize := d.Bytes + additionalBytes
+	if newSize <= 0 {
+		newSize = oldSize
+	}
+	err = db.usageRollupDownload(ctx, *d, oldSize, newSize)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to account for download %s in usage rollups: %v", d.ID.Hex(), err)
+	}
 	return nil
 }
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// UploadExport is a single upload in an export of the user's uploads.
+	UploadExport struct {
+		Skylink    string    `bson:"skylink" json:"skylink"`
+		Name       string    `bson:"name" json:"name"`
+		Size       int64     `bson:"size" json:"size"`
+		RawStorage int64     `bson:"-" json:"rawStorage"`
+		Timestamp  time.Time `bson:"timestamp" json:"uploadedOn"`
+		Unpinned   bool      `bson:"unpinned" json:"unpinned"`
+	}
+
+	// DownloadExport is a single download in an export of the user's
+	// downloads.
+	DownloadExport struct {
+		Skylink   string    `bson:"skylink" json:"skylink"`
+		Name      string    `bson:"name" json:"name"`
+		Size      int64     `bson:"size" json:"size"`
+		CreatedAt time.Time `bson:"created_at" json:"downloadedOn"`
+		UpdatedAt time.Time `bson:"updated_at" json:"updatedOn"`
+	}
+)
+
+// UploadsExport iterates over all uploads of the given user, including the
+// unpinned ones, in chronological order and calls fn for each of them. The
+// uploads are read from a cursor, so we never hold more than a single batch in
+// memory. Zero from or to values leave the respective end of the time range
+// open. Iteration stops at the first error returned by fn.
+func (db *DB) UploadsExport(ctx context.Context, user User, from, to time.Time, fn func(UploadExport) error) error {
+	if user.ID.IsZero() {
+		return errors.New("invalid user")
+	}
+	matchStage, err := exportMatchStage(user, "timestamp", from, to)
+	if err != nil {
+		return err
+	}
+	sortStage := bson.D{{"$sort", bson.D{{"timestamp", 1}, {"_id", 1}}}}
+	lookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "skylink_id"}, // field in the uploads collection
+			{"foreignField", "_id"},      // field in the skylinks collection
+			{"as", "fromSkylinks"},
+		}},
+	}
+	projectStage := bson.D{{"$project", bson.D{
+		{"skylink", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.skylink", 0}}}},
+		{"name", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.name", 0}}}},
+		{"size", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.size", 0}}}},
+		{"timestamp", 1},
+		{"unpinned", 1},
+	}}}
+	pipeline := mongo.Pipeline{matchStage, sortStage, lookupStage, projectStage}
+	return db.export(ctx, db.staticUploads, pipeline, func(c *mongo.Cursor) error {
+		var up UploadExport
+		if err := c.Decode(&up); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		up.RawStorage = skynet.RawStorageUsed(up.Size)
+		return fn(up)
+	})
+}
+
+// DownloadsExport iterates over all downloads of the given user in
+// chronological order and calls fn for each of them. It behaves in the same
+// way as UploadsExport.
+func (db *DB) DownloadsExport(ctx context.Context, user User, from, to time.Time, fn func(DownloadExport) error) error {
+	if user.ID.IsZero() {
+		return errors.New("invalid user")
+	}
+	matchStage, err := exportMatchStage(user, "created_at", from, to)
+	if err != nil {
+		return err
+	}
+	sortStage := bson.D{{"$sort", bson.D{{"created_at", 1}, {"_id", 1}}}}
+	lookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "skylink_id"}, // field in the downloads collection
+			{"foreignField", "_id"},      // field in the skylinks collection
+			{"as", "fromSkylinks"},
+		}},
+	}
+	// A download with zero `bytes` is a full download, so we report the
+	// skylink's size as its size.
+	skylinkSize := bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.size", 0}}}
+	projectStage := bson.D{{"$project", bson.D{
+		{"skylink", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.skylink", 0}}}},
+		{"name", bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.name", 0}}}},
+		{"size", bson.D{
+			{"$cond", bson.A{
+				bson.D{{"$gt", bson.A{"$bytes", 0}}}, // if
+				"$bytes",                             // then
+				skylinkSize,                          // else
+			}},
+		}},
+		{"created_at", 1},
+		{"updated_at", 1},
+	}}}
+	pipeline := mongo.Pipeline{matchStage, sortStage, lookupStage, projectStage}
+	return db.export(ctx, db.staticDownloads, pipeline, func(c *mongo.Cursor) error {
+		var d DownloadExport
+		if err := c.Decode(&d); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		return fn(d)
+	})
+}
+
+// export runs the given pipeline against the collection and calls fn for each
+// document the cursor returns. Exports can be large, so we allow the pipeline
+// to spill over to disk.
+func (db *DB) export(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, fn func(*mongo.Cursor) error) error {
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	c, err := coll.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	for c.Next(ctx) {
+		if err = fn(c); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// exportMatchStage returns a match stage which selects the user's records
+// with the given time field falling within the given range.
+func exportMatchStage(user User, timeField string, from, to time.Time) (bson.D, error) {
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return nil, ErrInvalidTimePeriod
+	}
+	filter := bson.D{{"user_id", user.ID}}
+	timeRange := bson.D{}
+	if !from.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$gte", Value: from})
+	}
+	if !to.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$lte", Value: to})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{Key: timeField, Value: timeRange})
+	}
+	return bson.D{{"$match", filter}}, nil
+}
@@ -0,0 +1,249 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+We protect password logins and account recovery against brute-force and
+credential stuffing attacks by counting failed attempts per email and per IP.
+
+The first few failures are free. After that, each failure blocks further
+attempts for an exponentially growing delay. Once the failures reach the
+lockout threshold, we block all attempts for LoginLockoutDuration and notify
+the user. The counters reset once there have been no failures for
+loginAttemptsResetAfter.
+*/
+
+const (
+	// LoginAttemptScopeLogin counts failed password logins.
+	LoginAttemptScopeLogin = "login"
+	// LoginAttemptScopeRecover counts account recovery requests.
+	LoginAttemptScopeRecover = "recover"
+
+	// loginAttemptsResetAfter defines how long we remember failed attempts.
+	loginAttemptsResetAfter = 24 * time.Hour
+)
+
+var (
+	// LoginLockoutDuration defines how long we block all attempts once their
+	// number reaches the lockout threshold.
+	LoginLockoutDuration = build.Select(build.Var{
+		Dev:      time.Minute,
+		Testing:  3 * time.Second,
+		Standard: time.Hour,
+	}).(time.Duration)
+
+	// loginBackoffBase is the delay after the first failure which is not
+	// free. Each subsequent failure doubles it.
+	loginBackoffBase = build.Select(build.Var{
+		Dev:      time.Second,
+		Testing:  time.Second,
+		Standard: time.Second,
+	}).(time.Duration)
+	// loginBackoffMax caps the exponential delay.
+	loginBackoffMax = build.Select(build.Var{
+		Dev:      10 * time.Second,
+		Testing:  2 * time.Second,
+		Standard: 5 * time.Minute,
+	}).(time.Duration)
+
+	// loginAttemptPolicyEmail defines how many failures we tolerate per
+	// email address.
+	loginAttemptPolicyEmail = loginAttemptPolicy{
+		FreeFailures:    3,
+		LockoutFailures: 10,
+	}
+	// loginAttemptPolicyIP defines how many failures we tolerate per IP. It's
+	// more lenient than the email policy because many users might share the
+	// same IP.
+	loginAttemptPolicyIP = loginAttemptPolicy{
+		FreeFailures:    20,
+		LockoutFailures: 100,
+	}
+)
+
+type (
+	// LoginAttempt counts the failed attempts for an email address or an IP
+	// within a scope. Exactly one of Email and IP is set.
+	LoginAttempt struct {
+		ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+		Scope         string             `bson:"scope" json:"scope"`
+		Email         types.Email        `bson:"email" json:"email,omitempty"`
+		IP            string             `bson:"ip" json:"ip,omitempty"`
+		Failures      int                `bson:"failures" json:"failures"`
+		LastFailureAt time.Time          `bson:"last_failure_at" json:"lastFailureAt"`
+		BlockedUntil  time.Time          `bson:"blocked_until,omitempty" json:"blockedUntil"`
+		ExpiresAt     time.Time          `bson:"expires_at" json:"-"`
+	}
+
+	// loginAttemptPolicy defines how many failures we tolerate before we
+	// start delaying and locking out attempts.
+	loginAttemptPolicy struct {
+		FreeFailures    int
+		LockoutFailures int
+	}
+)
+
+// blockedUntil returns until when we need to block attempts after the given
+// number of failures. It also returns true if this exact failure triggered a
+// lockout.
+func (p loginAttemptPolicy) blockedUntil(failures int, now time.Time) (time.Time, bool) {
+	if failures >= p.LockoutFailures {
+		return now.Add(LoginLockoutDuration), failures == p.LockoutFailures
+	}
+	if failures <= p.FreeFailures {
+		return time.Time{}, false
+	}
+	delay := loginBackoffBase
+	for i := p.FreeFailures + 1; i < failures && delay < loginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > loginBackoffMax {
+		delay = loginBackoffMax
+	}
+	return now.Add(delay), false
+}
+
+// LoginAttemptsBlockedUntil returns until when attempts with the given email
+// or from the given IP are blocked within the given scope. It returns a zero
+// time if they are not blocked.
+func (db *DB) LoginAttemptsBlockedUntil(ctx context.Context, scope string, email types.Email, ip string) (time.Time, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"scope":         scope,
+		"$or":           loginAttemptsOr(email, ip),
+		"blocked_until": bson.M{"$gt": now},
+	}
+	opts := options.FindOne().SetSort(bson.M{"blocked_until": -1})
+	var la LoginAttempt
+	err := db.staticLoginAttempts.FindOne(ctx, filter, opts).Decode(&la)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.AddContext(err, "failed to fetch login attempts")
+	}
+	return la.BlockedUntil, nil
+}
+
+// LoginAttemptFailed records a failed attempt for the given email and IP. It
+// returns the email's updated LoginAttempt and whether this failure locked it
+// out.
+func (db *DB) LoginAttemptFailed(ctx context.Context, scope string, email types.Email, ip string) (*LoginAttempt, bool, error) {
+	var la *LoginAttempt
+	var lockedOut bool
+	var errEmail, errIP error
+	if email != "" {
+		la, lockedOut, errEmail = db.loginAttemptFailed(ctx, scope, email, "", loginAttemptPolicyEmail)
+	}
+	if ip != "" {
+		_, _, errIP = db.loginAttemptFailed(ctx, scope, "", ip, loginAttemptPolicyIP)
+	}
+	if err := errors.Compose(errEmail, errIP); err != nil {
+		return nil, false, errors.AddContext(err, "failed to record failed attempt")
+	}
+	return la, lockedOut, nil
+}
+
+// LoginAttemptsReset forgets the failed attempts of the given email within the
+// given scope. We call it after a successful attempt. We don't reset the IP's
+// failures, so an attacker can't reset them by logging into their own
+// account.
+func (db *DB) LoginAttemptsReset(ctx context.Context, scope string, email types.Email) error {
+	_, err := db.staticLoginAttempts.DeleteOne(ctx, bson.M{"scope": scope, "email": email, "ip": ""})
+	return err
+}
+
+// LoginAttemptsBlocked returns all emails and IPs which are currently blocked.
+func (db *DB) LoginAttemptsBlocked(ctx context.Context) ([]LoginAttempt, error) {
+	filter := bson.M{"blocked_until": bson.M{"$gt": time.Now().UTC()}}
+	opts := options.Find().SetSort(bson.M{"blocked_until": -1})
+	c, err := db.staticLoginAttempts.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch login attempts")
+	}
+	las := make([]LoginAttempt, 0)
+	err = c.All(ctx, &las)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode login attempts")
+	}
+	return las, nil
+}
+
+// LoginAttemptsClear forgets all failed attempts of the given email and IP in
+// all scopes, which lifts any lockouts. It returns the number of cleared
+// records.
+func (db *DB) LoginAttemptsClear(ctx context.Context, email types.Email, ip string) (int64, error) {
+	if email == "" && ip == "" {
+		return 0, errors.New("either an email or an IP is required")
+	}
+	dr, err := db.staticLoginAttempts.DeleteMany(ctx, bson.M{"$or": loginAttemptsOr(email, ip)})
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to clear login attempts")
+	}
+	return dr.DeletedCount, nil
+}
+
+// loginAttemptFailed records a failed attempt for either an email or an IP
+// and blocks further attempts according to the given policy.
+func (db *DB) loginAttemptFailed(ctx context.Context, scope string, email types.Email, ip string, p loginAttemptPolicy) (*LoginAttempt, bool, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{
+		"scope": scope,
+		"email": email,
+		"ip":    ip,
+	}
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{
+			"last_failure_at": now,
+			"expires_at":      now.Add(loginAttemptsResetAfter),
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var la LoginAttempt
+	err := db.staticLoginAttempts.FindOneAndUpdate(ctx, filter, update, opts).Decode(&la)
+	if err != nil {
+		return nil, false, err
+	}
+	blockedUntil, lockedOut := p.blockedUntil(la.Failures, now)
+	if blockedUntil.IsZero() {
+		return &la, false, nil
+	}
+	// Use $max, so concurrent failures can't shorten the block.
+	_, err = db.staticLoginAttempts.UpdateOne(ctx, bson.M{"_id": la.ID}, bson.M{"$max": bson.M{"blocked_until": blockedUntil}})
+	if err != nil {
+		return nil, false, err
+	}
+	if blockedUntil.After(la.BlockedUntil) {
+		la.BlockedUntil = blockedUntil
+	}
+	return &la, lockedOut, nil
+}
+
+// loginAttemptsOr returns a filter which matches the LoginAttempt records of
+// the given email and the given IP. Empty values are ignored.
+func loginAttemptsOr(email types.Email, ip string) bson.A {
+	or := bson.A{}
+	if email != "" {
+		or = append(or, bson.M{"email": email, "ip": ""})
+	}
+	if ip != "" {
+		or = append(or, bson.M{"email": "", "ip": ip})
+	}
+	if len(or) == 0 {
+		// Match nothing.
+		or = append(or, bson.M{"_id": primitive.NilObjectID})
+	}
+	return or
+}
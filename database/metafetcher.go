@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MetaFetcherMaxAttempts defines the maximum number of attempts we are
+	// going to make at fetching the metadata of a given skylink before giving
+	// up on it. This const is defined here and not in the metafetcher package
+	// because the database package needs it in order to select jobs.
+	MetaFetcherMaxAttempts = 3
+
+	// metaFetcherLockTTL defines how long a metafetcher job can stay locked.
+	// Once the lock expires the job will be unlocked and free for other
+	// servers to lock and process. This protects us from losing jobs when a
+	// server dies while processing them.
+	metaFetcherLockTTL = 5 * time.Minute
+)
+
+type (
+	// MetaFetcherJob represents a skylink waiting to have its metadata
+	// fetched. Jobs are persisted in the database, so they survive restarts
+	// and can be shared between several accounts servers.
+	MetaFetcherJob struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty"`
+		SkylinkID primitive.ObjectID `bson:"skylink_id"`
+		Attempts  int                `bson:"attempts"`
+		LockedBy  string             `bson:"locked_by"`
+		LockedAt  time.Time          `bson:"locked_at,omitempty"`
+		// NextAttemptAt defines the earliest moment at which the job can be
+		// picked up for processing. We use it to back off between attempts.
+		NextAttemptAt time.Time `bson:"next_attempt_at"`
+		CreatedAt     time.Time `bson:"created_at"`
+	}
+)
+
+// MetaFetcherJobCreate queues the given skylink for having its metadata
+// fetched. There is at most one job per skylink. If the skylink is already
+// queued, its attempts counter is reset, so the skylink gets a fresh set of
+// attempts.
+func (db *DB) MetaFetcherJobCreate(ctx context.Context, skylinkID primitive.ObjectID) error {
+	if skylinkID.IsZero() {
+		return ErrInvalidSkylink
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"skylink_id": skylinkID}
+	update := bson.M{
+		"$set": bson.M{
+			"attempts":        0,
+			"next_attempt_at": now,
+		},
+		"$setOnInsert": bson.M{
+			"skylink_id": skylinkID,
+			"locked_by":  "",
+			"created_at": now,
+		},
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := db.staticMetaFetcherJobs.UpdateOne(ctx, filter, update, opts)
+	// Two concurrent upserts of the same skylink might race and one of them
+	// will fail with a duplicate key error. The job exists in that case, so
+	// we are happy.
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return errors.AddContext(err, "failed to queue metafetcher job")
+	}
+	return nil
+}
+
+// MetaFetcherJobRequeue queues the given skylink for having its metadata
+// fetched, unless it's already queued with attempts left. Jobs which exhausted
+// their attempts get a fresh set of attempts. Jobs which are still being
+// retried are left alone, so we don't interfere with their back off. It
+// reports whether the skylink was (re-)queued.
+func (db *DB) MetaFetcherJobRequeue(ctx context.Context, skylinkID primitive.ObjectID) (bool, error) {
+	if skylinkID.IsZero() {
+		return false, ErrInvalidSkylink
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{
+		"skylink_id": skylinkID,
+		"attempts":   bson.M{"$gte": MetaFetcherMaxAttempts},
+	}
+	update := bson.M{"$set": bson.M{
+		"attempts":        0,
+		"locked_by":       "",
+		"locked_at":       time.Time{},
+		"next_attempt_at": now,
+	}}
+	ur, err := db.staticMetaFetcherJobs.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to re-queue metafetcher job")
+	}
+	if ur.ModifiedCount > 0 {
+		return true, nil
+	}
+	// There is no exhausted job for this skylink. Create one, unless there
+	// is a job which is still being retried.
+	insert := bson.M{"$setOnInsert": bson.M{
+		"skylink_id":      skylinkID,
+		"attempts":        0,
+		"locked_by":       "",
+		"next_attempt_at": now,
+		"created_at":      now,
+	}}
+	opts := options.Update().SetUpsert(true)
+	ur, err = db.staticMetaFetcherJobs.UpdateOne(ctx, bson.M{"skylink_id": skylinkID}, insert, opts)
+	// A concurrent insert of the same skylink means the job exists.
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to queue metafetcher job")
+	}
+	return ur.UpsertedCount > 0, nil
+}
+
+// MetaFetcherJobLockAndFetch locks up to batchSize jobs with the given lockID
+// and returns up to batchSize locked jobs. Some of the returned jobs might not
+// have been locked during the current execution.
+func (db *DB) MetaFetcherJobLockAndFetch(ctx context.Context, lockID string, batchSize int64) ([]MetaFetcherJob, error) {
+	// Find out how many jobs are already locked by this id. Maybe we don't
+	// need to lock any additional ones.
+	filter := bson.M{
+		"locked_by": lockID,
+		"attempts":  bson.M{"$lt": MetaFetcherMaxAttempts},
+	}
+	count, err := db.staticMetaFetcherJobs.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to count locked metafetcher jobs")
+	}
+	// Lock some more jobs in order to fill the batch.
+	// We select jobs which:
+	//  - haven't failed more times than the limit
+	//  - are not backing off after a failed attempt
+	//  - are either unlocked or their lock has expired
+	filterLock := bson.M{
+		"attempts":        bson.M{"$lt": MetaFetcherMaxAttempts},
+		"next_attempt_at": bson.M{"$lte": time.Now().UTC()},
+		"$or": bson.A{
+			bson.M{"locked_by": ""},
+			bson.M{"locked_at": bson.M{"$lt": time.Now().UTC().Add(-metaFetcherLockTTL)}},
+		},
+	}
+	updateLock := bson.M{"$set": bson.M{
+		"locked_by": lockID,
+		"locked_at": time.Now().UTC(),
+	}}
+	for i := int64(0); i < batchSize-count; i++ {
+		sr := db.staticMetaFetcherJobs.FindOneAndUpdate(ctx, filterLock, updateLock)
+		if sr.Err() == mongo.ErrNoDocuments {
+			// No more jobs to lock. We can't fill the batch but we can
+			// process what we have.
+			break
+		}
+		if sr.Err() != nil {
+			db.staticLogger.Debugln("Error while trying to lock a metafetcher job:", sr.Err())
+			continue
+		}
+	}
+	// Fetch up to batchSize jobs already locked with lockID.
+	opts := options.Find().SetLimit(batchSize)
+	c, err := db.staticMetaFetcherJobs.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch locked metafetcher jobs")
+	}
+	jobs := make([]MetaFetcherJob, 0, batchSize)
+	err = c.All(ctx, &jobs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse value from DB")
+	}
+	return jobs, nil
+}
+
+// MetaFetcherJobComplete removes a successfully processed job from the queue.
+func (db *DB) MetaFetcherJobComplete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := db.staticMetaFetcherJobs.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete metafetcher job")
+	}
+	return nil
+}
+
+// MetaFetcherJobFail increments the job's attempts counter and unlocks it, so
+// it can be picked up again once nextAttempt is reached. Jobs which reach
+// MetaFetcherMaxAttempts stay in the queue but are no longer selected for
+// processing.
+func (db *DB) MetaFetcherJobFail(ctx context.Context, id primitive.ObjectID, nextAttempt time.Time) error {
+	filter := bson.M{"_id": id}
+	update := bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{
+			"locked_by":       "",
+			"locked_at":       time.Time{},
+			"next_attempt_at": nextAttempt.UTC().Truncate(time.Millisecond),
+		},
+	}
+	_, err := db.staticMetaFetcherJobs.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to mark metafetcher job as failed")
+	}
+	return nil
+}
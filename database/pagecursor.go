@@ -0,0 +1,161 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrInvalidCursor is returned when a page cursor cannot be parsed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorSortUnsupported is returned when cursor pagination is requested
+	// for a list which is not sorted by time.
+	ErrCursorSortUnsupported = errors.New("cursor pagination is only supported when sorting by time")
+)
+
+type (
+	// PageCursor points at a record in a list sorted by (timestamp, _id). A
+	// cursor selects the page of records which follow the record it points
+	// at or, if Backwards is set, the page of records which precede it. We
+	// expose cursors to clients as opaque tokens.
+	PageCursor struct {
+		Timestamp time.Time
+		ID        primitive.ObjectID
+		Backwards bool
+	}
+
+	// PageCursors holds the tokens of the pages neighbouring the current one.
+	// A token is empty when there is no such page.
+	PageCursors struct {
+		Next string `json:"next,omitempty"`
+		Prev string `json:"prev,omitempty"`
+	}
+)
+
+// String encodes the cursor as an opaque token.
+func (pc PageCursor) String() string {
+	dir := "n"
+	if pc.Backwards {
+		dir = "p"
+	}
+	s := fmt.Sprintf("%s.%d.%s", dir, pc.Timestamp.UnixMilli(), pc.ID.Hex())
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// ParsePageCursor decodes a token created by PageCursor.String.
+func ParsePageCursor(token string) (PageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return PageCursor{}, ErrInvalidCursor
+	}
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "p") {
+		return PageCursor{}, ErrInvalidCursor
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return PageCursor{}, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		return PageCursor{}, ErrInvalidCursor
+	}
+	return PageCursor{
+		Timestamp: time.UnixMilli(ms).UTC(),
+		ID:        id,
+		Backwards: parts[0] == "p",
+	}, nil
+}
+
+// NewPageCursors returns the tokens of the pages neighbouring a page. The
+// first and last values point at the first and last records on the page. We
+// also use this for pages fetched by offset, which allows clients to switch
+// from offset to cursor pagination at any point.
+func NewPageCursors(first, last PageCursor, hasPrev, hasNext bool) PageCursors {
+	var pcs PageCursors
+	if hasNext {
+		last.Backwards = false
+		pcs.Next = last.String()
+	}
+	if hasPrev {
+		first.Backwards = true
+		pcs.Prev = first.String()
+	}
+	return pcs
+}
+
+// cursorPage turns the records fetched with the stages returned by
+// cursorStages into a page. It puts the records of the given slice in list
+// order and returns the number of records on the page, which the caller needs
+// to trim the slice to, as well as the tokens of the neighbouring pages. The
+// key func returns the cursor which points at the i-th record of the slice.
+func cursorPage(records interface{}, cursor *PageCursor, pageSize int, key func(i int) PageCursor) (int, PageCursors) {
+	n := reflect.ValueOf(records).Len()
+	hasMore := n > pageSize
+	if hasMore {
+		n = pageSize
+	}
+	backwards := cursor != nil && cursor.Backwards
+	if n == 0 {
+		// There is nothing beyond the cursor, so we can only go back to where
+		// we came from.
+		var pcs PageCursors
+		if cursor != nil {
+			c := *cursor
+			c.Backwards = !backwards
+			if backwards {
+				pcs.Next = c.String()
+			} else {
+				pcs.Prev = c.String()
+			}
+		}
+		return 0, pcs
+	}
+	if backwards {
+		swap := reflect.Swapper(records)
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	hasNext := hasMore || backwards
+	hasPrev := (backwards && hasMore) || (!backwards && cursor != nil)
+	return n, NewPageCursors(key(0), key(n-1), hasPrev, hasNext)
+}
+
+// cursorStages returns the stages which select a page of records starting at
+// the given cursor from a list sorted by (field, _id). The list is sorted in
+// descending order if desc is set. We fetch one more record than the page
+// size, so the caller can tell whether there are more records. When the
+// cursor goes backwards the records are returned in reverse order, i.e.
+// starting with the one closest to the cursor.
+func cursorStages(field string, cursor *PageCursor, desc bool, pageSize int) []bson.D {
+	dir := 1
+	if desc {
+		dir = -1
+	}
+	if cursor != nil && cursor.Backwards {
+		dir = -dir
+	}
+	var stages []bson.D
+	if cursor != nil {
+		op := "$gt"
+		if dir < 0 {
+			op = "$lt"
+		}
+		stages = append(stages, bson.D{{"$match", bson.D{{"$or", bson.A{
+			bson.D{{field, bson.D{{op, cursor.Timestamp}}}},
+			bson.D{{field, cursor.Timestamp}, {"_id", bson.D{{op, cursor.ID}}}},
+		}}}}})
+	}
+	sortStage := bson.D{{"$sort", bson.D{{field, dir}, {"_id", dir}}}}
+	limitStage := bson.D{{"$limit", pageSize + 1}}
+	return append(stages, sortStage, limitStage)
+}
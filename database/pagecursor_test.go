@@ -0,0 +1,140 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPageCursor ensures page cursors survive the round trip through their
+// token representation and that we reject malformed tokens.
+func TestPageCursor(t *testing.T) {
+	pc := PageCursor{
+		Timestamp: time.Date(2022, 3, 4, 5, 6, 7, 8000000, time.UTC),
+		ID:        primitive.NewObjectID(),
+		Backwards: true,
+	}
+	pc2, err := ParsePageCursor(pc.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pc2.Timestamp.Equal(pc.Timestamp) || pc2.ID != pc.ID || pc2.Backwards != pc.Backwards {
+		t.Fatalf("Expected %+v, got %+v", pc, pc2)
+	}
+	for _, token := range []string{"", "not base64!", "eC4xLjI", pc.ID.Hex()} {
+		if _, err = ParsePageCursor(token); err != ErrInvalidCursor {
+			t.Fatalf("Expected '%v' for token '%s', got '%v'", ErrInvalidCursor, token, err)
+		}
+	}
+}
+
+// TestCursorPage ensures we correctly trim and order the records fetched with
+// a cursor and that we only return the cursors of pages which exist.
+func TestCursorPage(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	cursorOf := func(i int) PageCursor {
+		return PageCursor{Timestamp: now.Add(time.Duration(i) * time.Second)}
+	}
+	cursor := cursorOf(10)
+	backCursor := cursor
+	backCursor.Backwards = true
+
+	tests := []struct {
+		name     string
+		records  []int
+		cursor   *PageCursor
+		expected []int
+		hasNext  bool
+		hasPrev  bool
+	}{
+		{
+			name:     "first page",
+			records:  []int{1, 2, 3},
+			cursor:   nil,
+			expected: []int{1, 2},
+			hasNext:  true,
+		},
+		{
+			name:     "only page",
+			records:  []int{1, 2},
+			cursor:   nil,
+			expected: []int{1, 2},
+		},
+		{
+			name:     "forward",
+			records:  []int{11, 12, 13},
+			cursor:   &cursor,
+			expected: []int{11, 12},
+			hasNext:  true,
+			hasPrev:  true,
+		},
+		{
+			name:     "last page",
+			records:  []int{11},
+			cursor:   &cursor,
+			expected: []int{11},
+			hasPrev:  true,
+		},
+		{
+			name:     "backwards",
+			records:  []int{9, 8, 7},
+			cursor:   &backCursor,
+			expected: []int{8, 9},
+			hasNext:  true,
+			hasPrev:  true,
+		},
+		{
+			name:     "backwards to the first page",
+			records:  []int{9, 8},
+			cursor:   &backCursor,
+			expected: []int{8, 9},
+			hasNext:  true,
+		},
+		{
+			name:    "nothing beyond the cursor",
+			records: []int{},
+			cursor:  &cursor,
+			hasPrev: true,
+		},
+	}
+	for _, tt := range tests {
+		records := tt.records
+		n, pcs := cursorPage(records, tt.cursor, 2, func(i int) PageCursor {
+			return cursorOf(records[i])
+		})
+		records = records[:n]
+		if len(records) != len(tt.expected) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.expected, records)
+		}
+		for i := range records {
+			if records[i] != tt.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", tt.name, tt.expected, records)
+			}
+		}
+		if (pcs.Next != "") != tt.hasNext || (pcs.Prev != "") != tt.hasPrev {
+			t.Fatalf("%s: expected next %t and prev %t, got %+v", tt.name, tt.hasNext, tt.hasPrev, pcs)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if pcs.Next != "" {
+			next, err := ParsePageCursor(pcs.Next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.Backwards || !next.Timestamp.Equal(cursorOf(records[len(records)-1]).Timestamp) {
+				t.Fatalf("%s: unexpected next cursor %+v", tt.name, next)
+			}
+		}
+		if pcs.Prev != "" {
+			prev, err := ParsePageCursor(pcs.Prev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !prev.Backwards || !prev.Timestamp.Equal(cursorOf(records[0]).Timestamp) {
+				t.Fatalf("%s: unexpected prev cursor %+v", tt.name, prev)
+			}
+		}
+	}
+}
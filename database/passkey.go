@@ -0,0 +1,298 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/webauthn"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/**
+Passkeys are WebAuthn credentials which let users log in with a platform
+authenticator or a security key instead of a password. They follow the same
+challenge-response pattern as the MySky pubkey logins - we issue a challenge,
+the authenticator signs it and we verify the signature against the public key
+we stored when the user registered the passkey.
+
+Our relying party ID is the portal's domain but we only accept ceremonies from
+an explicit list of origins. The portal serves user-uploaded skapps from its
+subdomains and those must not be able to log in as their visitors.
+*/
+
+const (
+	// MaxPasskeysPerUser defines how many passkeys a user can register.
+	MaxPasskeysPerUser = 10
+	// PasskeyNameMaxLen defines the maximum length of a passkey's name.
+	PasskeyNameMaxLen = 64
+)
+
+var (
+	// PasskeyOrigins lists the origins from which we accept WebAuthn
+	// ceremonies. See PasskeyAllowedOrigins for the default.
+	// Can be overridden by the ACCOUNTS_PASSKEY_ORIGINS environment variable.
+	PasskeyOrigins []string
+
+	// ErrInvalidWebAuthnChallenge is returned when the response to a WebAuthn
+	// ceremony refers to a challenge which doesn't exist, has expired or has
+	// already been used.
+	ErrInvalidWebAuthnChallenge = errors.New("invalid or expired WebAuthn challenge")
+	// ErrPasskeyExists is returned when the user tries to register a passkey
+	// which is already registered.
+	ErrPasskeyExists = errors.New("passkey already registered")
+	// ErrPasskeyLimitReached is returned when the user tries to register more
+	// than MaxPasskeysPerUser passkeys.
+	ErrPasskeyLimitReached = errors.New("maximum number of passkeys reached")
+	// ErrPasskeyNotFound is returned when we can't find the given passkey.
+	ErrPasskeyNotFound = errors.New("passkey not found")
+)
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	CredentialID []byte `bson:"credential_id"`
+	Name         string `bson:"name"`
+	// PublicKey is the COSE-encoded public key of the credential.
+	PublicKey  []byte    `bson:"public_key"`
+	AAGUID     []byte    `bson:"aaguid"`
+	SignCount  uint32    `bson:"sign_count"`
+	CreatedAt  time.Time `bson:"created_at"`
+	LastUsedAt time.Time `bson:"last_used_at,omitempty"`
+}
+
+// PasskeyRPID returns the WebAuthn relying party ID of this portal, i.e. its
+// domain.
+func PasskeyRPID() string {
+	u, err := url.Parse(PortalName)
+	if err != nil || u.Hostname() == "" {
+		return PortalName
+	}
+	return u.Hostname()
+}
+
+// PasskeyAllowedOrigins returns the origins from which we accept WebAuthn
+// ceremonies. Unless PasskeyOrigins says otherwise, that's only the portal's
+// account dashboard.
+func PasskeyAllowedOrigins() []string {
+	if len(PasskeyOrigins) > 0 {
+		return PasskeyOrigins
+	}
+	return []string{"https://account." + PasskeyRPID()}
+}
+
+// NewWebAuthnChallenge creates a new challenge for a WebAuthn ceremony. The
+// userID is only relevant for registration challenges.
+func (db *DB) NewWebAuthnChallenge(ctx context.Context, userID primitive.ObjectID, cType string) (*Challenge, error) {
+	if cType != ChallengeTypeWebAuthnLogin && cType != ChallengeTypeWebAuthnRegister {
+		return nil, errors.New("invalid WebAuthn challenge type '" + cType + "'")
+	}
+	if cType == ChallengeTypeWebAuthnRegister && userID.IsZero() {
+		return nil, errors.New("registration challenges require a user")
+	}
+	ch := &Challenge{
+		Challenge: hex.EncodeToString(fastrand.Bytes(ChallengeSize)),
+		Type:      cType,
+		UserID:    userID,
+		ExpiresAt: time.Now().UTC().Add(challengeTTL).Truncate(time.Millisecond),
+	}
+	ior, err := db.staticChallenges.InsertOne(ctx, ch)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create challenge DB record")
+	}
+	ch.ID = ior.InsertedID.(primitive.ObjectID)
+	return ch, nil
+}
+
+// UserPasskeyRegister completes a WebAuthn registration ceremony and adds the
+// new passkey to the user.
+func (db *DB) UserPasskeyRegister(ctx context.Context, u *User, name string, clientDataJSON, attestationObject []byte) (*Passkey, error) {
+	if len(u.Passkeys) >= MaxPasskeysPerUser {
+		return nil, ErrPasskeyLimitReached
+	}
+	_, challenge, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := db.webAuthnChallengeConsume(ctx, challenge, ChallengeTypeWebAuthnRegister)
+	if err != nil {
+		return nil, err
+	}
+	if ch.UserID != u.ID {
+		return nil, ErrInvalidWebAuthnChallenge
+	}
+	cred, err := webauthn.VerifyRegistration(clientDataJSON, attestationObject, challenge, PasskeyRPID(), PasskeyAllowedOrigins())
+	if err != nil {
+		return nil, err
+	}
+	for _, pk := range u.Passkeys {
+		if bytes.Equal(pk.CredentialID, cred.ID) {
+			return nil, ErrPasskeyExists
+		}
+	}
+	if len(name) > PasskeyNameMaxLen {
+		name = name[:PasskeyNameMaxLen]
+	}
+	pk := Passkey{
+		CredentialID: cred.ID,
+		Name:         name,
+		PublicKey:    cred.PublicKey,
+		AAGUID:       cred.AAGUID,
+		SignCount:    cred.SignCount,
+		CreatedAt:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	// Guard against concurrent registrations going over the limit.
+	filter := bson.M{
+		"_id": u.ID,
+		"passkeys." + strconv.Itoa(MaxPasskeysPerUser-1): bson.M{"$exists": false},
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"passkeys": pk}})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrPasskeyExists
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to add passkey")
+	}
+	if ur.MatchedCount == 0 {
+		return nil, ErrPasskeyLimitReached
+	}
+	u.Passkeys = append(u.Passkeys, pk)
+	return &pk, nil
+}
+
+// UserByPasskeyAssertion completes a WebAuthn authentication ceremony and
+// returns the user who owns the passkey.
+func (db *DB) UserByPasskeyAssertion(ctx context.Context, credentialID, clientDataJSON, authData, signature []byte) (*User, error) {
+	_, challenge, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.webAuthnChallengeConsume(ctx, challenge, ChallengeTypeWebAuthnLogin)
+	if err != nil {
+		return nil, err
+	}
+	var u User
+	err = db.staticUsers.FindOne(ctx, bson.M{"passkeys.credential_id": credentialID}).Decode(&u)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrPasskeyNotFound
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch user")
+	}
+	pk := u.passkey(credentialID)
+	if pk == nil {
+		return nil, ErrPasskeyNotFound
+	}
+	signCount, err := webauthn.VerifyAssertion(pk.PublicKey, clientDataJSON, authData, signature, challenge, PasskeyRPID(), PasskeyAllowedOrigins(), pk.SignCount)
+	if err != nil {
+		return nil, err
+	}
+	// Only update the counter if nobody else used the passkey in the
+	// meantime. Otherwise, we might accept a replayed counter value.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{
+		"_id": u.ID,
+		"passkeys": bson.M{"$elemMatch": bson.M{
+			"credential_id": credentialID,
+			"sign_count":    pk.SignCount,
+		}},
+	}
+	update := bson.M{"$set": bson.M{
+		"passkeys.$.sign_count":   signCount,
+		"passkeys.$.last_used_at": now,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to update passkey")
+	}
+	if ur.MatchedCount == 0 {
+		return nil, webauthn.ErrSignCountRegressed
+	}
+	pk.SignCount = signCount
+	pk.LastUsedAt = now
+	return &u, nil
+}
+
+// UserPasskeyDelete removes the passkey with the given credential ID from the
+// user.
+func (db *DB) UserPasskeyDelete(ctx context.Context, u *User, credentialID []byte) error {
+	filter := bson.M{
+		"_id":                    u.ID,
+		"passkeys.credential_id": credentialID,
+	}
+	update := bson.M{"$pull": bson.M{"passkeys": bson.M{"credential_id": credentialID}}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete passkey")
+	}
+	if ur.ModifiedCount == 0 {
+		return ErrPasskeyNotFound
+	}
+	for i, pk := range u.Passkeys {
+		if bytes.Equal(pk.CredentialID, credentialID) {
+			u.Passkeys = append(u.Passkeys[:i], u.Passkeys[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// UserPasskeyRename changes the name of the passkey with the given credential
+// ID.
+func (db *DB) UserPasskeyRename(ctx context.Context, u *User, credentialID []byte, name string) error {
+	if len(name) > PasskeyNameMaxLen {
+		name = name[:PasskeyNameMaxLen]
+	}
+	filter := bson.M{
+		"_id":                    u.ID,
+		"passkeys.credential_id": credentialID,
+	}
+	update := bson.M{"$set": bson.M{"passkeys.$.name": name}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to rename passkey")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrPasskeyNotFound
+	}
+	if pk := u.passkey(credentialID); pk != nil {
+		pk.Name = name
+	}
+	return nil
+}
+
+// passkey returns a pointer to the user's passkey with the given credential
+// ID or nil if the user doesn't have such a passkey.
+func (u *User) passkey(credentialID []byte) *Passkey {
+	for i := range u.Passkeys {
+		if bytes.Equal(u.Passkeys[i].CredentialID, credentialID) {
+			return &u.Passkeys[i]
+		}
+	}
+	return nil
+}
+
+// webAuthnChallengeConsume fetches the given unexpired challenge from the DB
+// and deletes it, so it can't be used again.
+func (db *DB) webAuthnChallengeConsume(ctx context.Context, challenge []byte, cType string) (*Challenge, error) {
+	filter := bson.M{
+		"challenge":  hex.EncodeToString(challenge),
+		"type":       cType,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	var ch Challenge
+	err := db.staticChallenges.FindOneAndDelete(ctx, filter).Decode(&ch)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidWebAuthnChallenge
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch challenge")
+	}
+	return &ch, nil
+}
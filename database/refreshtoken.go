@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/**
+Refresh tokens allow clients to get new short-lived access JWTs without asking
+the user for their credentials again. Each refresh token can only be used once.
+Using it rotates it, i.e. we mark it as used and issue a new refresh token in
+its place. All refresh tokens which stem from the same login form a family,
+which is identified by the ID of the session they belong to.
+
+We only store the hashes of refresh tokens, so a leaked DB doesn't leak usable
+tokens.
+
+If a refresh token is used a second time, we assume that it has been stolen
+and either the thief or the legitimate user is replaying it. Since we cannot
+tell which one it is, we revoke the entire session, which logs out both of
+them.
+*/
+
+const (
+	// secretTokenSize defines the number of random bytes in a refresh token
+	// and in our other secret tokens.
+	secretTokenSize = 32
+)
+
+var (
+	// RefreshTokenTTL defines the lifetime of a refresh token in seconds. Each
+	// rotation issues a new refresh token with a full lifetime, so a session
+	// only expires if it is left unused for this long.
+	// Can be overridden by the ACCOUNTS_REFRESH_TOKEN_TTL environment variable.
+	RefreshTokenTTL = 720 * 3600
+
+	// ErrInvalidRefreshToken is returned when the given refresh token doesn't
+	// exist, has expired or has been revoked.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token which has already
+	// been used is presented again. When that happens we revoke the token's
+	// session.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken describes a refresh token issued to a user. The token itself is
+// only known to the client, we store its hash.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	SessionID primitive.ObjectID `bson:"session_id" json:"-"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"-"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"-"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"-"`
+	Revoked   bool               `bson:"revoked" json:"-"`
+}
+
+// RefreshTokenCreate issues the first refresh token of the given session. It
+// returns the token which should be handed to the client.
+func (db *DB) RefreshTokenCreate(ctx context.Context, s Session) (string, *RefreshToken, error) {
+	if s.ID.IsZero() || s.UserID.IsZero() {
+		return "", nil, errors.New("invalid session")
+	}
+	return db.refreshTokenCreate(ctx, s.UserID, s.ID)
+}
+
+// RefreshTokenRotate exchanges the given refresh token for a new one in the
+// same session and extends the session. It returns the new token and its
+// record. Presenting a token which has already been used revokes the token's
+// session and returns ErrRefreshTokenReused.
+func (db *DB) RefreshTokenRotate(ctx context.Context, token string) (string, *RefreshToken, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"token_hash": tokenHash(token),
+		"used_at":    bson.M{"$exists": false},
+		"revoked":    false,
+		"expires_at": bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"used_at": now}}
+	sr := db.staticRefreshTokens.FindOneAndUpdate(ctx, filter, update)
+	var rt RefreshToken
+	err := sr.Decode(&rt)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return "", nil, db.refreshTokenRejected(ctx, token)
+	}
+	if err != nil {
+		return "", nil, errors.AddContext(err, "failed to rotate refresh token")
+	}
+	token, newRT, err := db.refreshTokenCreate(ctx, rt.UserID, rt.SessionID)
+	if err != nil {
+		return "", nil, err
+	}
+	err = db.sessionExtend(ctx, rt.SessionID, newRT.ExpiresAt)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return "", nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return token, newRT, nil
+}
+
+// SessionRevokeByRefreshToken revokes the session of the given refresh token.
+// Unknown tokens are ignored.
+func (db *DB) SessionRevokeByRefreshToken(ctx context.Context, token string) error {
+	var rt RefreshToken
+	err := db.staticRefreshTokens.FindOne(ctx, bson.M{"token_hash": tokenHash(token)}).Decode(&rt)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch refresh token")
+	}
+	_, err = db.sessionsRevoke(ctx, bson.M{"_id": rt.SessionID})
+	return err
+}
+
+// refreshTokenRejected figures out why the given refresh token could
+// not be rotated. If the token exists and has already been used, this is a
+// reuse, so we revoke its session.
+func (db *DB) refreshTokenRejected(ctx context.Context, token string) error {
+	var rt RefreshToken
+	err := db.staticRefreshTokens.FindOne(ctx, bson.M{"token_hash": tokenHash(token)}).Decode(&rt)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch refresh token")
+	}
+	if rt.UsedAt == nil || rt.Revoked {
+		return ErrInvalidRefreshToken
+	}
+	_, err = db.sessionsRevoke(ctx, bson.M{"_id": rt.SessionID})
+	if err != nil {
+		db.staticLogger.Warnf("Failed to revoke session %s after a refresh token reuse: %v", rt.SessionID.Hex(), err)
+	}
+	return ErrRefreshTokenReused
+}
+
+// refreshTokenCreate generates a new refresh token in the given session and
+// stores its hash.
+func (db *DB) refreshTokenCreate(ctx context.Context, userID, sessionID primitive.ObjectID) (string, *RefreshToken, error) {
+	token := newSecretToken()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	rt := &RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenHash: tokenHash(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(RefreshTokenTTL) * time.Second),
+	}
+	ior, err := db.staticRefreshTokens.InsertOne(ctx, rt)
+	if err != nil {
+		return "", nil, errors.AddContext(err, "failed to store refresh token")
+	}
+	rt.ID = ior.InsertedID.(primitive.ObjectID)
+	return token, rt, nil
+}
+
+// newSecretToken generates a new random token which is safe to use in URLs
+// and headers.
+func newSecretToken() string {
+	return base64.RawURLEncoding.EncodeToString(fastrand.Bytes(secretTokenSize))
+}
+
+// tokenHash returns the hex-encoded hash under which we store the given
+// secret token, e.g. a refresh token.
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
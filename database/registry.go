@@ -2,56 +2,182 @@ package database
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// RegistryRead describes a single registry read by a user.
-type RegistryRead struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
-	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
-}
+const (
+	// registryUsageBucketSize defines the time span covered by a single
+	// registry usage record.
+	registryUsageBucketSize = time.Hour
+)
+
+var (
+	// registryUsageFlushInterval defines how often we flush the buffered
+	// registry usage counts to the DB.
+	registryUsageFlushInterval = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  100 * time.Millisecond,
+			Standard: 10 * time.Second,
+		},
+	).(time.Duration)
+)
+
+type (
+	// RegistryUsage describes the number of registry reads and writes a user
+	// made within a given time bucket.
+	RegistryUsage struct {
+		ID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+		UserID primitive.ObjectID `bson:"user_id" json:"userId"`
+		Bucket time.Time          `bson:"bucket" json:"bucket"`
+		Reads  int64              `bson:"reads" json:"reads"`
+		Writes int64              `bson:"writes" json:"writes"`
+	}
+
+	// registryUsageKey identifies the registry usage of a user within a given
+	// time bucket.
+	registryUsageKey struct {
+		UserID primitive.ObjectID
+		Bucket time.Time
+	}
 
-// RegistryWrite describes a single registry write by a user.
-type RegistryWrite struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
-	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	// registryUsageCounts holds the buffered number of registry reads and
+	// writes for a given registryUsageKey.
+	registryUsageCounts struct {
+		Reads  int64
+		Writes int64
+	}
+
+	// registryAggregator buffers the registry reads and writes of all users
+	// in memory and periodically flushes them to the DB, so we don't need to
+	// hit the DB on every registry call.
+	registryAggregator struct {
+		counts map[registryUsageKey]registryUsageCounts
+		mu     sync.Mutex
+	}
+)
+
+// newRegistryAggregator creates a new registryAggregator.
+func newRegistryAggregator() *registryAggregator {
+	return &registryAggregator{
+		counts: make(map[registryUsageKey]registryUsageCounts),
+	}
 }
 
-// RegistryReadCreate registers a new registry read.
-func (db *DB) RegistryReadCreate(ctx context.Context, user User) (*RegistryRead, error) {
-	if user.ID.IsZero() {
-		return nil, errors.New("invalid user")
+// add buffers the given number of reads and writes for the given user.
+func (ra *registryAggregator) add(userID primitive.ObjectID, reads, writes int64) {
+	key := registryUsageKey{
+		UserID: userID,
+		Bucket: time.Now().UTC().Truncate(registryUsageBucketSize),
 	}
-	rr := RegistryRead{
-		UserID:    user.ID,
-		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+	ra.mu.Lock()
+	c := ra.counts[key]
+	c.Reads += reads
+	c.Writes += writes
+	ra.counts[key] = c
+	ra.mu.Unlock()
+}
+
+// drain returns all buffered counts and resets the buffer.
+func (ra *registryAggregator) drain() map[registryUsageKey]registryUsageCounts {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	counts := ra.counts
+	ra.counts = make(map[registryUsageKey]registryUsageCounts)
+	return counts
+}
+
+// restore puts back counts we failed to flush, so we can retry later.
+func (ra *registryAggregator) restore(counts map[registryUsageKey]registryUsageCounts) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for key, c := range counts {
+		existing := ra.counts[key]
+		existing.Reads += c.Reads
+		existing.Writes += c.Writes
+		ra.counts[key] = existing
 	}
-	ior, err := db.staticRegistryReads.InsertOne(ctx, rr)
-	if err != nil {
-		return nil, err
+}
+
+// RegistryReadTrack registers a new registry read by the given user. The read
+// is buffered in memory and flushed to the DB with the next flush.
+func (db *DB) RegistryReadTrack(user User) error {
+	if user.ID.IsZero() {
+		return errors.New("invalid user")
 	}
-	rr.ID = ior.InsertedID.(primitive.ObjectID)
-	return &rr, nil
+	db.staticRegistryAggregator.add(user.ID, 1, 0)
+	return nil
 }
 
-// RegistryWriteCreate registers a new registry write.
-func (db *DB) RegistryWriteCreate(ctx context.Context, user User) (*RegistryWrite, error) {
+// RegistryWriteTrack registers a new registry write by the given user. The
+// write is buffered in memory and flushed to the DB with the next flush.
+func (db *DB) RegistryWriteTrack(user User) error {
 	if user.ID.IsZero() {
-		return nil, errors.New("invalid user")
+		return errors.New("invalid user")
+	}
+	db.staticRegistryAggregator.add(user.ID, 0, 1)
+	return nil
+}
+
+// RegistryUsageFlush writes all buffered registry reads and writes to the DB.
+// Counts which we fail to write remain buffered for the next flush.
+func (db *DB) RegistryUsageFlush(ctx context.Context) error {
+	counts := db.staticRegistryAggregator.drain()
+	if len(counts) == 0 {
+		return nil
 	}
-	rw := RegistryWrite{
-		UserID:    user.ID,
-		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+	keys := make([]registryUsageKey, 0, len(counts))
+	models := make([]mongo.WriteModel, 0, len(counts))
+	for key, c := range counts {
+		keys = append(keys, key)
+		filter := bson.M{
+			"user_id": key.UserID,
+			"bucket":  key.Bucket,
+		}
+		update := bson.M{"$inc": bson.M{
+			"reads":  c.Reads,
+			"writes": c.Writes,
+		}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
 	}
-	ior, err := db.staticRegistryWrites.InsertOne(ctx, rw)
+	opts := options.BulkWrite().SetOrdered(false)
+	_, err := db.staticRegistryUsage.BulkWrite(ctx, models, opts)
 	if err != nil {
-		return nil, err
+		// If we know exactly which updates failed we only restore those.
+		// Otherwise, we restore all of them.
+		failed := counts
+		if bwe, ok := err.(mongo.BulkWriteException); ok && len(bwe.WriteErrors) > 0 {
+			failed = make(map[registryUsageKey]registryUsageCounts)
+			for _, we := range bwe.WriteErrors {
+				failed[keys[we.Index]] = counts[keys[we.Index]]
+			}
+		}
+		db.staticRegistryAggregator.restore(failed)
+		return errors.AddContext(err, "failed to flush registry usage")
+	}
+	return nil
+}
+
+// threadedFlushRegistryUsage periodically flushes the buffered registry usage
+// to the DB until the context is closed.
+func (db *DB) threadedFlushRegistryUsage(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(registryUsageFlushInterval):
+		}
+		err := db.RegistryUsageFlush(ctx)
+		if err != nil {
+			db.staticLogger.Warnln("Failed to flush registry usage:", err)
+		}
 	}
-	rw.ID = ior.InsertedID.(primitive.ObjectID)
-	return &rw, nil
 }
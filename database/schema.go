@@ -15,12 +15,29 @@ var (
 				Keys:    bson.M{"sub": 1},
 				Options: options.Index().SetName("sub_unique").SetUnique(true),
 			},
+			{
+				Keys: bson.M{"passkeys.credential_id": 1},
+				Options: options.Index().SetName("passkeys_credential_id_unique").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"passkeys.credential_id": bson.M{"$exists": true}}),
+			},
+			{
+				Keys:    bson.M{"delete_at": 1},
+				Options: options.Index().SetName("delete_at").SetSparse(true),
+			},
+			{
+				Keys:    bson.M{"restore_token": 1},
+				Options: options.Index().SetName("restore_token_unique").SetUnique(true).SetSparse(true),
+			},
 		},
 		collSkylinks: {
 			{
 				Keys:    bson.M{"skylink": 1},
 				Options: options.Index().SetName("skylink_unique").SetUnique(true),
 			},
+			{
+				Keys:    bson.M{"size": 1},
+				Options: options.Index().SetName("size"),
+			},
 		},
 		collUploads: {
 			{
@@ -31,6 +48,22 @@ var (
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"unpinned", 1}, {"timestamp", -1}},
+				Options: options.Index().SetName("user_id_unpinned_timestamp"),
+			},
+			{
+				Keys:    bson.D{{"timestamp", -1}, {"_id", -1}},
+				Options: options.Index().SetName("timestamp"),
+			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", 1}, {"_id", 1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
+			{
+				Keys:    bson.D{{"uploader_ip", 1}, {"user_id", 1}},
+				Options: options.Index().SetName("uploader_ip_user_id"),
+			},
 		},
 		collDownloads: {
 			{
@@ -41,6 +74,10 @@ var (
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"created_at", -1}, {"_id", -1}},
+				Options: options.Index().SetName("user_id_created_at"),
+			},
 		},
 		collEmails: {
 			{
@@ -92,13 +129,122 @@ var (
 		},
 		collAPIKeys: {
 			{
-				Keys:    bson.M{"key": 1},
-				Options: options.Index().SetName("key_unique").SetUnique(true),
+				Keys: bson.M{"key_hash": 1},
+				// Records created before we started hashing API keys don't
+				// have a hash until they get migrated.
+				Options: options.Index().SetName("key_hash_unique").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"key_hash": bson.M{"$exists": true}}),
 			},
 			{
 				Keys:    bson.M{"user_id": 1},
 				Options: options.Index().SetName("user_id"),
 			},
 		},
+		collRegistryUsage: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"bucket", 1}},
+				Options: options.Index().SetName("user_id_bucket_unique").SetUnique(true),
+			},
+		},
+		collUsageRollups: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"day", 1}},
+				Options: options.Index().SetName("user_id_day_unique").SetUnique(true),
+			},
+		},
+		collRefreshTokens: {
+			{
+				Keys:    bson.M{"token_hash": 1},
+				Options: options.Index().SetName("token_hash_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"session_id": 1},
+				Options: options.Index().SetName("session_id"),
+			},
+			{
+				Keys:    bson.M{"user_id": 1},
+				Options: options.Index().SetName("user_id"),
+			},
+			{
+				// Expired refresh tokens are useless, so we let MongoDB
+				// remove them for us.
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
+		},
+		collSessions: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"last_seen_at", -1}},
+				Options: options.Index().SetName("user_id_last_seen_at"),
+			},
+			{
+				Keys:    bson.M{"revoked_at": 1},
+				Options: options.Index().SetName("revoked_at").SetSparse(true),
+			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
+		},
+		collTwoFactorLogins: {
+			{
+				Keys:    bson.M{"token_hash": 1},
+				Options: options.Index().SetName("token_hash_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
+		},
+		collLoginAttempts: {
+			{
+				Keys:    bson.D{{"scope", 1}, {"email", 1}, {"ip", 1}},
+				Options: options.Index().SetName("scope_email_ip_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"blocked_until": 1},
+				Options: options.Index().SetName("blocked_until"),
+			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+			},
+		},
+		collAuditEvents: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("user_id_created_at"),
+			},
+			{
+				Keys:    bson.D{{"actor", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("actor_created_at"),
+			},
+			{
+				Keys:    bson.D{{"action", 1}, {"created_at", -1}},
+				Options: options.Index().SetName("action_created_at"),
+			},
+			{
+				Keys:    bson.D{{"created_at", -1}},
+				Options: options.Index().SetName("created_at"),
+			},
+		},
+		collMetaFetcherJobs: {
+			{
+				Keys:    bson.M{"skylink_id": 1},
+				Options: options.Index().SetName("skylink_id_unique").SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"locked_by": 1},
+				Options: options.Index().SetName("locked_by"),
+			},
+			{
+				Keys:    bson.M{"attempts": 1},
+				Options: options.Index().SetName("attempts"),
+			},
+			{
+				Keys:    bson.M{"next_attempt_at": 1},
+				Options: options.Index().SetName("next_attempt_at"),
+			},
+		},
 	}
 )
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+A session starts when a user logs in and ends when they log out, when it gets
+revoked or when it's left unused for longer than the refresh token TTL. All
+JWTs issued within a session carry its ID in their `jti` claim and all refresh
+tokens issued within it form a single token family. This allows us to revoke
+a session's JWTs before they expire.
+*/
+
+const (
+	// sessionTouchInterval defines how often we update a session's last seen
+	// time while it's being used.
+	sessionTouchInterval = time.Minute
+)
+
+// Session describes a single login session of a user.
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+	UserAgent  string             `bson:"user_agent" json:"userAgent"`
+	IP         string             `bson:"ip" json:"ip"`
+	CreatedAt  time.Time          `bson:"created_at" json:"createdAt"`
+	LastSeenAt time.Time          `bson:"last_seen_at" json:"lastSeenAt"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expiresAt"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"-"`
+}
+
+// SessionCreate starts a new session for the given user.
+func (db *DB) SessionCreate(ctx context.Context, user User, userAgent, ip string) (*Session, error) {
+	if user.ID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	s := &Session{
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(RefreshTokenTTL) * time.Second),
+	}
+	ior, err := db.staticSessions.InsertOne(ctx, s)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create session")
+	}
+	s.ID = ior.InsertedID.(primitive.ObjectID)
+	return s, nil
+}
+
+// SessionByID returns the session with the given ID.
+func (db *DB) SessionByID(ctx context.Context, id primitive.ObjectID) (*Session, error) {
+	var s Session
+	err := db.staticSessions.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SessionTouch updates the session's last seen time and IP. It only writes to
+// the DB if the session hasn't been touched in the last sessionTouchInterval.
+func (db *DB) SessionTouch(ctx context.Context, id primitive.ObjectID, ip string) error {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":          id,
+		"last_seen_at": bson.M{"$lt": now.Add(-sessionTouchInterval)},
+	}
+	update := bson.M{"$set": bson.M{"last_seen_at": now, "ip": ip}}
+	_, err := db.staticSessions.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to touch session")
+	}
+	return nil
+}
+
+// SessionsByUser returns all active sessions of the given user, most recently
+// used first.
+func (db *DB) SessionsByUser(ctx context.Context, user User) ([]Session, error) {
+	if user.ID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	filter := bson.M{
+		"user_id":    user.ID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	opts := options.Find().SetSort(bson.D{{"last_seen_at", -1}, {"_id", -1}})
+	c, err := db.staticSessions.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch sessions")
+	}
+	// We want this to be a make in order to make sure its JSON representation
+	// is a valid JSONArray and not a null.
+	sessions := make([]Session, 0)
+	err = c.All(ctx, &sessions)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode sessions")
+	}
+	return sessions, nil
+}
+
+// SessionRevoke revokes the given session of the given user. It returns
+// mongo.ErrNoDocuments if the user has no such active session.
+func (db *DB) SessionRevoke(ctx context.Context, user User, id primitive.ObjectID) error {
+	filter := bson.M{
+		"_id":        id,
+		"user_id":    user.ID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	n, err := db.sessionsRevoke(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// SessionsRevokeAll revokes all sessions of the given user. It returns the
+// number of revoked sessions.
+func (db *DB) SessionsRevokeAll(ctx context.Context, user User) (int64, error) {
+	if user.ID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	filter := bson.M{
+		"user_id":    user.ID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	return db.sessionsRevoke(ctx, filter)
+}
+
+// SessionsRevokedSince returns all sessions revoked at or after the given
+// moment. Only the ID and revocation time of the returned sessions are set.
+func (db *DB) SessionsRevokedSince(ctx context.Context, since time.Time) ([]Session, error) {
+	filter := bson.M{"revoked_at": bson.M{"$gte": since}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "revoked_at": 1})
+	c, err := db.staticSessions.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch revoked sessions")
+	}
+	var sessions []Session
+	err = c.All(ctx, &sessions)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode sessions")
+	}
+	return sessions, nil
+}
+
+// sessionExtend marks the session as seen now and extends its expiration to a
+// full refresh token TTL from now. It returns mongo.ErrNoDocuments if the
+// session doesn't exist or has been revoked.
+func (db *DB) sessionExtend(ctx context.Context, id primitive.ObjectID, expiresAt time.Time) error {
+	filter := bson.M{
+		"_id":        id,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{
+		"last_seen_at": time.Now().UTC(),
+		"expires_at":   expiresAt,
+	}}
+	ur, err := db.staticSessions.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to extend session")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// sessionsRevoke revokes all sessions matching the given filter together with
+// their refresh tokens. It returns the number of revoked sessions.
+func (db *DB) sessionsRevoke(ctx context.Context, filter bson.M) (int64, error) {
+	c, err := db.staticSessions.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch sessions")
+	}
+	var sessions []Session
+	err = c.All(ctx, &sessions)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode sessions")
+	}
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(sessions))
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+	now := time.Now().UTC()
+	idFilter := bson.M{"_id": bson.M{"$in": ids}, "revoked_at": bson.M{"$exists": false}}
+	ur, err := db.staticSessions.UpdateMany(ctx, idFilter, bson.M{"$set": bson.M{"revoked_at": now}})
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to revoke sessions")
+	}
+	_, err = db.staticRefreshTokens.UpdateMany(ctx, bson.M{"session_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to revoke refresh tokens")
+	}
+	return ur.ModifiedCount, nil
+}
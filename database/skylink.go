@@ -3,11 +3,13 @@ package database
 import (
 	"context"
 	"regexp"
+	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -21,12 +23,27 @@ var (
 	extractSkylinkRE = regexp.MustCompile("^.*([a-z0-9]{55})|([a-zA-Z0-9-_]{46}).*$")
 )
 
-// Skylink represents a skylink object in the DB.
-type Skylink struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
-	Skylink string             `bson:"skylink" json:"skylink"`
-	Size    int64              `bson:"size" json:"size"`
-}
+type (
+	// Skylink represents a skylink object in the DB.
+	Skylink struct {
+		ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+		Skylink string             `bson:"skylink" json:"skylink"`
+		Size    int64              `bson:"size" json:"size"`
+
+		SkylinkMetadata `bson:",inline"`
+	}
+
+	// SkylinkMetadata holds the parts of a skyfile's metadata we store in the
+	// DB in addition to its name and size.
+	SkylinkMetadata struct {
+		ContentType   string `bson:"content_type,omitempty" json:"contentType"`
+		DefaultPath   string `bson:"default_path,omitempty" json:"defaultPath"`
+		SubfilesCount int    `bson:"subfiles_count,omitempty" json:"subfilesCount"`
+		SubfilesSize  int64  `bson:"subfiles_size,omitempty" json:"subfilesSize"`
+		// FetchedAt is the moment we first fetched the skyfile's metadata.
+		FetchedAt time.Time `bson:"fetched_at,omitempty" json:"fetchedAt"`
+	}
+)
 
 // Skylink gets the DB object for the given skylink.
 // If it doesn't exist it creates it.
@@ -81,10 +98,62 @@ func (db *DB) SkylinkUpdate(ctx context.Context, id primitive.ObjectID, name str
 	if size > 0 {
 		updates["size"] = size
 	}
-	_, err := db.staticSkylinks.UpdateOne(ctx, filter, bson.M{"$set": updates})
+	return db.skylinkUpdate(ctx, filter, bson.M{"$set": updates})
+}
+
+// SkylinkMetadataUpdate updates the metadata about the given skylink, in the
+// same way SkylinkUpdate does, and additionally stores the given extended
+// metadata. The FetchedAt timestamp is only set the first time we fetch the
+// skylink's metadata.
+func (db *DB) SkylinkMetadataUpdate(ctx context.Context, id primitive.ObjectID, name string, size int64, meta SkylinkMetadata) error {
+	filter := bson.M{"_id": id}
+	updates := bson.M{
+		"content_type":   meta.ContentType,
+		"default_path":   meta.DefaultPath,
+		"subfiles_count": meta.SubfilesCount,
+		"subfiles_size":  meta.SubfilesSize,
+	}
+	if name != "" {
+		updates["name"] = name
+	}
+	if size > 0 {
+		updates["size"] = size
+	}
+	fetchedAt := meta.FetchedAt
+	if fetchedAt.IsZero() {
+		fetchedAt = time.Now().UTC()
+	}
+	update := bson.M{
+		"$set": updates,
+		// $min only sets the value if the field is missing or holds a later
+		// timestamp, so we keep the moment of the first fetch.
+		"$min": bson.M{"fetched_at": fetchedAt.Truncate(time.Millisecond)},
+	}
+	return db.skylinkUpdate(ctx, filter, update)
+}
+
+// skylinkUpdate applies the given update to the skylink matching the filter.
+// If the update changes the skylink's size it also updates the usage rollups
+// of everyone who uploaded or downloaded it.
+func (db *DB) skylinkUpdate(ctx context.Context, filter, update bson.M) error {
+	var before Skylink
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := db.staticSkylinks.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil
+	}
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
 	}
+	set, _ := update["$set"].(bson.M)
+	size, ok := set["size"].(int64)
+	if !ok || size == before.Size {
+		return nil
+	}
+	err = db.usageRollupSkylinkResize(ctx, before.ID, before.Size, size)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to update usage rollups after resizing skylink %s: %v", before.Skylink, err)
+	}
 	return nil
 }
 
@@ -102,6 +171,76 @@ func (db *DB) SkylinkDownloadsUpdate(ctx context.Context, id primitive.ObjectID,
 	return nil
 }
 
+// SkylinksWithUnknownSize returns the IDs of all skylinks which are referenced
+// by at least one upload or download but whose size we still don't know.
+//
+// The Mongo query we want to ultimately execute is:
+//
+//	db.skylinks.aggregate([
+//		{ $match: { size: { $in: [ 0, null ] } } },
+//		{ $lookup: {
+//			from: "uploads",
+//			let: { skylinkId: "$_id" },
+//			pipeline: [
+//				{ $match: { $expr: { $eq: [ "$skylink_id", "$$skylinkId" ] } } },
+//				{ $limit: 1 },
+//				{ $project: { _id: 1 } }
+//			],
+//			as: "ups"
+//		} },
+//		{ $lookup: { from: "downloads", ... the same as above ..., as: "downs" } },
+//		{ $match: { $or: [ { "ups.0": { $exists: true } }, { "downs.0": { $exists: true } } ] } },
+//		{ $project: { _id: 1 } }
+//	])
+//
+// We only need to know whether a skylink is referenced at all, so each lookup
+// returns at most one projected document. This keeps the intermediate
+// documents small, no matter how popular the skylink is.
+func (db *DB) SkylinksWithUnknownSize(ctx context.Context) ([]primitive.ObjectID, error) {
+	matchStage := bson.D{{"$match", bson.D{{"size", bson.D{{"$in", bson.A{0, nil}}}}}}}
+	lookupUploadsStage := lookupReferencedStage(collUploads, "ups")
+	lookupDownloadsStage := lookupReferencedStage(collDownloads, "downs")
+	referencedStage := bson.D{{"$match", bson.D{{"$or", bson.A{
+		bson.D{{"ups.0", bson.D{{"$exists", true}}}},
+		bson.D{{"downs.0", bson.D{{"$exists", true}}}},
+	}}}}}
+	projectStage := bson.D{{"$project", bson.D{{"_id", 1}}}}
+
+	pipeline := mongo.Pipeline{matchStage, lookupUploadsStage, lookupDownloadsStage, referencedStage, projectStage}
+	c, err := db.staticSkylinks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find skylinks with unknown size")
+	}
+	var sls []Skylink
+	err = c.All(ctx, &sls)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse value from DB")
+	}
+	ids := make([]primitive.ObjectID, 0, len(sls))
+	for _, sl := range sls {
+		ids = append(ids, sl.ID)
+	}
+	return ids, nil
+}
+
+// lookupReferencedStage returns a lookup stage which adds to each skylink an
+// array with the ID of at most one document in the given collection which
+// references it.
+func lookupReferencedStage(coll, as string) bson.D {
+	return bson.D{
+		{"$lookup", bson.D{
+			{"from", coll},
+			{"let", bson.D{{"skylinkId", "$_id"}}},
+			{"pipeline", mongo.Pipeline{
+				bson.D{{"$match", bson.D{{"$expr", bson.D{{"$eq", bson.A{"$skylink_id", "$$skylinkId"}}}}}}},
+				bson.D{{"$limit", 1}},
+				bson.D{{"$project", bson.D{{"_id", 1}}}},
+			}},
+			{"as", as},
+		}},
+	}
+}
+
 // ExtractSkylink extracts the skylink from the given skylink URL that might
 // have protocol, path, etc. within it.
 func ExtractSkylink(skylink string) (string, error) {
@@ -0,0 +1,399 @@
+package database
+
+import (
+	"context"
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/totp"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+Users can protect their password logins with a second factor, a TOTP (RFC 6238)
+generated by an authenticator app. Enrollment happens in two steps - first we
+generate a pending secret and then the user confirms it by sending us a valid
+code. On confirmation we generate a set of one-time recovery codes which the
+user can use instead of a TOTP if they lose their device.
+
+Once enrolled, a correct email and password only start a two-factor login. The
+user completes it by sending a valid code together with the two-factor login's
+token.
+
+Each two-factor login only accepts a few wrong codes but an attacker who knows
+the password can start as many of them as they like. That's why we also count
+the wrong codes per account and lock the account's second factor once there
+are too many of them.
+*/
+
+const (
+	// TwoFactorLoginTTL defines how long a user has to complete a two-factor
+	// login.
+	TwoFactorLoginTTL = 5 * time.Minute
+	// TwoFactorLoginMaxAttempts defines how many wrong codes we accept for a
+	// two-factor login before we invalidate it.
+	TwoFactorLoginMaxAttempts = 5
+	// TwoFactorMaxFailures defines how many wrong codes we accept for an
+	// account across all of its two-factor logins before we lock its second
+	// factor for TwoFactorLockoutDuration.
+	TwoFactorMaxFailures = 10
+
+	// totpRecoveryCodesCount defines how many recovery codes we generate.
+	totpRecoveryCodesCount = 10
+	// totpRecoveryCodeSize defines the number of random bytes in a recovery
+	// code.
+	totpRecoveryCodeSize = 5
+)
+
+var (
+	// TwoFactorLockoutDuration defines how long we reject all two-factor
+	// logins of an account after too many wrong codes.
+	TwoFactorLockoutDuration = build.Select(build.Var{
+		Dev:      time.Minute,
+		Testing:  3 * time.Second,
+		Standard: time.Hour,
+	}).(time.Duration)
+
+	// ErrInvalidTOTPCode is returned when the given TOTP or recovery code is
+	// not valid.
+	ErrInvalidTOTPCode = errors.New("invalid two-factor code")
+	// ErrInvalidTwoFactorLogin is returned when the two-factor login doesn't
+	// exist, has expired or has been used up.
+	ErrInvalidTwoFactorLogin = errors.New("invalid or expired two-factor login")
+	// ErrTwoFactorLocked is returned when the account's second factor is
+	// locked after too many wrong codes.
+	ErrTwoFactorLocked = errors.New("too many failed two-factor attempts, please try again later")
+	// ErrTOTPAlreadyEnabled is returned when the user tries to enroll a TOTP
+	// while already having one.
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTOTPNotEnabled is returned when the user tries to disable two-factor
+	// authentication without having it enabled.
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrTOTPNotPending is returned when the user tries to confirm a TOTP
+	// enrollment which they haven't started.
+	ErrTOTPNotPending = errors.New("no pending two-factor enrollment")
+
+	// totpRecoveryEncoding is the encoding of recovery codes. Base32 is easy
+	// to read and type.
+	totpRecoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TwoFactorLogin describes a login which passed the password check and awaits
+// its second factor.
+type TwoFactorLogin struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	TokenHash string             `bson:"token_hash"`
+	JWTTTL    int                `bson:"jwt_ttl"`
+	Attempts  int                `bson:"attempts"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// TwoFactorEnabled returns true if the user has enrolled a second factor.
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// UserTOTPEnrollStart generates a new pending TOTP secret for the user. It
+// returns the secret and its provisioning URI. Starting a new enrollment
+// replaces any previous pending one.
+func (db *DB) UserTOTPEnrollStart(ctx context.Context, u *User) (string, string, error) {
+	if u.TwoFactorEnabled() {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	secret := totp.GenerateSecret()
+	filter := bson.M{"_id": u.ID, "totp_secret": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"totp_pending_secret": secret}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return "", "", errors.AddContext(err, "failed to store pending TOTP secret")
+	}
+	if ur.MatchedCount == 0 {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	u.TOTPPendingSecret = secret
+	account := u.Email.String()
+	if account == "" {
+		account = u.Sub
+	}
+	return secret, totp.ProvisioningURI(secret, totpIssuer(), account), nil
+}
+
+// UserTOTPEnrollConfirm completes the user's pending TOTP enrollment if the
+// given code is valid. It returns the user's recovery codes. This is the only
+// time we have them in plaintext.
+func (db *DB) UserTOTPEnrollConfirm(ctx context.Context, u *User, code string) ([]string, error) {
+	if u.TwoFactorEnabled() {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if u.TOTPPendingSecret == "" {
+		return nil, ErrTOTPNotPending
+	}
+	step, ok, err := totp.Validate(u.TOTPPendingSecret, code, time.Now(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+	codes, hashes := generateRecoveryCodes()
+	filter := bson.M{
+		"_id":                 u.ID,
+		"totp_pending_secret": u.TOTPPendingSecret,
+		"totp_secret":         bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"totp_secret":         u.TOTPPendingSecret,
+			"totp_last_step":      step,
+			"totp_recovery_codes": hashes,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to enable TOTP")
+	}
+	if ur.MatchedCount == 0 {
+		return nil, ErrTOTPNotPending
+	}
+	u.TOTPSecret = u.TOTPPendingSecret
+	u.TOTPPendingSecret = ""
+	u.TOTPLastStep = step
+	u.TOTPRecoveryCodes = hashes
+	return codes, nil
+}
+
+// UserTOTPVerify checks the given code against the user's second factor. The
+// code can be either a TOTP or one of the user's recovery codes. Each code
+// can only be used once.
+func (db *DB) UserTOTPVerify(ctx context.Context, u *User, code string) error {
+	if !u.TwoFactorEnabled() {
+		return ErrTOTPNotEnabled
+	}
+	step, ok, err := totp.Validate(u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// Only accept the code if no code from the same or a later time step
+		// has been used in the meantime.
+		filter := bson.M{"_id": u.ID, "totp_last_step": bson.M{"$lt": step}}
+		ur, err := db.staticUsers.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_step": step}})
+		if err != nil {
+			return errors.AddContext(err, "failed to update TOTP step")
+		}
+		if ur.ModifiedCount == 0 {
+			return ErrInvalidTOTPCode
+		}
+		u.TOTPLastStep = step
+		return nil
+	}
+	// Try the code as a recovery code. Pulling it from the list ensures it
+	// can only be used once.
+	h := tokenHash(normalizeRecoveryCode(code))
+	filter := bson.M{"_id": u.ID, "totp_recovery_codes": h}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"totp_recovery_codes": h}})
+	if err != nil {
+		return errors.AddContext(err, "failed to use recovery code")
+	}
+	if ur.ModifiedCount == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// UserTOTPCheck checks the given code against the user's second factor, just
+// like UserTOTPVerify, but it refuses to check codes while the second factor
+// is locked and counts wrong codes towards locking it.
+func (db *DB) UserTOTPCheck(ctx context.Context, u *User, code string) error {
+	if u.TOTPLockedUntil != nil && u.TOTPLockedUntil.After(time.Now().UTC()) {
+		return ErrTwoFactorLocked
+	}
+	err := db.UserTOTPVerify(ctx, u, code)
+	if errors.Contains(err, ErrInvalidTOTPCode) {
+		return errors.Compose(err, db.twoFactorFailed(ctx, u))
+	}
+	if err != nil {
+		return err
+	}
+	if u.TOTPFailures > 0 {
+		update := bson.M{"$unset": bson.M{"totp_failures": ""}}
+		_, err = db.staticUsers.UpdateOne(ctx, bson.M{"_id": u.ID}, update)
+		if err != nil {
+			return errors.AddContext(err, "failed to reset two-factor failures")
+		}
+		u.TOTPFailures = 0
+	}
+	return nil
+}
+
+// UserTOTPDisable removes the user's second factor.
+func (db *DB) UserTOTPDisable(ctx context.Context, u *User) error {
+	if !u.TwoFactorEnabled() {
+		return ErrTOTPNotEnabled
+	}
+	update := bson.M{"$unset": bson.M{
+		"totp_secret":         "",
+		"totp_pending_secret": "",
+		"totp_last_step":      "",
+		"totp_recovery_codes": "",
+		"totp_failures":       "",
+		"totp_locked_until":   "",
+	}}
+	_, err := db.staticUsers.UpdateOne(ctx, bson.M{"_id": u.ID}, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to disable TOTP")
+	}
+	u.TOTPSecret = ""
+	u.TOTPPendingSecret = ""
+	u.TOTPLastStep = 0
+	u.TOTPRecoveryCodes = nil
+	u.TOTPFailures = 0
+	u.TOTPLockedUntil = nil
+	return nil
+}
+
+// TwoFactorLoginCreate starts a two-factor login for the given user. It
+// returns the token with which the user can complete it.
+func (db *DB) TwoFactorLoginCreate(ctx context.Context, u User, jwtTTL int) (string, *TwoFactorLogin, error) {
+	if u.ID.IsZero() {
+		return "", nil, errors.New("invalid user")
+	}
+	token := newSecretToken()
+	tfl := &TwoFactorLogin{
+		UserID:    u.ID,
+		TokenHash: tokenHash(token),
+		JWTTTL:    jwtTTL,
+		ExpiresAt: time.Now().UTC().Add(TwoFactorLoginTTL).Truncate(time.Millisecond),
+	}
+	ior, err := db.staticTwoFactorLogins.InsertOne(ctx, tfl)
+	if err != nil {
+		return "", nil, errors.AddContext(err, "failed to create two-factor login")
+	}
+	tfl.ID = ior.InsertedID.(primitive.ObjectID)
+	return token, tfl, nil
+}
+
+// TwoFactorLoginUser returns the user of the active two-factor login with the
+// given token.
+func (db *DB) TwoFactorLoginUser(ctx context.Context, token string) (*User, error) {
+	filter := bson.M{
+		"token_hash": tokenHash(token),
+		"attempts":   bson.M{"$lt": TwoFactorLoginMaxAttempts},
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	var tfl TwoFactorLogin
+	err := db.staticTwoFactorLogins.FindOne(ctx, filter).Decode(&tfl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidTwoFactorLogin
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch two-factor login")
+	}
+	return db.UserByID(ctx, tfl.UserID)
+}
+
+// TwoFactorLoginComplete completes the two-factor login with the given token
+// if the given code is valid. It returns the user who logged in and the
+// two-factor login. Each wrong code counts as an attempt and we invalidate the
+// two-factor login after TwoFactorLoginMaxAttempts attempts. Wrong codes also
+// count towards the account's TwoFactorMaxFailures.
+func (db *DB) TwoFactorLoginComplete(ctx context.Context, token, code string) (*User, *TwoFactorLogin, error) {
+	filter := bson.M{
+		"token_hash": tokenHash(token),
+		"attempts":   bson.M{"$lt": TwoFactorLoginMaxAttempts},
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+	// Count the attempt before checking the code, so concurrent requests
+	// can't exceed the allowed number of attempts.
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var tfl TwoFactorLogin
+	err := db.staticTwoFactorLogins.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"attempts": 1}}, opts).Decode(&tfl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, nil, ErrInvalidTwoFactorLogin
+	}
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to fetch two-factor login")
+	}
+	u, err := db.UserByID(ctx, tfl.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.UserTOTPCheck(ctx, u, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = db.staticTwoFactorLogins.DeleteOne(ctx, bson.M{"_id": tfl.ID})
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to delete two-factor login")
+	}
+	return u, &tfl, nil
+}
+
+// twoFactorFailed counts a wrong two-factor code for the given user. Once the
+// user reaches TwoFactorMaxFailures, it locks their second factor for
+// TwoFactorLockoutDuration and starts counting anew.
+func (db *DB) twoFactorFailed(ctx context.Context, u *User) error {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated User
+	err := db.staticUsers.FindOneAndUpdate(ctx, bson.M{"_id": u.ID}, bson.M{"$inc": bson.M{"totp_failures": 1}}, opts).Decode(&updated)
+	if err != nil {
+		return errors.AddContext(err, "failed to count two-factor failure")
+	}
+	u.TOTPFailures = updated.TOTPFailures
+	if u.TOTPFailures < TwoFactorMaxFailures {
+		return nil
+	}
+	lockedUntil := time.Now().UTC().Add(TwoFactorLockoutDuration).Truncate(time.Millisecond)
+	filter := bson.M{"_id": u.ID, "totp_failures": bson.M{"$gte": TwoFactorMaxFailures}}
+	update := bson.M{
+		"$set":   bson.M{"totp_locked_until": lockedUntil},
+		"$unset": bson.M{"totp_failures": ""},
+	}
+	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to lock second factor")
+	}
+	u.TOTPFailures = 0
+	u.TOTPLockedUntil = &lockedUntil
+	return nil
+}
+
+// generateRecoveryCodes generates a new set of recovery codes. It returns
+// the codes and their hashes.
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0, totpRecoveryCodesCount)
+	hashes := make([]string, 0, totpRecoveryCodesCount)
+	for i := 0; i < totpRecoveryCodesCount; i++ {
+		c := strings.ToLower(totpRecoveryEncoding.EncodeToString(fastrand.Bytes(totpRecoveryCodeSize)))
+		code := c[:4] + "-" + c[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, tokenHash(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes
+}
+
+// normalizeRecoveryCode brings the recovery code to the canonical form in
+// which we hash it, so users don't need to care about case and dashes.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// totpIssuer returns the issuer we show in authenticator apps, i.e. the
+// portal's domain.
+func totpIssuer() string {
+	u, err := url.Parse(PortalName)
+	if err != nil || u.Host == "" {
+		return PortalName
+	}
+	return u.Host
+}
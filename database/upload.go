@@ -2,12 +2,15 @@ package database
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -16,6 +19,22 @@ var (
 	ErrInvalidTimePeriod = errors.New("invalid time period")
 )
 
+const (
+	// UploadStatePinned selects only the uploads which are still pinned.
+	UploadStatePinned = "pinned"
+	// UploadStateUnpinned selects only the uploads which have been unpinned.
+	UploadStateUnpinned = "unpinned"
+	// UploadStateAll selects all uploads, regardless of their pinned state.
+	UploadStateAll = "all"
+
+	// UploadsSortByTimestamp sorts uploads by the moment they were made.
+	UploadsSortByTimestamp = "timestamp"
+	// UploadsSortByName sorts uploads by the name of the uploaded skyfile.
+	UploadsSortByName = "name"
+	// UploadsSortBySize sorts uploads by the size of the uploaded skyfile.
+	UploadsSortBySize = "size"
+)
+
 // Upload ...
 type Upload struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
@@ -35,6 +54,120 @@ type UploadResponse struct {
 	Size       int64     `bson:"size" json:"size"`
 	RawStorage int64     `bson:"raw_storage" json:"rawStorage"`
 	Timestamp  time.Time `bson:"timestamp" json:"uploadedOn"`
+
+	SkylinkMetadata `bson:",inline"`
+}
+
+// UploadsFilter describes the criteria for listing a user's uploads. All
+// criteria are optional. Zero values mean no limitation, except for State,
+// which defaults to UploadStatePinned, and SortBy, which defaults to
+// UploadsSortByTimestamp.
+type UploadsFilter struct {
+	// Name matches all uploads whose skyfile name contains it, regardless of
+	// case.
+	Name    string
+	MinSize int64
+	MaxSize int64
+	From    time.Time
+	To      time.Time
+	State   string
+	SortBy  string
+	// SortAsc sorts the uploads in ascending order. The default is
+	// descending.
+	SortAsc bool
+}
+
+// Validate returns an error if the filter is not valid.
+func (f UploadsFilter) Validate() error {
+	var errs []error
+	switch f.State {
+	case "", UploadStatePinned, UploadStateUnpinned, UploadStateAll:
+	default:
+		errs = append(errs, errors.New("invalid upload state"))
+	}
+	switch f.SortBy {
+	case "", UploadsSortByTimestamp, UploadsSortByName, UploadsSortBySize:
+	default:
+		errs = append(errs, errors.New("invalid sort field"))
+	}
+	if f.MinSize < 0 || f.MaxSize < 0 {
+		errs = append(errs, errors.New("the size limits must be non-negative"))
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		errs = append(errs, errors.New("the minimum size must not exceed the maximum size"))
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.From.After(f.To) {
+		errs = append(errs, ErrInvalidTimePeriod)
+	}
+	return errors.Compose(errs...)
+}
+
+// uploadsMatchStage returns a match stage for the filter's criteria which
+// refer to fields of the uploads collection.
+func (f UploadsFilter) uploadsMatchStage(user User) bson.D {
+	filter := bson.D{{"user_id", user.ID}}
+	switch f.State {
+	case UploadStateAll:
+	case UploadStateUnpinned:
+		filter = append(filter, bson.E{Key: "unpinned", Value: true})
+	default:
+		filter = append(filter, bson.E{Key: "unpinned", Value: false})
+	}
+	timeRange := bson.D{}
+	if !f.From.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$gte", Value: f.From})
+	}
+	if !f.To.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$lte", Value: f.To})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{Key: "timestamp", Value: timeRange})
+	}
+	return bson.D{{"$match", filter}}
+}
+
+// skylinksMatchStage returns a match stage for the filter's criteria which
+// refer to fields of the skylinks collection, or nil if there are none.
+func (f UploadsFilter) skylinksMatchStage() bson.D {
+	filter := bson.D{}
+	if f.Name != "" {
+		filter = append(filter, bson.E{Key: "name", Value: primitive.Regex{Pattern: regexp.QuoteMeta(f.Name), Options: "i"}})
+	}
+	sizeRange := bson.D{}
+	if f.MinSize > 0 {
+		sizeRange = append(sizeRange, bson.E{Key: "$gte", Value: f.MinSize})
+	}
+	if f.MaxSize > 0 {
+		sizeRange = append(sizeRange, bson.E{Key: "$lte", Value: f.MaxSize})
+	}
+	if len(sizeRange) > 0 {
+		filter = append(filter, bson.E{Key: "size", Value: sizeRange})
+	}
+	if len(filter) == 0 {
+		return nil
+	}
+	return bson.D{{"$match", filter}}
+}
+
+// sortStage returns the sort stage defined by the filter. We always sort by
+// _id as well, so the order is stable across pages.
+func (f UploadsFilter) sortStage() bson.D {
+	field := f.SortBy
+	if field == "" {
+		field = UploadsSortByTimestamp
+	}
+	dir := -1
+	if f.SortAsc {
+		dir = 1
+	}
+	return bson.D{{"$sort", bson.D{{field, dir}, {"_id", dir}}}}
+}
+
+// PageCursor returns the cursor which points at this upload in a list of
+// uploads sorted by timestamp.
+func (ur UploadResponse) PageCursor() PageCursor {
+	id, _ := primitive.ObjectIDFromHex(ur.ID)
+	return PageCursor{Timestamp: ur.Timestamp, ID: id}
 }
 
 // UploadByID fetches a single upload from the DB.
@@ -60,11 +193,30 @@ func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Sk
 		SkylinkID:  skylink.ID,
 		Timestamp:  time.Now().UTC().Truncate(time.Millisecond),
 	}
+	// Only the user's first pinned upload of a skylink counts towards their
+	// storage.
+	var pinned int64
+	if !user.ID.IsZero() {
+		filter := bson.M{
+			"user_id":    user.ID,
+			"skylink_id": skylink.ID,
+			"unpinned":   false,
+		}
+		var err error
+		pinned, err = db.staticUploads.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to check for previous uploads")
+		}
+	}
 	ior, err := db.staticUploads.InsertOne(ctx, up)
 	if err != nil {
 		return nil, err
 	}
 	up.ID = ior.InsertedID.(primitive.ObjectID)
+	err = db.usageRollupUploadCreate(ctx, up, skylink.Size, pinned == 0)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to account for upload %s in usage rollups: %v", up.ID.Hex(), err)
+	}
 	return &up, nil
 }
 
@@ -115,11 +267,34 @@ func (db *DB) UnpinUploads(ctx context.Context, skylink Skylink, user User) (int
 		"user_id":    user.ID,
 		"unpinned":   false,
 	}
+	// Fetch the uploads we're about to unpin, so we can update the rollups
+	// of the days on which they were made.
+	c, err := db.staticUploads.Find(ctx, filter, options.Find().SetSort(bson.M{"timestamp": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var ups []Upload
+	err = c.All(ctx, &ups)
+	if err != nil {
+		return 0, err
+	}
+	if len(ups) == 0 {
+		return 0, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(ups))
+	for _, up := range ups {
+		ids = append(ids, up.ID)
+	}
+	filter["_id"] = bson.M{"$in": ids}
 	update := bson.M{"$set": bson.M{"unpinned": true}}
 	ur, err := db.staticUploads.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return 0, err
 	}
+	err = db.usageRollupUploadsUnpin(ctx, ups, skylink.Size)
+	if err != nil {
+		db.staticLogger.Warnf("Failed to account for unpinning skylink %s in usage rollups: %v", skylink.Skylink, err)
+	}
 	return ur.ModifiedCount, nil
 }
 
@@ -135,17 +310,74 @@ func (db *DB) UpdateUpload(ctx context.Context, id primitive.ObjectID, update bs
 // UploadsByUser fetches a page of uploads by this user and the total number of
 // such uploads.
 func (db *DB) UploadsByUser(ctx context.Context, user User, offset, pageSize int) ([]UploadResponse, int64, error) {
+	return db.UploadsByUserFiltered(ctx, user, UploadsFilter{}, offset, pageSize)
+}
+
+// UploadsByUserFiltered fetches a page of uploads by this user which match the
+// given filter, sorted as the filter defines, and the total number of such
+// uploads.
+func (db *DB) UploadsByUserFiltered(ctx context.Context, user User, filter UploadsFilter, offset, pageSize int) ([]UploadResponse, int64, error) {
 	if user.ID.IsZero() {
 		return nil, 0, errors.New("invalid user")
 	}
 	if err := validateOffsetPageSize(offset, pageSize); err != nil {
 		return nil, 0, err
 	}
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", user.ID},
-		{"unpinned", false},
-	}}}
-	return db.uploadsBy(ctx, matchStage, offset, pageSize)
+	if err := filter.Validate(); err != nil {
+		return nil, 0, err
+	}
+	matchStage := filter.uploadsMatchStage(user)
+	skylinksMatchStage := filter.skylinksMatchStage()
+	var cnt int64
+	var err error
+	if skylinksMatchStage == nil {
+		cnt, err = db.count(ctx, db.staticUploads, matchStage)
+	} else {
+		pipeline := append(mongo.Pipeline{matchStage}, skylinkLookupStages()...)
+		cnt, err = db.countPipeline(ctx, db.staticUploads, append(pipeline, skylinksMatchStage))
+	}
+	if err != nil || cnt == 0 {
+		return []UploadResponse{}, 0, err
+	}
+	sortsBySkylink := filter.SortBy == UploadsSortByName || filter.SortBy == UploadsSortBySize
+	pipeline := generateFilteredUploadsPipeline(matchStage, skylinksMatchStage, filter.sortStage(), sortsBySkylink, offset, pageSize)
+	// Sorting by the skylinks' fields happens in memory, so we need to allow
+	// it to spill over to disk for users with many uploads.
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	c, err := db.staticUploads.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	uploads := make([]UploadResponse, pageSize)
+	err = c.All(ctx, &uploads)
+	if err != nil {
+		return nil, 0, err
+	}
+	for ix := range uploads {
+		uploads[ix].RawStorage = skynet.RawStorageUsed(uploads[ix].Size)
+	}
+	return uploads, cnt, nil
+}
+
+// UploadsByUserCursor fetches the page of uploads by this user which match the
+// given filter and follow, or precede if the cursor goes backwards, the given
+// cursor. A nil cursor fetches the first page. Cursor pagination is only
+// supported for uploads sorted by timestamp.
+func (db *DB) UploadsByUserCursor(ctx context.Context, user User, filter UploadsFilter, cursor *PageCursor, pageSize int) ([]UploadResponse, PageCursors, error) {
+	if user.ID.IsZero() {
+		return nil, PageCursors{}, errors.New("invalid user")
+	}
+	if err := validateOffsetPageSize(0, pageSize); err != nil {
+		return nil, PageCursors{}, err
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, PageCursors{}, err
+	}
+	if filter.SortBy != "" && filter.SortBy != UploadsSortByTimestamp {
+		return nil, PageCursors{}, ErrCursorSortUnsupported
+	}
+	pipeline := generateCursorUploadsPipeline(filter.uploadsMatchStage(user), filter.skylinksMatchStage(), cursor, filter.SortAsc, pageSize)
+	return db.uploadsByCursor(ctx, pipeline, cursor, pageSize)
 }
 
 // UploadsByPeriod fetches a page of uploads created during the given time range.
@@ -163,6 +395,24 @@ func (db *DB) UploadsByPeriod(ctx context.Context, from, to time.Time, offset, p
 	return db.uploadsBy(ctx, matchStage, offset, pageSize)
 }
 
+// UploadsByPeriodCursor fetches the page of uploads created during the given
+// time range which follows, or precedes if the cursor goes backwards, the
+// given cursor. A nil cursor fetches the first page.
+func (db *DB) UploadsByPeriodCursor(ctx context.Context, from, to time.Time, cursor *PageCursor, pageSize int) ([]UploadResponse, PageCursors, error) {
+	if err := validateOffsetPageSize(0, pageSize); err != nil {
+		return nil, PageCursors{}, err
+	}
+	if from.After(to) {
+		return nil, PageCursors{}, ErrInvalidTimePeriod
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"timestamp", bson.D{{"$gte", from}}},
+		{"timestamp", bson.D{{"$lte", to}}},
+	}}}
+	pipeline := generateCursorUploadsPipeline(matchStage, nil, cursor, false, pageSize)
+	return db.uploadsByCursor(ctx, pipeline, cursor, pageSize)
+}
+
 // uploadsBy fetches a page of uploads, filtered by an arbitrary match criteria.
 // It also reports the total number of records in the list.
 func (db *DB) uploadsBy(ctx context.Context, matchStage bson.D, offset, pageSize int) ([]UploadResponse, int64, error) {
@@ -189,6 +439,30 @@ func (db *DB) uploadsBy(ctx context.Context, matchStage bson.D, offset, pageSize
 	return uploads, cnt, nil
 }
 
+// uploadsByCursor runs a pipeline created by generateCursorUploadsPipeline and
+// returns the resulting page of uploads together with the tokens of the
+// neighbouring pages.
+func (db *DB) uploadsByCursor(ctx context.Context, pipeline mongo.Pipeline, cursor *PageCursor, pageSize int) ([]UploadResponse, PageCursors, error) {
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	c, err := db.staticUploads.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	uploads := make([]UploadResponse, 0, pageSize+1)
+	err = c.All(ctx, &uploads)
+	if err != nil {
+		return nil, PageCursors{}, err
+	}
+	n, pcs := cursorPage(uploads, cursor, pageSize, func(i int) PageCursor {
+		return uploads[i].PageCursor()
+	})
+	uploads = uploads[:n]
+	for ix := range uploads {
+		uploads[ix].RawStorage = skynet.RawStorageUsed(uploads[ix].Size)
+	}
+	return uploads, pcs, nil
+}
+
 // validateOffsetPageSize returns an error if offset and/or page size are invalid.
 func validateOffsetPageSize(offset, pageSize int) error {
 	var errs []error
@@ -0,0 +1,427 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// usageRollupBucketSize defines the time span covered by a single usage
+	// rollup record.
+	usageRollupBucketSize = 24 * time.Hour
+)
+
+// UsageRollup holds the aggregated upload and download usage of a user for a
+// single day. Rollups are maintained incrementally as uploads and downloads
+// are registered, so we don't need to scan the user's entire history in order
+// to report their stats.
+type UsageRollup struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID primitive.ObjectID `bson:"user_id" json:"userId"`
+	Day    time.Time          `bson:"day" json:"day"`
+	// Uploads is the number of uploads made on this day which are still
+	// pinned.
+	Uploads int64 `bson:"uploads" json:"uploads"`
+	// UploadsSize and RawStorage only account for the first pinned upload of
+	// each skylink, so re-uploads don't count towards the user's storage.
+	UploadsSize       int64 `bson:"uploads_size" json:"uploadsSize"`
+	RawStorage        int64 `bson:"raw_storage" json:"rawStorage"`
+	UploadBandwidth   int64 `bson:"upload_bandwidth" json:"uploadBandwidth"`
+	Downloads         int64 `bson:"downloads" json:"downloads"`
+	DownloadsSize     int64 `bson:"downloads_size" json:"downloadsSize"`
+	DownloadBandwidth int64 `bson:"download_bandwidth" json:"downloadBandwidth"`
+}
+
+// usageRollupDay returns the start of the day to which the given moment
+// belongs.
+func usageRollupDay(t time.Time) time.Time {
+	return t.UTC().Truncate(usageRollupBucketSize)
+}
+
+// usageRollupInc increments the given fields of the user's rollup for the day
+// of the given moment, creating the rollup if needed.
+func (db *DB) usageRollupInc(ctx context.Context, userID primitive.ObjectID, t time.Time, inc bson.M) error {
+	if userID.IsZero() || len(inc) == 0 {
+		return nil
+	}
+	filter := bson.M{
+		"user_id": userID,
+		"day":     usageRollupDay(t),
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := db.staticUsageRollups.UpdateOne(ctx, filter, bson.M{"$inc": inc}, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to update usage rollup")
+	}
+	return nil
+}
+
+// usageRollupUploadCreate accounts for a new upload in the user's rollups.
+// The first pinned upload of a skylink counts towards the user's storage.
+func (db *DB) usageRollupUploadCreate(ctx context.Context, up Upload, size int64, first bool) error {
+	inc := bson.M{
+		"uploads":          1,
+		"upload_bandwidth": skynet.BandwidthUploadCost(size),
+	}
+	if first {
+		inc["uploads_size"] = size
+		inc["raw_storage"] = skynet.RawStorageUsed(size)
+	}
+	return db.usageRollupInc(ctx, up.UserID, up.Timestamp, inc)
+}
+
+// usageRollupUploadsUnpin removes the given uploads, which must all belong to
+// the same skylink and user and be sorted by timestamp, from the user's pinned
+// uploads. The upload bandwidth remains unchanged.
+func (db *DB) usageRollupUploadsUnpin(ctx context.Context, ups []Upload, size int64) error {
+	var errs []error
+	for i, up := range ups {
+		inc := bson.M{"uploads": -1}
+		if i == 0 {
+			// The earliest pinned upload is the one which carries the storage.
+			inc["uploads_size"] = -size
+			inc["raw_storage"] = -skynet.RawStorageUsed(size)
+		}
+		errs = append(errs, db.usageRollupInc(ctx, up.UserID, up.Timestamp, inc))
+	}
+	return errors.Compose(errs...)
+}
+
+// usageRollupDownload accounts for the change of a download's size from
+// oldSize to newSize in the user's rollups. A new download has an oldSize of
+// -1.
+func (db *DB) usageRollupDownload(ctx context.Context, d Download, oldSize, newSize int64) error {
+	inc := bson.M{
+		"downloads_size":     newSize,
+		"download_bandwidth": skynet.BandwidthDownloadCost(newSize),
+	}
+	if oldSize < 0 {
+		inc["downloads"] = 1
+	} else {
+		inc["downloads_size"] = newSize - oldSize
+		inc["download_bandwidth"] = skynet.BandwidthDownloadCost(newSize) - skynet.BandwidthDownloadCost(oldSize)
+	}
+	return db.usageRollupInc(ctx, d.UserID, d.CreatedAt, inc)
+}
+
+// usageRollupSkylinkResize updates the rollups of all users who uploaded or
+// fully downloaded the given skylink after its size changed. This typically
+// happens when the metafetcher learns the size of a skylink we've already
+// registered uploads for.
+func (db *DB) usageRollupSkylinkResize(ctx context.Context, skylinkID primitive.ObjectID, oldSize, newSize int64) error {
+	if oldSize == newSize {
+		return nil
+	}
+	bwDelta := skynet.BandwidthUploadCost(newSize) - skynet.BandwidthUploadCost(oldSize)
+	storageDelta := skynet.RawStorageUsed(newSize) - skynet.RawStorageUsed(oldSize)
+	opts := options.Find().SetSort(bson.M{"timestamp": 1})
+	c, err := db.staticUploads.Find(ctx, bson.M{"skylink_id": skylinkID}, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch uploads")
+	}
+	var ups []Upload
+	if err = c.All(ctx, &ups); err != nil {
+		return errors.AddContext(err, "failed to parse uploads")
+	}
+	var errs []error
+	storageCounted := make(map[primitive.ObjectID]bool)
+	for _, up := range ups {
+		inc := bson.M{"upload_bandwidth": bwDelta}
+		if !up.Unpinned && !storageCounted[up.UserID] {
+			inc["uploads_size"] = newSize - oldSize
+			inc["raw_storage"] = storageDelta
+			storageCounted[up.UserID] = true
+		}
+		errs = append(errs, db.usageRollupInc(ctx, up.UserID, up.Timestamp, inc))
+	}
+	// Downloads with zero bytes are full downloads, so their size is the
+	// skylink's size.
+	c, err = db.staticDownloads.Find(ctx, bson.M{"skylink_id": skylinkID, "bytes": 0})
+	if err != nil {
+		return errors.Compose(append(errs, errors.AddContext(err, "failed to fetch downloads"))...)
+	}
+	var downs []Download
+	if err = c.All(ctx, &downs); err != nil {
+		return errors.Compose(append(errs, errors.AddContext(err, "failed to parse downloads"))...)
+	}
+	for _, d := range downs {
+		errs = append(errs, db.usageRollupDownload(ctx, d, oldSize, newSize))
+	}
+	return errors.Compose(errs...)
+}
+
+// UsageRollupsRebuild recalculates the usage rollups of the given user from
+// the user's raw uploads and downloads. Each day's rollup is replaced
+// individually, so the user's stats remain available during the rebuild.
+//
+// Uploads and downloads registered while the rebuild is in progress might not
+// be accounted for, so this is best done during low traffic.
+func (db *DB) UsageRollupsRebuild(ctx context.Context, userID primitive.ObjectID) error {
+	if userID.IsZero() {
+		return errors.New("invalid user")
+	}
+	// We only hold a single rollup per day in memory, no matter how many
+	// uploads and downloads the user has.
+	rollups := make(map[time.Time]*UsageRollup)
+	rollup := func(t time.Time) *UsageRollup {
+		day := usageRollupDay(t)
+		r, ok := rollups[day]
+		if !ok {
+			r = &UsageRollup{UserID: userID, Day: day}
+			rollups[day] = r
+		}
+		return r
+	}
+	aggOpts := options.Aggregate().SetAllowDiskUse(true)
+
+	// Uploads. We sort them by timestamp, so the storage of each skylink is
+	// attributed to the user's earliest pinned upload of it.
+	upsPipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.M{"user_id": userID}}},
+		bson.D{{"$sort", bson.M{"timestamp": 1}}},
+	}
+	upsPipeline = append(upsPipeline, lookupSkylinkSizeStages("skylink_id")...)
+	upsPipeline = append(upsPipeline, bson.D{{"$project", bson.M{"skylink_id": 1, "unpinned": 1, "timestamp": 1, "size": 1}}})
+	pinned := make(map[primitive.ObjectID]bool)
+	err := db.usageRollupsStream(ctx, db.staticUploads, upsPipeline, aggOpts, func(c *mongo.Cursor) error {
+		var up struct {
+			SkylinkID primitive.ObjectID `bson:"skylink_id"`
+			Unpinned  bool               `bson:"unpinned"`
+			Timestamp time.Time          `bson:"timestamp"`
+			Size      int64              `bson:"size"`
+		}
+		if err := c.Decode(&up); err != nil {
+			return errors.AddContext(err, "failed to parse upload")
+		}
+		r := rollup(up.Timestamp)
+		r.UploadBandwidth += skynet.BandwidthUploadCost(up.Size)
+		if up.Unpinned {
+			return nil
+		}
+		r.Uploads++
+		if !pinned[up.SkylinkID] {
+			r.UploadsSize += up.Size
+			r.RawStorage += skynet.RawStorageUsed(up.Size)
+			pinned[up.SkylinkID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to process uploads")
+	}
+
+	// Downloads.
+	downsPipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.M{"user_id": userID}}},
+	}
+	downsPipeline = append(downsPipeline, lookupSkylinkSizeStages("skylink_id")...)
+	downsPipeline = append(downsPipeline, bson.D{{"$project", bson.M{"bytes": 1, "created_at": 1, "size": 1}}})
+	err = db.usageRollupsStream(ctx, db.staticDownloads, downsPipeline, aggOpts, func(c *mongo.Cursor) error {
+		var d struct {
+			Bytes     int64     `bson:"bytes"`
+			CreatedAt time.Time `bson:"created_at"`
+			Size      int64     `bson:"size"`
+		}
+		if err := c.Decode(&d); err != nil {
+			return errors.AddContext(err, "failed to parse download")
+		}
+		size := d.Bytes
+		if size <= 0 {
+			size = d.Size
+		}
+		r := rollup(d.CreatedAt)
+		r.Downloads++
+		r.DownloadsSize += size
+		r.DownloadBandwidth += skynet.BandwidthDownloadCost(size)
+		return nil
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to process downloads")
+	}
+
+	// Replace the rollup of each day in place and only then remove the
+	// rollups of days on which the user no longer has any usage.
+	days := make(bson.A, 0, len(rollups))
+	replaceOpts := options.Replace().SetUpsert(true)
+	for day, r := range rollups {
+		filter := bson.M{"user_id": userID, "day": day}
+		_, err = db.staticUsageRollups.ReplaceOne(ctx, filter, r, replaceOpts)
+		if err != nil {
+			return errors.AddContext(err, "failed to replace usage rollup")
+		}
+		days = append(days, day)
+	}
+	_, err = db.staticUsageRollups.DeleteMany(ctx, bson.M{"user_id": userID, "day": bson.M{"$nin": days}})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete stale usage rollups")
+	}
+	return nil
+}
+
+// usageRollupsStream runs the given aggregation pipeline and calls fn for each
+// resulting document, without loading them all in memory.
+func (db *DB) usageRollupsStream(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, opts *options.AggregateOptions, fn func(*mongo.Cursor) error) error {
+	c, err := coll.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	for c.Next(ctx) {
+		if err = fn(c); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// ensureUsageRollups builds the usage rollups of all users from their raw
+// uploads and downloads, unless that has already been done. We serve the
+// users' stats from the rollups, so deployments which predate them need this
+// before they can report correct stats. It's safe to run this on multiple
+// servers at once.
+func (db *DB) ensureUsageRollups(ctx context.Context) error {
+	_, err := db.ReadConfigValue(ctx, ConfValUsageRollupsBuilt)
+	if err == nil {
+		return nil
+	}
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		return errors.AddContext(err, "failed to read usage rollups marker")
+	}
+	db.staticLogger.Infoln("Building the usage rollups of all users. This might take a while.")
+	n, err := db.UsageRollupsRebuildAll(ctx)
+	if err != nil {
+		return err
+	}
+	db.staticLogger.Infof("Built the usage rollups of %d users.", n)
+	return db.WriteConfigValue(ctx, ConfValUsageRollupsBuilt, ConfValTrue)
+}
+
+// UsageRollupsRebuildAll rebuilds the usage rollups of all users. It returns
+// the number of users whose rollups were rebuilt.
+func (db *DB) UsageRollupsRebuildAll(ctx context.Context) (int, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticUsers.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch users")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	n := 0
+	for c.Next(ctx) {
+		var u User
+		if err = c.Decode(&u); err != nil {
+			return n, errors.AddContext(err, "failed to decode DB data")
+		}
+		err = db.UsageRollupsRebuild(ctx, u.ID)
+		if err != nil {
+			return n, errors.AddContext(err, "failed to rebuild usage rollups of user "+u.ID.Hex())
+		}
+		n++
+	}
+	return n, c.Err()
+}
+
+// userUsageRollupStats reports the user's upload and download stats, based on
+// their usage rollups.
+func (db *DB) userUsageRollupStats(ctx context.Context, userID primitive.ObjectID, since time.Time) (UserStatsUpload, UserStatsDownload, error) {
+	fields := []string{"uploads", "uploads_size", "raw_storage", "upload_bandwidth", "downloads", "downloads_size", "download_bandwidth"}
+	group := bson.D{{"_id", nil}}
+	for _, f := range fields {
+		group = append(group,
+			bson.E{Key: f, Value: bson.D{{"$sum", bson.D{
+				{"$cond", bson.A{
+					bson.D{{"$gte", bson.A{"$day", usageRollupDay(since)}}}, // if
+					"$" + f, // then
+					0,       // else
+				}},
+			}}}},
+			bson.E{Key: f + "_total", Value: bson.D{{"$sum", "$" + f}}},
+		)
+	}
+	matchStage := bson.D{{"$match", bson.D{{"user_id", userID}}}}
+	groupStage := bson.D{{"$group", group}}
+	c, err := db.staticUsageRollups.Aggregate(ctx, mongo.Pipeline{matchStage, groupStage})
+	if err != nil {
+		return UserStatsUpload{}, UserStatsDownload{}, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	if ok := c.Next(ctx); !ok {
+		// No results found. This is expected.
+		return UserStatsUpload{}, UserStatsDownload{}, c.Err()
+	}
+	// We need this struct, so we can safely decode both int32 and int64.
+	var res struct {
+		Uploads                int64 `bson:"uploads"`
+		UploadsTotal           int64 `bson:"uploads_total"`
+		UploadsSize            int64 `bson:"uploads_size"`
+		UploadsSizeTotal       int64 `bson:"uploads_size_total"`
+		RawStorage             int64 `bson:"raw_storage"`
+		RawStorageTotal        int64 `bson:"raw_storage_total"`
+		UploadBandwidth        int64 `bson:"upload_bandwidth"`
+		UploadBandwidthTotal   int64 `bson:"upload_bandwidth_total"`
+		Downloads              int64 `bson:"downloads"`
+		DownloadsTotal         int64 `bson:"downloads_total"`
+		DownloadsSize          int64 `bson:"downloads_size"`
+		DownloadsSizeTotal     int64 `bson:"downloads_size_total"`
+		DownloadBandwidth      int64 `bson:"download_bandwidth"`
+		DownloadBandwidthTotal int64 `bson:"download_bandwidth_total"`
+	}
+	if err = c.Decode(&res); err != nil {
+		return UserStatsUpload{}, UserStatsDownload{}, errors.AddContext(err, "failed to decode DB data")
+	}
+	upStats := UserStatsUpload{
+		Count:               res.Uploads,
+		CountTotal:          res.UploadsTotal,
+		Size:                res.UploadsSize,
+		SizeTotal:           res.UploadsSizeTotal,
+		RawStorageUsed:      res.RawStorage,
+		RawStorageUsedTotal: res.RawStorageTotal,
+		Bandwidth:           res.UploadBandwidth,
+		BandwidthTotal:      res.UploadBandwidthTotal,
+	}
+	downStats := UserStatsDownload{
+		Count:          res.Downloads,
+		CountTotal:     res.DownloadsTotal,
+		Size:           res.DownloadsSize,
+		SizeTotal:      res.DownloadsSizeTotal,
+		Bandwidth:      res.DownloadBandwidth,
+		BandwidthTotal: res.DownloadBandwidthTotal,
+	}
+	return upStats, downStats, nil
+}
+
+// lookupSkylinkSizeStages returns the aggregation stages which add the size of
+// the skylink referenced by the given field to each document.
+func lookupSkylinkSizeStages(field string) []bson.D {
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", collSkylinks},
+		{"localField", field},
+		{"foreignField", "_id"},
+		{"as", "skylink_data"},
+	}}}
+	sizeStage := bson.D{{"$addFields", bson.D{
+		{"size", bson.D{{"$ifNull", bson.A{
+			bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}},
+			0,
+		}}}},
+	}}}
+	return []bson.D{lookupStage, sizeStage}
+}
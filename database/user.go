@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net/mail"
+	"regexp"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/hash"
@@ -102,6 +103,12 @@ var (
 	// ErrInvalidToken is returned when the token is found to be invalid for any
 	// reason, including expiration.
 	ErrInvalidToken = errors.New("invalid token")
+	// ErrEmptyUsersFilter is returned when we try to search users without
+	// any criteria.
+	ErrEmptyUsersFilter = errors.New("at least one search criterion is required")
+	// ErrUserSuspended is returned when a suspended user tries to use their
+	// account.
+	ErrUserSuspended = errors.New("this account is suspended")
 )
 
 type (
@@ -126,6 +133,31 @@ type (
 		StripeID                         string             `bson:"stripe_id" json:"stripeCustomerId"`
 		QuotaExceeded                    bool               `bson:"quota_exceeded" json:"quotaExceeded"`
 		PubKeys                          []PubKey           `bson:"pub_keys" json:"-"`
+		TOTPSecret                       string             `bson:"totp_secret,omitempty" json:"-"`
+		TOTPPendingSecret                string             `bson:"totp_pending_secret,omitempty" json:"-"`
+		TOTPLastStep                     int64              `bson:"totp_last_step,omitempty" json:"-"`
+		TOTPRecoveryCodes                []string           `bson:"totp_recovery_codes,omitempty" json:"-"`
+		TOTPFailures                     int                `bson:"totp_failures,omitempty" json:"-"`
+		TOTPLockedUntil                  *time.Time         `bson:"totp_locked_until,omitempty" json:"-"`
+		Passkeys                         []Passkey          `bson:"passkeys,omitempty" json:"-"`
+		SuspendedAt                      *time.Time         `bson:"suspended_at,omitempty" json:"suspendedAt,omitempty"`
+		SuspendedUntil                   *time.Time         `bson:"suspended_until,omitempty" json:"suspendedUntil,omitempty"`
+		SuspensionReason                 string             `bson:"suspension_reason,omitempty" json:"suspensionReason,omitempty"`
+		DeleteAt                         *time.Time         `bson:"delete_at,omitempty" json:"deleteAt,omitempty"`
+		RestoreToken                     string             `bson:"restore_token,omitempty" json:"-"`
+	}
+	// UsersFilter describes the criteria for searching users. All criteria
+	// are optional but at least one of them needs to be set. Users need to
+	// match all given criteria.
+	UsersFilter struct {
+		// Email matches all users whose email contains it, regardless of
+		// case.
+		Email    string
+		Sub      string
+		StripeID string
+		PubKey   PubKey
+		// UploaderIP matches all users who have uploaded from this IP.
+		UploaderIP string
 	}
 	// TierLimits defines the speed limits imposed on the user based on their
 	// tier.
@@ -455,18 +487,30 @@ func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	if err != nil {
 		return errors.AddContext(err, "failed to delete user uploads")
 	}
-	_, err = db.staticRegistryReads.DeleteMany(ctx, filter)
+	_, err = db.staticRegistryUsage.DeleteMany(ctx, filter)
 	if err != nil {
-		return errors.AddContext(err, "failed to delete user registry reads")
+		return errors.AddContext(err, "failed to delete user registry usage")
 	}
-	_, err = db.staticRegistryWrites.DeleteMany(ctx, filter)
+	_, err = db.staticUsageRollups.DeleteMany(ctx, filter)
 	if err != nil {
-		return errors.AddContext(err, "failed to delete user registry writes")
+		return errors.AddContext(err, "failed to delete user usage rollups")
 	}
 	_, err = db.staticAPIKeys.DeleteMany(ctx, filter)
 	if err != nil {
 		return errors.AddContext(err, "failed to delete user API keys")
 	}
+	_, err = db.staticRefreshTokens.DeleteMany(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user refresh tokens")
+	}
+	_, err = db.staticSessions.DeleteMany(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user sessions")
+	}
+	_, err = db.staticTwoFactorLogins.DeleteMany(ctx, filter)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete user two-factor logins")
+	}
 	_, err = db.staticUnconfirmedUserUpdates.DeleteMany(ctx, bson.M{"sub": u.Sub})
 	if err != nil {
 		return errors.AddContext(err, "failed to delete user unconfirmed updates")
@@ -483,6 +527,47 @@ func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	return nil
 }
 
+// UserForceConfirmEmail marks the user's email as confirmed without them
+// following the confirmation link.
+func (db *DB) UserForceConfirmEmail(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"email_confirmation_token":            "",
+		"email_confirmation_token_expiration": time.Time{},
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.EmailConfirmationToken = ""
+	u.EmailConfirmationTokenExpiration = time.Time{}
+	return nil
+}
+
+// UserReinstate lifts the suspension of the given user.
+func (db *DB) UserReinstate(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"suspended_at":      "",
+		"suspended_until":   "",
+		"suspension_reason": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.SuspendedAt = nil
+	u.SuspendedUntil = nil
+	u.SuspensionReason = ""
+	return nil
+}
+
 // UserSave saves the user to the DB.
 func (db *DB) UserSave(ctx context.Context, u *User) error {
 	if db.staticDeps.Disrupt("DependencyMongoWriteConflictN") {
@@ -549,6 +634,82 @@ func (db *DB) UserSetStripeID(ctx context.Context, u *User, stripeID string) err
 	return nil
 }
 
+// UserSuspend suspends the given user for the given reason. Suspended users
+// can't use their accounts until they are reinstated or until the given
+// expiration time passes. A nil expiration time means that the suspension
+// doesn't expire.
+func (db *DB) UserSuspend(ctx context.Context, u *User, reason string, until *time.Time) error {
+	if reason == "" {
+		return errors.New("a suspension requires a reason")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if until != nil && !until.After(now) {
+		return errors.New("a suspension cannot expire in the past")
+	}
+	filter := bson.M{"_id": u.ID}
+	set := bson.M{
+		"suspended_at":      now,
+		"suspension_reason": reason,
+	}
+	update := bson.M{"$set": set}
+	if until != nil {
+		t := until.UTC().Truncate(time.Millisecond)
+		until = &t
+		set["suspended_until"] = t
+	} else {
+		update["$unset"] = bson.M{"suspended_until": ""}
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.SuspendedAt = &now
+	u.SuspendedUntil = until
+	u.SuspensionReason = reason
+	return nil
+}
+
+// UsersSearch returns up to limit users who match the given filter.
+func (db *DB) UsersSearch(ctx context.Context, f UsersFilter, limit int) ([]User, error) {
+	filter := bson.M{}
+	if f.Email != "" {
+		filter["email"] = primitive.Regex{Pattern: regexp.QuoteMeta(f.Email), Options: "i"}
+	}
+	if f.Sub != "" {
+		filter["sub"] = f.Sub
+	}
+	if f.StripeID != "" {
+		filter["stripe_id"] = f.StripeID
+	}
+	if len(f.PubKey) > 0 {
+		filter["pub_keys"] = f.PubKey
+	}
+	if f.UploaderIP != "" {
+		ids, err := db.staticUploads.Distinct(ctx, "user_id", bson.M{"uploader_ip": f.UploaderIP})
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to find uploads by IP")
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	if len(filter) == 0 {
+		return nil, ErrEmptyUsersFilter
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit))
+	c, err := db.staticUsers.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find users")
+	}
+	users := make([]User, 0)
+	err = c.All(ctx, &users)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse users")
+	}
+	return users, nil
+}
+
 // UserSetTier sets the user's tier to the given value.
 func (db *DB) UserSetTier(ctx context.Context, u *User, t int) error {
 	if t <= TierAnonymous || t >= TierMaxReserved {
@@ -623,6 +784,18 @@ func (u User) HasKey(pk PubKey) bool {
 	return false
 }
 
+// Suspended returns true if the user's account is suspended and the
+// suspension hasn't expired, yet.
+func (u User) Suspended() bool {
+	return u.SuspendedAt != nil && (u.SuspendedUntil == nil || u.SuspendedUntil.After(time.Now().UTC()))
+}
+
+// PendingDeletion returns true if the user's account is scheduled for
+// deletion.
+func (u User) PendingDeletion() bool {
+	return u.DeleteAt != nil
+}
+
 // monthStart returns the start of the user's subscription month.
 // Users get their bandwidth quota reset at the start of the month.
 //
@@ -652,8 +825,11 @@ func monthStartWithTime(subscribedUntil time.Time, current time.Time) time.Time
 		return time.Date(current.Year(), current.Month(), dayOfMonth, 0, 0, 0, 0, time.UTC)
 	}
 	// If we haven't reached the reset day this month, use last month's day.
-	dayOfMonth = normalizeDayOfMonth(current.Year(), current.Month()-1, subscribedUntil.Day())
-	return time.Date(current.Year(), current.Month()-1, dayOfMonth, 0, 0, 0, 0, time.UTC)
+	// We normalize the previous month first, so January correctly rolls over
+	// to December of the previous year.
+	prev := time.Date(current.Year(), current.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	dayOfMonth = normalizeDayOfMonth(prev.Year(), prev.Month(), subscribedUntil.Day())
+	return time.Date(prev.Year(), prev.Month(), dayOfMonth, 0, 0, 0, 0, time.UTC)
 }
 
 // normalizeDayOfMonth checks whether the current month has the given day and if
@@ -50,6 +50,14 @@ func TestMonthStart(t *testing.T) {
 			checkedOn:    time.Date(2022, 1, 1, 2, 3, 4, 5, time.UTC),
 			startOfMonth: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
 		},
+		{
+			// The sub expiration day of month is after the current day of month
+			// in January. We expect the start of month to be in December of
+			// the previous year.
+			subUntil:     time.Date(2020, 1, 15, 3, 4, 5, 6, time.UTC),
+			checkedOn:    time.Date(2022, 1, 10, 2, 3, 4, 5, time.UTC),
+			startOfMonth: time.Date(2021, 12, 15, 0, 0, 0, 0, time.UTC),
+		},
 	}
 
 	df := "2006-01-02"
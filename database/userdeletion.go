@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// UserDeletionGracePeriod defines how long we keep the accounts which
+	// their users have deleted, so they can change their minds and restore
+	// them. Once it passes, the purger deletes the account and all of its
+	// data. A zero grace period means that we delete accounts immediately.
+	// This value is configurable via the ACCOUNTS_DELETION_GRACE_DAYS
+	// environment variable.
+	UserDeletionGracePeriod = 30 * 24 * time.Hour
+
+	// userPurgeInterval defines how often we look for accounts whose grace
+	// period has passed.
+	userPurgeInterval = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Second,
+			Standard: time.Hour,
+		},
+	).(time.Duration)
+
+	// ErrUserPendingDeletion is returned when a user whose account is
+	// scheduled for deletion tries to use it.
+	ErrUserPendingDeletion = errors.New("this account is scheduled for deletion")
+)
+
+// UserByRestoreToken returns the user with the given restore token. Users
+// whose grace period has passed can't be restored, so we don't return them.
+func (db *DB) UserByRestoreToken(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	filter := bson.M{
+		"restore_token": tokenHash(token),
+		"delete_at":     bson.M{"$gt": time.Now().UTC()},
+	}
+	sr := db.staticUsers.FindOne(ctx, filter)
+	if errors.Contains(sr.Err(), mongo.ErrNoDocuments) {
+		return nil, ErrInvalidToken
+	}
+	if sr.Err() != nil {
+		return nil, errors.AddContext(sr.Err(), "failed to find user")
+	}
+	var u User
+	err := sr.Decode(&u)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode user")
+	}
+	return &u, nil
+}
+
+// UserRestore cancels the scheduled deletion of the given user's account.
+func (db *DB) UserRestore(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"delete_at":     "",
+		"restore_token": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.DeleteAt = nil
+	u.RestoreToken = ""
+	return nil
+}
+
+// UserScheduleDeletion schedules the given user's account for deletion once
+// UserDeletionGracePeriod passes. Until then the user can restore their
+// account with the given restore token. We only store the token's hash.
+func (db *DB) UserScheduleDeletion(ctx context.Context, u *User, restoreToken string) error {
+	if restoreToken == "" {
+		return errors.New("a scheduled deletion requires a restore token")
+	}
+	deleteAt := time.Now().UTC().Add(UserDeletionGracePeriod).Truncate(time.Millisecond)
+	h := tokenHash(restoreToken)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"delete_at":     deleteAt,
+		"restore_token": h,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.DeleteAt = &deleteAt
+	u.RestoreToken = h
+	return nil
+}
+
+// UsersPurge deletes all users whose grace period has passed by the given
+// time, together with all of their data. It returns the number of deleted
+// users.
+func (db *DB) UsersPurge(ctx context.Context, now time.Time) (int, error) {
+	filter := bson.M{"delete_at": bson.M{"$lte": now}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "sub": 1})
+	c, err := db.staticUsers.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to find users pending deletion")
+	}
+	var users []User
+	err = c.All(ctx, &users)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode users")
+	}
+	n := 0
+	var errs []error
+	for i := range users {
+		err = db.UserDelete(ctx, &users[i])
+		// Another instance might have purged this user already.
+		if errors.Contains(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, "failed to delete user "+users[i].ID.Hex()))
+			continue
+		}
+		n++
+	}
+	return n, errors.Compose(errs...)
+}
+
+// threadedPurgeUsers periodically deletes the users whose grace period has
+// passed until the context is closed.
+func (db *DB) threadedPurgeUsers(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(userPurgeInterval):
+		}
+		n, err := db.UsersPurge(ctx, time.Now().UTC())
+		if err != nil {
+			db.staticLogger.Warnln("Failed to purge users pending deletion:", err)
+		}
+		if n > 0 {
+			db.staticLogger.Infof("Purged %d users whose deletion grace period passed.", n)
+		}
+	}
+}
@@ -107,9 +107,9 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		upStats, err := db.UserStatsUpload(ctx, user.ID, startOfMonth)
+		upStats, downStats, err := db.userUsageRollupStats(ctx, user.ID, startOfMonth)
 		if err != nil {
-			regErr("Failed to get user's upload stats:", err)
+			regErr("Failed to get user's upload and download stats:", err)
 			return
 		}
 		stats.NumUploads = upStats.Count
@@ -122,15 +122,6 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.RawStorageUsed = upStats.RawStorageUsed
 		stats.RawStorageUsedTotal = upStats.RawStorageUsedTotal
 		db.staticLogger.Tracef("User %s upload stats: %v", user.ID.Hex(), upStats)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		downStats, err := db.userDownloadStats(ctx, user.ID, startOfMonth)
-		if err != nil {
-			regErr("Failed to get user's download stats:", err)
-			return
-		}
 		stats.NumDownloads = downStats.Count
 		stats.NumDownloadsTotal = downStats.CountTotal
 		stats.DownloadsSize = downStats.Size
@@ -151,7 +142,7 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.NumRegWrites = rwStats.Count
 		stats.NumRegWritesTotal = rwStats.CountTotal
 		stats.BandwidthRegWrites = rwStats.Bandwidth
-		stats.BandwidthRegWrites = rwStats.BandwidthTotal
+		stats.BandwidthRegWritesTotal = rwStats.BandwidthTotal
 		db.staticLogger.Tracef("User %s registry write stats: %v", user.ID.Hex(), rwStats)
 	}()
 	wg.Add(1)
@@ -178,174 +169,15 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 
 // UserStatsUpload reports on the user's uploads - count, total size and total
 // bandwidth used. It uses the total size of the uploaded skyfiles as basis.
-func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsUpload, err error) {
-	matchStage := bson.D{{"$match", bson.M{"user_id": id}}}
-	lookupStage := bson.D{
-		{"$lookup", bson.D{
-			{"from", "skylinks"},
-			{"localField", "skylink_id"},
-			{"foreignField", "_id"},
-			{"as", "skylink_data"},
-		}},
-	}
-	replaceStage := bson.D{
-		{"$replaceRoot", bson.D{
-			{"newRoot", bson.D{
-				{"$mergeObjects", bson.A{
-					bson.D{{"$arrayElemAt", bson.A{"$skylink_data", 0}}}, "$$ROOT"},
-				},
-			}},
-		}},
-	}
-	// These are the fields we don't need.
-	projectStage := bson.D{{"$project", bson.D{
-		{"_id", 0},
-		{"user_id", 0},
-		{"skylink_data", 0},
-		{"name", 0},
-		{"skylink_id", 0},
-	}}}
-
-	pipeline := mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
-	c, err := db.staticUploads.Aggregate(ctx, pipeline)
-	if err != nil {
-		return
-	}
-	defer func() {
-		if errDef := c.Close(ctx); errDef != nil {
-			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
-		}
-	}()
-
-	// We need this struct, so we can safely decode both int32 and int64.
-	result := struct {
-		Size      int64     `bson:"size"`
-		Skylink   string    `bson:"skylink"`
-		Unpinned  bool      `bson:"unpinned"`
-		Timestamp time.Time `bson:"timestamp"`
-	}{}
-	processedSkylinks := make(map[string]bool)
-	for c.Next(ctx) {
-		if err = c.Decode(&result); err != nil {
-			err = errors.AddContext(err, "failed to decode DB data")
-			return
-		}
-		// All bandwidth is counted, regardless of unpinned status and
-		// uniqueness.
-		stats.BandwidthTotal += skynet.BandwidthUploadCost(result.Size)
-		if result.Timestamp.After(since) {
-			stats.Bandwidth += skynet.BandwidthUploadCost(result.Size)
-		}
-		// Only count unique  uploads that are still pinned towards total count,
-		// size and storage used.
-		if result.Unpinned {
-			continue
-		}
-		stats.CountTotal++
-		if !processedSkylinks[result.Skylink] {
-			stats.SizeTotal += result.Size
-			stats.RawStorageUsedTotal += skynet.RawStorageUsed(result.Size)
-		}
-		// Check against the time threshold before continuing with the period
-		// counts.
-		if result.Timestamp.After(since) {
-			stats.Count++
-			if !processedSkylinks[result.Skylink] {
-				stats.Size += result.Size
-				stats.RawStorageUsed += skynet.RawStorageUsed(result.Size)
-			}
-		}
-		processedSkylinks[result.Skylink] = true
-	}
-	return stats, nil
-}
-
-// userDownloadStats reports on the user's downloads - count, total size and
-// total bandwidth used. It uses the actual bandwidth used, as reported by nginx.
-func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsDownload, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", id},
-	}}}
-	lookupStage := bson.D{
-		{"$lookup", bson.D{
-			{"from", "skylinks"},
-			{"localField", "skylink_id"}, // field in the downloads collection
-			{"foreignField", "_id"},      // field in the skylinks collection
-			{"as", "fromSkylinks"},
-		}},
-	}
-	replaceStage := bson.D{
-		{"$replaceRoot", bson.D{
-			{"newRoot", bson.D{
-				{"$mergeObjects", bson.A{
-					bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks", 0}}}, "$$ROOT"},
-				},
-			}},
-		}},
-	}
-	// This stage checks if the download has a non-zero `bytes` field and if so,
-	// it takes it as the download's size. Otherwise, it reports the full
-	// skylink's size as download's size.
-	projectStage := bson.D{{"$project", bson.D{
-		{"size", bson.D{
-			{"$cond", bson.A{
-				bson.D{{"$gt", bson.A{"$bytes", 0}}}, // if
-				"$bytes",                             // then
-				"$size",                              // else
-			}},
-		}},
-		{"created_at", "$created_at"},
-	}}}
-
-	pipeline := mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
-	c, err := db.staticDownloads.Aggregate(ctx, pipeline)
-	if err != nil {
-		err = errors.AddContext(err, "DB query failed")
-		return
-	}
-	defer func() {
-		if errDef := c.Close(ctx); errDef != nil {
-			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
-		}
-	}()
-
-	// We need this struct, so we can safely decode both int32 and int64.
-	result := struct {
-		Size      int64     `bson:"size"`
-		CreatedAt time.Time `bson:"created_at"`
-	}{}
-	for c.Next(ctx) {
-		if err = c.Decode(&result); err != nil {
-			err = errors.AddContext(err, "failed to decode DB data")
-			return
-		}
-		stats.CountTotal++
-		stats.SizeTotal += result.Size
-		stats.BandwidthTotal += skynet.BandwidthDownloadCost(result.Size)
-		if result.CreatedAt.After(since) {
-			stats.Count++
-			stats.Size += result.Size
-			stats.Bandwidth += skynet.BandwidthDownloadCost(result.Size)
-		}
-	}
-	return stats, nil
+func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since time.Time) (UserStatsUpload, error) {
+	stats, _, err := db.userUsageRollupStats(ctx, id, since)
+	return stats, err
 }
 
 // userRegistryWriteStats reports the number of registry writes by the user and
 // the bandwidth used.
 func (db *DB) userRegistryWriteStats(ctx context.Context, userID primitive.ObjectID, since time.Time) (stats UserStatsRegWrites, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", userID},
-		{"timestamp", bson.D{{"$gt", since}}},
-	}}}
-	writes, err := db.count(ctx, db.staticRegistryWrites, matchStage)
-	if err != nil {
-		return stats, errors.AddContext(err, "failed to fetch registry write bandwidth")
-	}
-	matchStage = bson.D{{"$match", bson.D{
-		{"user_id", userID},
-	}}}
-	writesTotal, err := db.count(ctx, db.staticRegistryWrites, matchStage)
+	writes, writesTotal, err := db.userRegistryUsage(ctx, userID, since, "writes")
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry write bandwidth")
 	}
@@ -359,18 +191,7 @@ func (db *DB) userRegistryWriteStats(ctx context.Context, userID primitive.Objec
 // userRegistryReadsStats reports the number of registry reads by the user and
 // the bandwidth used.
 func (db *DB) userRegistryReadStats(ctx context.Context, userID primitive.ObjectID, monthStart time.Time) (stats UserStatsRegReads, err error) {
-	matchStage := bson.D{{"$match", bson.D{
-		{"user_id", userID},
-		{"timestamp", bson.D{{"$gt", monthStart}}},
-	}}}
-	reads, err := db.count(ctx, db.staticRegistryReads, matchStage)
-	if err != nil {
-		return stats, errors.AddContext(err, "failed to fetch registry read bandwidth")
-	}
-	matchStage = bson.D{{"$match", bson.D{
-		{"user_id", userID},
-	}}}
-	readsTotal, err := db.count(ctx, db.staticRegistryReads, matchStage)
+	reads, readsTotal, err := db.userRegistryUsage(ctx, userID, monthStart, "reads")
 	if err != nil {
 		return stats, errors.AddContext(err, "failed to fetch registry read bandwidth")
 	}
@@ -380,3 +201,44 @@ func (db *DB) userRegistryReadStats(ctx context.Context, userID primitive.Object
 	stats.BandwidthTotal = readsTotal * skynet.CostBandwidthRegistryRead
 	return stats, nil
 }
+
+// userRegistryUsage sums the given field of the user's registry usage records.
+// It returns the sum since the given moment, as well as the total sum.
+func (db *DB) userRegistryUsage(ctx context.Context, userID primitive.ObjectID, since time.Time, field string) (count int64, countTotal int64, err error) {
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+	}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", nil},
+		{"count", bson.D{{"$sum", bson.D{
+			{"$cond", bson.A{
+				bson.D{{"$gte", bson.A{"$bucket", since.Truncate(registryUsageBucketSize)}}}, // if
+				"$" + field, // then
+				0,           // else
+			}},
+		}}}},
+		{"countTotal", bson.D{{"$sum", "$" + field}}},
+	}}}
+	c, err := db.staticRegistryUsage.Aggregate(ctx, mongo.Pipeline{matchStage, groupStage})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	if ok := c.Next(ctx); !ok {
+		// No results found. This is expected.
+		return 0, 0, nil
+	}
+	// We need this struct, so we can safely decode both int32 and int64.
+	result := struct {
+		Count      int64 `bson:"count"`
+		CountTotal int64 `bson:"countTotal"`
+	}{}
+	if err = c.Decode(&result); err != nil {
+		return 0, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	return result.Count, result.CountTotal, nil
+}
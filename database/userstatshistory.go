@@ -0,0 +1,315 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// StatsGranularityDay groups the stats history by calendar day.
+	StatsGranularityDay StatsGranularity = "day"
+	// StatsGranularityWeek groups the stats history by ISO week, i.e. weeks
+	// starting on Monday.
+	StatsGranularityWeek StatsGranularity = "week"
+	// StatsGranularityMonth groups the stats history by the user's billing
+	// month, as defined by monthStart.
+	StatsGranularityMonth StatsGranularity = "month"
+
+	// MaxStatsHistoryBuckets is the maximum number of buckets we return in a
+	// single stats history.
+	MaxStatsHistoryBuckets = 400
+)
+
+var (
+	// ErrInvalidGranularity is returned when the requested stats granularity
+	// is not supported.
+	ErrInvalidGranularity = errors.New("invalid granularity")
+	// ErrTooManyBuckets is returned when the requested time period contains
+	// more than MaxStatsHistoryBuckets buckets of the requested granularity.
+	ErrTooManyBuckets = errors.New("the requested period contains too many buckets")
+)
+
+type (
+	// StatsGranularity defines the size of the buckets in a stats history.
+	StatsGranularity string
+
+	// UserStatsHistoryBucket holds the user's stats for a single bucket of a
+	// stats history. The period values (e.g. NumUploads) cover only the
+	// bucket, while the total values (e.g. NumUploadsTotal) cover everything
+	// up to the end of the bucket.
+	UserStatsHistoryBucket struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		UserStats
+	}
+
+	// usageCounts holds the raw usage numbers from which we derive UserStats.
+	usageCounts struct {
+		Uploads           int64 `bson:"uploads"`
+		UploadsSize       int64 `bson:"uploads_size"`
+		RawStorage        int64 `bson:"raw_storage"`
+		UploadBandwidth   int64 `bson:"upload_bandwidth"`
+		Downloads         int64 `bson:"downloads"`
+		DownloadsSize     int64 `bson:"downloads_size"`
+		DownloadBandwidth int64 `bson:"download_bandwidth"`
+		RegReads          int64 `bson:"reads"`
+		RegWrites         int64 `bson:"writes"`
+	}
+)
+
+// Validate returns an error if the granularity is not supported.
+func (g StatsGranularity) Validate() error {
+	switch g {
+	case StatsGranularityDay, StatsGranularityWeek, StatsGranularityMonth:
+		return nil
+	}
+	return ErrInvalidGranularity
+}
+
+// bucketStart returns the start of the bucket to which the given moment
+// belongs. The subscribedUntil value defines the start of the billing month.
+func (g StatsGranularity) bucketStart(t, subscribedUntil time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	switch g {
+	case StatsGranularityWeek:
+		// Go's weeks start on Sunday, so we shift them to start on Monday.
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case StatsGranularityMonth:
+		return monthStartWithTime(subscribedUntil, t.UTC())
+	default:
+		return day
+	}
+}
+
+// nextBucketStart returns the start of the bucket following the one which
+// starts at the given moment.
+func (g StatsGranularity) nextBucketStart(start, subscribedUntil time.Time) time.Time {
+	switch g {
+	case StatsGranularityWeek:
+		return start.AddDate(0, 0, 7)
+	case StatsGranularityMonth:
+		next := time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		day := normalizeDayOfMonth(next.Year(), next.Month(), subscribedUntil.Day())
+		return time.Date(next.Year(), next.Month(), day, 0, 0, 0, 0, time.UTC)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// add adds the given counts to the current ones.
+func (uc *usageCounts) add(c usageCounts) {
+	uc.Uploads += c.Uploads
+	uc.UploadsSize += c.UploadsSize
+	uc.RawStorage += c.RawStorage
+	uc.UploadBandwidth += c.UploadBandwidth
+	uc.Downloads += c.Downloads
+	uc.DownloadsSize += c.DownloadsSize
+	uc.DownloadBandwidth += c.DownloadBandwidth
+	uc.RegReads += c.RegReads
+	uc.RegWrites += c.RegWrites
+}
+
+// userStats converts the given period and total counts to UserStats.
+func (uc usageCounts) userStats(total usageCounts) UserStats {
+	return UserStats{
+		NumRegReads:       uc.RegReads,
+		NumRegReadsTotal:  total.RegReads,
+		NumRegWrites:      uc.RegWrites,
+		NumRegWritesTotal: total.RegWrites,
+		NumUploads:        uc.Uploads,
+		NumUploadsTotal:   total.Uploads,
+		NumDownloads:      uc.Downloads,
+		NumDownloadsTotal: total.Downloads,
+
+		BandwidthUploads:        uc.UploadBandwidth,
+		BandwidthUploadsTotal:   total.UploadBandwidth,
+		BandwidthDownloads:      uc.DownloadBandwidth,
+		BandwidthDownloadsTotal: total.DownloadBandwidth,
+		BandwidthRegReads:       uc.RegReads * skynet.CostBandwidthRegistryRead,
+		BandwidthRegReadsTotal:  total.RegReads * skynet.CostBandwidthRegistryRead,
+		BandwidthRegWrites:      uc.RegWrites * skynet.CostBandwidthRegistryWrite,
+		BandwidthRegWritesTotal: total.RegWrites * skynet.CostBandwidthRegistryWrite,
+
+		RawStorageUsed:      uc.RawStorage,
+		RawStorageUsedTotal: total.RawStorage,
+		UploadsSize:         uc.UploadsSize,
+		UploadsSizeTotal:    total.UploadsSize,
+		DownloadsSize:       uc.DownloadsSize,
+		DownloadsSizeTotal:  total.DownloadsSize,
+
+		TotalUploadsSize:   total.UploadsSize,
+		TotalDownloadsSize: total.DownloadsSize,
+	}
+}
+
+// UserStatsHistory returns the user's stats between the given moments, split
+// into buckets of the given granularity. The first bucket starts at the start
+// of the bucket containing `from` and the last bucket contains `to`.
+func (db *DB) UserStatsHistory(ctx context.Context, user User, from, to time.Time, granularity StatsGranularity) ([]UserStatsHistoryBucket, error) {
+	if user.ID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	if err := granularity.Validate(); err != nil {
+		return nil, err
+	}
+	if from.After(to) {
+		return nil, ErrInvalidTimePeriod
+	}
+	// Build the empty buckets.
+	var buckets []UserStatsHistoryBucket
+	start := granularity.bucketStart(from, user.SubscribedUntil)
+	for len(buckets) == 0 || start.Before(to) {
+		if len(buckets) == MaxStatsHistoryBuckets {
+			return nil, ErrTooManyBuckets
+		}
+		end := granularity.nextBucketStart(start, user.SubscribedUntil)
+		buckets = append(buckets, UserStatsHistoryBucket{Start: start, End: end})
+		start = end
+	}
+	historyStart := buckets[0].Start
+	historyEnd := buckets[len(buckets)-1].End
+
+	// Everything that happened before the first bucket only counts towards
+	// the totals.
+	total, err := db.userUsageBefore(ctx, user.ID, historyStart)
+	if err != nil {
+		return nil, err
+	}
+	daily, err := db.userUsageDaily(ctx, user.ID, historyStart, historyEnd)
+	if err != nil {
+		return nil, err
+	}
+	period := make([]usageCounts, len(buckets))
+	for day, counts := range daily {
+		// Find the last bucket which starts no later than the given day.
+		i := sort.Search(len(buckets), func(i int) bool {
+			return buckets[i].Start.After(day)
+		}) - 1
+		if i < 0 {
+			continue
+		}
+		period[i].add(counts)
+	}
+	for i := range buckets {
+		total.add(period[i])
+		buckets[i].UserStats = period[i].userStats(total)
+	}
+	return buckets, nil
+}
+
+// userUsageBefore returns the user's usage before the given moment.
+func (db *DB) userUsageBefore(ctx context.Context, userID primitive.ObjectID, before time.Time) (usageCounts, error) {
+	var counts usageCounts
+	rollupFields := []string{"uploads", "uploads_size", "raw_storage", "upload_bandwidth", "downloads", "downloads_size", "download_bandwidth"}
+	err := db.sumFields(ctx, db.staticUsageRollups, bson.D{{"user_id", userID}, {"day", bson.D{{"$lt", before}}}}, rollupFields, &counts)
+	if err != nil {
+		return usageCounts{}, errors.AddContext(err, "failed to sum usage rollups")
+	}
+	var reg usageCounts
+	err = db.sumFields(ctx, db.staticRegistryUsage, bson.D{{"user_id", userID}, {"bucket", bson.D{{"$lt", before}}}}, []string{"reads", "writes"}, &reg)
+	if err != nil {
+		return usageCounts{}, errors.AddContext(err, "failed to sum registry usage")
+	}
+	counts.RegReads = reg.RegReads
+	counts.RegWrites = reg.RegWrites
+	return counts, nil
+}
+
+// userUsageDaily returns the user's usage between the given moments, grouped
+// by day.
+func (db *DB) userUsageDaily(ctx context.Context, userID primitive.ObjectID, from, to time.Time) (map[time.Time]usageCounts, error) {
+	daily := make(map[time.Time]usageCounts)
+	filter := bson.D{{"user_id", userID}, {"day", bson.D{{"$gte", from}, {"$lt", to}}}}
+	c, err := db.staticUsageRollups.Find(ctx, filter, options.Find().SetSort(bson.M{"day": 1}))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch usage rollups")
+	}
+	var rollups []UsageRollup
+	if err = c.All(ctx, &rollups); err != nil {
+		return nil, errors.AddContext(err, "failed to parse usage rollups")
+	}
+	for _, r := range rollups {
+		day := r.Day.UTC()
+		counts := daily[day]
+		counts.add(usageCounts{
+			Uploads:           r.Uploads,
+			UploadsSize:       r.UploadsSize,
+			RawStorage:        r.RawStorage,
+			UploadBandwidth:   r.UploadBandwidth,
+			Downloads:         r.Downloads,
+			DownloadsSize:     r.DownloadsSize,
+			DownloadBandwidth: r.DownloadBandwidth,
+		})
+		daily[day] = counts
+	}
+
+	// The registry usage is stored in hourly buckets, so we group it by day.
+	dayMs := int64(usageRollupBucketSize / time.Millisecond)
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"bucket", bson.D{{"$gte", from}, {"$lt", to}}},
+	}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", bson.D{{"$subtract", bson.A{
+			"$bucket",
+			bson.D{{"$mod", bson.A{bson.D{{"$toLong", "$bucket"}}, dayMs}}},
+		}}}},
+		{"reads", bson.D{{"$sum", "$reads"}}},
+		{"writes", bson.D{{"$sum", "$writes"}}},
+	}}}
+	c, err = db.staticRegistryUsage.Aggregate(ctx, mongo.Pipeline{matchStage, groupStage})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch registry usage")
+	}
+	var regDays []struct {
+		Day    time.Time `bson:"_id"`
+		Reads  int64     `bson:"reads"`
+		Writes int64     `bson:"writes"`
+	}
+	if err = c.All(ctx, &regDays); err != nil {
+		return nil, errors.AddContext(err, "failed to parse registry usage")
+	}
+	for _, r := range regDays {
+		day := r.Day.UTC()
+		counts := daily[day]
+		counts.RegReads += r.Reads
+		counts.RegWrites += r.Writes
+		daily[day] = counts
+	}
+	return daily, nil
+}
+
+// sumFields sums the given fields of all documents in the collection which
+// match the filter and decodes the result into res.
+func (db *DB) sumFields(ctx context.Context, coll *mongo.Collection, filter bson.D, fields []string, res interface{}) error {
+	group := bson.D{{"_id", nil}}
+	for _, f := range fields {
+		group = append(group, bson.E{Key: f, Value: bson.D{{"$sum", "$" + f}}})
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", filter}},
+		bson.D{{"$group", group}},
+	}
+	c, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	if ok := c.Next(ctx); !ok {
+		// No results found. This is expected.
+		return c.Err()
+	}
+	return c.Decode(res)
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStatsGranularityBuckets ensures we calculate the boundaries of the stats
+// history buckets correctly.
+func TestStatsGranularityBuckets(t *testing.T) {
+	subUntil := time.Date(2020, 1, 31, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		granularity StatsGranularity
+		checkedOn   time.Time
+		start       time.Time
+		next        time.Time
+	}{
+		{
+			granularity: StatsGranularityDay,
+			checkedOn:   time.Date(2022, 2, 28, 23, 59, 59, 0, time.UTC),
+			start:       time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// 2022-03-06 is a Sunday, so its week starts on the preceding
+			// Monday.
+			granularity: StatsGranularityWeek,
+			checkedOn:   time.Date(2022, 3, 6, 12, 0, 0, 0, time.UTC),
+			start:       time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			granularity: StatsGranularityWeek,
+			checkedOn:   time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC),
+			start:       time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// February doesn't have a 31st, so the billing month starts on
+			// its last day and the next one starts on March 31st.
+			granularity: StatsGranularityMonth,
+			checkedOn:   time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+			start:       time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2022, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			granularity: StatsGranularityMonth,
+			checkedOn:   time.Date(2022, 1, 15, 12, 0, 0, 0, time.UTC),
+			start:       time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			granularity: StatsGranularityMonth,
+			checkedOn:   time.Date(2022, 12, 31, 12, 0, 0, 0, time.UTC),
+			start:       time.Date(2022, 12, 31, 0, 0, 0, 0, time.UTC),
+			next:        time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		start := tt.granularity.bucketStart(tt.checkedOn, subUntil)
+		if !start.Equal(tt.start) {
+			t.Errorf("Expected %s bucket of %v to start on %v, got %v", tt.granularity, tt.checkedOn, tt.start, start)
+		}
+		next := tt.granularity.nextBucketStart(start, subUntil)
+		if !next.Equal(tt.next) {
+			t.Errorf("Expected %s bucket after %v to start on %v, got %v", tt.granularity, start, tt.next, next)
+		}
+	}
+	if err := StatsGranularity("year").Validate(); err != ErrInvalidGranularity {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidGranularity, err)
+	}
+}
@@ -2,6 +2,7 @@ package email
 
 import (
 	"context"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/types"
@@ -57,3 +58,26 @@ func (em Mailer) SendAccountAccessAttemptedEmail(ctx context.Context, email type
 	m := accountAccessAttemptedEmail(email.String())
 	return em.Send(ctx, *m)
 }
+
+// SendAccountLockedEmail sends a new email to the given email address that
+// notifies the user that we have temporarily locked their account after too
+// many failed login attempts.
+func (em Mailer) SendAccountLockedEmail(ctx context.Context, email types.Email, lockedUntil time.Time) error {
+	m := accountLockedEmail(email.String(), lockedUntil)
+	return em.Send(ctx, *m)
+}
+
+// SendAccountDeletionScheduledEmail sends a new email to the given email
+// address that notifies the user that their account is scheduled for deletion
+// and tells them how to restore it.
+func (em Mailer) SendAccountDeletionScheduledEmail(ctx context.Context, email types.Email, token string, deleteAt time.Time) error {
+	m := accountDeletionScheduledEmail(email.String(), token, deleteAt)
+	return em.Send(ctx, *m)
+}
+
+// SendAccountSuspendedEmail sends a new email to the given email address that
+// notifies the user that we have suspended their account.
+func (em Mailer) SendAccountSuspendedEmail(ctx context.Context, email types.Email, reason string, suspendedUntil *time.Time) error {
+	m := accountSuspendedEmail(email.String(), reason, suspendedUntil)
+	return em.Send(ctx, *m)
+}
@@ -1,7 +1,9 @@
 package email
 
 import (
+	"html"
 	"strings"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 )
@@ -91,6 +93,108 @@ If this was you, check if you signed up using a different address.
 If this was not you, please ignore this email.
 
 --f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405--
+`
+
+	accountLockedSubject = "Your account has been temporarily locked"
+	accountLockedMime    = "multipart/alternative; boundary=f312d6871cd0a4e607f7fe7100742dab232e2cac1b59bb523426fe07e608"
+	accountLockedTempl   = `
+--f312d6871cd0a4e607f7fe7100742dab232e2cac1b59bb523426fe07e608
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+
+Hi,
+
+we have seen too many failed attempts to log into your account, so we have =
+temporarily locked it. You will be able to log in again after {{.LockedUntil}}.
+
+If this was you, please wait until then or recover access to your account b=
+y resetting your password.
+
+If this was not you, someone might be trying to guess your password. Please =
+make sure it is strong and consider enabling two-factor authentication.
+
+--f312d6871cd0a4e607f7fe7100742dab232e2cac1b59bb523426fe07e608
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+
+Hi,
+
+we have seen too many failed attempts to log into your account, so we have =
+temporarily locked it. You will be able to log in again after {{.LockedUntil}}.
+
+If this was you, please wait until then or recover access to your account b=
+y resetting your password.
+
+If this was not you, someone might be trying to guess your password. Please =
+make sure it is strong and consider enabling two-factor authentication.
+
+--f312d6871cd0a4e607f7fe7100742dab232e2cac1b59bb523426fe07e608--
+`
+
+	accountSuspendedSubject = "Your account has been suspended"
+	accountSuspendedMime    = "multipart/alternative; boundary=5c2e8a1f7d4b90e36a18c5f2d7b4e09a3c61f8d2b5e7a04c9f13d6b8e2a5c7f0"
+	accountSuspendedTempl   = `
+--5c2e8a1f7d4b90e36a18c5f2d7b4e09a3c61f8d2b5e7a04c9f13d6b8e2a5c7f0
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+
+Hi,
+
+your account has been suspended {{.Until}} for the following reason:
+
+{{.Reason}}
+
+While your account is suspended you can't log in and your API keys don't wo=
+rk. If you believe this is a mistake, please reply to this email.
+
+--5c2e8a1f7d4b90e36a18c5f2d7b4e09a3c61f8d2b5e7a04c9f13d6b8e2a5c7f0
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+
+Hi,
+
+your account has been suspended {{.Until}} for the following reason:
+
+{{.ReasonHTML}}
+
+While your account is suspended you can't log in and your API keys don't wo=
+rk. If you believe this is a mistake, please reply to this email.
+
+--5c2e8a1f7d4b90e36a18c5f2d7b4e09a3c61f8d2b5e7a04c9f13d6b8e2a5c7f0--
+`
+
+	accountDeletionScheduledSubject = "Your account is scheduled for deletion"
+	accountDeletionScheduledMime    = "multipart/alternative; boundary=b81d4f6a2c93e07d5a1f8c4b6e2d90a73f5c1e8b4d6a2f07c9e3b5d1a8f4c6e2"
+	accountDeletionScheduledTempl   = `
+--b81d4f6a2c93e07d5a1f8c4b6e2d90a73f5c1e8b4d6a2f07c9e3b5d1a8f4c6e2
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+
+Hi,
+
+we received a request to delete your account. Your account and all of its =
+data will be permanently deleted on {{.DeleteAt}}.
+
+If you didn't mean to delete your account, you can restore it until then by=
+ clicking the following link:
+
+<a href="{{.RestoreEndpoint}}?token={{.Token}}">{{.RestoreEndpoint}}?token={{.Token}}</a>
+
+--b81d4f6a2c93e07d5a1f8c4b6e2d90a73f5c1e8b4d6a2f07c9e3b5d1a8f4c6e2
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+
+Hi,
+
+we received a request to delete your account. Your account and all of its =
+data will be permanently deleted on {{.DeleteAt}}.
+
+If you didn't mean to delete your account, you can restore it until then by=
+ clicking the following link:
+
+<a href="{{.RestoreEndpoint}}?token={{.Token}}">{{.RestoreEndpoint}}?token={{.Token}}</a>
+
+--b81d4f6a2c93e07d5a1f8c4b6e2d90a73f5c1e8b4d6a2f07c9e3b5d1a8f4c6e2--
 `
 )
 
@@ -134,3 +238,53 @@ func accountAccessAttemptedEmail(to string) *database.EmailMessage {
 		BodyMime: accountAccessAttemptedMime,
 	}
 }
+
+// accountSuspendedEmail generates an email for notifying a user that we have
+// suspended their account. A nil suspendedUntil means that the suspension
+// doesn't expire.
+func accountSuspendedEmail(to string, reason string, suspendedUntil *time.Time) *database.EmailMessage {
+	until := "until further notice"
+	if suspendedUntil != nil {
+		until = "until " + suspendedUntil.UTC().Format(time.RFC1123)
+	}
+	body := strings.ReplaceAll(accountSuspendedTempl, "{{.Until}}", until)
+	// The body is quoted-printable, so we need to escape the equals signs.
+	body = strings.ReplaceAll(body, "{{.ReasonHTML}}", strings.ReplaceAll(html.EscapeString(reason), "=", "=3D"))
+	body = strings.ReplaceAll(body, "{{.Reason}}", strings.ReplaceAll(reason, "=", "=3D"))
+	return &database.EmailMessage{
+		From:     From,
+		To:       to,
+		Subject:  accountSuspendedSubject,
+		Body:     body,
+		BodyMime: accountSuspendedMime,
+	}
+}
+
+// accountLockedEmail generates an email for notifying a user that we have
+// temporarily locked their account after too many failed login attempts.
+func accountLockedEmail(to string, lockedUntil time.Time) *database.EmailMessage {
+	body := strings.ReplaceAll(accountLockedTempl, "{{.LockedUntil}}", lockedUntil.UTC().Format(time.RFC1123))
+	return &database.EmailMessage{
+		From:     From,
+		To:       to,
+		Subject:  accountLockedSubject,
+		Body:     body,
+		BodyMime: accountLockedMime,
+	}
+}
+
+// accountDeletionScheduledEmail generates an email for notifying a user that
+// their account is scheduled for deletion. It contains a link with which they
+// can restore their account before the given deletion time.
+func accountDeletionScheduledEmail(to string, token string, deleteAt time.Time) *database.EmailMessage {
+	body := strings.ReplaceAll(accountDeletionScheduledTempl, "{{.RestoreEndpoint}}", PortalAddressAccounts+"/user/restore")
+	body = strings.ReplaceAll(body, "{{.Token}}", token)
+	body = strings.ReplaceAll(body, "{{.DeleteAt}}", deleteAt.UTC().Format(time.RFC1123))
+	return &database.EmailMessage{
+		From:     From,
+		To:       to,
+		Subject:  accountDeletionScheduledSubject,
+		Body:     body,
+		BodyMime: accountDeletionScheduledMime,
+	}
+}
@@ -3,6 +3,7 @@ package email
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/lib"
 )
@@ -59,3 +60,68 @@ func TestAccountAccessAttemptedEmail(t *testing.T) {
 		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
 	}
 }
+
+// TestAccountLockedEmail ensures that the email we send to the user tells them
+// until when their account is locked.
+func TestAccountLockedEmail(t *testing.T) {
+	to := "user@siasky.net"
+	until := time.Date(2022, 3, 4, 12, 30, 0, 0, time.UTC)
+	em := accountLockedEmail(to, until)
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+	if !strings.Contains(em.Body, "after Fri, 04 Mar 2022 12:30:00 UTC.") {
+		t.Fatal("Expected the email to contain the lockout's end.")
+	}
+}
+
+// TestAccountSuspendedEmail ensures that the email we send to the user tells
+// them why and until when their account is suspended.
+func TestAccountSuspendedEmail(t *testing.T) {
+	to := "user@siasky.net"
+	until := time.Date(2022, 3, 4, 12, 30, 0, 0, time.UTC)
+	em := accountSuspendedEmail(to, "terms of service violation <spam>", &until)
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+	if !strings.Contains(em.Body, "suspended until Fri, 04 Mar 2022 12:30:00 UTC") {
+		t.Fatal("Expected the email to contain the suspension's end.")
+	}
+	if !strings.Contains(em.Body, "terms of service violation <spam>") || !strings.Contains(em.Body, "terms of service violation &lt;spam&gt;") {
+		t.Fatal("Expected the email to contain the suspension's reason.")
+	}
+	em = accountSuspendedEmail(to, "a=b", nil)
+	if !strings.Contains(em.Body, "suspended until further notice") {
+		t.Fatal("Expected the email to mention that the suspension doesn't expire.")
+	}
+	if !strings.Contains(em.Body, "a=3Db") {
+		t.Fatal("Expected the reason to be quoted-printable encoded.")
+	}
+}
+
+// TestAccountDeletionScheduledEmail ensures that the email we send to the user
+// tells them when their account will be deleted and how to restore it.
+func TestAccountDeletionScheduledEmail(t *testing.T) {
+	to := "user@siasky.net"
+	token := "restore-token"
+	deleteAt := time.Date(2022, 3, 4, 12, 30, 0, 0, time.UTC)
+	em := accountDeletionScheduledEmail(to, token, deleteAt)
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.From != From {
+		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
+	}
+	if !strings.Contains(em.Body, "deleted on Fri, 04 Mar 2022 12:30:00 UTC.") {
+		t.Fatal("Expected the email to contain the deletion time.")
+	}
+	if !strings.Contains(em.Body, "https://account.siasky.net/user/restore?token="+token) {
+		t.Fatal("Invalid restore link.")
+	}
+}
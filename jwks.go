@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/jwt"
+	"github.com/lestrrat-go/jwx/jwk"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// defaultKeyRetireAfter defines for how long we keep accepting the
+	// signatures of a signing key after it gets replaced. It needs to be
+	// longer than the lifetime of our JWTs.
+	defaultKeyRetireAfter = 24 * time.Hour
+
+	// jwksUsage describes the usage of the `jwks` command.
+	jwksUsage = `Usage:
+  accounts jwks rotate [-file path] [-promote=true] [-retire-after 24h]
+      Generates a new signing key and adds it to the JWKS. Unless -promote is
+      false, the new key becomes the signing key and the previous one gets
+      retired after the given period.
+  accounts jwks promote -kid <kid> [-file path] [-retire-after 24h]
+      Makes the key with the given ID the signing key and retires the previous
+      one after the given period.`
+)
+
+// jwksCommand manages the keys in the JWKS file. Running servers pick up the
+// changes without a restart.
+func jwksCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(jwksUsage)
+	}
+	fs := flag.NewFlagSet("jwks "+args[0], flag.ContinueOnError)
+	file := fs.String("file", jwksFile(), "path to the JWKS file")
+	retireAfter := fs.Duration("retire-after", defaultKeyRetireAfter, "how long to keep accepting the previous signing key")
+	promote := fs.Bool("promote", true, "make the new key the signing key")
+	kid := fs.String("kid", "", "ID of the key to promote")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *retireAfter < 0 {
+		return errors.New("retire-after cannot be negative")
+	}
+	set, err := readKeySet(*file)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "rotate":
+		var key jwk.Key
+		set, key, err = jwt.RotateKeySet(set, *retireAfter, *promote)
+		if err != nil {
+			return errors.AddContext(err, "failed to rotate keys")
+		}
+		fmt.Println("Added key", key.KeyID())
+	case "promote":
+		if *kid == "" {
+			return errors.New("missing key ID")
+		}
+		set, err = jwt.PromoteKey(set, *kid, *retireAfter)
+		if err != nil {
+			return errors.AddContext(err, "failed to promote key")
+		}
+		fmt.Println("Promoted key", *kid)
+	default:
+		return errors.New(jwksUsage)
+	}
+	return writeKeySet(*file, set)
+}
+
+// jwksFile returns the path to the JWKS file, as defined by the environment.
+func jwksFile() string {
+	if f := os.Getenv(envAccountsJWKSFile); f != "" {
+		return f
+	}
+	return jwt.AccountsJWKSFile
+}
+
+// readKeySet reads the key set in the given file.
+func readKeySet(file string) (jwk.Set, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to read JWKS file")
+	}
+	set := jwk.NewSet()
+	err = json.Unmarshal(b, set)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse JWKS file")
+	}
+	return set, nil
+}
+
+// writeKeySet atomically replaces the given file with the given key set.
+func writeKeySet(file string, set jwk.Set) error {
+	b, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return errors.AddContext(err, "failed to serialize JWKS")
+	}
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return errors.AddContext(err, "failed to write JWKS file")
+	}
+	return errors.AddContext(os.Rename(tmp, file), "failed to replace JWKS file")
+}
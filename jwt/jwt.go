@@ -16,10 +16,11 @@ import (
 )
 
 var (
-	// AccountsJWKS is the public RS key set used by accounts for JWT signing.
+	// AccountsJWKS is the full key set used by accounts for JWT signing.
 	AccountsJWKS jwk.Set
 
-	// AccountsPublicJWKS is a verification-only version of the JWKS.
+	// AccountsPublicJWKS is a verification-only version of the JWKS. It only
+	// contains keys which haven't been retired. Use PublicKeySet to access it.
 	// We cannot use the full version of the JWKS for verification.
 	AccountsPublicJWKS jwk.Set
 
@@ -41,9 +42,10 @@ var (
 	// Can be overridden by main.go is PORTAL_DOMAIN is set.
 	PortalName = "https://siasky.net"
 
-	// TTL defines the lifetime of the JWT token in seconds.'
+	// TTL defines the lifetime of the JWT token in seconds. JWTs are
+	// short-lived, clients get new ones via `POST /token/refresh`.
 	// Can be overridden by the ACCOUNTS_JWT_TTL environment variable.
-	TTL = 720 * 3600
+	TTL = 15 * 60
 )
 
 type (
@@ -76,11 +78,19 @@ func ContextWithToken(ctx context.Context, token jwt.Token) context.Context {
 // The tokens generated by this function are a slimmed down version of the ones
 // described in ValidateToken's docstring.
 func TokenForUser(email types.Email, sub string, jwtTTL int) (jwt.Token, error) {
+	return TokenForSession(email, sub, "", jwtTTL)
+}
+
+// TokenForSession creates a serialized JWT token for the given user, which
+// belongs to the given session. The session's ID is stored in the token's
+// `jti` claim, which allows us to revoke the token together with its session.
+// An empty session ID results in a token without a `jti` claim.
+func TokenForSession(email types.Email, sub, sessionID string, jwtTTL int) (jwt.Token, error) {
 	sigAlgo, key, err := signatureAlgoAndKey()
 	if err != nil {
 		return nil, err
 	}
-	t, err := tokenForUser(email, sub, jwtTTL)
+	t, err := tokenForUser(email, sub, sessionID, jwtTTL)
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to build token")
 	}
@@ -187,7 +197,7 @@ func TokenSerialize(t jwt.Token) ([]byte, error) {
 //	 },
 //	}
 func ValidateToken(t string) (jwt.Token, error) {
-	token, err := jwt.Parse([]byte(t), jwt.WithKeySet(AccountsPublicJWKS))
+	token, err := jwt.Parse([]byte(t), jwt.WithKeySet(PublicKeySet()))
 	if err != nil {
 		return nil, err
 	}
@@ -201,6 +211,10 @@ func ValidateToken(t string) (jwt.Token, error) {
 // verifying JWTs and caches it in AccountsJWKS (full version) and
 // AccountsPublicJWKS (public key only version).
 //
+// The set may contain multiple keys. We sign with the one marked as the
+// signing key (or with the first key, if none is marked) and we verify with
+// all keys which haven't been retired, yet. See keyset.go for details.
+//
 // See https://tools.ietf.org/html/rfc7517
 // See https://auth0.com/blog/navigating-rs256-and-jwks/
 // See http://self-issued.info/docs/draft-ietf-oauth-json-web-token.html
@@ -218,24 +232,30 @@ func LoadAccountsKeySet(logger *logrus.Logger) error {
 		logger.Warningln("JWKS string:", string(b))
 		return err
 	}
-	// Cache the key set.
-	AccountsJWKS = set
-	// Cache a public version of the key set.
-	AccountsPublicJWKS, err = jwk.PublicSetOf(AccountsJWKS)
+	err = setAccountsKeySet(set, time.Now().UTC())
 	if err != nil {
-		logger.Warningln("ERROR while fetching accounts public JWKS", err)
-		AccountsJWKS = nil
-		AccountsPublicJWKS = nil
+		logger.Warningln("ERROR while loading accounts JWKS", err)
 		return err
 	}
 	return nil
 }
 
-// signatureAlgoAndKey is a helper which returns the algorithm and key defined
-// by the current JWKS.
+// PublicKeySet returns the public keys which are currently valid for
+// verifying our JWTs.
+func PublicKeySet() jwk.Set {
+	refreshPublicKeySet()
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return AccountsPublicJWKS
+}
+
+// signatureAlgoAndKey is a helper which returns the algorithm and the key we
+// currently sign with.
 func signatureAlgoAndKey() (jwa.SignatureAlgorithm, jwk.Key, error) {
-	key, found := AccountsJWKS.Get(0)
-	if !found {
+	keySetMu.RLock()
+	key := signingKey
+	keySetMu.RUnlock()
+	if key == nil {
 		return "", nil, errors.New("JWKS is empty")
 	}
 	var sigAlgo jwa.SignatureAlgorithm
@@ -253,7 +273,7 @@ func signatureAlgoAndKey() (jwa.SignatureAlgorithm, jwk.Key, error) {
 
 // tokenForUser is a helper method that puts together an unsigned token based
 // on the provided values.
-func tokenForUser(emailAddr types.Email, sub string, jwtTTL int) (jwt.Token, error) {
+func tokenForUser(emailAddr types.Email, sub, jti string, jwtTTL int) (jwt.Token, error) {
 	if emailAddr == "" || sub == "" {
 		return nil, errors.New("email and sub cannot be empty")
 	}
@@ -279,5 +299,11 @@ func tokenForUser(emailAddr types.Email, sub string, jwtTTL int) (jwt.Token, err
 	if err != nil {
 		return nil, err
 	}
+	if jti != "" {
+		err = t.Set("jti", jti)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return t, nil
 }
@@ -106,3 +106,27 @@ func TestValidateToken_Expired(t *testing.T) {
 		t.Fatalf("Expected an ErrTokenExpired, got %v", err)
 	}
 }
+
+// TestTokenForSession ensures that session tokens carry the session's ID in
+// their `jti` claim and that other tokens don't have one.
+func TestTokenForSession(t *testing.T) {
+	err := LoadAccountsKeySet(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	tk, err := TokenForSession(email, "sub", "session id", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.JwtID() != "session id" {
+		t.Fatalf("Expected jti '%s', got '%s'", "session id", tk.JwtID())
+	}
+	tk, err = TokenForUser(email, "sub", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.JwtID() != "" {
+		t.Fatalf("Expected no jti, got '%s'", tk.JwtID())
+	}
+}
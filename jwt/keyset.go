@@ -0,0 +1,362 @@
+package jwt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+/**
+Key rotation
+
+Our JWKS may hold multiple keys. Exactly one of them is the signing key. We
+mark it with the custom `signing` parameter. If no key is marked, the first key
+in the set is the signing key, which keeps single-key sets working as before.
+
+When we promote a new signing key, the previous one stays in the set, so the
+JWTs it signed remain valid. We mark it with the custom `retire_at` parameter,
+which holds a unix timestamp. Once that moment passes, we stop accepting the
+key's signatures and drop it from the published JWKS.
+
+A rotation goes like this:
+ 1. `accounts jwks rotate -promote=false` adds a new key without promoting it.
+ 2. Wait until all servers have picked up the new key, so they can verify its
+    signatures.
+ 3. `accounts jwks promote -kid <kid>` starts signing with the new key and
+    retires the old one.
+A plain `accounts jwks rotate` performs all of these at once, which is fine for
+a single server.
+*/
+
+const (
+	// KeyParamSigning is the name of the custom JWK parameter which marks the
+	// key we sign with.
+	KeyParamSigning = "signing"
+	// KeyParamRetireAt is the name of the custom JWK parameter which holds
+	// the unix timestamp after which we no longer accept signatures by this
+	// key.
+	KeyParamRetireAt = "retire_at"
+
+	// keyRSABits defines the size of the RSA keys we generate.
+	keyRSABits = 2048
+)
+
+var (
+	// ErrKeyNotFound is returned when we can't find a key with the given ID
+	// in the key set.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrSigningKeyRetired is returned when the JWKS's signing key has been
+	// retired.
+	ErrSigningKeyRetired = errors.New("the signing key has been retired")
+
+	// keySetReloadInterval defines how often we check the JWKS file for
+	// changes.
+	keySetReloadInterval = build.Select(build.Var{
+		Dev:      10 * time.Second,
+		Testing:  time.Second,
+		Standard: time.Minute,
+	}).(time.Duration)
+
+	// keySetMu guards AccountsJWKS, AccountsPublicJWKS, signingKey and
+	// nextRetirement.
+	keySetMu sync.RWMutex
+	// signingKey is the key we currently sign our JWTs with.
+	signingKey jwk.Key
+	// nextRetirement is the earliest retirement time of a key in the
+	// public key set. A zero value means that no key is scheduled for
+	// retirement.
+	nextRetirement time.Time
+)
+
+// GenerateKey generates a new RSA key suitable for signing JWTs.
+func GenerateKey() (jwk.Key, error) {
+	raw, err := rsa.GenerateKey(rand.Reader, keyRSABits)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to generate RSA key")
+	}
+	key, err := jwk.New(raw)
+	if err != nil {
+		return nil, err
+	}
+	err1 := key.Set(jwk.KeyIDKey, uuid.New().String())
+	err2 := key.Set(jwk.AlgorithmKey, jwa.RS256.String())
+	err3 := key.Set(jwk.KeyUsageKey, jwk.ForSignature.String())
+	err = errors.Compose(err1, err2, err3)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RotateKeySet returns a copy of the given key set with a newly generated key
+// added to it. If promote is true, the new key becomes the signing key and the
+// previous signing key gets retired after retireAfter. Keys which have already
+// been retired are dropped from the set.
+func RotateKeySet(set jwk.Set, retireAfter time.Duration, promote bool) (jwk.Set, jwk.Key, error) {
+	now := time.Now().UTC()
+	newSet, err := copyKeySet(set)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Drop all retired keys.
+	for _, k := range keys(newSet) {
+		if keyRetired(k, now) {
+			newSet.Remove(k)
+		}
+	}
+	// Mark the current signing key explicitly, so adding a new key to the set
+	// doesn't change which key we sign with.
+	if sk, err := signingKeyOf(newSet); err == nil {
+		if err = sk.Set(KeyParamSigning, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	newSet.Add(key)
+	if promote {
+		err = promoteKey(newSet, key.KeyID(), now.Add(retireAfter))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return newSet, key, nil
+}
+
+// PromoteKey returns a copy of the given key set in which the key with the
+// given ID is the signing key. The previous signing key gets retired after
+// retireAfter.
+func PromoteKey(set jwk.Set, kid string, retireAfter time.Duration) (jwk.Set, error) {
+	newSet, err := copyKeySet(set)
+	if err != nil {
+		return nil, err
+	}
+	err = promoteKey(newSet, kid, time.Now().UTC().Add(retireAfter))
+	if err != nil {
+		return nil, err
+	}
+	return newSet, nil
+}
+
+// WatchAccountsKeySet periodically checks the JWKS file for changes and
+// reloads it when it changes. This allows us to rotate keys without
+// restarting the service.
+func WatchAccountsKeySet(ctx context.Context, logger *logrus.Logger) {
+	go threadedWatchAccountsKeySet(ctx, logger)
+}
+
+// threadedWatchAccountsKeySet reloads the JWKS file whenever its modification
+// time changes, until the context is cancelled.
+func threadedWatchAccountsKeySet(ctx context.Context, logger *logrus.Logger) {
+	var lastMod time.Time
+	if fi, err := os.Stat(AccountsJWKSFile); err == nil {
+		lastMod = fi.ModTime()
+	}
+	ticker := time.NewTicker(keySetReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(AccountsJWKSFile)
+		if err != nil {
+			logger.Warningln("Failed to stat the accounts JWKS file:", err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		// On failure we keep using the key set we already have and we'll
+		// retry on the next tick.
+		if err = LoadAccountsKeySet(logger); err != nil {
+			continue
+		}
+		lastMod = fi.ModTime()
+		logger.Infoln("Reloaded the accounts JWKS.")
+	}
+}
+
+// setAccountsKeySet makes the given key set the one we use for signing and
+// verifying JWTs.
+func setAccountsKeySet(set jwk.Set, now time.Time) error {
+	sk, err := signingKeyOf(set)
+	if err != nil {
+		return err
+	}
+	if keyRetired(sk, now) {
+		return ErrSigningKeyRetired
+	}
+	pub, next, err := publicKeySetOf(set, now)
+	if err != nil {
+		return errors.AddContext(err, "failed to build public JWKS")
+	}
+	keySetMu.Lock()
+	AccountsJWKS = set
+	AccountsPublicJWKS = pub
+	signingKey = sk
+	nextRetirement = next
+	keySetMu.Unlock()
+	return nil
+}
+
+// refreshPublicKeySet rebuilds the public key set once a key in it gets
+// retired.
+func refreshPublicKeySet() {
+	now := time.Now().UTC()
+	keySetMu.RLock()
+	set := AccountsJWKS
+	next := nextRetirement
+	keySetMu.RUnlock()
+	if set == nil || next.IsZero() || now.Before(next) {
+		return
+	}
+	pub, next, err := publicKeySetOf(set, now)
+	if err != nil {
+		return
+	}
+	keySetMu.Lock()
+	// Make sure the key set didn't get reloaded in the meantime.
+	if AccountsJWKS == set {
+		AccountsPublicJWKS = pub
+		nextRetirement = next
+	}
+	keySetMu.Unlock()
+}
+
+// publicKeySetOf returns the public versions of all keys in the set which
+// haven't been retired, yet. It also returns the earliest upcoming retirement
+// among them.
+func publicKeySetOf(set jwk.Set, now time.Time) (jwk.Set, time.Time, error) {
+	pub := jwk.NewSet()
+	var next time.Time
+	for _, k := range keys(set) {
+		if keyRetired(k, now) {
+			continue
+		}
+		if retireAt, ok := keyRetireAt(k); ok && (next.IsZero() || retireAt.Before(next)) {
+			next = retireAt
+		}
+		pk, err := jwk.PublicKeyOf(k)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		// Our custom parameters are of no interest to the outside world.
+		err1 := pk.Remove(KeyParamSigning)
+		err2 := pk.Remove(KeyParamRetireAt)
+		if err = errors.Compose(err1, err2); err != nil {
+			return nil, time.Time{}, err
+		}
+		pub.Add(pk)
+	}
+	return pub, next, nil
+}
+
+// promoteKey makes the key with the given ID the signing key of the set and
+// schedules the retirement of the previous signing key. It modifies the set.
+func promoteKey(set jwk.Set, kid string, retireAt time.Time) error {
+	key, ok := set.LookupKeyID(kid)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if key.Algorithm() == "" {
+		return errors.New("the key doesn't define a signature algorithm")
+	}
+	prev, err := signingKeyOf(set)
+	if err != nil {
+		return err
+	}
+	if prev.KeyID() == key.KeyID() {
+		return nil
+	}
+	err1 := prev.Remove(KeyParamSigning)
+	err2 := prev.Set(KeyParamRetireAt, retireAt.Unix())
+	err3 := key.Set(KeyParamSigning, true)
+	err4 := key.Remove(KeyParamRetireAt)
+	return errors.Compose(err1, err2, err3, err4)
+}
+
+// signingKeyOf returns the key we sign with. That's the key marked as the
+// signing key or, if there is no such key, the first key in the set.
+func signingKeyOf(set jwk.Set) (jwk.Key, error) {
+	for _, k := range keys(set) {
+		if v, ok := k.Get(KeyParamSigning); ok {
+			if signing, ok := v.(bool); ok && signing {
+				return k, nil
+			}
+		}
+	}
+	k, ok := set.Get(0)
+	if !ok {
+		return nil, errors.New("JWKS is empty")
+	}
+	return k, nil
+}
+
+// keyRetireAt returns the moment the given key gets retired, if it's
+// scheduled for retirement.
+func keyRetireAt(k jwk.Key) (time.Time, bool) {
+	v, ok := k.Get(KeyParamRetireAt)
+	if !ok {
+		return time.Time{}, false
+	}
+	switch ts := v.(type) {
+	case float64:
+		return time.Unix(int64(ts), 0).UTC(), true
+	case int64:
+		return time.Unix(ts, 0).UTC(), true
+	case json.Number:
+		n, err := ts.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(n, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// keyRetired returns true if the given key has been retired by the given
+// moment.
+func keyRetired(k jwk.Key, now time.Time) bool {
+	retireAt, ok := keyRetireAt(k)
+	return ok && !now.Before(retireAt)
+}
+
+// keys returns a slice of all keys in the set.
+func keys(set jwk.Set) []jwk.Key {
+	ks := make([]jwk.Key, 0, set.Len())
+	for i := 0; i < set.Len(); i++ {
+		if k, ok := set.Get(i); ok {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// copyKeySet returns a deep copy of the given key set.
+func copyKeySet(set jwk.Set) (jwk.Set, error) {
+	b, err := json.Marshal(set)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to serialize JWKS")
+	}
+	newSet := jwk.NewSet()
+	err = json.Unmarshal(b, newSet)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to parse JWKS")
+	}
+	return newSet, nil
+}
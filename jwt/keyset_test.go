@@ -0,0 +1,114 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/sirupsen/logrus"
+)
+
+// TestKeyRotation ensures that we sign with the promoted key while we keep
+// accepting signatures by the previous keys until they get retired.
+func TestKeyRotation(t *testing.T) {
+	err := LoadAccountsKeySet(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restore the original key set when we're done.
+	defer func() {
+		if err := LoadAccountsKeySet(logrus.New()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	// newToken issues a new serialized token.
+	newToken := func() string {
+		tk, err := TokenForUser(email, "sub", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := TokenSerialize(tk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	orig, err := signingKeyOf(AccountsJWKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkOrig := newToken()
+	numKeys := AccountsJWKS.Len()
+
+	// Add a new key without promoting it. We should keep signing with the
+	// original key.
+	set, key, err := RotateKeySet(AccountsJWKS, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != numKeys+1 {
+		t.Fatalf("Expected %d keys, got %d", numKeys+1, set.Len())
+	}
+	sk, err := signingKeyOf(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk.KeyID() != orig.KeyID() {
+		t.Fatalf("Expected signing key %s, got %s", orig.KeyID(), sk.KeyID())
+	}
+
+	// Promote the new key. Tokens signed by either key should be valid.
+	set, err = PromoteKey(set, key.KeyID(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setAccountsKeySet(set, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkNew := newToken()
+	for _, tk := range []string{tkOrig, tkNew} {
+		if _, err = ValidateToken(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub := PublicKeySet()
+	if pub.Len() != numKeys+1 {
+		t.Fatalf("Expected %d public keys, got %d", numKeys+1, pub.Len())
+	}
+	for _, k := range keys(pub) {
+		_, ok1 := k.Get(KeyParamSigning)
+		_, ok2 := k.Get(KeyParamRetireAt)
+		if ok1 || ok2 {
+			t.Fatalf("Expected no custom params in public key %s", k.KeyID())
+		}
+	}
+
+	// Rotate again and retire the previous key immediately. Its tokens should
+	// no longer be valid and the original key should still be accepted.
+	set, _, err = RotateKeySet(set, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setAccountsKeySet(set, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ValidateToken(tkNew); err == nil {
+		t.Fatal("Expected the token of a retired key to be rejected.")
+	}
+	if _, err = ValidateToken(tkOrig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ValidateToken(newToken()); err != nil {
+		t.Fatal(err)
+	}
+	if PublicKeySet().Len() != numKeys+1 {
+		t.Fatalf("Expected %d public keys, got %d", numKeys+1, PublicKeySet().Len())
+	}
+	// Promoting an unknown key fails.
+	if _, err = PromoteKey(set, "unknown", time.Hour); err != ErrKeyNotFound {
+		t.Fatalf("Expected '%v', got '%v'", ErrKeyNotFound, err)
+	}
+}
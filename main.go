@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/build"
@@ -29,6 +32,9 @@ const (
 	envAccountsJWKSFile = "ACCOUNTS_JWKS_FILE"
 	// envJWTTTL holds the name of the environment variable for JWT TTL.
 	envJWTTTL = "ACCOUNTS_JWT_TTL"
+	// envRefreshTokenTTL holds the name of the environment variable for the
+	// refresh token TTL.
+	envRefreshTokenTTL = "ACCOUNTS_REFRESH_TOKEN_TTL" // #nosec
 	// envDBHost holds the name of the environment variable for DB host.
 	envDBHost = "SKYNET_DB_HOST"
 	// envDBPort holds the name of the environment variable for DB port.
@@ -64,6 +70,57 @@ const (
 	// reaches that limit they can always delete some API keys in order to make
 	// space for new ones.
 	envMaxNumAPIKeysPerUser = "ACCOUNTS_MAX_NUM_API_KEYS_PER_USER" // #nosec
+	// envAdminSubs holds the name of the environment variable for the
+	// comma-separated list of subs of the users who can access the admin
+	// endpoints.
+	envAdminSubs = "ACCOUNTS_ADMIN_SUBS"
+	// envPasskeyOrigins holds the name of the environment variable for the
+	// comma-separated list of origins from which we accept passkey logins and
+	// registrations.
+	envPasskeyOrigins = "ACCOUNTS_PASSKEY_ORIGINS"
+	// envAPIKeySecret holds the name of the environment variable for the
+	// secret with which we hash API keys before storing them. Changing it
+	// invalidates all existing API keys.
+	envAPIKeySecret = "ACCOUNTS_API_KEY_SECRET" // #nosec G101: Potential hardcoded credentials
+	// envTrustedProxies holds the name of the environment variable for the
+	// comma-separated list of IP addresses and CIDR ranges of the reverse
+	// proxies whose forwarding headers we trust.
+	envTrustedProxies = "ACCOUNTS_TRUSTED_PROXIES"
+	// envInternalSecret holds the name of the environment variable for the
+	// shared secret with which callers sign their requests to the internal
+	// endpoints.
+	envInternalSecret = "ACCOUNTS_INTERNAL_SECRET" // #nosec G101: Potential hardcoded credentials
+	// envInternalPort holds the name of the environment variable for the port
+	// of the separate listener of the internal endpoints. Optional.
+	envInternalPort = "ACCOUNTS_INTERNAL_PORT"
+	// envInternalTLSCert holds the name of the environment variable for the
+	// path to the certificate of the internal listener. Setting it, together
+	// with the key and the client CA, enables mTLS on the internal listener.
+	envInternalTLSCert = "ACCOUNTS_INTERNAL_TLS_CERT"
+	// envInternalTLSKey holds the name of the environment variable for the
+	// path to the private key of the internal listener's certificate.
+	envInternalTLSKey = "ACCOUNTS_INTERNAL_TLS_KEY"
+	// envInternalClientCA holds the name of the environment variable for the
+	// path to the CA bundle we verify the client certificates against.
+	envInternalClientCA = "ACCOUNTS_INTERNAL_CLIENT_CA"
+	// envSkydURL holds the name of the environment variable which defines the
+	// base URL of the skyd instance we fetch skyfile metadata from.
+	// Example: http://sia:9980
+	envSkydURL = "ACCOUNTS_SKYD_URL"
+	// envSkydAPIPassword holds the name of the environment variable which
+	// holds the API password of the skyd instance at ACCOUNTS_SKYD_URL.
+	envSkydAPIPassword = "SIA_API_PASSWORD" // #nosec G101: Potential hardcoded credentials
+	// envMetaFetcherTimeout holds the name of the environment variable which
+	// defines how many seconds the metafetcher waits for skyd to return a
+	// skyfile's metadata.
+	envMetaFetcherTimeout = "ACCOUNTS_METAFETCHER_TIMEOUT"
+	// envMetaFetcherWorkers holds the name of the environment variable
+	// which defines how many skylinks the metafetcher processes in parallel.
+	envMetaFetcherWorkers = "ACCOUNTS_METAFETCHER_CONCURRENCY"
+	// envDeletionGraceDays holds the name of the environment variable which
+	// defines for how many days deleted accounts can be restored before we
+	// purge them.
+	envDeletionGraceDays = "ACCOUNTS_DELETION_GRACE_DAYS"
 )
 
 type (
@@ -78,9 +135,22 @@ type (
 		StripeKey             string
 		JWKSFile              string
 		JWTTTL                int
+		RefreshTokenTTL       int
 		EmailURI              string
 		EmailFrom             string
 		MaxAPIKeys            int
+		AdminSubs             []string
+		PasskeyOrigins        []string
+		APIKeySecret          string
+		TrustedProxies        []*net.IPNet
+		InternalSecret        string
+		InternalPort          int
+		InternalTLSConfig     *tls.Config
+		SkydURL               string
+		SkydAPIPassword       string
+		MetaFetcherTimeout    time.Duration
+		MetaFetcherWorkers    int
+		DeletionGracePeriod   time.Duration
 	}
 )
 
@@ -184,6 +254,19 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 		// The environment doesn't specify a value, use the default.
 		config.JWTTTL = jwt.TTL
 	}
+	// Parse the optional env var that controls the TTL of the refresh tokens.
+	if rtTTLStr := os.Getenv(envRefreshTokenTTL); rtTTLStr != "" {
+		rtTTL, err := strconv.Atoi(rtTTLStr)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envRefreshTokenTTL, err)
+		}
+		if rtTTL <= 0 {
+			return ServiceConfig{}, fmt.Errorf("the %s env var is set to a non-positive value, which is invalid (must be positive or unset)", envRefreshTokenTTL)
+		}
+		config.RefreshTokenTTL = rtTTL
+	} else {
+		config.RefreshTokenTTL = database.RefreshTokenTTL
+	}
 
 	// Fetch configuration data for sending emails.
 	config.EmailURI = os.Getenv(envEmailURI)
@@ -225,6 +308,95 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 		// The environment doesn't specify a value, use the default.
 		config.MaxAPIKeys = database.MaxNumAPIKeysPerUser
 	}
+	for _, sub := range strings.Split(os.Getenv(envAdminSubs), ",") {
+		if sub = strings.TrimSpace(sub); sub != "" {
+			config.AdminSubs = append(config.AdminSubs, sub)
+		}
+	}
+	for _, o := range strings.Split(os.Getenv(envPasskeyOrigins), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			config.PasskeyOrigins = append(config.PasskeyOrigins, o)
+		}
+	}
+	config.TrustedProxies = api.TrustedProxies
+	if tp := os.Getenv(envTrustedProxies); tp != "" {
+		config.TrustedProxies, err = api.ParseTrustedProxies(tp)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envTrustedProxies, err)
+		}
+	}
+	config.InternalSecret = os.Getenv(envInternalSecret)
+	if portStr := os.Getenv(envInternalPort); portStr != "" {
+		config.InternalPort, err = strconv.Atoi(portStr)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envInternalPort, err)
+		}
+		if config.InternalPort <= 0 || config.InternalPort > 65535 {
+			return ServiceConfig{}, fmt.Errorf("the %s env var is set to %d, which is an invalid value (must be a valid port or unset)", envInternalPort, config.InternalPort)
+		}
+	}
+	certFile, keyFile, caFile := os.Getenv(envInternalTLSCert), os.Getenv(envInternalTLSKey), os.Getenv(envInternalClientCA)
+	if certFile != "" || keyFile != "" || caFile != "" {
+		if config.InternalPort == 0 {
+			return ServiceConfig{}, fmt.Errorf("mTLS requires a separate internal listener, please set %s", envInternalPort)
+		}
+		config.InternalTLSConfig, err = api.LoadInternalTLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			return ServiceConfig{}, errors.AddContext(err, "failed to load the internal listener's TLS config")
+		}
+	}
+	if config.InternalSecret == "" && config.InternalTLSConfig == nil {
+		logger.Warningf(`Neither %s nor mTLS is configured! All requests to the internal endpoints will be rejected.`, envInternalSecret)
+	}
+	config.APIKeySecret = os.Getenv(envAPIKeySecret)
+	if config.APIKeySecret == "" {
+		logger.Warningf(`Environment variable %s is missing! API keys are hashed`+
+			` without a secret, so anyone with access to the DB can verify guessed keys offline.`, envAPIKeySecret)
+	}
+
+	// Fetch the configuration of the skyd instance we fetch metadata from.
+	config.SkydURL = metafetcher.SkydURL
+	if skydURL := os.Getenv(envSkydURL); skydURL != "" {
+		uri, err := url.Parse(skydURL)
+		if err != nil || uri.Scheme == "" || uri.Host == "" {
+			return ServiceConfig{}, errors.New("invalid value for env var " + envSkydURL)
+		}
+		config.SkydURL = skydURL
+	}
+	config.SkydAPIPassword = os.Getenv(envSkydAPIPassword)
+	config.MetaFetcherTimeout = metafetcher.RequestTimeout
+	if timeoutStr := os.Getenv(envMetaFetcherTimeout); timeoutStr != "" {
+		timeout, err := strconv.Atoi(timeoutStr)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envMetaFetcherTimeout, err)
+		}
+		if timeout <= 0 {
+			return ServiceConfig{}, fmt.Errorf("the %s env var is set to %d, which is an invalid value (must be positive or unset)", envMetaFetcherTimeout, timeout)
+		}
+		config.MetaFetcherTimeout = time.Duration(timeout) * time.Second
+	}
+	config.MetaFetcherWorkers = metafetcher.MaxConcurrency
+	if concurrencyStr := os.Getenv(envMetaFetcherWorkers); concurrencyStr != "" {
+		concurrency, err := strconv.Atoi(concurrencyStr)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envMetaFetcherWorkers, err)
+		}
+		if concurrency <= 0 {
+			return ServiceConfig{}, fmt.Errorf("the %s env var is set to %d, which is an invalid value (must be positive or unset)", envMetaFetcherWorkers, concurrency)
+		}
+		config.MetaFetcherWorkers = concurrency
+	}
+	config.DeletionGracePeriod = database.UserDeletionGracePeriod
+	if daysStr := os.Getenv(envDeletionGraceDays); daysStr != "" {
+		days, err := strconv.Atoi(daysStr)
+		if err != nil {
+			return ServiceConfig{}, fmt.Errorf("failed to parse env var %s: %s", envDeletionGraceDays, err)
+		}
+		if days < 0 {
+			return ServiceConfig{}, fmt.Errorf("the %s env var is set to %d, which is an invalid value (must be non-negative or unset)", envDeletionGraceDays, days)
+		}
+		config.DeletionGracePeriod = time.Duration(days) * 24 * time.Hour
+	}
 
 	return config, nil
 }
@@ -239,6 +411,21 @@ func main() {
 
 	// Load the environment variables from the .env file.
 	_ = godotenv.Load()
+	// Handle admin commands.
+	if len(os.Args) > 1 && os.Args[1] == "jwks" {
+		err := jwksCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "usage-rollups" {
+		err := usageRollupsCommand(ctx, logger, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	config, err := parseConfiguration(logger)
 	if err != nil {
 		log.Fatal(err)
@@ -248,11 +435,25 @@ func main() {
 	email.PortalAddressAccounts = config.PortalAddressAccounts
 	api.DashboardURL = config.PortalAddressAccounts
 	email.ServerLockID = config.ServerLockID
+	metafetcher.ServerLockID = config.ServerLockID
 	stripe.Key = config.StripeKey
 	jwt.AccountsJWKSFile = config.JWKSFile
 	jwt.TTL = config.JWTTTL
+	database.RefreshTokenTTL = config.RefreshTokenTTL
 	email.From = config.EmailFrom
 	database.MaxNumAPIKeysPerUser = config.MaxAPIKeys
+	api.AdminSubs = config.AdminSubs
+	database.PasskeyOrigins = config.PasskeyOrigins
+	database.APIKeyHashSecret = config.APIKeySecret
+	api.TrustedProxies = config.TrustedProxies
+	api.InternalSecret = []byte(config.InternalSecret)
+	api.InternalPort = config.InternalPort
+	api.InternalTLSConfig = config.InternalTLSConfig
+	metafetcher.SkydURL = config.SkydURL
+	metafetcher.SkydAPIPassword = config.SkydAPIPassword
+	metafetcher.RequestTimeout = config.MetaFetcherTimeout
+	metafetcher.MaxConcurrency = config.MetaFetcherWorkers
+	database.UserDeletionGracePeriod = config.DeletionGracePeriod
 
 	// Set up key components:
 
@@ -261,6 +462,8 @@ func main() {
 	if err != nil {
 		log.Fatal(errors.AddContext(err, fmt.Sprintf("failed to load JWKS file from %s", jwt.AccountsJWKSFile)))
 	}
+	// Pick up key rotations without a restart.
+	jwt.WatchAccountsKeySet(ctx, logger)
 	// Connect to the database.
 	db, err := database.New(ctx, config.DBCreds, logger)
 	if err != nil {
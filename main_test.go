@@ -6,9 +6,11 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/metafetcher"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 )
@@ -28,9 +30,14 @@ func TestParseConfiguration(t *testing.T) {
 			envStripeAPIKey,
 			envAccountsJWKSFile,
 			envJWTTTL,
+			envRefreshTokenTTL,
 			envEmailURI,
 			envEmailFrom,
 			envMaxNumAPIKeysPerUser,
+			envSkydURL,
+			envSkydAPIPassword,
+			envMetaFetcherTimeout,
+			envMetaFetcherWorkers,
 		}
 		values := make(map[string]string)
 		for _, k := range keys {
@@ -137,6 +144,19 @@ func TestParseConfiguration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Invalid ACCOUNTS_REFRESH_TOKEN_TTL
+	err = os.Setenv(envRefreshTokenTTL, "-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseConfiguration(logger)
+	if err == nil || !strings.Contains(err.Error(), envRefreshTokenTTL) {
+		t.Fatal("Failed to error out on negative", envRefreshTokenTTL)
+	}
+	err = os.Unsetenv(envRefreshTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Missing ACCOUNTS_EMAIL_URI
 	err = os.Setenv(envEmailURI, "")
@@ -158,6 +178,50 @@ func TestParseConfiguration(t *testing.T) {
 		t.Fatal("Failed to error out on invalid", envEmailURI)
 	}
 
+	// Invalid ACCOUNTS_SKYD_URL
+	err = os.Setenv(envEmailURI, emailURIValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv(envSkydURL, "not a URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseConfiguration(logger)
+	if err == nil || !strings.Contains(err.Error(), "invalid value for env var "+envSkydURL) {
+		t.Fatal("Failed to error out on invalid", envSkydURL)
+	}
+	err = os.Setenv(envSkydURL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zero ACCOUNTS_METAFETCHER_TIMEOUT
+	err = os.Setenv(envMetaFetcherTimeout, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseConfiguration(logger)
+	if err == nil || !strings.Contains(err.Error(), "must be positive or unset") {
+		t.Fatal("Failed to error out on zero", envMetaFetcherTimeout)
+	}
+	err = os.Setenv(envMetaFetcherTimeout, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Invalid ACCOUNTS_METAFETCHER_CONCURRENCY
+	err = os.Setenv(envMetaFetcherWorkers, "many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseConfiguration(logger)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse env var "+envMetaFetcherWorkers) {
+		t.Fatal("Failed to error out on invalid", envMetaFetcherWorkers)
+	}
+	err = os.Setenv(envMetaFetcherWorkers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Set all values
 	err = os.Setenv(envEmailURI, emailURIValue)
 	if err != nil {
@@ -199,9 +263,21 @@ func TestParseConfiguration(t *testing.T) {
 	if config.JWTTTL != ttl {
 		t.Fatalf("Expected %d, got %d", ttl, config.JWTTTL)
 	}
+	if config.RefreshTokenTTL != database.RefreshTokenTTL {
+		t.Fatalf("Expected %d, got %d", database.RefreshTokenTTL, config.RefreshTokenTTL)
+	}
 	if config.MaxAPIKeys != database.MaxNumAPIKeysPerUser {
 		t.Fatalf("Expected %d, got %d", database.MaxNumAPIKeysPerUser, config.MaxAPIKeys)
 	}
+	if config.SkydURL != metafetcher.SkydURL {
+		t.Fatalf("Expected %s, got %s", metafetcher.SkydURL, config.SkydURL)
+	}
+	if config.MetaFetcherTimeout != metafetcher.RequestTimeout {
+		t.Fatalf("Expected %v, got %v", metafetcher.RequestTimeout, config.MetaFetcherTimeout)
+	}
+	if config.MetaFetcherWorkers != metafetcher.MaxConcurrency {
+		t.Fatalf("Expected %d, got %d", metafetcher.MaxConcurrency, config.MetaFetcherWorkers)
+	}
 
 	// Set alternative config values and test their outcomes.
 
@@ -216,6 +292,24 @@ func TestParseConfiguration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	skydURL := "http://localhost:9980"
+	err = os.Setenv(envSkydURL, skydURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydPass := "not-a-password"
+	err = os.Setenv(envSkydAPIPassword, skydPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv(envMetaFetcherTimeout, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv(envMetaFetcherWorkers, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	config, err = parseConfiguration(logger)
 	if err != nil {
@@ -227,6 +321,18 @@ func TestParseConfiguration(t *testing.T) {
 	if config.MaxAPIKeys != maxKeys {
 		t.Fatalf("Expected %d, got %d", maxKeys, config.MaxAPIKeys)
 	}
+	if config.SkydURL != skydURL {
+		t.Fatalf("Expected %s, got %s", skydURL, config.SkydURL)
+	}
+	if config.SkydAPIPassword != skydPass {
+		t.Fatalf("Expected %s, got %s", skydPass, config.SkydAPIPassword)
+	}
+	if config.MetaFetcherTimeout != 5*time.Second {
+		t.Fatalf("Expected %v, got %v", 5*time.Second, config.MetaFetcherTimeout)
+	}
+	if config.MetaFetcherWorkers != 3 {
+		t.Fatalf("Expected %d, got %d", 3, config.MetaFetcherWorkers)
+	}
 }
 
 // TestLoadDBCredentials ensures that we validate that all required environment
@@ -6,31 +6,117 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// maxAttempts defines the maximum number of attempts we are going to make to
-// process a message.
-const maxAttempts = 3
+const (
+	// batchSize defines the largest batch of jobs we will process at once.
+	batchSize = 100
+	// maxBackoff defines the longest we are going to wait before retrying a
+	// failed job.
+	maxBackoff = time.Hour
+)
+
+var (
+	// ServerLockID holds the name of this particular server. We use it to
+	// lock the jobs we are processing, so other servers sharing the same DB
+	// don't process them at the same time. Its value is controlled by the
+	// SERVER_DOMAIN environment variable.
+	ServerLockID = build.Select(
+		build.Var{
+			Dev:      "",
+			Testing:  "siasky.test",
+			Standard: "",
+		},
+	).(string)
+
+	// SkydURL is the base URL of the skyd instance we fetch skyfile metadata
+	// from. We talk directly to skyd, so we don't get rate-limited by nginx in
+	// case we need to make many requests. Its value is controlled by the
+	// ACCOUNTS_SKYD_URL environment variable.
+	SkydURL = "http://sia:9980"
+	// SkydAPIPassword is the API password of the skyd instance at SkydURL.
+	// Its value is controlled by the SIA_API_PASSWORD environment variable.
+	SkydAPIPassword = ""
+	// RequestTimeout defines how long we are going to wait for skyd to return
+	// a skyfile's metadata. Its value is controlled by the
+	// ACCOUNTS_METAFETCHER_TIMEOUT environment variable.
+	RequestTimeout = 30 * time.Second
+	// MaxConcurrency defines the number of workers fetching metadata in
+	// parallel. Its value is controlled by the
+	// ACCOUNTS_METAFETCHER_CONCURRENCY environment variable.
+	MaxConcurrency = 10
+
+	// baseBackoff defines how long we wait before retrying a job after its
+	// first failed attempt. Each subsequent failure doubles that time.
+	baseBackoff = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  10 * time.Millisecond,
+			Standard: time.Minute,
+		},
+	).(time.Duration)
 
-// Message is the format we use to tell the MetaFetcher to download
-// the metadata for a given skylink and then add its size to the used space of
-// a given user.
-type Message struct {
-	SkylinkID primitive.ObjectID
-	Attempts  uint8
+	// sleepBetweenScans defines how long the MetaFetcher should sleep between
+	// its sweeps of the DB.
+	sleepBetweenScans = build.Select(
+		build.Var{
+			Dev:      time.Second,
+			Testing:  100 * time.Millisecond,
+			Standard: 3 * time.Second,
+		},
+	).(time.Duration)
+)
+
+type (
+	// skyfileMetadata is the subset of the skyfile metadata returned by skyd
+	// which we are interested in.
+	skyfileMetadata struct {
+		Filename    string                    `json:"filename"`
+		Length      int64                     `json:"length"`
+		DefaultPath string                    `json:"defaultpath"`
+		Subfiles    map[string]skyfileSubfile `json:"subfiles"`
+	}
+	// skyfileSubfile describes a single file within a skyfile.
+	skyfileSubfile struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"contenttype"`
+		Len         int64  `json:"len"`
+	}
+)
+
+// task is a job handed over to the workers, along with the WaitGroup of the
+// batch it belongs to.
+type task struct {
+	job database.MetaFetcherJob
+	wg  *sync.WaitGroup
 }
 
-// MetaFetcher is a background task that listens for messages on its queue and
-// then processes them.
+// MetaFetcher is a background task that periodically scans the DB for queued
+// skylinks and fetches their metadata. The queue is persisted in the DB, so
+// no work is lost on restart and several servers can share the work.
 type MetaFetcher struct {
-	Queue  chan Message
 	db     *database.DB
 	logger *logrus.Logger
+	wakeUp chan struct{}
+	// tasks feeds the jobs of the current batch to the workers.
+	tasks        chan task
+	staticClient *http.Client
+
+	// lastReconciliation holds the report of the last reconciliation run.
+	lastReconciliation ReconciliationReport
+	mu                 sync.Mutex
+	// staticReconcileMu ensures that only one reconciliation runs at a time.
+	staticReconcileMu sync.Mutex
 }
 
 // New returns a new MetaFetcher instance and starts its internal queue watcher.
@@ -39,58 +125,123 @@ func New(ctx context.Context, db *database.DB, logger *logrus.Logger) *MetaFetch
 		logger = logrus.New()
 	}
 	mf := MetaFetcher{
-		Queue:  make(chan Message, 1000),
 		db:     db,
 		logger: logger,
+		wakeUp: make(chan struct{}, 1),
+		tasks:  make(chan task),
+		staticClient: &http.Client{
+			Timeout: RequestTimeout,
+		},
 	}
 
+	workers := MaxConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go mf.threadedWorker(ctx)
+	}
 	go mf.threadedStartQueueWatcher(ctx)
+	go mf.threadedReconcile(ctx)
 
 	return &mf
 }
 
-// threadedStartQueueWatcher starts a loop over the Queue that processes each
-// incoming message in a separate goroutine.
+// Enqueue adds the given skylink to the persistent queue of skylinks waiting
+// to have their metadata fetched.
+func (mf *MetaFetcher) Enqueue(ctx context.Context, skylinkID primitive.ObjectID) error {
+	err := mf.db.MetaFetcherJobCreate(ctx, skylinkID)
+	if err != nil {
+		return err
+	}
+	mf.notify()
+	return nil
+}
+
+// notify lets the watcher know there is work for it, so it doesn't need to
+// wait for its next scan. If it's already been notified, there is no need to
+// do it again.
+func (mf *MetaFetcher) notify() {
+	select {
+	case mf.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// threadedStartQueueWatcher periodically scans the queue in the DB and
+// processes the jobs it finds there.
 func (mf *MetaFetcher) threadedStartQueueWatcher(ctx context.Context) {
-	for m := range mf.Queue {
+	for {
+		mf.processQueue(ctx)
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			// Process each message in a separate goroutine because fetching the
-			// meta might take a long time (30 seconds) and we don't want to block
-			// the queue.
-			go mf.processMessage(ctx, m)
+		case <-mf.wakeUp:
+		case <-time.After(sleepBetweenScans):
 		}
 	}
 }
 
-// processMessage tries to download the metadata for the given skylink and
-// update the skylink's record in the database. If it fails to download it will
-// put the message back in the queue and retry it later a maximum of maxAttempts
-// times.
-func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
-	sl, err := mf.db.SkylinkByID(ctx, m.SkylinkID)
+// threadedWorker processes jobs from the tasks channel until the context is
+// closed. We run a fixed number of workers, so we never hammer skyd with more
+// than MaxConcurrency parallel requests.
+func (mf *MetaFetcher) threadedWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-mf.tasks:
+			mf.processJob(ctx, t.job)
+			t.wg.Done()
+		}
+	}
+}
+
+// processQueue locks a batch of jobs and hands them over to the workers. It
+// returns once all jobs in the batch are processed.
+func (mf *MetaFetcher) processQueue(ctx context.Context) {
+	jobs, err := mf.db.MetaFetcherJobLockAndFetch(ctx, ServerLockID, batchSize)
 	if err != nil {
-		logrus.Tracef("Failed to fetch skylink from DB. Skylink ID: %v, error: %v", m.SkylinkID, err)
-		if m.Attempts >= maxAttempts {
-			mf.logger.Debugf("Message exceeded its maximum number of attempts, dropping: %v. Last error: %v.", m, err)
+		mf.logger.Warningln(errors.AddContext(err, "failed to fetch metafetcher jobs"))
+		return
+	}
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		select {
+		case <-ctx.Done():
+			// The workers are shutting down, there is no point in waiting
+			// for them.
 			return
+		case mf.tasks <- task{job: j, wg: &wg}:
 		}
-		m.Attempts++
-		go func() { mf.Queue <- m }()
+	}
+	wg.Wait()
+}
+
+// processJob tries to download the metadata for the given skylink and
+// update the skylink's record in the database. If it fails to download it will
+// mark the job as failed, so it's retried later, up to
+// database.MetaFetcherMaxAttempts times.
+func (mf *MetaFetcher) processJob(ctx context.Context, j database.MetaFetcherJob) {
+	sl, err := mf.db.SkylinkByID(ctx, j.SkylinkID)
+	if err != nil {
+		mf.logger.Tracef("Failed to fetch skylink from DB. Skylink ID: %v, error: %v", j.SkylinkID, err)
+		mf.failJob(ctx, j, err)
 		return
 	}
 	// Check if we have already fetched the size of this skylink and skip the
 	// HTTP call if we have.
 	if sl.Size != 0 {
+		mf.completeJob(ctx, j)
 		return
 	}
-	// Make a HEAD request directly to the local `sia` container. We do that, so
-	// we don't get rate-limited by nginx in case we need to make many requests.
-	metaURL, err := url.Parse(fmt.Sprintf("http://sia:9980/skynet/metadata/%s", sl.Skylink))
+	// Make a request directly to skyd. We do that, so we don't get
+	// rate-limited by nginx in case we need to make many requests.
+	metaURL, err := url.Parse(fmt.Sprintf("%s/skynet/metadata/%s", strings.TrimSuffix(SkydURL, "/"), sl.Skylink))
 	if err != nil {
 		mf.logger.Debugf("Error while forming skylink URL for skylink %s. Error: %v", sl.Skylink, err)
+		mf.completeJob(ctx, j)
 		return
 	}
 	req := http.Request{
@@ -98,8 +249,10 @@ func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
 		URL:    metaURL,
 		Header: http.Header{"User-Agent": []string{"Sia-Agent"}},
 	}
-	client := http.Client{}
-	res, err := client.Do(&req)
+	if SkydAPIPassword != "" {
+		req.SetBasicAuth("", SkydAPIPassword)
+	}
+	res, err := mf.staticClient.Do(req.WithContext(ctx))
 	if err == nil {
 		defer res.Body.Close()
 	}
@@ -109,35 +262,83 @@ func (mf *MetaFetcher) processMessage(ctx context.Context, m Message) {
 			statusCode = res.StatusCode
 		}
 		mf.logger.Tracef("Failed to fetch metadata. Skylink: %s, status: %v, error: %v", sl.Skylink, statusCode, err)
-		if m.Attempts >= maxAttempts {
-			mf.logger.Debugf("Message exceeded its maximum number of attempts, dropping: %v. Last error: %v.", m, err)
-			return
-		}
-		m.Attempts++
-		go func() { mf.Queue <- m }()
+		mf.failJob(ctx, j, err)
 		return
 	}
-	var meta struct {
-		Filename string `json:"filename"`
-		Length   int64  `json:"length"`
-	}
+	var meta skyfileMetadata
 	err = json.NewDecoder(res.Body).Decode(&meta)
 	if err != nil {
 		mf.logger.Debugf("Failed to parse skyfile metadata: %s", err)
+		mf.completeJob(ctx, j)
 		return
 	}
 	mf.logger.Tracef("Successfully fetched metdata for skylink %v %s: %v", sl.ID, sl.Skylink, meta)
-	err = mf.db.SkylinkUpdate(ctx, m.SkylinkID, meta.Filename, meta.Length)
+	err = mf.db.SkylinkMetadataUpdate(ctx, j.SkylinkID, meta.Filename, meta.Length, meta.toDB())
 	if err != nil {
 		mf.logger.Debugf("Failed to update skyfile metadata: %s", err)
 		// We don't return here because we want to perform the next operations
 		// regardless of the success of the current one.
 	}
-	err = mf.db.SkylinkDownloadsUpdate(ctx, m.SkylinkID, meta.Length)
+	err = mf.db.SkylinkDownloadsUpdate(ctx, j.SkylinkID, meta.Length)
 	if err != nil {
 		mf.logger.Debugf("Failed to update skyfile downloads: %s", err)
 		// We don't return here because we want to perform the next operations
 		// regardless of the success of the current one.
 	}
-	mf.logger.Tracef("Successfully updated skylink %v.", m.SkylinkID)
+	mf.completeJob(ctx, j)
+	mf.logger.Tracef("Successfully updated skylink %v.", j.SkylinkID)
+}
+
+// completeJob removes the given job from the queue.
+func (mf *MetaFetcher) completeJob(ctx context.Context, j database.MetaFetcherJob) {
+	err := mf.db.MetaFetcherJobComplete(ctx, j.ID)
+	if err != nil {
+		mf.logger.Debugf("Failed to remove metafetcher job %v from the queue: %v", j.ID, err)
+	}
+}
+
+// failJob registers a failed attempt to process the given job and unlocks it,
+// so it can be retried after an exponential backoff.
+func (mf *MetaFetcher) failJob(ctx context.Context, j database.MetaFetcherJob, cause error) {
+	if j.Attempts+1 >= database.MetaFetcherMaxAttempts {
+		mf.logger.Debugf("Job exceeded its maximum number of attempts: %v. Last error: %v.", j, cause)
+	}
+	err := mf.db.MetaFetcherJobFail(ctx, j.ID, time.Now().Add(backoff(j.Attempts)))
+	if err != nil {
+		mf.logger.Debugf("Failed to mark metafetcher job %v as failed: %v", j.ID, err)
+	}
+}
+
+// toDB converts the skyfile metadata into the format we store in the DB. The
+// content type of the skyfile is the content type of the file served by
+// default, i.e. the file at the default path or the skyfile's only file.
+func (meta skyfileMetadata) toDB() database.SkylinkMetadata {
+	sm := database.SkylinkMetadata{
+		DefaultPath:   meta.DefaultPath,
+		SubfilesCount: len(meta.Subfiles),
+	}
+	for _, sf := range meta.Subfiles {
+		sm.SubfilesSize += sf.Len
+	}
+	if sf, ok := meta.Subfiles[strings.TrimPrefix(meta.DefaultPath, "/")]; ok {
+		sm.ContentType = sf.ContentType
+	} else if len(meta.Subfiles) == 1 {
+		for _, sf := range meta.Subfiles {
+			sm.ContentType = sf.ContentType
+		}
+	}
+	return sm
+}
+
+// backoff returns how long we should wait before retrying a job which has
+// already failed the given number of times.
+func backoff(attempts int) time.Duration {
+	b := baseBackoff
+	for i := 0; i < attempts && b < maxBackoff; i++ {
+		b *= 2
+	}
+	if b > maxBackoff {
+		b = maxBackoff
+	}
+	return b
 }
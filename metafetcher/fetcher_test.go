@@ -0,0 +1,46 @@
+package metafetcher
+
+import (
+	"testing"
+)
+
+// TestSkyfileMetadataToDB ensures that we correctly extract the extended
+// skyfile metadata we store in the DB.
+func TestSkyfileMetadataToDB(t *testing.T) {
+	t.Parallel()
+
+	// A single file.
+	meta := skyfileMetadata{
+		Filename: "image.png",
+		Length:   123,
+		Subfiles: map[string]skyfileSubfile{
+			"image.png": {Filename: "image.png", ContentType: "image/png", Len: 123},
+		},
+	}
+	sm := meta.toDB()
+	if sm.ContentType != "image/png" || sm.SubfilesCount != 1 || sm.SubfilesSize != 123 || sm.DefaultPath != "" {
+		t.Fatalf("Unexpected metadata %+v", sm)
+	}
+
+	// A directory with a default path.
+	meta = skyfileMetadata{
+		Filename:    "website",
+		Length:      300,
+		DefaultPath: "/index.html",
+		Subfiles: map[string]skyfileSubfile{
+			"index.html": {Filename: "index.html", ContentType: "text/html", Len: 100},
+			"style.css":  {Filename: "style.css", ContentType: "text/css", Len: 200},
+		},
+	}
+	sm = meta.toDB()
+	if sm.ContentType != "text/html" || sm.SubfilesCount != 2 || sm.SubfilesSize != 300 || sm.DefaultPath != "/index.html" {
+		t.Fatalf("Unexpected metadata %+v", sm)
+	}
+
+	// A directory without a default path. We can't tell its content type.
+	meta.DefaultPath = ""
+	sm = meta.toDB()
+	if sm.ContentType != "" || sm.SubfilesCount != 2 {
+		t.Fatalf("Unexpected metadata %+v", sm)
+	}
+}
@@ -0,0 +1,101 @@
+package metafetcher
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+var (
+	// reconcileInterval defines how often we look for skylinks with unknown
+	// size and re-queue them.
+	reconcileInterval = build.Select(
+		build.Var{
+			Dev:      time.Minute,
+			Testing:  time.Hour,
+			Standard: 6 * time.Hour,
+		},
+	).(time.Duration)
+)
+
+// ReconciliationReport describes the outcome of a single reconciliation run.
+type ReconciliationReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Requeued is the number of skylinks of unknown size which we put back
+	// in the queue because they had no job or had exhausted their attempts.
+	Requeued int `json:"requeued"`
+	// Queued is the number of skylinks of unknown size which were already
+	// queued with attempts left. We leave those alone.
+	Queued int `json:"queued"`
+	// Unresolved is the number of skylinks referenced by uploads or
+	// downloads whose size we don't know and which remain out of the queue
+	// after the run because we failed to re-queue them.
+	Unresolved int `json:"unresolved"`
+	// Error holds the reason the run failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// LastReconciliation returns the report of the last reconciliation run. The
+// report is empty if no run has finished yet.
+func (mf *MetaFetcher) LastReconciliation() ReconciliationReport {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	return mf.lastReconciliation
+}
+
+// Reconcile finds all skylinks which are referenced by uploads or downloads
+// but whose size we still don't know, and queues them for having their
+// metadata fetched. Those are typically skylinks for which we exhausted all
+// fetching attempts. Skylinks which are still being retried keep their
+// attempts and back off. Only one reconciliation runs at a time.
+func (mf *MetaFetcher) Reconcile(ctx context.Context) ReconciliationReport {
+	mf.staticReconcileMu.Lock()
+	defer mf.staticReconcileMu.Unlock()
+
+	report := ReconciliationReport{
+		StartedAt: time.Now().UTC(),
+	}
+	ids, err := mf.db.SkylinksWithUnknownSize(ctx)
+	if err != nil {
+		mf.logger.Warnf("Failed to find skylinks with unknown size: %v", err)
+		report.Error = err.Error()
+	}
+	for _, id := range ids {
+		requeued, err := mf.db.MetaFetcherJobRequeue(ctx, id)
+		if err != nil {
+			mf.logger.Debugf("Failed to re-queue skylink %v: %v", id, err)
+			report.Unresolved++
+			continue
+		}
+		if requeued {
+			report.Requeued++
+		} else {
+			report.Queued++
+		}
+	}
+	if report.Requeued > 0 {
+		mf.notify()
+	}
+	report.FinishedAt = time.Now().UTC()
+	mf.logger.Infof("Metafetcher reconciliation finished. Re-queued skylinks: %d, already queued: %d, unresolved: %d.", report.Requeued, report.Queued, report.Unresolved)
+
+	mf.mu.Lock()
+	mf.lastReconciliation = report
+	mf.mu.Unlock()
+	return report
+}
+
+// threadedReconcile periodically runs a reconciliation until the context is
+// closed.
+func (mf *MetaFetcher) threadedReconcile(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconcileInterval):
+		}
+		mf.Reconcile(ctx)
+	}
+}
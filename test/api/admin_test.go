@@ -0,0 +1,354 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testAdmin ensures that only admins can use the admin endpoints and that
+// those work as expected.
+func testAdmin(t *testing.T, at *test.AccountsTester) {
+	admin, adminCookie, err := test.CreateUserAndLogin(at, t.Name()+"_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, cookie, err := test.CreateUserAndLogin(at, t.Name()+"_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = errors.Compose(admin.Delete(at.Ctx), u.Delete(at.Ctx)); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete users in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	bySub := url.Values{}
+	bySub.Set("sub", u.Sub)
+
+	// Regular users can't use the admin endpoints.
+	at.SetCookie(adminCookie)
+	_, s, err := at.AdminUsersGET(bySub)
+	if s != http.StatusForbidden || err == nil || !strings.Contains(err.Error(), api.ErrNotAdmin.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", api.ErrNotAdmin, http.StatusForbidden, err, s)
+	}
+	api.AdminSubs = []string{admin.Sub}
+	defer func() { api.AdminSubs = nil }()
+
+	// Search without criteria.
+	_, s, _ = at.AdminUsersGET(nil)
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	// Search by sub, part of the email and uploader IP.
+	sl, err := at.DB.Skylink(at.Ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.UploadCreate(at.Ctx, *u.User, "198.51.100.9", *sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byEmail := url.Values{}
+	byEmail.Set("email", strings.ToUpper(strings.Split(u.Email.String(), "@")[0]))
+	byIP := url.Values{}
+	byIP.Set("ip", "198.51.100.9")
+	for _, params := range []url.Values{bySub, byEmail, byIP} {
+		resp, _, err := at.AdminUsersGET(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Items) != 1 || resp.Items[0].Sub != u.Sub {
+			t.Fatalf("Expected to find user %s by %v, got %+v", u.Sub, params, resp.Items)
+		}
+	}
+	// Inspect a user who doesn't exist.
+	_, s, _ = at.AdminUserGET("nonexistent")
+	if s != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, s)
+	}
+
+	// Override the user's tier and confirm their email.
+	s, err = at.AdminUserTierPOST(u.Sub, database.TierAnonymous)
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d and error '%v'", http.StatusBadRequest, s, err)
+	}
+	s, err = at.AdminUserTierPOST(u.Sub, database.TierPremium20)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	s, err = at.AdminUserConfirmPOST(u.Sub)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	// Suspend the user and expect them to be unable to use their account.
+	s, _ = at.AdminUserSuspendPOST(u.Sub, " ", nil)
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	s, err = at.AdminUserSuspendPOST(u.Sub, "abuse", nil)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	resp, _, err := at.AdminUserGET(u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.User.Tier != database.TierPremium20 || !resp.User.EmailConfirmed || resp.User.SuspensionReason != "abuse" || resp.Stats == nil {
+		t.Fatalf("Unexpected user %+v", resp)
+	}
+	at.SetCookie(cookie)
+	_, s, err = at.UserGET()
+	if s != http.StatusForbidden || err == nil || !strings.Contains(err.Error(), database.ErrUserSuspended.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", database.ErrUserSuspended, http.StatusForbidden, err, s)
+	}
+	// Reinstate the user.
+	at.SetCookie(adminCookie)
+	s, err = at.AdminUserReinstatePOST(u.Sub)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	at.SetCookie(cookie)
+	_, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expect all admin actions to be in the user's audit trail, newest first.
+	at.SetCookie(adminCookie)
+	resp, _, err = at.AdminUserGET(u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		database.AuditActionUserReinstate,
+		database.AuditActionUserSuspend,
+		database.AuditActionUserConfirmEmail,
+		database.AuditActionUserTier,
+	}
+	if len(resp.Events) != len(expected) {
+		t.Fatalf("Expected %d audit events, got %+v", len(expected), resp.Events)
+	}
+	for i, ae := range resp.Events {
+		if ae.Action != expected[i] || ae.Actor != admin.Sub || ae.IP != "127.0.0.1" {
+			t.Fatalf("Unexpected audit event %+v, expected action '%s'", ae, expected[i])
+		}
+	}
+}
+
+// testUserSuspension ensures that suspended users can't log in, refresh their
+// tokens or use their API keys, that they get anonymous limits and that
+// suspensions with an expiry lift on their own.
+func testUserSuspension(t *testing.T, at *test.AccountsTester) {
+	admin, adminCookie, err := test.CreateUserAndLogin(at, t.Name()+"_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	password := name + "_pass"
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = errors.Compose(admin.Delete(at.Ctx), u.Delete(at.Ctx)); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete users in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	api.AdminSubs = []string{admin.Sub}
+	defer func() { api.AdminSubs = nil }()
+
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	akHeader := map[string]string{api.APIKeyHeader: ak.Key.String()}
+	// Cache the user's tier before suspending them.
+	ul, _, err := at.UserLimits("", akHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+
+	// Suspensions can't expire in the past.
+	at.SetCookie(adminCookie)
+	past := time.Now().UTC().Add(-time.Hour)
+	s, _ := at.AdminUserSuspendPOST(u.Sub, "abuse", &past)
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	until := time.Now().UTC().Add(3 * time.Second)
+	s, err = at.AdminUserSuspendPOST(u.Sub, "abuse", &until)
+	if err != nil || s != http.StatusNoContent {
+		t.Fatal(s, err)
+	}
+	at.ClearCredentials()
+	// Expect the user to have been notified.
+	filter := bson.M{"to": email, "subject": "Your account has been suspended"}
+	_, msgs, err := at.DB.FindEmails(at.Ctx, filter, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !strings.Contains(msgs[0].Body, "abuse") {
+		t.Fatalf("Expected a single suspension email, got %+v", msgs)
+	}
+	// The user can't log in or use their API key.
+	r, b, _ := at.LoginCredentialsPOST(email.String(), password)
+	if r.StatusCode != http.StatusForbidden || !strings.Contains(string(b), database.ErrUserSuspended.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%s' with status %d", database.ErrUserSuspended, http.StatusForbidden, string(b), r.StatusCode)
+	}
+	at.SetAPIKey(ak.Key.String())
+	_, s, _ = at.UserAPIKeysLIST()
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	at.ClearCredentials()
+	// The user's cached tier was dropped, so they get anonymous limits.
+	ul, _, err = at.UserLimits("", akHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+
+	// Once the suspension expires, everything works again.
+	time.Sleep(time.Until(until) + time.Second)
+	_, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul, _, err = at.UserLimits("", akHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+}
+
+// testUserEvents ensures that security-relevant account changes are recorded
+// and that users and admins can list them.
+func testUserEvents(t *testing.T, at *test.AccountsTester) {
+	admin, adminCookie, err := test.CreateUserAndLogin(at, t.Name()+"_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, cookie, err := test.CreateUserAndLogin(at, t.Name()+"_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = errors.Compose(admin.Delete(at.Ctx), u.Delete(at.Ctx)); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete users in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Change the password, create an API key and delete it.
+	at.SetCookie(cookie)
+	_, _, err = at.UserPUT("", "new password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.UserAPIKeysDELETE(ak.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect the user to see these events, newest first.
+	resp, _, err := at.UserEventsGET(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		database.AuditActionAPIKeyDelete,
+		database.AuditActionAPIKeyCreate,
+		database.AuditActionUserPassword,
+	}
+	if len(resp.Items) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), resp.Items)
+	}
+	for i, ae := range resp.Items {
+		if ae.Action != expected[i] || ae.Actor != u.Sub || ae.IP != "127.0.0.1" || ae.UserAgent == "" {
+			t.Fatalf("Unexpected event %+v, expected action '%s'", ae, expected[i])
+		}
+	}
+	summary := "private key " + ak.KeyPrefix + ` "ci"`
+	if resp.Items[0].Before != summary || resp.Items[1].After != summary {
+		t.Fatalf("Expected API key summary '%s', got %+v", summary, resp.Items[:2])
+	}
+	// Filter by action and page through the events.
+	params := url.Values{}
+	params.Set("pageSize", "1")
+	resp, _, err = at.UserEventsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 || resp.Next == "" {
+		t.Fatalf("Unexpected page %+v", resp)
+	}
+	params.Set("cursor", resp.Next)
+	resp, _, err = at.UserEventsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 || resp.Items[0].Action != expected[1] {
+		t.Fatalf("Unexpected page %+v", resp)
+	}
+	params = url.Values{}
+	params.Set("action", database.AuditActionUserPassword)
+	resp, _, err = at.UserEventsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 || resp.Items[0].Action != database.AuditActionUserPassword {
+		t.Fatalf("Unexpected events %+v", resp.Items)
+	}
+
+	// Only admins can query all events.
+	at.SetCookie(adminCookie)
+	params = url.Values{}
+	params.Set("sub", u.Sub)
+	params.Set("action", database.AuditActionAPIKeyCreate)
+	_, s, _ := at.AdminEventsGET(params)
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	api.AdminSubs = []string{admin.Sub}
+	defer func() { api.AdminSubs = nil }()
+	resp, _, err = at.AdminEventsGET(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 || resp.Items[0].After != summary {
+		t.Fatalf("Unexpected events %+v", resp.Items)
+	}
+	params.Set("sub", "nonexistent")
+	_, s, _ = at.AdminEventsGET(params)
+	if s != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, s)
+	}
+}
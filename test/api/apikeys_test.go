@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/database"
@@ -345,12 +346,10 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		{verb: http.MethodGet, endpoint: "/user"},
 		{verb: http.MethodPut, endpoint: "/user"},
 		{verb: http.MethodDelete, endpoint: "/user"},
-		{verb: http.MethodGet, endpoint: "/user/stats"},
 		{verb: http.MethodDelete, endpoint: "/user/pubkey/somePubKey"},
 		{verb: http.MethodGet, endpoint: "/user/pubkey/register"},
 		{verb: http.MethodPost, endpoint: "/user/pubkey/register"},
 		{verb: http.MethodGet, endpoint: "/user/uploads"},
-		{verb: http.MethodDelete, endpoint: "/user/uploads/someSkylink"},
 		{verb: http.MethodGet, endpoint: "/user/downloads"},
 		{verb: http.MethodPost, endpoint: "/user/reconfirm"},
 	}
@@ -372,6 +371,9 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		{verb: http.MethodPost, endpoint: "/track/download/:skylink"},
 		{verb: http.MethodPost, endpoint: "/track/registry/read"},
 		{verb: http.MethodPost, endpoint: "/track/registry/write"},
+		{verb: http.MethodGet, endpoint: "/user/stats"},
+		{verb: http.MethodGet, endpoint: "/user/stats/history"},
+		{verb: http.MethodDelete, endpoint: "/user/uploads/someSkylink"},
 		{verb: http.MethodPost, endpoint: "/user/apikeys"},
 		{verb: http.MethodGet, endpoint: "/user/apikeys"},
 		{verb: http.MethodGet, endpoint: "/user/apikeys/someId"},
@@ -387,3 +389,262 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		}
 	}
 }
+
+// testAPIKeysExpiration ensures that API keys expire and that we track their
+// last use.
+func testAPIKeysExpiration(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	r, _, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := test.ExtractCookie(r)
+	at.SetCookie(cookie)
+	defer at.ClearCredentials()
+
+	// API keys can't expire in the past.
+	past := time.Now().UTC().Add(-time.Minute)
+	_, s, _ := at.UserAPIKeysPOST(api.APIKeyPOST{ExpiresAt: &past})
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	expiresAt := time.Now().UTC().Add(2 * time.Second)
+	akWithKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akWithKey.ExpiresAt == nil || akWithKey.LastUsedAt != nil {
+		t.Fatalf("Unexpected API key %+v", akWithKey)
+	}
+	// Use the API key.
+	at.SetAPIKey(akWithKey.Key.String())
+	_, _, err = at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul, _, err := at.UserLimits("", map[string]string{api.APIKeyHeader: akWithKey.Key.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+	// Expect its last use to be recorded.
+	at.SetCookie(cookie)
+	ak, _, err := at.UserAPIKeysGET(akWithKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.LastUsedAt == nil || ak.LastUsedIP != "127.0.0.1" {
+		t.Fatalf("Expected the API key's last use to be recorded, got %+v", ak)
+	}
+	// An API key can't create API keys which outlive it.
+	at.SetCookie(cookie)
+	mgmtScopes := []string{database.APIKeyScopeAPIKeysManage}
+	mgmtExpiresAt := time.Now().UTC().Add(time.Hour)
+	mgmtKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, ExpiresAt: &mgmtExpiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(mgmtKey.Key.String())
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	later := mgmtExpiresAt.Add(time.Minute)
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, ExpiresAt: &later})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	earlier := mgmtExpiresAt.Add(-time.Minute)
+	_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, ExpiresAt: &earlier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the API key to expire and expect it to stop working.
+	time.Sleep(time.Until(expiresAt))
+	at.SetAPIKey(akWithKey.Key.String())
+	_, s, _ = at.UserAPIKeysLIST()
+	if s != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, s)
+	}
+	ul, _, err = at.UserLimits("", map[string]string{api.APIKeyHeader: akWithKey.Key.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+}
+
+// testAPIKeysScopes ensures that scoped API keys can only access the endpoints
+// their scopes allow.
+func testAPIKeysScopes(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	r, _, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := test.ExtractCookie(r)
+	at.SetCookie(cookie)
+	defer at.ClearCredentials()
+
+	// Invalid scopes and scopes on public API keys are rejected.
+	_, s, _ := at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: []string{"everything"}})
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Scopes: []string{database.APIKeyScopeDownload}})
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	// Create a key which can upload and read stats.
+	scopes := []string{database.APIKeyScopeUpload, database.APIKeyScopeStatsRead}
+	ciKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Name: "ci", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciKey.Scopes) != len(scopes) {
+		t.Fatalf("Expected scopes %v, got %v", scopes, ciKey.Scopes)
+	}
+	at.SetAPIKey(ciKey.Key.String())
+	// The key can read stats.
+	_, s, err = at.UserStats("", nil)
+	if err != nil || s != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d and error '%v'", http.StatusOK, s, err)
+	}
+	// The key can't manage API keys or delete uploads.
+	_, s, err = at.UserAPIKeysLIST()
+	if s != http.StatusForbidden || err == nil || !strings.Contains(err.Error(), api.ErrAPIKeyInsufficientScope.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", api.ErrAPIKeyInsufficientScope, http.StatusForbidden, err, s)
+	}
+	s, _ = at.UploadsDELETE(test.RandomSkylink())
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	// Endpoints which don't allow API keys still don't allow them.
+	_, s, _ = at.UserGET()
+	if s != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, s)
+	}
+
+	// A key which can manage API keys can't grant scopes it doesn't have.
+	at.SetCookie(cookie)
+	mgmtScopes := []string{database.APIKeyScopeAPIKeysManage, database.APIKeyScopeStatsRead}
+	mgmtKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(mgmtKey.Key.String())
+	_, _, err = at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A key without the upload scope can't register uploads, not even as
+	// anonymous ones.
+	s, _ = at.TrackUpload(test.RandomSkylink(), "")
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: []string{database.APIKeyScopeUpload}})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: []string{database.APIKeyScopeStatsRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testAPIKeysAllowedIPs ensures that API keys with an IP allow-list can only be
+// used from the allowed addresses.
+func testAPIKeysAllowedIPs(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	r, _, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := test.ExtractCookie(r)
+	at.SetCookie(cookie)
+	defer at.ClearCredentials()
+
+	// Invalid ranges are rejected.
+	_, s, _ := at.UserAPIKeysPOST(api.APIKeyPOST{AllowedIPs: []string{"203.0.113.0/33"}})
+	if s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, s)
+	}
+	akWithKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{AllowedIPs: []string{"203.0.113.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akWithKey.AllowedIPs) != 1 || akWithKey.AllowedIPs[0] != "203.0.113.0/24" {
+		t.Fatalf("Unexpected allowed IPs %v", akWithKey.AllowedIPs)
+	}
+	// The tester connects from 127.0.0.1, which is outside the allowed range.
+	at.SetAPIKey(akWithKey.Key.String())
+	_, s, err = at.UserAPIKeysLIST()
+	if s != http.StatusForbidden || err == nil || !strings.Contains(err.Error(), database.ErrAPIKeyIPNotAllowed.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", database.ErrAPIKeyIPNotAllowed, http.StatusForbidden, err, s)
+	}
+	// The tester's address is a trusted proxy, so we can forward a client
+	// address from within the allowed range.
+	allowed := map[string]string{"X-Forwarded-For": "203.0.113.5"}
+	r, err = at.Request(http.MethodGet, "/user/apikeys", nil, nil, allowed, nil)
+	if err != nil {
+		t.Fatal(err, r.StatusCode)
+	}
+	// A client can't spoof its address by prepending it to the header.
+	spoofed := map[string]string{"X-Forwarded-For": "203.0.113.5, 198.51.100.1"}
+	r, _ = at.Request(http.MethodGet, "/user/apikeys", nil, nil, spoofed, nil)
+	if r.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, r.StatusCode)
+	}
+
+	// An API key can't create API keys which can be used from addresses it
+	// can't be used from.
+	at.SetCookie(cookie)
+	mgmtScopes := []string{database.APIKeyScopeAPIKeysManage}
+	mgmtKey, _, err := at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, AllowedIPs: []string{"127.0.0.1", "203.0.113.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetAPIKey(mgmtKey.Key.String())
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	_, s, _ = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, AllowedIPs: []string{"203.0.113.0/24", "198.51.100.7"}})
+	if s != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, s)
+	}
+	_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{Scopes: mgmtScopes, AllowedIPs: []string{"203.0.113.0/25"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.ClearCredentials()
+
+	// The limits endpoint returns the user's tier only to allowed addresses,
+	// even after the tier has been cached.
+	allowed[api.APIKeyHeader] = akWithKey.Key.String()
+	ul, _, err := at.UserLimits("", allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierFree {
+		t.Fatalf("Expected tier %d, got %d", database.TierFree, ul.TierID)
+	}
+	ul, _, err = at.UserLimits("", map[string]string{api.APIKeyHeader: akWithKey.Key.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.TierID != database.TierAnonymous {
+		t.Fatalf("Expected tier %d, got %d", database.TierAnonymous, ul.TierID)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testUserExport ensures the uploads and downloads exports work as expected.
+func testUserExport(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	// An empty export only holds the CSV header.
+	b, _, err := at.UserExport("uploads", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "skylink" {
+		t.Fatalf("Expected only a header row, got %v", rows)
+	}
+
+	// Upload two skylinks, unpin one of them and download the other.
+	size := int64(1 + fastrand.Intn(skynet.MiB))
+	sl1, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl2, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.UnpinUploads(at.Ctx, *sl1, *u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.DownloadCreate(at.Ctx, *u.User, *sl2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Export the uploads as CSV.
+	b, _, err = at.UserExport("uploads", "csv", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err = csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected a header and 2 rows, got %v", rows)
+	}
+	if rows[1][0] != sl1.Skylink || rows[1][5] != "true" {
+		t.Fatalf("Expected an unpinned upload of %s, got %v", sl1.Skylink, rows[1])
+	}
+	if rows[2][0] != sl2.Skylink || rows[2][2] != strconv.FormatInt(size, 10) || rows[2][5] != "false" {
+		t.Fatalf("Expected a pinned upload of %s with size %d, got %v", sl2.Skylink, size, rows[2])
+	}
+
+	// Export the downloads as NDJSON.
+	b, _, err = at.UserExport("downloads", "ndjson", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 download, got %d", len(lines))
+	}
+	var d database.DownloadExport
+	err = json.Unmarshal([]byte(lines[0]), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Skylink != sl2.Skylink || d.Size != size {
+		t.Fatalf("Expected a full download of %s, got %+v", sl2.Skylink, d)
+	}
+
+	// Limit the export to a period without uploads.
+	past := time.Now().UTC().Add(-24 * time.Hour).Unix()
+	b, _, err = at.UserExport("uploads", "ndjson", past-3600, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Fatalf("Expected an empty export, got %s", string(b))
+	}
+
+	// Invalid parameters.
+	_, sc, err := at.UserExport("uploads", "xml", 0, 0)
+	if err == nil || sc != http.StatusBadRequest {
+		t.Fatalf("Expected an error and status 400, got '%v' and %d", err, sc)
+	}
+	_, sc, err = at.UserExport("uploads", "csv", past, past-3600)
+	if err == nil || sc != http.StatusBadRequest {
+		t.Fatalf("Expected an error and status 400, got '%v' and %d", err, sc)
+	}
+}
@@ -66,6 +66,8 @@ func TestHandlers(t *testing.T) {
 		{name: "UserAddPubKey", test: testUserAddPubKey},
 		{name: "DeletePubKey", test: testUserDeletePubKey},
 		{name: "UserDelete", test: testUserDELETE},
+		{name: "UserRestore", test: testUserRestore},
+		{name: "UserRestoreWithoutEmail", test: testUserRestoreWithoutEmail},
 		{name: "UserLimits", test: testUserLimits},
 		{name: "UserDeleteUploads", test: testUserUploadsDELETE},
 		{name: "UserConfirmReconfirmEmail", test: testUserConfirmReconfirmEmailGET},
@@ -79,7 +81,21 @@ func TestHandlers(t *testing.T) {
 		{name: "PublicAPIKeysFlow", test: testPublicAPIKeysFlow},
 		{name: "PublicAPIKeysUsage", test: testPublicAPIKeysUsage},
 		{name: "APIKeysAcceptance", test: testAPIKeysAcceptance},
+		{name: "APIKeysExpiration", test: testAPIKeysExpiration},
+		{name: "APIKeysScopes", test: testAPIKeysScopes},
+		{name: "APIKeysAllowedIPs", test: testAPIKeysAllowedIPs},
+		{name: "Admin", test: testAdmin},
+		{name: "UserSuspension", test: testUserSuspension},
+		{name: "UserEvents", test: testUserEvents},
+		{name: "InternalAuth", test: testInternalAuth},
 		{name: "UploadInfo", test: testUploadInfo},
+		{name: "UserExport", test: testUserExport},
+		{name: "CursorPagination", test: testCursorPagination},
+		{name: "TokenRefresh", test: testTokenRefresh},
+		{name: "Sessions", test: testSessions},
+		{name: "TwoFactor", test: testTwoFactor},
+		{name: "Passkeys", test: testPasskeys},
+		{name: "LoginLockout", test: testLoginLockout},
 	}
 
 	// Run subtests
@@ -388,6 +404,33 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil || status != http.StatusNoContent {
 		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
 	}
+	// Make sure the user is scheduled for deletion but still exists.
+	u1, err := at.DB.UserByEmail(at.Ctx, u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u1.PendingDeletion() || u1.RestoreToken == "" || u1.DeleteAt.Before(time.Now().UTC().Add(database.UserDeletionGracePeriod-time.Minute)) {
+		t.Fatalf("Expected the user to be scheduled for deletion, got %+v", u1)
+	}
+	// The user's session was revoked.
+	_, status, _ = at.UserGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, status)
+	}
+	// Purging before the grace period passes doesn't delete the user.
+	_, err = at.DB.UsersPurge(at.Ctx, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.UserByEmail(at.Ctx, u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Purge the user once the grace period passes.
+	n, err := at.DB.UsersPurge(at.Ctx, u1.DeleteAt.Add(time.Second))
+	if err != nil || n == 0 {
+		t.Fatalf("Expected to purge at least one user, purged %d, error '%v'", n, err)
+	}
 	// Make sure the use doesn't exist anymore.
 	_, err = at.DB.UserByEmail(at.Ctx, u.Email)
 	if !errors.Contains(err, database.ErrUserNotFound) {
@@ -407,11 +450,15 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User)
+	err = at.DB.RegistryWriteTrack(*u.User)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryReadCreate(at.Ctx, *u.User)
+	err = at.DB.RegistryReadTrack(*u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = at.DB.RegistryUsageFlush(at.Ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -428,6 +475,10 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil || status != http.StatusNoContent {
 		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
 	}
+	_, err = at.DB.UsersPurge(at.Ctx, time.Now().UTC().Add(database.UserDeletionGracePeriod+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Make sure the user doesn't exist anymore.
 	_, err = at.DB.UserByEmail(at.Ctx, u.Email)
 	if !errors.Contains(err, database.ErrUserNotFound) {
@@ -449,6 +500,138 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testUserRestore ensures that users can restore their accounts while they are
+// scheduled for deletion.
+func testUserRestore(t *testing.T, at *test.AccountsTester) {
+	email := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	r, _, err := at.LoginCredentialsPOST(email.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	defer at.ClearCredentials()
+	status, err := at.UserDELETE()
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
+	}
+	at.ClearCredentials()
+	// The user can't log in while their account is pending deletion.
+	r, b, _ := at.LoginCredentialsPOST(email.String(), password)
+	if r.StatusCode != http.StatusForbidden || !strings.Contains(string(b), database.ErrUserPendingDeletion.Error()) {
+		t.Fatalf("Expected error '%s' with status %d, got '%s' with status %d", database.ErrUserPendingDeletion, http.StatusForbidden, string(b), r.StatusCode)
+	}
+	// Expect the user to have been sent a restore link.
+	filter := bson.M{"to": email, "subject": "Your account is scheduled for deletion"}
+	_, msgs, err := at.DB.FindEmails(at.Ctx, filter, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Expected a single deletion email, got %+v", msgs)
+	}
+	m := regexp.MustCompile(`/user/restore\?token=([^"<\s]+)`).FindStringSubmatch(msgs[0].Body)
+	if len(m) != 2 {
+		t.Fatalf("Expected the email to contain a restore link, got '%s'", msgs[0].Body)
+	}
+	token := m[1]
+	// An invalid token.
+	status, _ = at.UserRestorePOST("not-a-token")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, status)
+	}
+	// Restore the account.
+	status, err = at.UserRestorePOST(token)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
+	}
+	u1, err := at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.PendingDeletion() || u1.RestoreToken != "" {
+		t.Fatalf("Expected the user to not be scheduled for deletion, got %+v", u1)
+	}
+	// The token can't be reused.
+	status, _ = at.UserRestorePOST(token)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, status)
+	}
+	// The user can log in again and the purger leaves them alone.
+	r, _, err = at.LoginCredentialsPOST(email.String(), password)
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to log in, got status %d and error '%v'", r.StatusCode, err)
+	}
+	_, err = at.DB.UsersPurge(at.Ctx, time.Now().UTC().Add(database.UserDeletionGracePeriod+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.DB.UserByEmail(at.Ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The restoration shows up in the user's audit log.
+	events, err := at.DB.AuditEventsByUser(at.Ctx, u1.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != database.AuditActionUserRestore || events[1].Action != database.AuditActionUserDelete {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+}
+
+// testUserRestoreWithoutEmail ensures that users without an email address get
+// their restore token when they delete their accounts, since we can't email it
+// to them.
+func testUserRestoreWithoutEmail(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	u.Email = ""
+	err = at.DB.UserSave(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+	var resp api.UserDELETE
+	r, err := at.Request(http.MethodDelete, "/user", nil, nil, nil, &resp)
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d success, got %d '%v'", http.StatusOK, r.StatusCode, err)
+	}
+	if resp.RestoreToken == "" || resp.DeleteAt.Before(time.Now().UTC()) {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	at.ClearCredentials()
+	// The token restores the account.
+	status, err := at.UserRestorePOST(resp.RestoreToken)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected %d success, got %d '%s'", http.StatusNoContent, status, err)
+	}
+	u1, err := at.DB.UserBySub(at.Ctx, u.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.PendingDeletion() {
+		t.Fatalf("Expected the user to not be scheduled for deletion, got %+v", u1)
+	}
+}
+
 // testUserLimits tests the /user/limits endpoint.
 func testUserLimits(t *testing.T, at *test.AccountsTester) {
 	u, c, err := test.CreateUserAndLogin(at, t.Name())
@@ -953,6 +1136,31 @@ func testTrackingAndStats(t *testing.T, at *test.AccountsTester) {
 	expectedStats.DownloadsSizeTotal += 200
 	expectedStats.TotalDownloadsSize += 200
 
+	// Call trackRegistryRead and trackRegistryWrite.
+	_, err = at.TrackRegistryRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.TrackRegistryWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registry usage is buffered in memory, so we need to flush it to the DB
+	// before it shows up in the stats.
+	err = at.DB.RegistryUsageFlush(at.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Adjust the expectations.
+	expectedStats.NumRegReads++
+	expectedStats.NumRegReadsTotal++
+	expectedStats.BandwidthRegReads += skynet.CostBandwidthRegistryRead
+	expectedStats.BandwidthRegReadsTotal += skynet.CostBandwidthRegistryRead
+	expectedStats.NumRegWrites++
+	expectedStats.NumRegWritesTotal++
+	expectedStats.BandwidthRegWrites += skynet.CostBandwidthRegistryWrite
+	expectedStats.BandwidthRegWritesTotal += skynet.CostBandwidthRegistryWrite
+
 	// Call userStats without a cookie.
 	at.ClearCredentials()
 	_, _, err = at.UserStats("", nil)
@@ -968,6 +1176,29 @@ func testTrackingAndStats(t *testing.T, at *test.AccountsTester) {
 	if !reflect.DeepEqual(serverStats, expectedStats) {
 		t.Fatalf("Expected\n%+v\ngot\n%+v", expectedStats, serverStats)
 	}
+
+	// Call userStatsHistory with an invalid granularity.
+	_, _, err = at.UserStatsHistory(0, 0, "year")
+	if err == nil || !strings.Contains(err.Error(), badRequest) {
+		t.Fatalf("Expected '%s', got '%v'", badRequest, err)
+	}
+	// Call userStatsHistory. All usage happened today, so the last bucket
+	// should hold all of it.
+	history, _, err := at.UserStatsHistory(0, 0, string(database.StatsGranularityDay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) < 30 {
+		t.Fatalf("Expected at least 30 daily buckets, got %d", len(history))
+	}
+	if !reflect.DeepEqual(history[len(history)-1].UserStats, expectedStats) {
+		t.Fatalf("Expected\n%+v\ngot\n%+v", expectedStats, history[len(history)-1].UserStats)
+	}
+	for _, b := range history[:len(history)-1] {
+		if b.NumUploads != 0 || b.NumDownloads != 0 || b.NumRegReads != 0 || b.NumRegWrites != 0 {
+			t.Fatalf("Expected no usage in bucket starting on %v, got %+v", b.Start, b.UserStats)
+		}
+	}
 }
 
 // testUserFlow tests the happy path of a user's everyday life: create, login,
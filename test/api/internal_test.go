@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// testInternalAuth ensures that the internal endpoints reject requests which
+// aren't properly signed.
+func testInternalAuth(t *testing.T, at *test.AccountsTester) {
+	params := url.Values{}
+	params.Set("from", "0")
+	params.Set("to", strconv.FormatInt(time.Now().UTC().Unix(), 10))
+	ts := time.Now().UTC().Unix()
+	uri := "/uploadedskylinks?" + params.Encode()
+	badSigs := []map[string]string{
+		// No signature.
+		nil,
+		// A signature made with the wrong secret.
+		{
+			api.InternalTimestampHeader: strconv.FormatInt(ts, 10),
+			api.InternalSignatureHeader: api.InternalSignature([]byte("wrong"), http.MethodGet, uri, ts, nil),
+		},
+		// A signature of a different request.
+		{
+			api.InternalTimestampHeader: strconv.FormatInt(ts, 10),
+			api.InternalSignatureHeader: api.InternalSignature(test.InternalSecret, http.MethodGet, "/metafetcher/reconciliation?", ts, nil),
+		},
+		// A stale signature.
+		{
+			api.InternalTimestampHeader: strconv.FormatInt(ts-3600, 10),
+			api.InternalSignatureHeader: api.InternalSignature(test.InternalSecret, http.MethodGet, uri, ts-3600, nil),
+		},
+	}
+	for _, headers := range badSigs {
+		r, err := at.Request(http.MethodGet, "/uploadedskylinks", params, nil, headers, nil)
+		if r.StatusCode != http.StatusUnauthorized || err == nil || !strings.Contains(err.Error(), api.ErrInternalAuthFailed.Error()) {
+			t.Fatalf("Expected error '%s' with status %d, got '%v' with status %d", api.ErrInternalAuthFailed, http.StatusUnauthorized, err, r.StatusCode)
+		}
+	}
+	// A properly signed request.
+	_, _, err := at.UploadedSkylinks(0, time.Now().UTC().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
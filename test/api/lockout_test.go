@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testLoginLockout ensures that repeated failed logins get blocked and that
+// the lockouts can be cleared.
+func testLoginLockout(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, adminCookie, err := test.CreateUserAndLogin(at, t.Name()+"_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.AdminSubs = []string{admin.Sub}
+	defer func() { api.AdminSubs = nil }()
+	defer func() {
+		// All test requests come from the same IP, so we don't want to leave
+		// its failures behind for the other tests.
+		at.SetCookie(adminCookie)
+		_, _, _ = at.LockoutsDELETE("", "127.0.0.1")
+		at.ClearCredentials()
+		if err = errors.Compose(u.Delete(at.Ctx), admin.Delete(at.Ctx)); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete users in defer"))
+		}
+	}()
+
+	// The first few failures are free.
+	for i := 0; i < 4; i++ {
+		r, _, _ := at.LoginCredentialsPOST(emailAddr.String(), "wrong password")
+		if r.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, r.StatusCode)
+		}
+	}
+	// After that, even the correct password gets blocked.
+	r, _, _ := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if r.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, r.StatusCode)
+	}
+	if r.Header.Get("Retry-After") == "" {
+		t.Fatal("Expected a Retry-After header.")
+	}
+	// Only admins can list the lockouts.
+	_, status, _ := at.LockoutsGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+	other, c, err := test.CreateUserAndLogin(at, t.Name()+"_other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = other.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	_, status, _ = at.LockoutsGET()
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+	_, status, _ = at.LockoutsDELETE(emailAddr.String(), "")
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+	at.SetCookie(adminCookie)
+	lg, _, err := at.LockoutsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, la := range lg.Items {
+		if la.Email == emailAddr && la.Failures == 4 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected to find %s among the lockouts, got %+v", emailAddr, lg.Items)
+	}
+
+	// Clearing requires an email or an IP.
+	_, status, _ = at.LockoutsDELETE("", "")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+	}
+	ld, _, err := at.LockoutsDELETE(emailAddr.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.Cleared != 1 {
+		t.Fatalf("Expected to clear 1 record, cleared %d", ld.Cleared)
+	}
+	// The user can log in again.
+	at.ClearCredentials()
+	_, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
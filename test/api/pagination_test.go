@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testCursorPagination ensures clients can paginate over their uploads and API
+// keys using cursors, starting from a regular offset-based page.
+func testCursorPagination(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	for i := 0; i < 3; i++ {
+		_, _, err = test.CreateTestUpload(at.Ctx, at.DB, *u.User, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = at.UserAPIKeysPOST(api.APIKeyPOST{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first offset-based page points at the next one.
+	ups, _, err := at.UserUploadsGETPage(url.Values{"pageSize": []string{"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups.Items) != 2 || ups.Count != 3 || ups.Next == "" || ups.Prev != "" {
+		t.Fatalf("Unexpected first page %+v", ups)
+	}
+	// Follow the cursor to the last page.
+	ups2, _, err := at.UserUploadsGETPage(url.Values{"pageSize": []string{"2"}, "cursor": []string{ups.Next}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups2.Items) != 1 || ups2.Next != "" || ups2.Prev == "" {
+		t.Fatalf("Unexpected last page %+v", ups2)
+	}
+	if ups2.Items[0].ID == ups.Items[0].ID || ups2.Items[0].ID == ups.Items[1].ID {
+		t.Fatalf("Expected a new upload on the last page, got %+v", ups2.Items[0])
+	}
+	// Go back to the first page.
+	ups3, _, err := at.UserUploadsGETPage(url.Values{"pageSize": []string{"2"}, "cursor": []string{ups2.Prev}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups3.Items) != 2 || ups3.Items[0].ID != ups.Items[0].ID || ups3.Items[1].ID != ups.Items[1].ID {
+		t.Fatalf("Expected the first page %+v, got %+v", ups.Items, ups3.Items)
+	}
+	// Invalid cursors and sorting by something other than time are rejected.
+	_, sc, err := at.UserUploadsGETPage(url.Values{"cursor": []string{"invalid"}})
+	if err == nil || sc != http.StatusBadRequest {
+		t.Fatalf("Expected an error and status 400, got '%v' and %d", err, sc)
+	}
+	_, sc, err = at.UserUploadsGETPage(url.Values{"cursor": []string{ups.Next}, "sortBy": []string{"name"}})
+	if err == nil || sc != http.StatusBadRequest {
+		t.Fatalf("Expected an error and status 400, got '%v' and %d", err, sc)
+	}
+
+	// Without pagination parameters we list all API keys.
+	aks, _, err := at.UserAPIKeysLIST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aks) != 3 {
+		t.Fatalf("Expected 3 API keys, got %d", len(aks))
+	}
+	// With them, we list a page and get the cursors in the headers.
+	page, h, _, err := at.UserAPIKeysLISTPage(url.Values{"pageSize": []string{"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := h.Get(api.HeaderNextCursor)
+	if len(page) != 2 || page[0].ID != aks[0].ID || next == "" || h.Get(api.HeaderPrevCursor) != "" {
+		t.Fatalf("Unexpected first page %+v with headers %v", page, h)
+	}
+	page, h, _, err = at.UserAPIKeysLISTPage(url.Values{"pageSize": []string{"2"}, "cursor": []string{next}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].ID != aks[2].ID || h.Get(api.HeaderNextCursor) != "" || h.Get(api.HeaderPrevCursor) == "" {
+		t.Fatalf("Unexpected last page %+v with headers %v", page, h)
+	}
+}
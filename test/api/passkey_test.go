@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/test/fixtures"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/SkynetLabs/skynet-accounts/webauthn"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testPasskeys ensures that users can register passkeys, log in with them and
+// manage them.
+func testPasskeys(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// The passkey endpoints require a logged in user.
+	_, status, _ := at.UserPasskeysGET()
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetToken(r.Header.Get("Skynet-Token"))
+
+	// Register a passkey.
+	opts, _, err := at.UserPasskeyRegisterGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Challenge == "" || opts.RP.ID != database.PasskeyRPID() || opts.User.Name != emailAddr.String() {
+		t.Fatalf("Unexpected creation options %+v", opts)
+	}
+	if len(opts.PubKeyCredParams) != len(webauthn.SupportedAlgorithms) || len(opts.ExcludeCredentials) != 0 {
+		t.Fatalf("Unexpected creation options %+v", opts)
+	}
+	body := api.PasskeyRegisterPOST{
+		Name:              "laptop",
+		ClientDataJSON:    webauthn.EncodeToString(test.PasskeyClientData(webauthn.TypeCreate, opts.Challenge)),
+		AttestationObject: fixtures.PasskeyAttestationObject,
+	}
+	pk, _, err := at.UserPasskeyRegisterPOST(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.ID != fixtures.PasskeyCredentialID || pk.Name != "laptop" {
+		t.Fatalf("Unexpected passkey %+v", pk)
+	}
+	// The challenge can't be reused.
+	_, status, _ = at.UserPasskeyRegisterPOST(body)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+	}
+	// The passkey is now excluded from new registrations.
+	opts, _, err = at.UserPasskeyRegisterGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.ExcludeCredentials) != 1 || opts.ExcludeCredentials[0].ID != fixtures.PasskeyCredentialID {
+		t.Fatalf("Expected the passkey to be excluded, got %+v", opts.ExcludeCredentials)
+	}
+	body.ClientDataJSON = webauthn.EncodeToString(test.PasskeyClientData(webauthn.TypeCreate, opts.Challenge))
+	_, status, _ = at.UserPasskeyRegisterPOST(body)
+	if status != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, status)
+	}
+	pks, _, err := at.UserPasskeysGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0].ID != fixtures.PasskeyCredentialID {
+		t.Fatalf("Expected one passkey, got %+v", pks)
+	}
+
+	// assertion signs a new login challenge with the fixture authenticator.
+	assertion := func(signCount uint32) api.PasskeyLoginPOST {
+		ro, _, err := at.LoginPasskeyGET()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ro.RPID != database.PasskeyRPID() {
+			t.Fatalf("Expected relying party %s, got %s", database.PasskeyRPID(), ro.RPID)
+		}
+		cd := test.PasskeyClientData(webauthn.TypeGet, ro.Challenge)
+		ad, sig, err := test.PasskeyAssertion(cd, signCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return api.PasskeyLoginPOST{
+			ID:                fixtures.PasskeyCredentialID,
+			ClientDataJSON:    webauthn.EncodeToString(cd),
+			AuthenticatorData: webauthn.EncodeToString(ad),
+			Signature:         webauthn.EncodeToString(sig),
+		}
+	}
+
+	// Log in with the passkey.
+	at.ClearCredentials()
+	r, err = at.LoginPasskeyPOST(assertion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetToken(r.Header.Get("Skynet-Token"))
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ug.Email != emailAddr {
+		t.Fatalf("Expected user %s, got %s", emailAddr, ug.Email)
+	}
+	// Logins with a bad signature or a reused counter fail.
+	at.ClearCredentials()
+	la := assertion(2)
+	la.Signature = webauthn.EncodeToString(fastrand.Bytes(64))
+	r, _ = at.LoginPasskeyPOST(la)
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+	r, _ = at.LoginPasskeyPOST(assertion(1))
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+
+	// Rename and delete the passkey.
+	r, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.SetToken(r.Header.Get("Skynet-Token"))
+	_, err = at.UserPasskeyPATCH(fixtures.PasskeyCredentialID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pks, _, err = at.UserPasskeysGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0].Name != "phone" || pks[0].LastUsedAt.IsZero() {
+		t.Fatalf("Unexpected passkeys %+v", pks)
+	}
+	status, _ = at.UserPasskeyDELETE("not base64!")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+	}
+	_, err = at.UserPasskeyDELETE(fixtures.PasskeyCredentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ = at.UserPasskeyDELETE(fixtures.PasskeyCredentialID)
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, status)
+	}
+	// The deleted passkey can no longer log in.
+	at.ClearCredentials()
+	r, _ = at.LoginPasskeyPOST(assertion(2))
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+}
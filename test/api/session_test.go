@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testSessions ensures that users can list and revoke their sessions and that
+// the JWTs of revoked sessions are rejected.
+func testSessions(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// login logs the user in and returns the JWT of the new session.
+	login := func() string {
+		r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tk := r.Header.Get("Skynet-Token")
+		if tk == "" {
+			t.Fatal("Expected a JWT.")
+		}
+		return tk
+	}
+	tkA := login()
+	tkB := login()
+
+	// List the sessions using the first one.
+	at.SetToken(tkA)
+	sessions, _, err := at.UserSessionsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	var current, other string
+	for _, s := range sessions {
+		if s.Current {
+			current = s.ID.Hex()
+		} else {
+			other = s.ID.Hex()
+		}
+	}
+	if current == "" || other == "" {
+		t.Fatalf("Expected exactly one current session, got %+v", sessions)
+	}
+
+	// Updating the user reissues the JWT within the current session instead
+	// of starting a new one.
+	password = hex.EncodeToString(fastrand.Bytes(16))
+	body, err := json.Marshal(map[string]string{"password": password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := at.Request(http.MethodPut, "/user", nil, body, nil, &api.UserGET{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkA = r.Header.Get("Skynet-Token")
+	if tkA == "" {
+		t.Fatal("Expected a JWT.")
+	}
+	at.SetToken(tkA)
+	sessions, _, err = at.UserSessionsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current && s.ID.Hex() != current {
+			t.Fatalf("Expected the current session to remain %s, got %s", current, s.ID.Hex())
+		}
+	}
+
+	// Revoke the second session and make sure its JWT no longer works.
+	status, err := at.UserSessionDELETE(other)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d and '%v'", status, err)
+	}
+	at.SetToken(tkB)
+	_, status, err = at.UserGET()
+	if err == nil || status != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", status, err)
+	}
+	// The first session is not affected.
+	at.SetToken(tkA)
+	_, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revoking a session twice or revoking an unknown session fails.
+	status, _ = at.UserSessionDELETE(other)
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", status)
+	}
+	status, _ = at.UserSessionDELETE(primitive.NewObjectID().Hex())
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", status)
+	}
+	status, _ = at.UserSessionDELETE("not-an-id")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", status)
+	}
+
+	// Logging out revokes the session's JWT.
+	tkC := login()
+	at.SetToken(tkC)
+	_, err = at.Request(http.MethodPost, "/logout", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, status, err = at.UserGET()
+	if err == nil || status != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", status, err)
+	}
+
+	// Log out everywhere.
+	tkD := login()
+	at.SetToken(tkA)
+	status, err = at.UserSessionsDELETE()
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d and '%v'", status, err)
+	}
+	for _, tk := range []string{tkA, tkD} {
+		at.SetToken(tk)
+		_, status, err = at.UserGET()
+		if err == nil || status != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d and '%v'", status, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testTokenRefresh ensures refresh tokens can be exchanged for new JWTs
+// exactly once and that replaying a refresh token ends the session.
+func testTokenRefresh(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+
+	// Logging in gives us a refresh token.
+	r, _, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt1 := r.Header.Get(api.RefreshTokenHeader)
+	if rt1 == "" {
+		t.Fatal("Expected a refresh token.")
+	}
+	// Exchange it for a new JWT and a new refresh token.
+	r, err = at.TokenRefreshPOST(rt1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2 := r.Header.Get(api.RefreshTokenHeader)
+	tk := r.Header.Get("Skynet-Token")
+	if rt2 == "" || rt2 == rt1 || tk == "" {
+		t.Fatalf("Expected a new JWT and refresh token, got '%s' and '%s'", tk, rt2)
+	}
+	// Make sure the new JWT works.
+	at.SetToken(tk)
+	_, _, err = at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replay the first refresh token. Expect this to fail and to revoke the
+	// second refresh token as well.
+	r, err = at.TokenRefreshPOST(rt1)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+	r, err = at.TokenRefreshPOST(rt2)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+
+	// Logging out revokes the session's refresh token.
+	r, _, err = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt3 := r.Header.Get(api.RefreshTokenHeader)
+	at.SetCookie(test.ExtractCookie(r))
+	_, err = at.Request(http.MethodPost, "/logout", nil, nil, map[string]string{api.RefreshTokenHeader: rt3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = at.TokenRefreshPOST(rt3)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+}
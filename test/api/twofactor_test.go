@@ -0,0 +1,200 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/api"
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/totp"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testTwoFactor ensures that users can enroll a TOTP and that password logins
+// require a second factor once they have done so.
+func testTwoFactor(t *testing.T, at *test.AccountsTester) {
+	emailAddr := types.NewEmail(test.DBNameForTest(t.Name()) + "@siasky.net")
+	password := hex.EncodeToString(fastrand.Bytes(16))
+	u, err := test.CreateUser(at, emailAddr, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	defer at.ClearCredentials()
+	defer func() {
+		// Wrong codes count as failed logins and all test requests come from
+		// the same IP, so we don't want to leave them behind for the other
+		// tests.
+		_, _ = at.DB.LoginAttemptsClear(at.Ctx, emailAddr, "127.0.0.1")
+	}()
+
+	// login logs the user in with their credentials. It returns the response
+	// and the two-factor challenge, if there is one.
+	login := func() (*http.Response, api.TwoFactorChallenge) {
+		r, b, err := at.LoginCredentialsPOST(emailAddr.String(), password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ch api.TwoFactorChallenge
+		if r.StatusCode == http.StatusOK {
+			if err = json.Unmarshal(b, &ch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r, ch
+	}
+	r, _ := login()
+	at.SetToken(r.Header.Get("Skynet-Token"))
+
+	// Enroll a TOTP.
+	enr, _, err := at.UserTOTPPOST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enr.Secret == "" || enr.URI == "" {
+		t.Fatalf("Expected a secret and a URI, got %+v", enr)
+	}
+	_, status, _ := at.UserTOTPConfirmPOST("invalid")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", status)
+	}
+	now := time.Now()
+	code, err := totp.Code(enr.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := at.UserTOTPConfirmPOST(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.RecoveryCodes) == 0 {
+		t.Fatal("Expected recovery codes.")
+	}
+	ug, _, err := at.UserGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ug.TwoFactorEnabled {
+		t.Fatal("Expected two-factor authentication to be enabled.")
+	}
+	// Enrolling again is not allowed.
+	_, status, _ = at.UserTOTPPOST()
+	if status != http.StatusConflict {
+		t.Fatalf("Expected status 409, got %d", status)
+	}
+
+	// A password login now requires a second factor.
+	r, ch := login()
+	if r.StatusCode != http.StatusOK || !ch.TwoFactorRequired || ch.Token == "" {
+		t.Fatalf("Expected a two-factor challenge, got %d and %+v", r.StatusCode, ch)
+	}
+	if r.Header.Get("Skynet-Token") != "" {
+		t.Fatal("Expected no JWT before the second factor.")
+	}
+	// The code we used for the enrollment can't be reused.
+	r, err = at.LoginTwoFactorPOST(ch.Token, code)
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+	// A code from the next time step is accepted.
+	code, err = totp.Code(enr.Secret, now.Add(totp.Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = at.LoginTwoFactorPOST(ch.Token, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Get("Skynet-Token") == "" {
+		t.Fatal("Expected a JWT.")
+	}
+	// The two-factor login can't be completed twice.
+	_, err = at.LoginTwoFactorPOST(ch.Token, rc.RecoveryCodes[0])
+	if err == nil {
+		t.Fatal("Expected a used two-factor login to be rejected.")
+	}
+
+	// Recovery codes work exactly once.
+	_, ch = login()
+	_, err = at.LoginTwoFactorPOST(ch.Token, rc.RecoveryCodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ch = login()
+	r, err = at.LoginTwoFactorPOST(ch.Token, rc.RecoveryCodes[0])
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+
+	// Confirming the user's email doesn't bypass the second factor.
+	at.ClearCredentials()
+	var confirmCh api.TwoFactorChallenge
+	r, err = at.Request(http.MethodGet, "/user/confirm", url.Values{"token": {u.EmailConfirmationToken}}, nil, nil, &confirmCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !confirmCh.TwoFactorRequired || confirmCh.Token == "" || r.Header.Get("Skynet-Token") != "" {
+		t.Fatalf("Expected a two-factor challenge, got %+v", confirmCh)
+	}
+
+	// Wrong codes count as failed logins. A correct password doesn't reset
+	// them, so they eventually block the user's logins like wrong passwords.
+	_, ch = login()
+	blocked := false
+	for i := 0; i < database.TwoFactorLoginMaxAttempts && !blocked; i++ {
+		r, _ = at.LoginTwoFactorPOST(ch.Token, "invalid")
+		blocked = r.StatusCode == http.StatusTooManyRequests
+	}
+	if !blocked {
+		t.Fatal("Expected the wrong codes to get blocked.")
+	}
+	r, _, _ = at.LoginCredentialsPOST(emailAddr.String(), password)
+	if r.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, r.StatusCode)
+	}
+	_, err = at.DB.LoginAttemptsClear(at.Ctx, emailAddr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too many wrong codes invalidate the two-factor login.
+	_, ch = login()
+	for i := 0; i < database.TwoFactorLoginMaxAttempts; i++ {
+		_, _ = at.LoginTwoFactorPOST(ch.Token, "invalid")
+		// Lift the block the wrong codes cause, so we can use up the
+		// two-factor login.
+		_, err = at.DB.LoginAttemptsClear(at.Ctx, emailAddr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err = at.LoginTwoFactorPOST(ch.Token, rc.RecoveryCodes[1])
+	if err == nil || r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d and '%v'", r.StatusCode, err)
+	}
+
+	// Disable two-factor authentication. Logging in no longer requires it.
+	status, _ = at.UserTOTPDisablePOST("invalid")
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", status)
+	}
+	status, err = at.UserTOTPDisablePOST(rc.RecoveryCodes[1])
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d and '%v'", status, err)
+	}
+	r, ch = login()
+	if ch.TwoFactorRequired || r.Header.Get("Skynet-Token") == "" {
+		t.Fatal("Expected a login without a second factor.")
+	}
+}
@@ -2,10 +2,13 @@ package database
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
 )
 
 // TestAPIKeys ensures the DB operations with API keys work as expected.
@@ -27,7 +30,7 @@ func TestAPIKeys(t *testing.T) {
 	sl2 := test.RandomSkylink()
 
 	// Create a private API key.
-	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil)
+	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,17 +38,26 @@ func TestAPIKeys(t *testing.T) {
 		t.Fatal("Unexpected name.")
 	}
 	// Create a private API key with skylinks. Expect to fail.
-	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1})
+	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1}, nil, nil, nil)
 	if err == nil {
 		t.Fatal("Managed to create a private API key with skylinks.")
 	}
+	// Public API keys can't have scopes and all scopes need to be valid.
+	_, err = db.APIKeyCreate(ctx, *u, "", true, []string{sl1}, []string{database.APIKeyScopeDownload}, nil, nil)
+	if !errors.Contains(err, database.ErrInvalidAPIKeyOperation) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidAPIKeyOperation, err)
+	}
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, []string{"admin"}, nil, nil)
+	if !errors.Contains(err, database.ErrInvalidAPIKeyOperation) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidAPIKeyOperation, err)
+	}
 	// Create a public API key
-	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1})
+	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1}, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Create a public API key without any skylinks.
-	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil)
+	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,6 +69,10 @@ func TestAPIKeys(t *testing.T) {
 	if akr1a.ID.Hex() != akr1.ID.Hex() {
 		t.Fatal("Did not get the correct API key!")
 	}
+	// We don't store the key itself, only its hash and prefix.
+	if akr1a.Key != "" || akr1a.KeyHash != akr1.Key.Hash() || akr1a.KeyPrefix != akr1.Key.Prefix() {
+		t.Fatalf("Unexpected stored API key %+v", akr1a)
+	}
 	// Get an API key by key.
 	akr1a, err = db.APIKeyByKey(ctx, akr1.Key.String())
 	if err != nil {
@@ -65,6 +81,45 @@ func TestAPIKeys(t *testing.T) {
 	if akr1a.ID.Hex() != akr1.ID.Hex() {
 		t.Fatal("Did not get the correct API key by key!")
 	}
+	// API keys are case-insensitive.
+	akr1a, err = db.APIKeyByKey(ctx, strings.ToLower(akr1.Key.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr1a.ID.Hex() != akr1.ID.Hex() {
+		t.Fatal("Did not get the correct API key by lower case key!")
+	}
+	// Record the API key's use.
+	err = db.APIKeyUsed(ctx, &akr1a, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Further uses within the throttle window don't get written.
+	akr1b := akr1a
+	err = db.APIKeyUsed(ctx, &akr1b, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr1a, err = db.APIKeyGet(ctx, akr1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr1a.LastUsedAt == nil || akr1a.LastUsedIP != "10.0.0.1" {
+		t.Fatalf("Unexpected last use %v from %s", akr1a.LastUsedAt, akr1a.LastUsedIP)
+	}
+	// Expired API keys.
+	expiresAt := time.Now().UTC().Add(-time.Second)
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, nil, nil, &expiresAt)
+	if !errors.Contains(err, database.ErrInvalidAPIKeyOperation) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidAPIKeyOperation, err)
+	}
+	if akr1a.Expired() {
+		t.Fatal("Expected an API key without an expiration not to expire.")
+	}
+	akr1a.ExpiresAt = &expiresAt
+	if !akr1a.Expired() {
+		t.Fatal("Expected the API key to be expired.")
+	}
 	// List API keys.
 	akrs, err := db.APIKeyList(ctx, *u)
 	if err != nil {
@@ -85,6 +140,26 @@ func TestAPIKeys(t *testing.T) {
 	if found != 3 {
 		t.Fatalf("Expected to find %d API keys we expect, found %d", 3, found)
 	}
+	// Create an API key with an IP allow-list. Bare IPs get normalised to
+	// single-address ranges and invalid ranges are rejected.
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, nil, []string{"not-an-ip"}, nil)
+	if !errors.Contains(err, database.ErrInvalidAPIKeyOperation) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidAPIKeyOperation, err)
+	}
+	akr4, err := db.APIKeyCreate(ctx, *u, "", false, nil, nil, []string{"10.0.0.1", "192.168.0.0/16"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr4a, err := db.APIKeyGet(ctx, akr4.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akr4a.AllowedIPs) != 2 || akr4a.AllowedIPs[0] != "10.0.0.1/32" || akr4a.AllowedIPs[1] != "192.168.0.0/16" {
+		t.Fatalf("Unexpected allowed IPs %v", akr4a.AllowedIPs)
+	}
+	if !akr4a.AllowsIP("192.168.1.1") || akr4a.AllowsIP("10.0.0.2") {
+		t.Fatal("Unexpected IP allow-list behaviour.")
+	}
 
 	// Try to update a general API key. Expect to fail.
 	err = db.APIKeyUpdate(ctx, *u, akr1.ID, []string{sl1})
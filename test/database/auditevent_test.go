@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestAuditEvents ensures that we can record and read audit events.
+func TestAuditEvents(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uID := primitive.NewObjectID()
+
+	// Events need a user and an action.
+	err = db.AuditEventCreate(ctx, database.AuditEvent{Action: database.AuditActionUserSuspend})
+	if err == nil {
+		t.Fatal("Managed to record an audit event without a user.")
+	}
+	err = db.AuditEventCreate(ctx, database.AuditEvent{UserID: uID})
+	if err == nil {
+		t.Fatal("Managed to record an audit event without an action.")
+	}
+	// Record a few events.
+	actions := []string{database.AuditActionUserSuspend, database.AuditActionUserReinstate, database.AuditActionUserTier}
+	for _, action := range actions {
+		err = db.AuditEventCreate(ctx, database.AuditEvent{UserID: uID, Actor: "admin", Action: action, IP: "198.51.100.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another user's events don't show up.
+	err = db.AuditEventCreate(ctx, database.AuditEvent{UserID: primitive.NewObjectID(), Action: database.AuditActionUserTier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect the latest events, newest first.
+	events, err := db.AuditEventsByUser(ctx, uID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != actions[2] || events[1].Action != actions[1] {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if events[0].Actor != "admin" || events[0].IP != "198.51.100.1" || events[0].CreatedAt.IsZero() {
+		t.Fatalf("Unexpected event %+v", events[0])
+	}
+
+	// Filter by user and action and page through the results.
+	err = db.AuditEventCreate(ctx, database.AuditEvent{UserID: uID, Actor: database.AuditActorStripe, Action: database.AuditActionUserTier, Before: "1", After: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := database.AuditEventsFilter{UserID: uID, Action: database.AuditActionUserTier}
+	events, pcs, err := db.AuditEventsCursor(ctx, f, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Actor != database.AuditActorStripe || events[0].Before != "1" || events[0].After != "2" || pcs.Next == "" {
+		t.Fatalf("Unexpected events %+v and cursors %+v", events, pcs)
+	}
+	cursor, err := database.ParsePageCursor(pcs.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, pcs, err = db.AuditEventsCursor(ctx, f, &cursor, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Actor != "admin" || pcs.Next != "" {
+		t.Fatalf("Unexpected events %+v and cursors %+v", events, pcs)
+	}
+	// Filter by actor and time.
+	events, _, err = db.AuditEventsCursor(ctx, database.AuditEventsFilter{Actor: "admin", IP: "198.51.100.1"}, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(actions) {
+		t.Fatalf("Expected %d events, got %+v", len(actions), events)
+	}
+	events, _, err = db.AuditEventsCursor(ctx, database.AuditEventsFilter{UserID: uID, From: time.Now().UTC().Add(time.Hour)}, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Expected no events, got %+v", events)
+	}
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+)
+
+// TestLoginAttempts ensures that failed attempts get counted, delayed, locked
+// out and cleared.
+func TestLoginAttempts(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	ip := "10.0.0.1"
+	scope := database.LoginAttemptScopeLogin
+
+	// Nothing is blocked initially.
+	until, err := db.LoginAttemptsBlockedUntil(ctx, scope, email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.IsZero() {
+		t.Fatalf("Expected no block, got %v", until)
+	}
+	// The first three failures are free.
+	for i := 1; i <= 3; i++ {
+		la, lockedOut, err := db.LoginAttemptFailed(ctx, scope, email, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if la.Failures != i || lockedOut || !la.BlockedUntil.IsZero() {
+			t.Fatalf("Unexpected attempt %+v, locked out: %t", la, lockedOut)
+		}
+	}
+	// The fourth one blocks further attempts.
+	la, lockedOut, err := db.LoginAttemptFailed(ctx, scope, email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockedOut || la.BlockedUntil.Before(time.Now()) {
+		t.Fatalf("Expected a short block, got %+v, locked out: %t", la, lockedOut)
+	}
+	until, err = db.LoginAttemptsBlockedUntil(ctx, scope, email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.IsZero() {
+		t.Fatal("Expected the email to be blocked.")
+	}
+	// The block only applies to its own scope.
+	until, err = db.LoginAttemptsBlockedUntil(ctx, database.LoginAttemptScopeRecover, email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.IsZero() {
+		t.Fatalf("Expected no block, got %v", until)
+	}
+	// The tenth failure locks the email out.
+	for i := 5; i <= 10; i++ {
+		la, lockedOut, err = db.LoginAttemptFailed(ctx, scope, email, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lockedOut != (i == 10) {
+			t.Fatalf("Unexpected lockout after %d failures", i)
+		}
+	}
+	if la.BlockedUntil.Before(time.Now().Add(database.LoginLockoutDuration / 2)) {
+		t.Fatalf("Expected a lockout, got %+v", la)
+	}
+	// Subsequent failures don't trigger a new lockout.
+	_, lockedOut, err = db.LoginAttemptFailed(ctx, scope, email, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockedOut {
+		t.Fatal("Expected no new lockout.")
+	}
+	las, err := db.LoginAttemptsBlocked(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(las) != 1 || las[0].Email != email {
+		t.Fatalf("Expected one blocked email, got %+v", las)
+	}
+
+	// Block the IP as well. It's already got 11 failures.
+	for i := 12; i <= 21; i++ {
+		_, _, err = db.LoginAttemptFailed(ctx, scope, "", ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Resetting the email doesn't reset the IP.
+	err = db.LoginAttemptsReset(ctx, scope, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until, err = db.LoginAttemptsBlockedUntil(ctx, scope, email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.IsZero() {
+		t.Fatalf("Expected no block, got %v", until)
+	}
+	until, err = db.LoginAttemptsBlockedUntil(ctx, scope, "", ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.IsZero() {
+		t.Fatal("Expected the IP to remain blocked.")
+	}
+	// Clear the IP.
+	n, err := db.LoginAttemptsClear(ctx, "", ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected to clear 1 record, cleared %d", n)
+	}
+	_, err = db.LoginAttemptsClear(ctx, "", "")
+	if err == nil {
+		t.Fatal("Expected clearing without an email or IP to fail.")
+	}
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestMetaFetcherJobs ensures that the persistent metafetcher queue correctly
+// locks, fails and completes jobs.
+func TestMetaFetcherJobs(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queue the same skylink twice. We expect a single job.
+	err = db.MetaFetcherJobCreate(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MetaFetcherJobCreate(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockID1 := t.Name() + "_1"
+	lockID2 := t.Name() + "_2"
+	jobs, err := db.MetaFetcherJobLockAndFetch(ctx, lockID1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(jobs))
+	}
+	if jobs[0].SkylinkID != sl.ID || jobs[0].LockedBy != lockID1 {
+		t.Fatalf("Unexpected job %+v", jobs[0])
+	}
+	// Another server should not be able to lock the same job.
+	jobs2, err := db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs2) != 0 {
+		t.Fatalf("Expected 0 jobs, got %d", len(jobs2))
+	}
+	// Fail the job. This unlocks it, so other servers can pick it up.
+	err = db.MetaFetcherJobFail(ctx, jobs[0].ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep failing the job until it runs out of attempts. It should be
+	// available for locking until then.
+	for i := 1; i < database.MetaFetcherMaxAttempts; i++ {
+		jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 1 || jobs[0].Attempts != i {
+			t.Fatalf("Expected 1 job with %d attempts, got %+v", i, jobs)
+		}
+		err = db.MetaFetcherJobFail(ctx, jobs[0].ID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The job has exhausted its attempts, so we don't expect to lock it.
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected 0 jobs, got %d", len(jobs))
+	}
+	// Queuing the skylink again gives it a fresh set of attempts.
+	err = db.MetaFetcherJobCreate(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Attempts != 0 {
+		t.Fatalf("Expected 1 job with 0 attempts, got %+v", jobs)
+	}
+	// Complete the job and make sure it's gone.
+	err = db.MetaFetcherJobComplete(ctx, jobs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected 0 jobs, got %d", len(jobs))
+	}
+
+	// Queue a new skylink and fail it with a future next attempt. We don't
+	// expect to be able to lock it while it's backing off.
+	sl, err = db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MetaFetcherJobCreate(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(jobs))
+	}
+	err = db.MetaFetcherJobFail(ctx, jobs[0].ID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected 0 jobs, got %d", len(jobs))
+	}
+	// Re-queuing a job which still has attempts left should not reset its
+	// back off.
+	requeued, err := db.MetaFetcherJobRequeue(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued {
+		t.Fatal("Expected the job not to be re-queued.")
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected 0 jobs, got %d", len(jobs))
+	}
+
+	// Re-queuing a skylink without a job queues it.
+	sl, err = db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requeued, err = db.MetaFetcherJobRequeue(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requeued {
+		t.Fatal("Expected the job to be queued.")
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].SkylinkID != sl.ID {
+		t.Fatalf("Expected 1 job for skylink %v, got %+v", sl.ID, jobs)
+	}
+	// Exhaust the job's attempts. Re-queuing it gives it a fresh set.
+	for i := 0; i < database.MetaFetcherMaxAttempts; i++ {
+		err = db.MetaFetcherJobFail(ctx, jobs[0].ID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	requeued, err = db.MetaFetcherJobRequeue(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requeued {
+		t.Fatal("Expected the job to be re-queued.")
+	}
+	jobs, err = db.MetaFetcherJobLockAndFetch(ctx, lockID2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Attempts != 0 {
+		t.Fatalf("Expected 1 job with 0 attempts, got %+v", jobs)
+	}
+}
+
+// TestSkylinksWithUnknownSize ensures that SkylinksWithUnknownSize only returns
+// zero-size skylinks which are referenced by uploads or downloads.
+func TestSkylinksWithUnknownSize(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		err := db.UserDelete(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(u)
+
+	// A skylink with a known size.
+	_, _, err = test.CreateTestUpload(ctx, db, *u, 123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A skylink nobody references.
+	_, err = db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An uploaded skylink with unknown size.
+	slUp, _, err := test.CreateTestUpload(ctx, db, *u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A downloaded skylink with unknown size.
+	slDown, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *slDown, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.SkylinksWithUnknownSize(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 skylinks, got %d", len(ids))
+	}
+	for _, id := range ids {
+		if id != slUp.ID && id != slDown.ID {
+			t.Fatalf("Unexpected skylink %v", id)
+		}
+	}
+}
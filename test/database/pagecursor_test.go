@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestCursorPagination ensures we can walk the user's uploads and downloads
+// page by page in both directions, using cursors.
+func TestCursorPagination(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+
+	// Upload and download five skylinks. We expect to list them from newest
+	// to oldest.
+	var skylinks []string
+	for i := 0; i < 5; i++ {
+		sl, _, err := test.CreateTestUpload(ctx, db, *u, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *sl, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skylinks = append([]string{sl.Skylink}, skylinks...)
+	}
+
+	// Walk forward over the uploads.
+	var pages [][]database.UploadResponse
+	var cursor *database.PageCursor
+	for {
+		ups, pcs, err := db.UploadsByUserCursor(ctx, *u, database.UploadsFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, ups)
+		if pcs.Next == "" {
+			break
+		}
+		c, err := database.ParsePageCursor(pcs.Next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = &c
+	}
+	var walked []string
+	for _, p := range pages {
+		for _, up := range p {
+			walked = append(walked, up.Skylink)
+		}
+	}
+	if len(pages) != 3 || !equalSkylinks(walked, skylinks) {
+		t.Fatalf("Expected %v in 3 pages, got %v in %d pages", skylinks, walked, len(pages))
+	}
+
+	// Go back from the last page and expect to get the second one.
+	back := pages[2][0].PageCursor()
+	back.Backwards = true
+	ups, pcs, err := db.UploadsByUserCursor(ctx, *u, database.UploadsFilter{}, &back, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups) != 2 || ups[0].Skylink != skylinks[2] || ups[1].Skylink != skylinks[3] {
+		t.Fatalf("Expected the second page, got %v", ups)
+	}
+	if pcs.Next == "" || pcs.Prev == "" {
+		t.Fatalf("Expected both cursors, got %+v", pcs)
+	}
+
+	// Cursors are only supported when sorting by time.
+	_, _, err = db.UploadsByUserCursor(ctx, *u, database.UploadsFilter{SortBy: database.UploadsSortByName}, nil, 2)
+	if err != database.ErrCursorSortUnsupported {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrCursorSortUnsupported, err)
+	}
+
+	// Walk forward over the downloads.
+	walked = nil
+	cursor = nil
+	for {
+		downs, pcs, err := db.DownloadsByUserCursor(ctx, *u, cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range downs {
+			walked = append(walked, d.Skylink)
+		}
+		if pcs.Next == "" {
+			break
+		}
+		c, err := database.ParsePageCursor(pcs.Next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = &c
+	}
+	if !equalSkylinks(walked, skylinks) {
+		t.Fatalf("Expected %v, got %v", skylinks, walked)
+	}
+}
+
+// equalSkylinks returns true if both lists hold the same skylinks in the same
+// order.
+func equalSkylinks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/test/fixtures"
+	"github.com/SkynetLabs/skynet-accounts/webauthn"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPasskeys ensures that users can register passkeys, log in with them and
+// manage them.
+func TestPasskeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+	att, err := webauthn.DecodeString(fixtures.PasskeyAttestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID, err := webauthn.DecodeString(fixtures.PasskeyCredentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// challenge creates a new WebAuthn challenge and returns it in its
+	// base64url form.
+	challenge := func(userID primitive.ObjectID, cType string) string {
+		ch, err := db.NewWebAuthnChallenge(ctx, userID, cType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := hex.DecodeString(ch.Challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return webauthn.EncodeToString(b)
+	}
+
+	// Registration challenges belong to a user.
+	_, err = db.NewWebAuthnChallenge(ctx, primitive.NilObjectID, database.ChallengeTypeWebAuthnRegister)
+	if err == nil {
+		t.Fatal("Expected a registration challenge without a user to fail")
+	}
+	// A challenge issued to another user is not accepted.
+	cd := test.PasskeyClientData(webauthn.TypeCreate, challenge(primitive.NewObjectID(), database.ChallengeTypeWebAuthnRegister))
+	_, err = db.UserPasskeyRegister(ctx, u, "laptop", cd, att)
+	if !errors.Contains(err, database.ErrInvalidWebAuthnChallenge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidWebAuthnChallenge, err)
+	}
+	// Register the passkey.
+	cd = test.PasskeyClientData(webauthn.TypeCreate, challenge(u.ID, database.ChallengeTypeWebAuthnRegister))
+	pk, err := db.UserPasskeyRegister(ctx, u, "laptop", cd, att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pk.CredentialID, credID) || pk.Name != "laptop" || len(u.Passkeys) != 1 {
+		t.Fatalf("Unexpected passkey %+v", pk)
+	}
+	// The challenge can't be used again.
+	_, err = db.UserPasskeyRegister(ctx, u, "laptop", cd, att)
+	if !errors.Contains(err, database.ErrInvalidWebAuthnChallenge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidWebAuthnChallenge, err)
+	}
+	// The same passkey can't be registered twice.
+	cd = test.PasskeyClientData(webauthn.TypeCreate, challenge(u.ID, database.ChallengeTypeWebAuthnRegister))
+	_, err = db.UserPasskeyRegister(ctx, u, "laptop", cd, att)
+	if !errors.Contains(err, database.ErrPasskeyExists) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrPasskeyExists, err)
+	}
+
+	// Log in with the passkey.
+	cd = test.PasskeyClientData(webauthn.TypeGet, challenge(primitive.NilObjectID, database.ChallengeTypeWebAuthnLogin))
+	ad, sig, err := test.PasskeyAssertion(cd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByPasskeyAssertion(ctx, credID, cd, ad, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s", u.ID.Hex(), u2.ID.Hex())
+	}
+	if u2.Passkeys[0].SignCount != 1 || u2.Passkeys[0].LastUsedAt.IsZero() {
+		t.Fatalf("Expected the passkey's usage to be updated, got %+v", u2.Passkeys[0])
+	}
+	// Replaying the assertion fails.
+	_, err = db.UserByPasskeyAssertion(ctx, credID, cd, ad, sig)
+	if !errors.Contains(err, database.ErrInvalidWebAuthnChallenge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidWebAuthnChallenge, err)
+	}
+	// An assertion which doesn't increase the counter fails.
+	cd = test.PasskeyClientData(webauthn.TypeGet, challenge(primitive.NilObjectID, database.ChallengeTypeWebAuthnLogin))
+	ad, sig, err = test.PasskeyAssertion(cd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByPasskeyAssertion(ctx, credID, cd, ad, sig)
+	if !errors.Contains(err, webauthn.ErrSignCountRegressed) {
+		t.Fatalf("Expected '%v', got '%v'", webauthn.ErrSignCountRegressed, err)
+	}
+
+	// Rename the passkey.
+	err = db.UserPasskeyRename(ctx, u, credID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Passkeys) != 1 || u.Passkeys[0].Name != "phone" {
+		t.Fatalf("Expected the passkey to be renamed, got %+v", u.Passkeys)
+	}
+	// Delete the passkey.
+	err = db.UserPasskeyDelete(ctx, u, credID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Passkeys) != 0 {
+		t.Fatalf("Expected no passkeys, got %d", len(u.Passkeys))
+	}
+	err = db.UserPasskeyDelete(ctx, u, credID)
+	if !errors.Contains(err, database.ErrPasskeyNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrPasskeyNotFound, err)
+	}
+	// The deleted passkey can no longer log in.
+	cd = test.PasskeyClientData(webauthn.TypeGet, challenge(primitive.NilObjectID, database.ChallengeTypeWebAuthnLogin))
+	ad, sig, err = test.PasskeyAssertion(cd, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByPasskeyAssertion(ctx, credID, cd, ad, sig)
+	if !errors.Contains(err, database.ErrPasskeyNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrPasskeyNotFound, err)
+	}
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestRefreshTokens ensures refresh tokens rotate correctly and that reusing
+// one revokes its entire session but not the user's other sessions.
+func TestRefreshTokens(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+
+	// Start two sessions.
+	sA, err := db.SessionCreate(ctx, *u, "agent A", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sB, err := db.SessionCreate(ctx, *u, "agent B", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtA1, rtr, err := db.RefreshTokenCreate(ctx, *sA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtr.UserID != u.ID || rtr.SessionID != sA.ID || rtr.TokenHash == rtA1 {
+		t.Fatalf("Unexpected refresh token record %+v", rtr)
+	}
+	rtB1, _, err := db.RefreshTokenCreate(ctx, *sB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate the first session's token.
+	rtA2, rtr2, err := db.RefreshTokenRotate(ctx, rtA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtA2 == rtA1 || rtr2.SessionID != sA.ID {
+		t.Fatalf("Expected a new token in session %s, got %+v", sA.ID.Hex(), rtr2)
+	}
+	// Reuse the first token. Expect the whole session to be revoked.
+	_, _, err = db.RefreshTokenRotate(ctx, rtA1)
+	if !errors.Contains(err, database.ErrRefreshTokenReused) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrRefreshTokenReused, err)
+	}
+	_, _, err = db.RefreshTokenRotate(ctx, rtA2)
+	if !errors.Contains(err, database.ErrInvalidRefreshToken) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidRefreshToken, err)
+	}
+	// The second session is not affected.
+	rtB2, _, err := db.RefreshTokenRotate(ctx, rtB1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revoking the session via its refresh token ends it.
+	err = db.SessionRevokeByRefreshToken(ctx, rtB2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.RefreshTokenRotate(ctx, rtB2)
+	if !errors.Contains(err, database.ErrInvalidRefreshToken) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidRefreshToken, err)
+	}
+	// Unknown tokens are rejected.
+	_, _, err = db.RefreshTokenRotate(ctx, "unknown")
+	if !errors.Contains(err, database.ErrInvalidRefreshToken) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidRefreshToken, err)
+	}
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestSessions ensures that we can list and revoke user sessions and that
+// revoking a session revokes its refresh tokens.
+func TestSessions(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u2)
+
+	start := time.Now().UTC().Add(-time.Second)
+	sA, err := db.SessionCreate(ctx, *u, "agent A", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sB, err := db.SessionCreate(ctx, *u, "agent B", "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := db.SessionCreate(ctx, *u2, "agent C", "127.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtA, _, err := db.RefreshTokenCreate(ctx, *sA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := db.SessionsByUser(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+
+	// Users cannot revoke each other's sessions.
+	err = db.SessionRevoke(ctx, *u, s2.ID)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+	// Revoke the first session. Its refresh token should stop working.
+	err = db.SessionRevoke(ctx, *u, sA.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.RefreshTokenRotate(ctx, rtA)
+	if !errors.Contains(err, database.ErrInvalidRefreshToken) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidRefreshToken, err)
+	}
+	sessions, err = db.SessionsByUser(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != sB.ID {
+		t.Fatalf("Expected only session %s, got %+v", sB.ID.Hex(), sessions)
+	}
+	// The revoked session shows up among the recently revoked ones.
+	revoked, err := db.SessionsRevokedSince(ctx, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range revoked {
+		found = found || s.ID == sA.ID
+	}
+	if !found {
+		t.Fatalf("Expected session %s to be revoked", sA.ID.Hex())
+	}
+
+	// Revoke all sessions of the first user. The second user's session is
+	// not affected.
+	n, err := db.SessionsRevokeAll(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 revoked session, got %d", n)
+	}
+	sessions, err = db.SessionsByUser(ctx, *u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != s2.ID {
+		t.Fatalf("Expected only session %s, got %+v", s2.ID.Hex(), sessions)
+	}
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestSkylinkMetadataUpdate ensures that SkylinkMetadataUpdate stores the
+// extended metadata of a skylink and keeps its first-fetched timestamp.
+func TestSkylinkMetadataUpdate(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	meta := database.SkylinkMetadata{
+		ContentType:   "text/html",
+		DefaultPath:   "/index.html",
+		SubfilesCount: 2,
+		SubfilesSize:  300,
+		FetchedAt:     fetchedAt,
+	}
+	err = db.SkylinkMetadataUpdate(ctx, sl.ID, "website", 300, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err = db.SkylinkByID(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.Size != 300 || sl.ContentType != meta.ContentType || sl.DefaultPath != meta.DefaultPath ||
+		sl.SubfilesCount != meta.SubfilesCount || sl.SubfilesSize != meta.SubfilesSize || !sl.FetchedAt.Equal(fetchedAt) {
+		t.Fatalf("Unexpected skylink %+v", sl)
+	}
+	// Update the metadata again. We expect the first-fetched timestamp to
+	// remain unchanged.
+	meta.FetchedAt = time.Time{}
+	meta.SubfilesCount = 3
+	err = db.SkylinkMetadataUpdate(ctx, sl.ID, "website", 300, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err = db.SkylinkByID(ctx, sl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.SubfilesCount != 3 || !sl.FetchedAt.Equal(fetchedAt) {
+		t.Fatalf("Unexpected skylink %+v", sl)
+	}
+}
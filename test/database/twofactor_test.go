@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/totp"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestTOTP ensures that TOTP enrollment works and that each TOTP and recovery
+// code can only be used once.
+func TestTOTP(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+
+	// Confirming without a pending enrollment fails.
+	_, err = db.UserTOTPEnrollConfirm(ctx, u, "123456")
+	if !errors.Contains(err, database.ErrTOTPNotPending) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrTOTPNotPending, err)
+	}
+	secret, _, err := db.UserTOTPEnrollStart(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := db.UserTOTPEnrollConfirm(ctx, u, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the changes are persisted.
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.TwoFactorEnabled() || u.TOTPPendingSecret != "" || len(u.TOTPRecoveryCodes) != len(codes) {
+		t.Fatalf("Unexpected TOTP state %+v", u)
+	}
+
+	// The enrollment code can't be reused but the next one works once.
+	err = db.UserTOTPVerify(ctx, u, code)
+	if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+	}
+	code, err = totp.Code(secret, now.Add(totp.Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserTOTPVerify(ctx, u, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserTOTPVerify(ctx, u, code)
+	if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+	}
+	// Recovery codes work once, regardless of case.
+	err = db.UserTOTPVerify(ctx, u, " "+codes[0]+" ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserTOTPVerify(ctx, u, codes[0])
+	if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+	}
+
+	// A two-factor login gets invalidated after too many wrong codes.
+	token, _, err := db.TwoFactorLoginCreate(ctx, *u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < database.TwoFactorLoginMaxAttempts; i++ {
+		_, _, err = db.TwoFactorLoginComplete(ctx, token, "wrong")
+		if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+			t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+		}
+	}
+	_, _, err = db.TwoFactorLoginComplete(ctx, token, codes[1])
+	if !errors.Contains(err, database.ErrInvalidTwoFactorLogin) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTwoFactorLogin, err)
+	}
+	// A correct code completes a two-factor login.
+	token, _, err = db.TwoFactorLoginCreate(ctx, *u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, _, err := db.TwoFactorLoginComplete(ctx, token, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s", u.ID.Hex(), u2.ID.Hex())
+	}
+
+	// Wrong codes count across two-factor logins and too many of them lock
+	// the account's second factor.
+	for i := 0; i < database.TwoFactorMaxFailures; i++ {
+		if i%database.TwoFactorLoginMaxAttempts == 0 {
+			token, _, err = db.TwoFactorLoginCreate(ctx, *u, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, _, err = db.TwoFactorLoginComplete(ctx, token, "wrong")
+		if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+			t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+		}
+	}
+	token, _, err = db.TwoFactorLoginCreate(ctx, *u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.TwoFactorLoginComplete(ctx, token, codes[2])
+	if !errors.Contains(err, database.ErrTwoFactorLocked) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrTwoFactorLocked, err)
+	}
+	// The lock expires.
+	time.Sleep(database.TwoFactorLockoutDuration)
+	_, _, err = db.TwoFactorLoginComplete(ctx, token, codes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking codes outside of a two-factor login counts towards the same
+	// lock.
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < database.TwoFactorMaxFailures; i++ {
+		err = db.UserTOTPCheck(ctx, u, "wrong")
+		if !errors.Contains(err, database.ErrInvalidTOTPCode) {
+			t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidTOTPCode, err)
+		}
+	}
+	err = db.UserTOTPCheck(ctx, u, codes[3])
+	if !errors.Contains(err, database.ErrTwoFactorLocked) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrTwoFactorLocked, err)
+	}
+	time.Sleep(database.TwoFactorLockoutDuration)
+	err = db.UserTOTPCheck(ctx, u, codes[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disable the second factor.
+	err = db.UserTOTPDisable(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.TwoFactorEnabled() || len(u.TOTPRecoveryCodes) != 0 {
+		t.Fatalf("Unexpected TOTP state %+v", u)
+	}
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/skynet"
@@ -299,3 +300,111 @@ func TestUploadCreateAnon(t *testing.T) {
 		t.Fatalf("Expected empty UploaderIP, got '%s'", up.UploaderIP)
 	}
 }
+
+// TestUploadsByUserFiltered ensures UploadsByUserFiltered filters and sorts the
+// user's uploads correctly.
+func TestUploadsByUserFiltered(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+
+	// Create three uploads with different names and sizes.
+	names := []string{"Holiday.jpg", "notes.txt", "holiday-video.mp4"}
+	sizes := []int64{2 * skynet.MiB, 100, 50 * skynet.MiB}
+	var skylinks []*database.Skylink
+	for i := range names {
+		sl, _, err := test.CreateTestUpload(ctx, db, *u, sizes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.SkylinkUpdate(ctx, sl.ID, names[i], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skylinks = append(skylinks, sl)
+	}
+	// Unpin the last one.
+	_, err = db.UnpinUploads(ctx, *skylinks[2], *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   database.UploadsFilter
+		expected []string
+	}{
+		{
+			name:     "default",
+			filter:   database.UploadsFilter{},
+			expected: []string{names[1], names[0]},
+		},
+		{
+			name:     "name",
+			filter:   database.UploadsFilter{Name: "HOLIDAY", State: database.UploadStateAll},
+			expected: []string{names[2], names[0]},
+		},
+		{
+			name:     "size",
+			filter:   database.UploadsFilter{MinSize: skynet.MiB, MaxSize: 10 * skynet.MiB, State: database.UploadStateAll},
+			expected: []string{names[0]},
+		},
+		{
+			name:     "unpinned",
+			filter:   database.UploadsFilter{State: database.UploadStateUnpinned},
+			expected: []string{names[2]},
+		},
+		{
+			name:     "sort by size",
+			filter:   database.UploadsFilter{State: database.UploadStateAll, SortBy: database.UploadsSortBySize, SortAsc: true},
+			expected: []string{names[1], names[0], names[2]},
+		},
+		{
+			name:     "sort by name",
+			filter:   database.UploadsFilter{SortBy: database.UploadsSortByName},
+			expected: []string{names[1], names[0]},
+		},
+		{
+			name:     "date range",
+			filter:   database.UploadsFilter{To: time.Now().UTC().Add(-time.Hour)},
+			expected: []string{},
+		},
+	}
+	for _, tt := range tests {
+		ups, n, err := db.UploadsByUserFiltered(ctx, *u, tt.filter, 0, database.DefaultPageSize)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if n != int64(len(tt.expected)) || len(ups) != len(tt.expected) {
+			t.Fatalf("%s: expected %d uploads, got %d (total %d)", tt.name, len(tt.expected), len(ups), n)
+		}
+		for i := range ups {
+			if ups[i].Name != tt.expected[i] {
+				t.Fatalf("%s: expected upload %d to be '%s', got '%s'", tt.name, i, tt.expected[i], ups[i].Name)
+			}
+		}
+	}
+
+	// Invalid filters.
+	_, _, err = db.UploadsByUserFiltered(ctx, *u, database.UploadsFilter{State: "lost"}, 0, database.DefaultPageSize)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid state.")
+	}
+	_, _, err = db.UploadsByUserFiltered(ctx, *u, database.UploadsFilter{MinSize: 10, MaxSize: 5}, 0, database.DefaultPageSize)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid size range.")
+	}
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// TestUsageRollups ensures the usage rollups are kept up to date as uploads
+// and downloads are registered and that rebuilding them from the raw data
+// yields the same stats.
+func TestUsageRollups(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		_ = db.UserDelete(ctx, user)
+	}(u)
+
+	// Upload a skylink of known size twice and download it partially.
+	size := int64(1 + fastrand.Intn(10*skynet.MiB))
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.RegisterTestUpload(ctx, db, *u, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downSize := int64(1 + fastrand.Intn(skynet.MiB))
+	_, err = db.DownloadCreate(ctx, *u, *sl, downSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Downloading it again within the update window increments the existing
+	// download.
+	_, err = db.DownloadCreate(ctx, *u, *sl, downSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload and fully download a skylink of unknown size and only then
+	// learn its size.
+	unknown, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.RegisterTestUpload(ctx, db, *u, unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *unknown, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownSize := int64(1 + fastrand.Intn(10*skynet.MiB))
+	err = db.SkylinkUpdate(ctx, unknown.ID, "", unknownSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploadsTotal != 3 {
+		t.Fatalf("Expected %d uploads, got %d", 3, stats.NumUploadsTotal)
+	}
+	if stats.UploadsSizeTotal != size+unknownSize {
+		t.Fatalf("Expected uploads size %d, got %d", size+unknownSize, stats.UploadsSizeTotal)
+	}
+	expectedStorage := skynet.RawStorageUsed(size) + skynet.RawStorageUsed(unknownSize)
+	if stats.RawStorageUsedTotal != expectedStorage {
+		t.Fatalf("Expected raw storage %d, got %d", expectedStorage, stats.RawStorageUsedTotal)
+	}
+	expectedUpBW := 2*skynet.BandwidthUploadCost(size) + skynet.BandwidthUploadCost(unknownSize)
+	if stats.BandwidthUploadsTotal != expectedUpBW {
+		t.Fatalf("Expected upload bandwidth %d, got %d", expectedUpBW, stats.BandwidthUploadsTotal)
+	}
+	if stats.NumDownloadsTotal != 2 {
+		t.Fatalf("Expected %d downloads, got %d", 2, stats.NumDownloadsTotal)
+	}
+	if stats.DownloadsSizeTotal != 2*downSize+unknownSize {
+		t.Fatalf("Expected downloads size %d, got %d", 2*downSize+unknownSize, stats.DownloadsSizeTotal)
+	}
+	expectedDownBW := skynet.BandwidthDownloadCost(2*downSize) + skynet.BandwidthDownloadCost(unknownSize)
+	if stats.BandwidthDownloadsTotal != expectedDownBW {
+		t.Fatalf("Expected download bandwidth %d, got %d", expectedDownBW, stats.BandwidthDownloadsTotal)
+	}
+
+	// Unpin the first skylink. Its storage is released but the bandwidth
+	// remains.
+	_, err = db.UnpinUploads(ctx, *sl, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploadsTotal != 1 {
+		t.Fatalf("Expected %d uploads, got %d", 1, stats.NumUploadsTotal)
+	}
+	if stats.UploadsSizeTotal != unknownSize {
+		t.Fatalf("Expected uploads size %d, got %d", unknownSize, stats.UploadsSizeTotal)
+	}
+	if stats.BandwidthUploadsTotal != expectedUpBW {
+		t.Fatalf("Expected upload bandwidth %d, got %d", expectedUpBW, stats.BandwidthUploadsTotal)
+	}
+
+	// Rebuilding the rollups from the raw data should not change the stats.
+	err = db.UsageRollupsRebuild(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *rebuilt != *stats {
+		t.Fatalf("Expected rebuilt stats to match.\nExpected: %+v\nGot: %+v", stats, rebuilt)
+	}
+	n, err := db.UsageRollupsRebuildAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1 {
+		t.Fatalf("Expected to rebuild the rollups of at least one user, got %d", n)
+	}
+	rebuilt, err = db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *rebuilt != *stats {
+		t.Fatalf("Expected rebuilt stats to match.\nExpected: %+v\nGot: %+v", stats, rebuilt)
+	}
+}
+
+// TestUsageRollupsBuiltOnStart ensures we build the usage rollups once when
+// connecting to a database which doesn't have them yet.
+func TestUsageRollupsBuiltOnStart(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := db.ReadConfigValue(ctx, database.ConfValUsageRollupsBuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != database.ConfValTrue {
+		t.Fatalf("Expected the usage rollups marker to be '%s', got '%s'", database.ConfValTrue, val)
+	}
+}
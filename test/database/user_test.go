@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -769,10 +770,14 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	err = db.RegistryReadTrack(*u)
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
+	err = db.RegistryUsageFlush(ctx)
+	if err != nil {
+		t.Fatal("Failed to flush registry usage.", err)
+	}
 	expectedRegReadBandwidth := int64(skynet.CostBandwidthRegistryRead)
 	// Check bandwidth.
 	stats, err = db.UserStats(ctx, *u)
@@ -788,10 +793,14 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegReads, stats.BandwidthRegReads/skynet.MiB)
 	}
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	err = db.RegistryReadTrack(*u)
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
+	err = db.RegistryUsageFlush(ctx)
+	if err != nil {
+		t.Fatal("Failed to flush registry usage.", err)
+	}
 	expectedRegReadBandwidth += int64(skynet.CostBandwidthRegistryRead)
 	// Check bandwidth.
 	stats, err = db.UserStats(ctx, *u)
@@ -808,10 +817,14 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	err = db.RegistryWriteTrack(*u)
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
+	err = db.RegistryUsageFlush(ctx)
+	if err != nil {
+		t.Fatal("Failed to flush registry usage.", err)
+	}
 	expectedRegWriteBandwidth := int64(skynet.CostBandwidthRegistryWrite)
 	// Check bandwidth.
 	stats, err = db.UserStats(ctx, *u)
@@ -827,10 +840,14 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	err = db.RegistryWriteTrack(*u)
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
+	err = db.RegistryUsageFlush(ctx)
+	if err != nil {
+		t.Fatal("Failed to flush registry usage.", err)
+	}
 	expectedRegWriteBandwidth += int64(skynet.CostBandwidthRegistryWrite)
 	// Check bandwidth.
 	stats, err = db.UserStats(ctx, *u)
@@ -846,3 +863,252 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 }
+
+// TestUserSuspend ensures that UserSuspend, UserReinstate and
+// UserForceConfirmEmail work as expected.
+func TestUserSuspend(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		err = db.UserDelete(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(u)
+	if u.Suspended() {
+		t.Fatal("Expected a new user not to be suspended.")
+	}
+	// A suspension needs a reason.
+	err = db.UserSuspend(ctx, u, "", nil)
+	if err == nil {
+		t.Fatal("Managed to suspend a user without a reason.")
+	}
+	// A suspension can't expire in the past.
+	past := time.Now().UTC().Add(-time.Minute)
+	err = db.UserSuspend(ctx, u, "abuse", &past)
+	if err == nil {
+		t.Fatal("Managed to suspend a user until a past time.")
+	}
+	until := time.Now().UTC().Add(time.Hour)
+	err = db.UserSuspend(ctx, u, "abuse", &until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u2.Suspended() || u2.SuspensionReason != "abuse" || u2.SuspendedUntil == nil {
+		t.Fatalf("Expected the user to be suspended, got %+v", u2)
+	}
+	// Suspensions expire.
+	u2.SuspendedUntil = &past
+	if u2.Suspended() {
+		t.Fatal("Expected the suspension to have expired.")
+	}
+	// Suspending the user again without an expiration replaces the previous
+	// suspension.
+	err = db.UserSuspend(ctx, u, "more abuse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u2.Suspended() || u2.SuspensionReason != "more abuse" || u2.SuspendedUntil != nil {
+		t.Fatalf("Expected the user to be suspended indefinitely, got %+v", u2)
+	}
+	err = db.UserReinstate(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Suspended() || u2.SuspensionReason != "" {
+		t.Fatalf("Expected the user to be reinstated, got %+v", u2)
+	}
+	// Force the confirmation of the user's email.
+	if u2.EmailConfirmationToken == "" {
+		t.Fatal("Expected a new user to have an unconfirmed email.")
+	}
+	err = db.UserForceConfirmEmail(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.EmailConfirmationToken != "" {
+		t.Fatal("Expected the user's email to be confirmed.")
+	}
+	// Suspend a user who doesn't exist.
+	err = db.UserSuspend(ctx, &database.User{ID: primitive.NewObjectID()}, "abuse", nil)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUserScheduleDeletion ensures that we can schedule a user for deletion,
+// restore them and purge them once their grace period passes.
+func TestUserScheduleDeletion(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PendingDeletion() {
+		t.Fatal("Expected a new user not to be pending deletion.")
+	}
+	// A scheduled deletion needs a restore token.
+	err = db.UserScheduleDeletion(ctx, u, "")
+	if err == nil {
+		t.Fatal("Managed to schedule a deletion without a restore token.")
+	}
+	err = db.UserScheduleDeletion(ctx, u, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByRestoreToken(ctx, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID || !u2.PendingDeletion() || !u2.DeleteAt.Equal(*u.DeleteAt) {
+		t.Fatalf("Expected the user to be pending deletion at %v, got %+v", u.DeleteAt, u2)
+	}
+	// We only store the token's hash.
+	if u2.RestoreToken == "" || u2.RestoreToken == "token" {
+		t.Fatalf("Expected the restore token to be hashed, got '%s'", u2.RestoreToken)
+	}
+	// Restore the user. The token is no longer valid afterwards.
+	err = db.UserRestore(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByRestoreToken(ctx, "token")
+	if !errors.Contains(err, database.ErrInvalidToken) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidToken, err)
+	}
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.PendingDeletion() || u2.RestoreToken != "" {
+		t.Fatalf("Expected the user to be restored, got %+v", u2)
+	}
+	// Schedule the deletion again and purge the user once it's due.
+	err = db.UserScheduleDeletion(ctx, u, "token2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.UsersPurge(ctx, u.DeleteAt.Add(-time.Second))
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to purge no users, purged %d, error '%v'", n, err)
+	}
+	n, err = db.UsersPurge(ctx, *u.DeleteAt)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected to purge one user, purged %d, error '%v'", n, err)
+	}
+	_, err = db.UserByID(ctx, u.ID)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUsersSearch ensures that UsersSearch works as expected.
+func TestUsersSearch(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk database.PubKey = fastrand.Bytes(database.PubKeySize)
+	u1, err := db.UserCreatePK(ctx, types.NewEmail(t.Name()+"_one@siasky.net"), "", "", pk, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"_two@siasky.net"), "pass", t.Name()+"sub2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err = errors.Compose(db.UserDelete(ctx, u1), db.UserDelete(ctx, u2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	err = db.UserSetStripeID(ctx, u2, "cus_search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UploadCreate(ctx, *u1, "198.51.100.1", *sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   database.UsersFilter
+		expected []string
+	}{
+		{name: "email", filter: database.UsersFilter{Email: strings.ToUpper(t.Name())}, expected: []string{u1.Sub, u2.Sub}},
+		{name: "email with regex characters", filter: database.UsersFilter{Email: t.Name() + ".one"}, expected: nil},
+		{name: "sub", filter: database.UsersFilter{Sub: u2.Sub}, expected: []string{u2.Sub}},
+		{name: "stripe id", filter: database.UsersFilter{StripeID: "cus_search"}, expected: []string{u2.Sub}},
+		{name: "pubkey", filter: database.UsersFilter{PubKey: pk}, expected: []string{u1.Sub}},
+		{name: "uploader ip", filter: database.UsersFilter{UploaderIP: "198.51.100.1"}, expected: []string{u1.Sub}},
+		{name: "all criteria", filter: database.UsersFilter{Email: t.Name() + "_two", UploaderIP: "198.51.100.1"}, expected: nil},
+	}
+	for _, tt := range tests {
+		users, err := db.UsersSearch(ctx, tt.filter, 10)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		subs := make([]string, 0, len(users))
+		for _, u := range users {
+			subs = append(subs, u.Sub)
+		}
+		if len(subs) != len(tt.expected) {
+			t.Fatalf("Test '%s': expected %v, got %v", tt.name, tt.expected, subs)
+		}
+		for _, sub := range tt.expected {
+			if !test.Contains(subs, sub) {
+				t.Fatalf("Test '%s': expected %v, got %v", tt.name, tt.expected, subs)
+			}
+		}
+	}
+	_, err = db.UsersSearch(ctx, database.UsersFilter{}, 10)
+	if !errors.Contains(err, database.ErrEmptyUsersFilter) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrEmptyUsersFilter, err)
+	}
+}
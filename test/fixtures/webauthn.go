@@ -0,0 +1,17 @@
+package fixtures
+
+// These fixtures describe a software authenticator with a single ES256
+// credential registered for the "siasky.net" relying party. The attestation
+// object uses "none" attestation and a zero signature counter.
+const (
+	// PasskeyCredentialID is the base64url-encoded ID of the credential.
+	PasskeyCredentialID = "RTwtJk2x1PVSqUm3vGpEe_yh-PSNBlIBQdsEI45N1-U"
+	// PasskeyPrivateKey is the base64url-encoded, SEC 1 DER-encoded P-256
+	// private key of the credential.
+	PasskeyPrivateKey = "MHcCAQEEIKCcdGnERBX9Ke232SwFVZd0UI5o10Jy1tEtSAq5qyXioAoGCCqGSM49AwEHoUQDQgAEPjKvPw7CtmWi0x7xxnfrtu50ACwapXbV0Y15S079fwAK6c4ca-a3vy69yCOKFWLlEw7P268sopCH5vt84DuaOw"
+	// PasskeyAttestationObject is the base64url-encoded attestation object
+	// the authenticator returns when it creates the credential.
+	PasskeyAttestationObject = "o2NmbXRkbm9uZWdhdHRTdG10oGhhdXRoRGF0YVikvb2iCBh56GRQn4Zsc7K7BjW1h_QWST5yB12JFS2ZNTBFAAAAAAAAAAAAAAAAAAAAAAAAAAAAIEU8LSZNsdT1UqlJt7xqRHv8ofj0jQZSAUHbBCOOTdflpQECAyYgASFYID4yrz8OwrZlotMe8cZ367budAAsGqV21dGNeUtO_X8AIlggCunOHGvmt78uvcgjihVi5RMOz9uvLKKQh-b7fOA7mjs"
+	// PasskeyRPID is the relying party the credential was created for.
+	PasskeyRPID = "siasky.net"
+)
@@ -32,6 +32,10 @@ var (
 	testPortalPort = "6000"
 	pathToJWKSFile = "../../jwt/fixtures/jwks.json"
 
+	// InternalSecret is the secret with which the tester signs its requests
+	// to the internal endpoints.
+	InternalSecret = []byte("test internal secret")
+
 	// dontFollowRedirectsCheckRedirectFn is a function that instructs http.Client
 	// to return with the last user response, instead of following a redirect.
 	dontFollowRedirectsCheckRedirectFn = func(req *http.Request, via []*http.Request) error {
@@ -92,6 +96,7 @@ func NewAccountsTester(dbName string, promoter api.Promoter, deps lib.Dependenci
 	// Initialise the environment.
 	jwt.PortalName = testPortalAddr
 	jwt.AccountsJWKSFile = pathToJWKSFile
+	api.InternalSecret = InternalSecret
 	err := jwt.LoadAccountsKeySet(logger)
 	if err != nil {
 		return nil, errors.AddContext(err, fmt.Sprintf("failed to load JWKS file from %s", jwt.AccountsJWKSFile))
@@ -293,6 +298,20 @@ func (at *AccountsTester) Request(method string, endpoint string, queryParams ur
 	return r, err
 }
 
+// InternalRequest signs the request with InternalSecret and executes it via
+// Request.
+func (at *AccountsTester) InternalRequest(method string, endpoint string, queryParams url.Values, body []byte, obj interface{}) (*http.Response, error) {
+	if queryParams == nil {
+		queryParams = url.Values{}
+	}
+	ts := time.Now().UTC().Unix()
+	headers := map[string]string{
+		api.InternalTimestampHeader: strconv.FormatInt(ts, 10),
+		api.InternalSignatureHeader: api.InternalSignature(InternalSecret, method, endpoint+"?"+queryParams.Encode(), ts, body),
+	}
+	return at.Request(method, endpoint, queryParams, body, headers, obj)
+}
+
 // executeRequest is a helper method which executes a test Request and processes
 // the response by extracting the body from it and handling non-OK status codes.
 //
@@ -404,6 +423,44 @@ func (at *AccountsTester) LogoutPOST() (*http.Response, []byte, error) {
 	return at.post("/logout", nil, nil)
 }
 
+// TokenRefreshPOST performs `POST /token/refresh` with the given refresh
+// token.
+//
+// NOTE: The Body of the returned response is already read and closed.
+func (at *AccountsTester) TokenRefreshPOST(refreshToken string) (*http.Response, error) {
+	headers := map[string]string{api.RefreshTokenHeader: refreshToken}
+	return at.Request(http.MethodPost, "/token/refresh", nil, nil, headers, nil)
+}
+
+// LoginTwoFactorPOST performs `POST /login/2fa`.
+//
+// NOTE: The Body of the returned response is already read and closed.
+func (at *AccountsTester) LoginTwoFactorPOST(token, code string) (*http.Response, error) {
+	b, err := json.Marshal(api.TwoFactorLoginPOST{Token: token, Code: code})
+	if err != nil {
+		return &http.Response{}, err
+	}
+	return at.Request(http.MethodPost, "/login/2fa", nil, b, nil, nil)
+}
+
+// LoginPasskeyGET performs `GET /login/passkey`.
+func (at *AccountsTester) LoginPasskeyGET() (api.PasskeyRequestOptionsGET, int, error) {
+	var result api.PasskeyRequestOptionsGET
+	r, err := at.Request(http.MethodGet, "/login/passkey", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// LoginPasskeyPOST performs `POST /login/passkey`.
+//
+// NOTE: The Body of the returned response is already read and closed.
+func (at *AccountsTester) LoginPasskeyPOST(body api.PasskeyLoginPOST) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return &http.Response{}, err
+	}
+	return at.Request(http.MethodPost, "/login/passkey", nil, b, nil, nil)
+}
+
 /*** Registration helpers ***/
 
 // RegisterGET performs `GET /register`
@@ -532,6 +589,21 @@ func (at *AccountsTester) UserUploadsGET() (api.UploadsGET, int, error) {
 	return result, r.StatusCode, err
 }
 
+// UserUploadsGETPage performs `GET /user/uploads` with the given pagination
+// parameters.
+func (at *AccountsTester) UserUploadsGETPage(params url.Values) (api.UploadsGET, int, error) {
+	var result api.UploadsGET
+	r, err := at.Request(http.MethodGet, "/user/uploads", params, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserEventsGET performs `GET /user/events` with the given parameters.
+func (at *AccountsTester) UserEventsGET(params url.Values) (api.AuditEventsGET, int, error) {
+	var resp api.AuditEventsGET
+	r, err := at.Request(http.MethodGet, "/user/events", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 /*** User API keys helpers ***/
 
 // UserAPIKeysDELETE performs a `DELETE /user/apikeys/:id` Request.
@@ -554,6 +626,15 @@ func (at *AccountsTester) UserAPIKeysLIST() ([]api.APIKeyResponse, int, error) {
 	return result, r.StatusCode, err
 }
 
+// UserAPIKeysLISTPage performs a `GET /user/apikeys` Request with the given
+// pagination parameters. It also returns the response headers, which hold the
+// cursors of the neighbouring pages.
+func (at *AccountsTester) UserAPIKeysLISTPage(params url.Values) ([]api.APIKeyResponse, http.Header, int, error) {
+	result := make([]api.APIKeyResponse, 0)
+	r, err := at.Request(http.MethodGet, "/user/apikeys", params, nil, nil, &result)
+	return result, r.Header, r.StatusCode, err
+}
+
 // UserAPIKeysPOST performs a `POST /user/apikeys` Request.
 func (at *AccountsTester) UserAPIKeysPOST(body api.APIKeyPOST) (api.APIKeyResponseWithKey, int, error) {
 	b, err := json.Marshal(body)
@@ -673,6 +754,131 @@ func (at *AccountsTester) UserRecoverRequestPOST(email string) (int, error) {
 	return r.StatusCode, nil
 }
 
+// UserRestorePOST performs `POST /user/restore`
+func (at *AccountsTester) UserRestorePOST(tk string) (int, error) {
+	body := url.Values{}
+	body.Set("token", tk)
+	r, _, err := at.post("/user/restore", nil, body)
+	return r.StatusCode, err
+}
+
+/*** User sessions helpers ***/
+
+// UserSessionsGET performs a `GET /user/sessions` Request.
+func (at *AccountsTester) UserSessionsGET() ([]api.SessionGET, int, error) {
+	result := make([]api.SessionGET, 0)
+	r, err := at.Request(http.MethodGet, "/user/sessions", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserSessionDELETE performs a `DELETE /user/sessions/:id` Request.
+func (at *AccountsTester) UserSessionDELETE(id string) (int, error) {
+	r, err := at.Request(http.MethodDelete, "/user/sessions/"+id, nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserSessionsDELETE performs a `DELETE /user/sessions` Request.
+func (at *AccountsTester) UserSessionsDELETE() (int, error) {
+	r, err := at.Request(http.MethodDelete, "/user/sessions", nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+/*** User two-factor authentication helpers ***/
+
+// UserTOTPPOST performs a `POST /user/2fa/totp` Request.
+func (at *AccountsTester) UserTOTPPOST() (api.TOTPEnrollmentGET, int, error) {
+	var result api.TOTPEnrollmentGET
+	r, err := at.Request(http.MethodPost, "/user/2fa/totp", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserTOTPConfirmPOST performs a `POST /user/2fa/totp/confirm` Request.
+func (at *AccountsTester) UserTOTPConfirmPOST(code string) (api.TOTPRecoveryCodesGET, int, error) {
+	var result api.TOTPRecoveryCodesGET
+	b, err := json.Marshal(api.TOTPCodePOST{Code: code})
+	if err != nil {
+		return result, 0, err
+	}
+	r, err := at.Request(http.MethodPost, "/user/2fa/totp/confirm", nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserTOTPDisablePOST performs a `POST /user/2fa/totp/disable` Request.
+func (at *AccountsTester) UserTOTPDisablePOST(code string) (int, error) {
+	b, err := json.Marshal(api.TOTPCodePOST{Code: code})
+	if err != nil {
+		return 0, err
+	}
+	r, err := at.Request(http.MethodPost, "/user/2fa/totp/disable", nil, b, nil, nil)
+	return r.StatusCode, err
+}
+
+/*** User passkeys helpers ***/
+
+// UserPasskeysGET performs a `GET /user/passkeys` Request.
+func (at *AccountsTester) UserPasskeysGET() ([]api.PasskeyGET, int, error) {
+	result := make([]api.PasskeyGET, 0)
+	r, err := at.Request(http.MethodGet, "/user/passkeys", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserPasskeyRegisterGET performs a `GET /user/passkeys/register` Request.
+func (at *AccountsTester) UserPasskeyRegisterGET() (api.PasskeyCreationOptionsGET, int, error) {
+	var result api.PasskeyCreationOptionsGET
+	r, err := at.Request(http.MethodGet, "/user/passkeys/register", nil, nil, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserPasskeyRegisterPOST performs a `POST /user/passkeys/register` Request.
+func (at *AccountsTester) UserPasskeyRegisterPOST(body api.PasskeyRegisterPOST) (api.PasskeyGET, int, error) {
+	var result api.PasskeyGET
+	b, err := json.Marshal(body)
+	if err != nil {
+		return result, 0, err
+	}
+	r, err := at.Request(http.MethodPost, "/user/passkeys/register", nil, b, nil, &result)
+	return result, r.StatusCode, err
+}
+
+// UserPasskeyPATCH performs a `PATCH /user/passkeys/:id` Request.
+func (at *AccountsTester) UserPasskeyPATCH(id, name string) (int, error) {
+	b, err := json.Marshal(api.PasskeyPATCH{Name: name})
+	if err != nil {
+		return 0, err
+	}
+	r, err := at.Request(http.MethodPatch, "/user/passkeys/"+id, nil, b, nil, nil)
+	return r.StatusCode, err
+}
+
+// UserPasskeyDELETE performs a `DELETE /user/passkeys/:id` Request.
+func (at *AccountsTester) UserPasskeyDELETE(id string) (int, error) {
+	r, err := at.Request(http.MethodDelete, "/user/passkeys/"+id, nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+/*** Lockout helpers ***/
+
+// LockoutsGET performs a `GET /admin/lockouts` request.
+func (at *AccountsTester) LockoutsGET() (api.LockoutsGET, int, error) {
+	var resp api.LockoutsGET
+	r, err := at.Request(http.MethodGet, "/admin/lockouts", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// LockoutsDELETE performs a `DELETE /admin/lockouts` request.
+func (at *AccountsTester) LockoutsDELETE(email, ip string) (api.LockoutsDELETE, int, error) {
+	queryParams := url.Values{}
+	if email != "" {
+		queryParams.Set("email", email)
+	}
+	if ip != "" {
+		queryParams.Set("ip", ip)
+	}
+	var resp api.LockoutsDELETE
+	r, err := at.Request(http.MethodDelete, "/admin/lockouts", queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 /*** Uploads and downloads helpers ***/
 
 // UploadsDELETE performs `DELETE /user/uploads/:skylink`
@@ -692,13 +898,44 @@ func (at *AccountsTester) UserStats(unit string, headers map[string]string) (dat
 	return resp, r.StatusCode, err
 }
 
+// UserExport performs a `GET /user/uploads/export` or a
+// `GET /user/downloads/export` request, depending on the given kind, and
+// returns the raw response body.
+func (at *AccountsTester) UserExport(kind, format string, from, to int64) ([]byte, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("format", format)
+	queryParams.Set("from", strconv.FormatInt(from, 10))
+	queryParams.Set("to", strconv.FormatInt(to, 10))
+	serviceURL := testPortalAddr + ":" + testPortalPort + "/user/" + kind + "/export?" + queryParams.Encode()
+	req, err := http.NewRequest(http.MethodGet, serviceURL, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	r, b, err := at.executeRequest(req)
+	if err != nil {
+		return nil, r.StatusCode, errors.AddContext(err, string(b))
+	}
+	return b, r.StatusCode, nil
+}
+
+// UserStatsHistory performs a `GET /user/stats/history` request.
+func (at *AccountsTester) UserStatsHistory(from, to int64, granularity string) ([]database.UserStatsHistoryBucket, int, error) {
+	queryParams := url.Values{}
+	queryParams.Set("from", strconv.FormatInt(from, 10))
+	queryParams.Set("to", strconv.FormatInt(to, 10))
+	queryParams.Set("granularity", granularity)
+	var resp []database.UserStatsHistoryBucket
+	r, err := at.Request(http.MethodGet, "/user/stats/history", queryParams, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UploadInfo performs a `GET /uploadinfo/:skylink` request.
 func (at *AccountsTester) UploadInfo(sl string) ([]api.UploadInfo, int, error) {
 	if !database.ValidSkylink(sl) {
 		return nil, http.StatusBadRequest, database.ErrInvalidSkylink
 	}
 	var resp []api.UploadInfo
-	r, err := at.Request(http.MethodGet, "/uploadinfo/"+sl, nil, nil, nil, &resp)
+	r, err := at.InternalRequest(http.MethodGet, "/uploadinfo/"+sl, nil, nil, &resp)
 	if err != nil {
 		return nil, r.StatusCode, err
 	}
@@ -711,7 +948,7 @@ func (at *AccountsTester) UploadedSkylinks(from, to int64) (api.SkylinksList, in
 	queryParams.Set("from", strconv.FormatInt(from, 10))
 	queryParams.Set("to", strconv.FormatInt(to, 10))
 	var resp api.SkylinksList
-	r, err := at.Request(http.MethodGet, "/uploadedskylinks", queryParams, nil, nil, &resp)
+	r, err := at.InternalRequest(http.MethodGet, "/uploadedskylinks", queryParams, nil, &resp)
 	if err != nil {
 		return api.SkylinksList{}, r.StatusCode, err
 	}
@@ -794,6 +1031,61 @@ func (at *AccountsTester) PromoterSetTierPOST(sub string, tier int) (int, error)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	r, err := at.Request(http.MethodPost, "/promoter/settier/"+sub, nil, bodyBytes, nil, nil)
+	r, err := at.InternalRequest(http.MethodPost, "/promoter/settier/"+sub, nil, bodyBytes, nil)
+	return r.StatusCode, err
+}
+
+/*** Admin helpers ***/
+
+// AdminEventsGET performs a `GET /admin/events` request.
+func (at *AccountsTester) AdminEventsGET(params url.Values) (api.AuditEventsGET, int, error) {
+	var resp api.AuditEventsGET
+	r, err := at.Request(http.MethodGet, "/admin/events", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// AdminUsersGET performs a `GET /admin/users` request.
+func (at *AccountsTester) AdminUsersGET(params url.Values) (api.AdminUsersGET, int, error) {
+	var resp api.AdminUsersGET
+	r, err := at.Request(http.MethodGet, "/admin/users", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// AdminUserGET performs a `GET /admin/users/:sub` request.
+func (at *AccountsTester) AdminUserGET(sub string) (api.AdminUserGET, int, error) {
+	var resp api.AdminUserGET
+	r, err := at.Request(http.MethodGet, "/admin/users/"+sub, nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// AdminUserSuspendPOST performs a `POST /admin/users/:sub/suspend` request.
+func (at *AccountsTester) AdminUserSuspendPOST(sub, reason string, until *time.Time) (int, error) {
+	bodyBytes, err := json.Marshal(api.AdminUserSuspendPOST{Reason: reason, Until: until})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	r, err := at.Request(http.MethodPost, "/admin/users/"+sub+"/suspend", nil, bodyBytes, nil, nil)
+	return r.StatusCode, err
+}
+
+// AdminUserReinstatePOST performs a `POST /admin/users/:sub/reinstate` request.
+func (at *AccountsTester) AdminUserReinstatePOST(sub string) (int, error) {
+	r, err := at.Request(http.MethodPost, "/admin/users/"+sub+"/reinstate", nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// AdminUserTierPOST performs a `POST /admin/users/:sub/tier` request.
+func (at *AccountsTester) AdminUserTierPOST(sub string, tier int) (int, error) {
+	bodyBytes, err := json.Marshal(api.AdminUserTierPOST{Tier: tier})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	r, err := at.Request(http.MethodPost, "/admin/users/"+sub+"/tier", nil, bodyBytes, nil, nil)
+	return r.StatusCode, err
+}
+
+// AdminUserConfirmPOST performs a `POST /admin/users/:sub/confirm` request.
+func (at *AccountsTester) AdminUserConfirmPOST(sub string) (int, error) {
+	r, err := at.Request(http.MethodPost, "/admin/users/"+sub+"/confirm", nil, nil, nil, nil)
 	return r.StatusCode, err
 }
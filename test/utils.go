@@ -3,13 +3,21 @@ package test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test/fixtures"
 	"github.com/SkynetLabs/skynet-accounts/types"
+	"github.com/SkynetLabs/skynet-accounts/webauthn"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
@@ -153,6 +161,42 @@ func DBTestCredentials() database.DBCredentials {
 	}
 }
 
+// PasskeyClientData returns the client data JSON a browser on this portal
+// would send for a WebAuthn ceremony with the given base64url challenge.
+func PasskeyClientData(cdType, challenge string) []byte {
+	b, _ := json.Marshal(webauthn.ClientData{
+		Type:      cdType,
+		Challenge: challenge,
+		Origin:    database.PasskeyAllowedOrigins()[0],
+	})
+	return b
+}
+
+// PasskeyAssertion acts as the fixture authenticator. It returns the
+// authenticator data and signature of an assertion over the given client
+// data.
+func PasskeyAssertion(clientDataJSON []byte, signCount uint32) ([]byte, []byte, error) {
+	der, err := webauthn.DecodeString(fixtures.PasskeyPrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The flags say that the user was present and verified.
+	rpIDHash := sha256.Sum256([]byte(fixtures.PasskeyRPID))
+	ad := append(rpIDHash[:], 0x05, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(ad[33:], signCount)
+	cdHash := sha256.Sum256(clientDataJSON)
+	h := sha256.Sum256(append(append([]byte{}, ad...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, sk, h[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return ad, sig, nil
+}
+
 // RandomSkylink generates a random skylink
 func RandomSkylink() string {
 	var h crypto.Hash
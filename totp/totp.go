@@ -0,0 +1,120 @@
+// Package totp implements time-based one-time passwords as defined by RFC 6238,
+// using the defaults which all common authenticator apps support: HMAC-SHA1,
+// six digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505: RFC 6238 mandates SHA1 by default.
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+const (
+	// Digits is the number of digits in a code.
+	Digits = 6
+	// Period is the number of seconds for which a code is valid.
+	Period = 30
+	// Skew is the number of periods before and after the current one for
+	// which we still accept codes. This compensates for clock drift and for
+	// the time it takes users to type the code.
+	Skew = 1
+
+	// secretSize is the number of random bytes in a secret. RFC 4226
+	// recommends 160 bits.
+	secretSize = 20
+)
+
+var (
+	// ErrInvalidSecret is returned when the secret is not valid base32.
+	ErrInvalidSecret = errors.New("invalid TOTP secret")
+
+	// b32 is the encoding we use for secrets. Authenticator apps expect
+	// unpadded base32.
+	b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// GenerateSecret returns a new random base32-encoded secret.
+func GenerateSecret() string {
+	return b32.EncodeToString(fastrand.Bytes(secretSize))
+}
+
+// ProvisioningURI returns the `otpauth://` URI which authenticator apps use to
+// enroll the given secret. Clients usually show it as a QR code.
+//
+// See https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func ProvisioningURI(secret, issuer, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(Period))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step returns the time step to which the given moment belongs.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for the given secret at the given moment.
+func Code(secret string, t time.Time) (string, error) {
+	return codeAt(secret, Step(t))
+}
+
+// Validate checks whether the given code is valid for the given secret at the
+// given moment. It only accepts codes from time steps after lastStep, which
+// prevents the reuse of codes. On success it returns the time step of the
+// code, which the caller should store and pass as lastStep next time.
+func Validate(secret, code string, t time.Time, lastStep int64) (int64, bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false, nil
+	}
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := codeAt(secret, step)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// codeAt computes the code for the given secret and time step as defined by
+// RFC 4226.
+func codeAt(secret string, step int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(key) == 0 {
+		return "", ErrInvalidSecret
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	// Dynamic truncation.
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, bin%mod), nil
+}
@@ -0,0 +1,88 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCode ensures we generate the codes given by the test vectors in RFC 6238
+// Appendix B for SHA1, truncated to six digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := Code(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("Expected code %s at %d, got %s", tt.code, tt.unix, code)
+		}
+	}
+	_, err := Code("not base32!", time.Now())
+	if err != ErrInvalidSecret {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidSecret, err)
+	}
+}
+
+// TestValidate ensures we accept codes within the allowed skew and that we
+// reject reused codes.
+func TestValidate(t *testing.T) {
+	secret := GenerateSecret()
+	now := time.Now()
+	for _, offset := range []int{-Skew, 0, Skew} {
+		code, err := Code(secret, now.Add(time.Duration(offset*Period)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok, err := Validate(secret, code, now, 0)
+		if err != nil || !ok {
+			t.Fatalf("Expected code with offset %d to be valid, got %v", offset, err)
+		}
+		if step != Step(now)+int64(offset) {
+			t.Fatalf("Expected step %d, got %d", Step(now)+int64(offset), step)
+		}
+		// The same code is not accepted twice.
+		_, ok, _ = Validate(secret, code, now, step)
+		if ok {
+			t.Fatalf("Expected reused code with offset %d to be rejected", offset)
+		}
+	}
+	// Codes outside the skew are rejected.
+	code, err := Code(secret, now.Add(time.Duration((Skew+2)*Period)*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := Validate(secret, code, now, 0); ok {
+		t.Fatal("Expected a code outside the skew to be rejected")
+	}
+	if _, ok, _ := Validate(secret, "12345", now, 0); ok {
+		t.Fatal("Expected a short code to be rejected")
+	}
+}
+
+// TestProvisioningURI ensures the provisioning URI contains the parameters
+// authenticator apps need.
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("SECRET", "siasky.net", "user@siasky.net")
+	if !strings.HasPrefix(uri, "otpauth://totp/siasky.net:user@siasky.net?") {
+		t.Fatalf("Unexpected URI prefix: %s", uri)
+	}
+	for _, param := range []string{"secret=SECRET", "issuer=siasky.net", "digits=6", "period=30"} {
+		if !strings.Contains(uri, param) {
+			t.Fatalf("Expected URI to contain '%s', got %s", param, uri)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// usageRollupsUsage describes the usage of the `usage-rollups` command.
+	usageRollupsUsage = `Usage:
+  accounts usage-rollups rebuild [-user id]
+      Recalculates the usage rollups from the raw uploads and downloads. If a
+      user ID is given only that user's rollups are rebuilt, otherwise we
+      rebuild the rollups of all users.`
+)
+
+// usageRollupsCommand manages the users' usage rollups. It connects to the
+// database defined by the environment.
+func usageRollupsCommand(ctx context.Context, logger *logrus.Logger, args []string) error {
+	if len(args) == 0 || args[0] != "rebuild" {
+		return errors.New(usageRollupsUsage)
+	}
+	fs := flag.NewFlagSet("usage-rollups "+args[0], flag.ContinueOnError)
+	user := fs.String("user", "", "ID of the user whose rollups to rebuild")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	var uid primitive.ObjectID
+	if *user != "" {
+		uid, err = primitive.ObjectIDFromHex(*user)
+		if err != nil {
+			return errors.AddContext(err, "invalid user ID")
+		}
+	}
+	creds, err := loadDBCredentials()
+	if err != nil {
+		return errors.AddContext(err, "failed to load DB credentials")
+	}
+	db, err := database.New(ctx, creds, logger)
+	if err != nil {
+		return errors.AddContext(err, "failed to connect to the DB")
+	}
+	defer func() {
+		if errDef := db.Disconnect(ctx); errDef != nil {
+			logger.Warnln("Failed to disconnect from the DB:", errDef)
+		}
+	}()
+	if !uid.IsZero() {
+		err = db.UsageRollupsRebuild(ctx, uid)
+		if err != nil {
+			return errors.AddContext(err, "failed to rebuild usage rollups")
+		}
+		fmt.Println("Rebuilt the usage rollups of user", uid.Hex())
+		return nil
+	}
+	n, err := db.UsageRollupsRebuildAll(ctx)
+	if err != nil {
+		return errors.AddContext(err, fmt.Sprintf("rebuilt the usage rollups of %d users before failing", n))
+	}
+	fmt.Printf("Rebuilt the usage rollups of %d users\n", n)
+	return nil
+}
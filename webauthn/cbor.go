@@ -0,0 +1,138 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"math"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// This file contains a minimal CBOR (RFC 8949) decoder. It supports the
+// subset of CBOR which authenticators use for attestation objects and COSE
+// keys - integers, byte and text strings, arrays, maps and simple values. It
+// doesn't support indefinite lengths, tags or floats.
+
+const (
+	// cborMaxDepth limits the nesting of arrays and maps, so malicious input
+	// can't exhaust our stack.
+	cborMaxDepth = 16
+)
+
+var (
+	// errCBORInvalid is returned when the input is not valid CBOR or uses
+	// features we don't support.
+	errCBORInvalid = errors.New("invalid or unsupported CBOR")
+)
+
+// cborDecode decodes the first CBOR item in b. It returns the item and the
+// remaining bytes. Integers decode to int64, byte strings to []byte, text
+// strings to string, arrays to []interface{} and maps to
+// map[interface{}]interface{}.
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+// cborDecodeDepth decodes the first CBOR item in b, tracking the nesting depth.
+func cborDecodeDepth(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth || len(b) == 0 {
+		return nil, nil, errCBORInvalid
+	}
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+	// Simple values carry their value in the additional info.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+		return nil, nil, errCBORInvalid
+	}
+	arg, b, err := cborArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBORInvalid
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBORInvalid
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBORInvalid
+		}
+		data := b[:arg]
+		if major == 3 {
+			return string(data), b[arg:], nil
+		}
+		return append([]byte{}, data...), b[arg:], nil
+	case 4:
+		// Each item takes at least one byte.
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBORInvalid
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, b, nil
+	case 5:
+		// Each entry takes at least two bytes.
+		if arg > uint64(len(b))/2 {
+			return nil, nil, errCBORInvalid
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v interface{}
+			k, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBORInvalid
+			}
+			v, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	}
+	return nil, nil, errCBORInvalid
+}
+
+// cborArgument decodes the argument of a CBOR item, given its additional
+// info.
+func cborArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	}
+	return 0, nil, errCBORInvalid
+}
@@ -0,0 +1,394 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+/**
+This package implements the server side of the WebAuthn (Level 2) registration
+and authentication ceremonies, as far as we need them for passkey logins. We
+don't verify attestation statements - we ask authenticators for "none"
+attestation and only care that the credential's key signs our challenges.
+
+See https://www.w3.org/TR/webauthn-2/#sctn-rp-operations
+*/
+
+const (
+	// AlgES256 is the COSE identifier of ECDSA with P-256 and SHA-256.
+	AlgES256 = -7
+	// AlgEdDSA is the COSE identifier of EdDSA.
+	AlgEdDSA = -8
+	// AlgRS256 is the COSE identifier of RSASSA-PKCS1-v1_5 with SHA-256.
+	AlgRS256 = -257
+
+	// TypeCreate is the client data type of a registration ceremony.
+	TypeCreate = "webauthn.create"
+	// TypeGet is the client data type of an authentication ceremony.
+	TypeGet = "webauthn.get"
+
+	// flagUserPresent is set when the user interacted with the authenticator.
+	flagUserPresent = 0x01
+	// flagUserVerified is set when the authenticator verified the user, e.g.
+	// via biometrics or a PIN.
+	flagUserVerified = 0x04
+	// flagAttestedCredentialData is set when the authenticator data contains
+	// a credential.
+	flagAttestedCredentialData = 0x40
+
+	// authDataMinSize is the size of the authenticator data without attested
+	// credential data and extensions - rpIdHash, flags and signCount.
+	authDataMinSize = 32 + 1 + 4
+	// aaguidSize is the size of the authenticator's AAGUID.
+	aaguidSize = 16
+	// maxCredentialIDSize is the largest credential ID the spec allows.
+	maxCredentialIDSize = 1023
+)
+
+var (
+	// SupportedAlgorithms lists the COSE algorithms we accept, in order of
+	// preference.
+	SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+	// ErrInvalidAttestation is returned when the attestation object is
+	// malformed or doesn't match our expectations.
+	ErrInvalidAttestation = errors.New("invalid attestation object")
+	// ErrInvalidAuthenticatorData is returned when the authenticator data is
+	// malformed or doesn't match our expectations.
+	ErrInvalidAuthenticatorData = errors.New("invalid authenticator data")
+	// ErrInvalidClientData is returned when the client data is malformed or
+	// doesn't match our expectations.
+	ErrInvalidClientData = errors.New("invalid client data")
+	// ErrInvalidPublicKey is returned when the credential's public key is
+	// malformed.
+	ErrInvalidPublicKey = errors.New("invalid credential public key")
+	// ErrInvalidSignature is returned when the assertion's signature doesn't
+	// verify.
+	ErrInvalidSignature = errors.New("invalid assertion signature")
+	// ErrSignCountRegressed is returned when the authenticator's signature
+	// counter didn't increase. This indicates a cloned authenticator.
+	ErrSignCountRegressed = errors.New("authenticator signature counter did not increase")
+	// ErrUnsupportedAlgorithm is returned when the credential uses an
+	// algorithm we don't support.
+	ErrUnsupportedAlgorithm = errors.New("unsupported credential algorithm")
+	// ErrUserNotVerified is returned when the authenticator didn't verify
+	// the user, e.g. via biometrics or a PIN.
+	ErrUserNotVerified = errors.New("the authenticator did not verify the user")
+)
+
+type (
+	// ClientData is the part of the client's CollectedClientData we verify.
+	ClientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+
+	// Credential describes a newly registered credential.
+	Credential struct {
+		ID []byte
+		// PublicKey is the COSE-encoded public key of the credential.
+		PublicKey []byte
+		AAGUID    []byte
+		SignCount uint32
+	}
+
+	// authenticatorData is a parsed authenticator data structure.
+	authenticatorData struct {
+		RPIDHash  []byte
+		Flags     byte
+		SignCount uint32
+		// The following are only set when flagAttestedCredentialData is set.
+		AAGUID       []byte
+		CredentialID []byte
+		PublicKey    []byte
+	}
+)
+
+// EncodeToString encodes b in the unpadded base64url form WebAuthn uses.
+func EncodeToString(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeString decodes a base64url string. It accepts both padded and
+// unpadded input.
+func DecodeString(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ParseClientData parses the client data JSON and returns the challenge it
+// carries. It doesn't verify anything, so the caller can use the challenge to
+// look up the ceremony before verifying it.
+func ParseClientData(clientDataJSON []byte) (*ClientData, []byte, error) {
+	var cd ClientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return nil, nil, errors.Compose(err, ErrInvalidClientData)
+	}
+	challenge, err := DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, nil, ErrInvalidClientData
+	}
+	return &cd, challenge, nil
+}
+
+// VerifyRegistration verifies the response to a registration ceremony and
+// returns the new credential. The challenge is the one we issued for the
+// ceremony, rpID is our relying party ID, i.e. the portal's domain, and
+// origins are the origins from which we accept ceremonies.
+func VerifyRegistration(clientDataJSON, attestationObject, challenge []byte, rpID string, origins []string) (*Credential, error) {
+	err := verifyClientData(clientDataJSON, TypeCreate, challenge, origins)
+	if err != nil {
+		return nil, err
+	}
+	obj, rest, err := cborDecode(attestationObject)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrInvalidAttestation
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrInvalidAttestation
+	}
+	// We don't verify attestation statements, so we don't accept any.
+	if format, _ := m["fmt"].(string); format != "none" {
+		return nil, errors.AddContext(ErrInvalidAttestation, "unsupported attestation format")
+	}
+	rawAuthData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidAttestation
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyAuthenticatorData(ad, rpID)
+	if err != nil {
+		return nil, err
+	}
+	if ad.Flags&flagAttestedCredentialData == 0 {
+		return nil, errors.AddContext(ErrInvalidAuthenticatorData, "missing credential")
+	}
+	// Make sure we can use the key before we store it.
+	_, _, err = parsePublicKey(ad.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:        ad.CredentialID,
+		PublicKey: ad.PublicKey,
+		AAGUID:    ad.AAGUID,
+		SignCount: ad.SignCount,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an authentication ceremony against
+// the credential's COSE-encoded public key. The signCount is the last counter
+// value we have seen for this credential. On success it returns the
+// credential's new counter value.
+func VerifyAssertion(publicKey, clientDataJSON, rawAuthData, signature, challenge []byte, rpID string, origins []string, signCount uint32) (uint32, error) {
+	err := verifyClientData(clientDataJSON, TypeGet, challenge, origins)
+	if err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	err = verifyAuthenticatorData(ad, rpID)
+	if err != nil {
+		return 0, err
+	}
+	// The signature covers the authenticator data and the hash of the client
+	// data.
+	cdHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), cdHash[:]...)
+	err = verifySignature(publicKey, signed, signature)
+	if err != nil {
+		return 0, err
+	}
+	// Authenticators which don't implement a counter always send zero.
+	if (ad.SignCount != 0 || signCount != 0) && ad.SignCount <= signCount {
+		return 0, ErrSignCountRegressed
+	}
+	return ad.SignCount, nil
+}
+
+// verifyClientData makes sure the client data belongs to the expected
+// ceremony, carries our challenge and comes from one of our origins.
+func verifyClientData(clientDataJSON []byte, cdType string, challenge []byte, origins []string) error {
+	cd, ch, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if cd.Type != cdType {
+		return errors.AddContext(ErrInvalidClientData, "unexpected type")
+	}
+	if len(challenge) == 0 || subtle.ConstantTimeCompare(ch, challenge) != 1 {
+		return errors.AddContext(ErrInvalidClientData, "unexpected challenge")
+	}
+	if !validOrigin(cd.Origin, origins) {
+		return errors.AddContext(ErrInvalidClientData, "unexpected origin")
+	}
+	return nil
+}
+
+// validOrigin returns true if the origin is served over HTTPS and is one of the
+// given origins. We can't accept all subdomains of the relying party because
+// portals serve user-uploaded skapps from them.
+func validOrigin(origin string, origins []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	for _, o := range origins {
+		if strings.TrimSuffix(o, "/") == u.Scheme+"://"+u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthenticatorData parses the authenticator data structure.
+//
+// See https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < authDataMinSize {
+		return nil, ErrInvalidAuthenticatorData
+	}
+	ad := &authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&flagAttestedCredentialData == 0 {
+		return ad, nil
+	}
+	b = b[authDataMinSize:]
+	if len(b) < aaguidSize+2 {
+		return nil, ErrInvalidAuthenticatorData
+	}
+	ad.AAGUID = b[:aaguidSize]
+	idLen := int(binary.BigEndian.Uint16(b[aaguidSize:]))
+	b = b[aaguidSize+2:]
+	if idLen == 0 || idLen > maxCredentialIDSize || idLen > len(b) {
+		return nil, ErrInvalidAuthenticatorData
+	}
+	ad.CredentialID = b[:idLen]
+	b = b[idLen:]
+	// The public key is a CBOR map. Anything after it belongs to the
+	// extensions, which we ignore.
+	_, rest, err := cborDecode(b)
+	if err != nil {
+		return nil, errors.Compose(err, ErrInvalidAuthenticatorData)
+	}
+	ad.PublicKey = b[:len(b)-len(rest)]
+	return ad, nil
+}
+
+// verifyAuthenticatorData makes sure the authenticator data was created for
+// our relying party and that the user was present and verified. We require
+// user verification because a passkey login replaces both the password and
+// the second factor.
+func verifyAuthenticatorData(ad *authenticatorData, rpID string) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return errors.AddContext(ErrInvalidAuthenticatorData, "unexpected relying party")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errors.AddContext(ErrInvalidAuthenticatorData, "user not present")
+	}
+	if ad.Flags&flagUserVerified == 0 {
+		return ErrUserNotVerified
+	}
+	return nil
+}
+
+// parsePublicKey parses a COSE-encoded public key and returns it together
+// with its algorithm.
+//
+// See https://www.rfc-editor.org/rfc/rfc8152#section-13
+func parsePublicKey(b []byte) (crypto.PublicKey, int64, error) {
+	obj, rest, err := cborDecode(b)
+	if err != nil || len(rest) > 0 {
+		return nil, 0, ErrInvalidPublicKey
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrInvalidPublicKey
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, okX := m[int64(-2)].([]byte)
+		y, okY := m[int64(-3)].([]byte)
+		if crv != 1 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrInvalidPublicKey
+		}
+		pk := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pk.Curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, 0, ErrInvalidPublicKey
+		}
+		return pk, alg, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, ok := m[int64(-2)].([]byte)
+		// Curve 6 is Ed25519.
+		if crv != 6 || !ok || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrInvalidPublicKey
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == AlgRS256:
+		n, okN := m[int64(-1)].([]byte)
+		e, okE := m[int64(-2)].([]byte)
+		if !okN || !okE || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrInvalidPublicKey
+		}
+		exp := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, alg, nil
+	}
+	return nil, 0, ErrUnsupportedAlgorithm
+}
+
+// verifySignature verifies the signature over data with the given
+// COSE-encoded public key.
+func verifySignature(publicKey, data, sig []byte) error {
+	pk, alg, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch alg {
+	case AlgES256:
+		h := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(pk.(*ecdsa.PublicKey), h[:], sig)
+	case AlgEdDSA:
+		valid = ed25519.Verify(pk.(ed25519.PublicKey), data, sig)
+	case AlgRS256:
+		h := sha256.Sum256(data)
+		valid = rsa.VerifyPKCS1v15(pk.(*rsa.PublicKey), crypto.SHA256, h[:], sig) == nil
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
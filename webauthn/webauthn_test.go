@@ -0,0 +1,194 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/test/fixtures"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// testOrigin is the origin from which the tests run their ceremonies.
+const testOrigin = "https://account.siasky.net"
+
+// testOrigins are the origins the tests accept ceremonies from.
+var testOrigins = []string{testOrigin}
+
+// TestVerifyRegistration ensures we accept the fixture attestation object and
+// reject client data which doesn't match the ceremony.
+func TestVerifyRegistration(t *testing.T) {
+	challenge := fastrand.Bytes(32)
+	att, err := DecodeString(fixtures.PasskeyAttestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID, err := DecodeString(fixtures.PasskeyCredentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := clientData(t, TypeCreate, challenge, testOrigin)
+	cred, err := VerifyRegistration(cd, att, challenge, fixtures.PasskeyRPID, testOrigins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cred.ID, credID) {
+		t.Fatalf("Expected credential ID %x, got %x", credID, cred.ID)
+	}
+	if cred.SignCount != 0 || len(cred.AAGUID) != aaguidSize {
+		t.Fatalf("Unexpected credential %+v", cred)
+	}
+	_, alg, err := parsePublicKey(cred.PublicKey)
+	if err != nil || alg != AlgES256 {
+		t.Fatalf("Expected an ES256 key, got %d, %v", alg, err)
+	}
+
+	tests := []struct {
+		name string
+		cd   []byte
+		rpID string
+	}{
+		{"wrong type", clientData(t, TypeGet, challenge, testOrigin), fixtures.PasskeyRPID},
+		{"wrong challenge", clientData(t, TypeCreate, fastrand.Bytes(32), testOrigin), fixtures.PasskeyRPID},
+		{"wrong origin", clientData(t, TypeCreate, challenge, "https://evilsiasky.net"), fixtures.PasskeyRPID},
+		{"portal origin", clientData(t, TypeCreate, challenge, "https://siasky.net"), fixtures.PasskeyRPID},
+		{"skapp origin", clientData(t, TypeCreate, challenge, "https://skapp.siasky.net"), fixtures.PasskeyRPID},
+		{"no https", clientData(t, TypeCreate, challenge, "http://account.siasky.net"), fixtures.PasskeyRPID},
+		{"wrong relying party", clientData(t, TypeCreate, challenge, testOrigin), "example.com"},
+	}
+	for _, tt := range tests {
+		_, err = VerifyRegistration(tt.cd, att, challenge, tt.rpID, testOrigins)
+		if err == nil {
+			t.Errorf("Expected registration with %s to fail", tt.name)
+		}
+	}
+	// Corrupt attestation objects are rejected.
+	_, err = VerifyRegistration(cd, att[:len(att)-10], challenge, fixtures.PasskeyRPID, testOrigins)
+	if err == nil {
+		t.Fatal("Expected a truncated attestation object to be rejected")
+	}
+}
+
+// TestVerifyAssertion ensures we verify assertion signatures and enforce an
+// increasing signature counter.
+func TestVerifyAssertion(t *testing.T) {
+	att, err := DecodeString(fixtures.PasskeyAttestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := fastrand.Bytes(32)
+	cred, err := VerifyRegistration(clientData(t, TypeCreate, challenge, testOrigin), att, challenge, fixtures.PasskeyRPID, testOrigins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := clientData(t, TypeGet, challenge, testOrigin)
+	ad, sig := sign(t, cd, 5, flagUserPresent|flagUserVerified)
+	count, err := VerifyAssertion(cred.PublicKey, cd, ad, sig, challenge, fixtures.PasskeyRPID, testOrigins, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("Expected sign count 5, got %d", count)
+	}
+	// Replaying the same assertion fails because the counter didn't increase.
+	_, err = VerifyAssertion(cred.PublicKey, cd, ad, sig, challenge, fixtures.PasskeyRPID, testOrigins, count)
+	if !errors.Contains(err, ErrSignCountRegressed) {
+		t.Fatalf("Expected '%v', got '%v'", ErrSignCountRegressed, err)
+	}
+	// A tampered signature fails.
+	sig[len(sig)-1]++
+	_, err = VerifyAssertion(cred.PublicKey, cd, ad, sig, challenge, fixtures.PasskeyRPID, testOrigins, 0)
+	if !errors.Contains(err, ErrInvalidSignature) {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidSignature, err)
+	}
+	// A registration's client data is not accepted.
+	cd = clientData(t, TypeCreate, challenge, testOrigin)
+	ad, sig = sign(t, cd, 6, flagUserPresent|flagUserVerified)
+	_, err = VerifyAssertion(cred.PublicKey, cd, ad, sig, challenge, fixtures.PasskeyRPID, testOrigins, 0)
+	if !errors.Contains(err, ErrInvalidClientData) {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidClientData, err)
+	}
+	// An assertion without user verification is not accepted.
+	cd = clientData(t, TypeGet, challenge, testOrigin)
+	ad, sig = sign(t, cd, 7, flagUserPresent)
+	_, err = VerifyAssertion(cred.PublicKey, cd, ad, sig, challenge, fixtures.PasskeyRPID, testOrigins, 0)
+	if !errors.Contains(err, ErrUserNotVerified) {
+		t.Fatalf("Expected '%v', got '%v'", ErrUserNotVerified, err)
+	}
+}
+
+// TestCBORDecode ensures the decoder handles the types we need and rejects
+// malformed input.
+func TestCBORDecode(t *testing.T) {
+	// {1: -7, "a": [h'0102', true, null]}
+	b := []byte{0xa2, 0x01, 0x26, 0x61, 'a', 0x83, 0x42, 0x01, 0x02, 0xf5, 0xf6}
+	v, rest, err := cborDecode(b)
+	if err != nil || len(rest) != 0 {
+		t.Fatal(err, rest)
+	}
+	m := v.(map[interface{}]interface{})
+	if m[int64(1)] != int64(-7) {
+		t.Fatalf("Unexpected value %v", m[int64(1)])
+	}
+	arr := m["a"].([]interface{})
+	if !bytes.Equal(arr[0].([]byte), []byte{1, 2}) || arr[1] != true || arr[2] != nil {
+		t.Fatalf("Unexpected array %v", arr)
+	}
+	invalid := [][]byte{
+		{},
+		{0x42, 0x01},       // truncated byte string
+		{0xa1, 0x01},       // map without a value
+		{0x9f, 0x01, 0xff}, // indefinite length
+		{0xa1, 0x40, 0x01}, // byte string key
+		bytes.Repeat([]byte{0x81}, cborMaxDepth+2),
+	}
+	for _, b := range invalid {
+		_, _, err = cborDecode(b)
+		if err == nil {
+			t.Errorf("Expected %x to be rejected", b)
+		}
+	}
+}
+
+// clientData returns the client data JSON of a ceremony.
+func clientData(t *testing.T, cdType string, challenge []byte, origin string) []byte {
+	b, err := json.Marshal(ClientData{
+		Type:      cdType,
+		Challenge: EncodeToString(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sign acts as the fixture authenticator and returns the authenticator data
+// with the given flags and the signature of an assertion over the given client
+// data.
+func sign(t *testing.T, clientDataJSON []byte, signCount uint32, flags byte) ([]byte, []byte) {
+	der, err := DecodeString(fixtures.PasskeyPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpIDHash := sha256.Sum256([]byte(fixtures.PasskeyRPID))
+	ad := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(ad[33:], signCount)
+	cdHash := sha256.Sum256(clientDataJSON)
+	h := sha256.Sum256(append(append([]byte{}, ad...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, sk, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ad, sig
+}